@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/conformance"
+	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
+	_ "github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	_ "github.com/aplulu/etcd-shim/internal/driver/mysql"
+	_ "github.com/aplulu/etcd-shim/internal/driver/postgres"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	_ "github.com/aplulu/etcd-shim/internal/driver/sqlite"
+	"github.com/aplulu/etcd-shim/internal/server"
+)
+
+// conformance boots the shim in-process for every registered driver and
+// runs the clientv3 conformance checks against it. Drivers that need an
+// external database, postgres and mysql, only run when their DSN is set,
+// e.g. ETCD_SHIM_POSTGRES_DSN. With -endpoints it checks a running server
+// instead. -trace adds a check replaying a trace recorded with --trace-file.
+func main() {
+	var (
+		drivers   = flag.String("drivers", strings.Join(registry.Drivers(), ","), "comma separated drivers to check")
+		endpoints = flag.String("endpoints", "", "comma separated endpoints of a running server to check instead")
+		traceFile = flag.String("trace", "", "trace file to replay as an additional check")
+		verbose   = flag.Bool("v", false, "log server output")
+	)
+	flag.Parse()
+
+	checks := conformance.Checks
+	if *traceFile != "" {
+		data, err := os.ReadFile(*traceFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "command.ConformanceCommand: failed to read trace: %+v\n", err)
+			os.Exit(1)
+		}
+		checks = append(checks, conformance.TraceCheck("Trace", data))
+	}
+
+	level := slog.LevelError + 1
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+
+	ctx := context.Background()
+	failed := false
+	if *endpoints != "" {
+		ok, err := check(ctx, *endpoints, strings.Split(*endpoints, ","), checks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "command.ConformanceCommand: %+v\n", err)
+			os.Exit(1)
+		}
+		failed = !ok
+	} else {
+		for _, name := range strings.Split(*drivers, ",") {
+			ok, err := checkDriver(ctx, log, name, checks)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "command.ConformanceCommand: %s: %+v\n", name, err)
+				failed = true
+				continue
+			}
+			failed = failed || !ok
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func checkDriver(ctx context.Context, log *slog.Logger, name string, checks []conformance.Check) (bool, error) {
+	conf, err := config.LoadDriverConfig("")
+	if err != nil {
+		return false, err
+	}
+	if (name == "postgres" && conf.Postgres.DSN == "") || (name == "mysql" && conf.MySQL.DSN == "") {
+		fmt.Printf("SKIP %s: no DSN configured\n", name)
+		return true, nil
+	}
+
+	dir, err := os.MkdirTemp("", "etcd-shim-conformance-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	conf.Badger.DataDir = filepath.Join(dir, "badger")
+	conf.SQLite.Path = filepath.Join(dir, "etcd-shim.db")
+	conf.Bbolt.Path = filepath.Join(dir, "bbolt", "db")
+	conf.Memory.SnapshotPath = ""
+
+	drv, err := registry.NewDriver(name, ctx, log, conf)
+	if err != nil {
+		return false, fmt.Errorf("failed to create driver: %w", err)
+	}
+	defer drv.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return false, fmt.Errorf("failed to listen: %w", err)
+	}
+	srv, err := server.New(ctx, server.Options{
+		Driver:   drv,
+		Listener: listener,
+		Logger:   log,
+	})
+	if err != nil {
+		listener.Close()
+		return false, err
+	}
+	go func() {
+		if err := srv.Serve(); err != nil {
+			log.Error(fmt.Sprintf("command.ConformanceCommand: failed to serve: %+v", err))
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error(fmt.Sprintf("command.ConformanceCommand: failed to stop server: %+v", err))
+		}
+	}()
+	<-srv.Ready()
+
+	return check(ctx, name, []string{"http://" + listener.Addr().String()}, checks)
+}
+
+// check prints one line per check and reports whether all of them passed.
+func check(ctx context.Context, name string, endpoints []string, checks []conformance.Check) (bool, error) {
+	results, err := conformance.Run(ctx, endpoints, checks)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	for _, r := range results {
+		if r.Err != nil {
+			ok = false
+			fmt.Printf("FAIL %s/%s (%s): %v\n", name, r.Check, r.Duration.Round(time.Millisecond), r.Err)
+			continue
+		}
+		fmt.Printf("PASS %s/%s (%s)\n", name, r.Check, r.Duration.Round(time.Millisecond))
+	}
+
+	return ok, nil
+}
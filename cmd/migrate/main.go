@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	_ "github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/config"
+	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
+	_ "github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	_ "github.com/aplulu/etcd-shim/internal/driver/mysql"
+	_ "github.com/aplulu/etcd-shim/internal/driver/postgres"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	_ "github.com/aplulu/etcd-shim/internal/driver/sqlite"
+	"github.com/aplulu/etcd-shim/internal/migrate"
+)
+
+// exclusiveDrivers cannot be read while a server has them open: badger and
+// bbolt lock their files, and the memory driver lives in the server
+// process. -follow cannot catch up with a running server on them.
+var exclusiveDrivers = map[string]bool{
+	"badger": true,
+	"bbolt":  true,
+	"memory": true,
+}
+
+func main() {
+	var (
+		source    = flag.String("source", "", "name of the source driver")
+		target    = flag.String("target", "", "name of the target driver")
+		batchSize = flag.Int("batch-size", 500, "number of events copied per target transaction")
+		follow    = flag.Bool("follow", false, "keep running catch-up passes until SIGINT or SIGTERM, then run a final pass; needs a source the server shares, such as sqlite, postgres or mysql")
+		interval  = flag.Duration("interval", 5*time.Second, "delay between catch-up passes with -follow")
+	)
+	flag.Parse()
+
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	if err := run(log, *source, *target, *batchSize, *follow, *interval); err != nil {
+		log.Error(fmt.Sprintf("command.MigrateCommand: %+v", err))
+		os.Exit(1)
+	}
+}
+
+func run(log *slog.Logger, source string, target string, batchSize int, follow bool, interval time.Duration) error {
+	if source == "" || target == "" {
+		return fmt.Errorf("both -source and -target are required")
+	}
+	if follow && exclusiveDrivers[source] {
+		return fmt.Errorf("-follow cannot read the %s driver while a server has it open; stop the server and migrate without -follow", source)
+	}
+
+	// Each side is configured through its own environment namespace, e.g.
+	// ETCD_SHIM_SOURCE_BADGER_DATA_DIR and ETCD_SHIM_TARGET_BADGER_DATA_DIR.
+	srcConf, err := config.LoadDriverConfig("source")
+	if err != nil {
+		return fmt.Errorf("failed to load source driver config: %w", err)
+	}
+	dstConf, err := config.LoadDriverConfig("target")
+	if err != nil {
+		return fmt.Errorf("failed to load target driver config: %w", err)
+	}
+	if source == target {
+		if store := srcConf.Store(source); store != "" && store == dstConf.Store(target) {
+			return fmt.Errorf("source and target are the same %s store", source)
+		}
+	}
+
+	ctx := context.Background()
+
+	src, err := registry.NewDriver(source, ctx, log.With("driver", "source"), srcConf)
+	if err != nil {
+		return fmt.Errorf("failed to create source driver %q: %w", source, err)
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Error(fmt.Sprintf("command.MigrateCommand: failed to close source driver: %+v", err))
+		}
+	}()
+	dst, err := registry.NewDriver(target, ctx, log.With("driver", "target"), dstConf)
+	if err != nil {
+		return fmt.Errorf("failed to create target driver %q: %w", target, err)
+	}
+	defer func() {
+		if err := dst.Close(); err != nil {
+			log.Error(fmt.Sprintf("command.MigrateCommand: failed to close target driver: %+v", err))
+		}
+	}()
+
+	m := migrate.New(log, src, dst, batchSize)
+
+	log.Info("Starting migration...", "source", source, "target", target)
+	if _, err := m.Pass(ctx); err != nil {
+		return err
+	}
+
+	if follow {
+		quitCh := make(chan os.Signal, 1)
+		signal.Notify(quitCh, syscall.SIGINT, syscall.SIGTERM)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+	loop:
+		for {
+			select {
+			case <-quitCh:
+				break loop
+			case <-ticker.C:
+				if _, err := m.Pass(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		log.Info("Running final pass for cutover...")
+		if _, err := m.Pass(ctx); err != nil {
+			return err
+		}
+	}
+
+	return m.Verify(ctx)
+}
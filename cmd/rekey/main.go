@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver/badger"
+)
+
+// rekey replaces the master key of an encrypted Badger data directory. The
+// server using the directory must be stopped first.
+func main() {
+	if err := config.LoadConf(nil); err != nil {
+		panic(err)
+	}
+	conf := config.Drivers().Badger
+
+	var (
+		dataDir    = flag.String("data-dir", conf.DataDir, "Badger data directory")
+		oldKeyFile = flag.String("old-key-file", "", "file holding the current master key")
+		newKeyFile = flag.String("new-key-file", "", "file holding the new master key")
+	)
+	flag.Parse()
+
+	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	if err := run(*dataDir, *oldKeyFile, *newKeyFile, conf); err != nil {
+		log.Error(fmt.Sprintf("command.RekeyCommand: %+v", err))
+		os.Exit(1)
+	}
+
+	log.Info("Master key replaced", "data_dir", *dataDir)
+}
+
+func run(dataDir string, oldKeyFile string, newKeyFile string, conf config.BadgerConfig) error {
+	if oldKeyFile == "" || newKeyFile == "" {
+		return fmt.Errorf("both -old-key-file and -new-key-file are required")
+	}
+
+	oldKey, err := badger.ReadKeyFile(oldKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read old key: %w", err)
+	}
+	newKey, err := badger.ReadKeyFile(newKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read new key: %w", err)
+	}
+
+	return badger.Rekey(dataDir, oldKey, newKey, conf.EncryptionKeyRotationDuration)
+}
@@ -2,47 +2,402 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"github.com/aplulu/etcd-shim/internal/server"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	_ "github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/audit"
 	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
+	_ "github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	_ "github.com/aplulu/etcd-shim/internal/driver/mysql"
+	_ "github.com/aplulu/etcd-shim/internal/driver/postgres"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	_ "github.com/aplulu/etcd-shim/internal/driver/sqlite"
+	interfacegrpc "github.com/aplulu/etcd-shim/internal/interface/grpc"
+	"github.com/aplulu/etcd-shim/internal/logging"
+	"github.com/aplulu/etcd-shim/internal/ratelimit"
+	"github.com/aplulu/etcd-shim/internal/server"
+	"github.com/aplulu/etcd-shim/internal/tenant"
+	"github.com/aplulu/etcd-shim/internal/tracing"
 )
 
 func main() {
-	if err := config.LoadConf(); err != nil {
+	printConfig := flag.Bool("print-config", false, "validate the configuration, print it and exit")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "command.ServeCommand: unexpected arguments %q\n", flag.Args())
+		os.Exit(2)
+	}
+
+	if err := config.LoadConf(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "command.ServeCommand: %+v\n", err)
+		os.Exit(1)
+	}
+	settings, err := check()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "command.ServeCommand: invalid configuration: %+v\n", err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		if err := config.Write(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "command.ServeCommand: %+v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(settings.level)
+	handler, err := logging.NewHandler(os.Stdout, config.Log().Format, logLevel)
+	if err != nil {
 		panic(err)
 	}
+	log := slog.New(tracing.LogHandler(handler))
+	for _, name := range config.DeprecatedEnv() {
+		log.Warn("Environment variable is deprecated, use the prefixed one", "name", name, "replacement", config.EnvPrefix+name)
+	}
 
-	log := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	var tp *sdktrace.TracerProvider
+	if conf := config.Tracing(); conf.Endpoint != "" {
+		tp, err = tracing.NewProvider(context.Background(), tracing.Options{
+			Endpoint:    conf.Endpoint,
+			Insecure:    conf.Insecure,
+			SampleRatio: conf.SampleRatio,
+		})
+		if err != nil {
+			log.Error(fmt.Sprintf("command.ServeCommand: failed to start tracing: %+v", err))
+			os.Exit(1)
+		}
+	}
+
+	certs := server.NewCertificates(settings.tlsConfig)
+
+	log.Info("Starting server...")
+	srv, drv, files, err := newServer(log, tp, certs)
+	if err != nil {
+		log.Error(fmt.Sprintf("command.ServeCommand: failed to start server: %+v", err))
+		os.Exit(1)
+	}
 
 	quitCh := make(chan os.Signal, 1)
 	signal.Notify(quitCh,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
+	// SIGHUP reloads the configuration, as it does for most daemons.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	serveCh := make(chan error, 1)
 	go func() {
-		<-quitCh
-		log.Info("Shutting down server...")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.StopServer(shutdownCtx); err != nil {
-			log.Error(fmt.Sprintf("command.ServeCommand: failed to stop server: %+v", err))
-			os.Exit(1)
-			return
+		serveCh <- srv.Serve()
+	}()
+
+	exitCode := 0
+loop:
+	for {
+		select {
+		case <-hupCh:
+			log.Info("Reloading configuration...")
+			reload(log, logLevel, certs, srv)
+		case <-quitCh:
+			break loop
+		case err := <-serveCh:
+			log.Error(fmt.Sprintf("command.ServeCommand: failed to serve: %+v", err))
+			exitCode = 1
+			break loop
 		}
+	}
+
+	// Serve returns as soon as the listeners close, so the drain is waited
+	// for here. The driver, the files and the trace exporter are closed
+	// after it, within the same deadline.
+	log.Info("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error(fmt.Sprintf("command.ServeCommand: failed to stop server: %+v", err))
+		exitCode = 1
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- drv.Close()
 	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			log.Error(fmt.Sprintf("command.ServeCommand: failed to close driver: %+v", err))
+			exitCode = 1
+		}
+	case <-shutdownCtx.Done():
+		log.Error("command.ServeCommand: timed out closing driver")
+		exitCode = 1
+	}
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			log.Error(fmt.Sprintf("command.ServeCommand: failed to close file: %+v", err))
+			exitCode = 1
+		}
+	}
 
-	log.Info("Starting server...")
-	if err := server.StartServer(log); err != nil {
-		log.Error(fmt.Sprintf("command.ServeCommand: failed to start server: %+v", err))
-		os.Exit(1)
+	if tp != nil {
+		if err := tp.Shutdown(shutdownCtx); err != nil {
+			log.Error(fmt.Sprintf("command.ServeCommand: failed to flush traces: %+v", err))
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// checked holds the settings parsed by check.
+type checked struct {
+	level     slog.Level
+	tlsConfig *tls.Config
+	rateLimit ratelimit.Options
+}
+
+// check validates the configuration as far as possible without opening the
+// listeners or the driver, for --print-config and reloads. The certificates
+// are loaded even when their paths are unchanged, to pick up rotated files.
+func check() (checked, error) {
+	var (
+		c   checked
+		err error
+	)
+	logConf := config.Log()
+	if c.level, err = logging.HandlerLevel(logConf.Level); err != nil {
+		return checked{}, err
+	}
+	if _, err := logging.NewHandler(io.Discard, logConf.Format, new(slog.LevelVar)); err != nil {
+		return checked{}, err
+	}
+	if _, err := logging.NewRequestLogger(nil, requestOptions(logConf)); err != nil {
+		return checked{}, err
+	}
+
+	if c.tlsConfig, err = server.NewTLSConfig(tlsOptions(config.TLS())); err != nil {
+		return checked{}, err
+	}
+	for _, u := range append(config.ListenClientURLs(), config.ListenMetricsURLs()...) {
+		if err := server.CheckURL(u, c.tlsConfig); err != nil {
+			return checked{}, err
+		}
+	}
+
+	c.rateLimit = rateLimitOptions(config.RateLimit())
+	if _, err := ratelimit.New(c.rateLimit, nil); err != nil {
+		return checked{}, err
+	}
+
+	if err := tenantOptions(config.Tenant()).Validate(); err != nil {
+		return checked{}, fmt.Errorf("invalid tenants: %w", err)
+	}
+
+	if !slices.Contains(registry.Drivers(), config.Driver()) {
+		return checked{}, fmt.Errorf("unknown driver %q, expected one of %s", config.Driver(), strings.Join(registry.Drivers(), ", "))
+	}
+	if err := registry.Check(config.Driver(), config.Drivers()); err != nil {
+		return checked{}, fmt.Errorf("invalid %s settings: %w", config.Driver(), err)
+	}
+
+	return c, nil
+}
+
+// reload applies the reloadable settings of the configuration read again.
+// If any setting is invalid the running configuration is kept.
+func reload(log *slog.Logger, logLevel *slog.LevelVar, certs *server.Certificates, srv *server.Server) {
+	var settings checked
+	changes, err := config.Reload(func() error {
+		var err error
+		if settings, err = check(); err != nil {
+			return err
+		}
+		if certs != nil && settings.tlsConfig == nil {
+			return fmt.Errorf("TLS cannot be disabled without a restart")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(fmt.Sprintf("command.ServeCommand: rejected configuration: %+v", err))
+		return
+	}
+
+	logLevel.Set(settings.level)
+	if certs != nil {
+		certs.Set(settings.tlsConfig)
+	}
+	if err := srv.SetRateLimit(settings.rateLimit); err != nil {
+		log.Error(fmt.Sprintf("command.ServeCommand: failed to apply rate limits: %+v", err))
+	}
+
+	for _, c := range changes {
+		// Without TLS at start there are no listeners to serve it on.
+		if c.Reloadable() && (certs != nil || !strings.HasPrefix(c.Name, "TLS_")) {
+			log.Info("Setting changed", "setting", c.Name, "old", c.Old, "new", c.New)
+		} else {
+			log.Warn("Setting changed, restart to apply it", "setting", c.Name)
+		}
+	}
+	log.Info("Configuration reloaded", "changes", len(changes))
+}
+
+func tlsOptions(conf config.TLSConfig) server.TLSOptions {
+	return server.TLSOptions{
+		CertFile:       conf.CertFile,
+		KeyFile:        conf.KeyFile,
+		TrustedCAFile:  conf.TrustedCAFile,
+		ClientCertAuth: conf.ClientCertAuth,
+	}
+}
+
+func requestOptions(conf config.LogConfig) logging.RequestOptions {
+	return logging.RequestOptions{
+		Level:         conf.RequestLevel,
+		Methods:       conf.MethodLevels,
+		Sample:        conf.MethodSample,
+		SlowThreshold: conf.SlowThreshold,
+		ValuePrefixes: conf.ValuePrefixes,
+	}
+}
+
+func rateLimitOptions(conf config.RateLimitConfig) ratelimit.Options {
+	return ratelimit.Options{
+		Key:         conf.Key,
+		Read:        ratelimit.Budget{Rate: conf.ReadRate, Burst: conf.ReadBurst},
+		Write:       ratelimit.Budget{Rate: conf.WriteRate, Burst: conf.WriteBurst},
+		Watch:       ratelimit.Budget{Rate: conf.WatchRate, Burst: conf.WatchBurst},
+		MaxInFlight: conf.MaxInFlight,
+	}
+}
+
+func tenantOptions(conf config.TenantConfig) tenant.Options {
+	return tenant.Options{
+		Key:        conf.Key,
+		Prefixes:   conf.Prefixes,
+		QuotaBytes: conf.QuotaBytes,
+		Quotas:     conf.Quotas,
+	}
+}
+
+// newServer returns the server, its driver and the files it writes, such as
+// the audit log, which the caller closes in that order after the server has
+// shut down. certs is nil without TLS.
+func newServer(log *slog.Logger, tp *sdktrace.TracerProvider, certs *server.Certificates) (*server.Server, driver.Driver, []io.Closer, error) {
+	ctx := context.Background()
+
+	drv, err := registry.NewDriver(config.Driver(), ctx, log, config.Drivers())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create driver: %w", err)
+	}
+	srv, files, err := newServerWithDriver(ctx, log, tp, certs, drv)
+	if err != nil {
+		drv.Close()
+		return nil, nil, nil, err
+	}
+
+	return srv, drv, files, nil
+}
+
+func newServerWithDriver(ctx context.Context, log *slog.Logger, tp *sdktrace.TracerProvider, certs *server.Certificates, drv driver.Driver) (*server.Server, []io.Closer, error) {
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.Config()
+	}
+
+	opts := server.Options{
+		Driver:              drv,
+		AdvertiseClientURLs: config.AdvertiseClientURLs(),
+		Logger:              log,
+		ETCDVersion:         config.ETCDVersion(),
+		ETCDClusterVersion:  config.ETCDClusterVersion(),
+	}
+	var files []io.Closer
+	closeAll := func() {
+		for _, l := range append(opts.Listeners, opts.MetricsListeners...) {
+			l.Close()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, u := range config.ListenClientURLs() {
+		l, err := server.Listen(u, tlsConfig)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to listen: %w", err)
+		}
+		opts.Listeners = append(opts.Listeners, l)
+	}
+	for _, u := range config.ListenMetricsURLs() {
+		l, err := server.Listen(u, tlsConfig)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+		opts.MetricsListeners = append(opts.MetricsListeners, l)
+	}
+	if path := config.TraceFile(); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to create trace file: %w", err)
+		}
+		files = append(files, f)
+		log.Warn("Recording traffic, requests are serialized", "trace_file", path)
+		opts.Trace = f
+	}
+	if tp != nil {
+		opts.TracerProvider = tp
+	}
+	if auditConf := config.Audit(); auditConf.Path != "" {
+		sink, err := audit.NewSink(audit.SinkOptions{
+			Path:       auditConf.Path,
+			MaxSize:    auditConf.MaxSize,
+			MaxBackups: auditConf.MaxBackups,
+			MaxAge:     auditConf.MaxAge,
+			Compress:   auditConf.Compress,
+		})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		files = append(files, sink)
+		opts.Audit = audit.New(sink, audit.Options{Prefixes: auditConf.Prefixes})
+	}
+	opts.RequestLog = requestOptions(config.Log())
+
+	opts.RateLimit = rateLimitOptions(config.RateLimit())
+	opts.Tenants = tenantOptions(config.Tenant())
+	limits := config.Limits()
+	opts.Limits = interfacegrpc.Limits{
+		MaxRequestBytes: limits.MaxRequestBytes,
+		MaxTxnOps:       limits.MaxTxnOps,
+		MaxRangeBytes:   limits.MaxRangeBytes,
+	}
+	opts.DriverLimits = driver.Limits{
+		MaxKeyBytes:   limits.MaxKeyBytes,
+		MaxValueBytes: limits.MaxValueBytes,
+		QuotaBytes:    limits.QuotaBackendBytes,
+	}
+	opts.MaxRecvMsgBytes = limits.GRPCMaxRecvMsgBytes
+	opts.MaxSendMsgBytes = limits.GRPCMaxSendMsgBytes
+
+	srv, err := server.New(ctx, opts)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
 	}
+	return srv, files, nil
 }
@@ -0,0 +1,21 @@
+package memory
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/drivertest"
+)
+
+func TestDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.Driver {
+		d, err := New(Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
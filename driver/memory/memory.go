@@ -0,0 +1,457 @@
+// Package memory provides an in-memory driver, for tests and for
+// deployments that can afford to lose data between snapshots.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+)
+
+const historyBatchSize = 1000
+
+func init() {
+	registry.Register("memory", newDriver)
+}
+
+func newDriver(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	d, err := New(Options{
+		SnapshotPath:     conf.Memory.SnapshotPath,
+		SnapshotInterval: conf.Memory.SnapshotInterval,
+		Logger:           log,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+type Options struct {
+	// SnapshotPath, if set, is loaded on start and overwritten with the
+	// contents of the driver every SnapshotInterval and on Close.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Driver keeps every version of every key in memory. It is safe for
+// concurrent use and independent of any other Driver in the process.
+type Driver struct {
+	log  *slog.Logger
+	opts Options
+	hub  *driver.WatchHub
+
+	// mu serializes writers and guards everything below.
+	mu      sync.RWMutex
+	keys    *btree.BTreeG[*keyHistory]
+	changes []*entry
+	buckets map[string]*btree.BTreeG[bucketItem]
+	current int64
+	compact int64
+	seq     int64
+	// generation counts mutations, so unchanged state is not snapshotted.
+	generation int64
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// entry is a single version of a key. Deletions only carry the key and
+// mod revision.
+type entry struct {
+	seq     int64
+	kv      driver.KeyValue
+	deleted bool
+	// prev is the version this one superseded, nil once compacted.
+	prev *entry
+}
+
+func (e *entry) event() *driver.WatchEvent {
+	kv := e.kv
+	ev := &driver.WatchEvent{
+		KV:      &kv,
+		Deleted: e.deleted,
+		Created: !e.deleted && e.kv.Version == 1,
+	}
+	if e.prev != nil && !e.prev.deleted {
+		prev := e.prev.kv
+		ev.PrevKV = &prev
+	}
+	return ev
+}
+
+type keyHistory struct {
+	key []byte
+	// entries is ordered oldest first.
+	entries []*entry
+}
+
+// at returns the latest version at or before revision, or nil.
+func (h *keyHistory) at(revision int64) *entry {
+	i := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].kv.ModRevision > revision
+	})
+	if i == 0 {
+		return nil
+	}
+	return h.entries[i-1]
+}
+
+type bucketItem struct {
+	key   []byte
+	value []byte
+}
+
+// New creates a Driver, restoring the snapshot at opts.SnapshotPath when
+// one exists. Call Close to write the final snapshot.
+func New(opts Options) (*Driver, error) {
+	log := opts.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+
+	d := &Driver{
+		log:     log,
+		opts:    opts,
+		hub:     driver.NewWatchHub(),
+		keys:    newKeyTree(),
+		buckets: map[string]*btree.BTreeG[bucketItem]{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.SnapshotPath != "" {
+		if err := d.loadSnapshot(); err != nil {
+			return nil, fmt.Errorf("memory.New: %w", err)
+		}
+	}
+
+	if opts.SnapshotPath != "" && opts.SnapshotInterval > 0 {
+		go d.snapshotLoop()
+	} else {
+		close(d.done)
+	}
+
+	return d, nil
+}
+
+func newKeyTree() *btree.BTreeG[*keyHistory] {
+	return btree.NewG(32, func(a, b *keyHistory) bool {
+		return bytes.Compare(a.key, b.key) < 0
+	})
+}
+
+func newBucketTree() *btree.BTreeG[bucketItem] {
+	return btree.NewG(32, func(a, b bucketItem) bool {
+		return bytes.Compare(a.key, b.key) < 0
+	})
+}
+
+// Close stops the snapshot loop, closes the watch channels and writes a
+// final snapshot.
+func (d *Driver) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		d.hub.Close()
+		if d.opts.SnapshotPath != "" {
+			err = d.Snapshot()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("memory.Close: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) CurrentRevision(ctx context.Context) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.current, nil
+}
+
+func (d *Driver) CompactRevision(ctx context.Context) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.compact, nil
+}
+
+func (d *Driver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.newTxn().Range(key, end, opts)
+}
+
+func (d *Driver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t := d.newTxn()
+	if err := fn(t); err != nil {
+		return 0, err
+	}
+	if len(t.pending) == 0 {
+		return t.current, nil
+	}
+
+	d.commit(t.pending, t.revision)
+
+	return t.revision, nil
+}
+
+// commit adds the versions written at revision and publishes them. It must
+// be called with mu held.
+func (d *Driver) commit(entries []*entry, revision int64) {
+	events := make([]*driver.WatchEvent, len(entries))
+	for i, e := range entries {
+		d.seq++
+		e.seq = d.seq
+		h, ok := d.keys.Get(&keyHistory{key: e.kv.Key})
+		if !ok {
+			h = &keyHistory{key: e.kv.Key}
+			d.keys.ReplaceOrInsert(h)
+		}
+		h.entries = append(h.entries, e)
+		d.changes = append(d.changes, e)
+		events[i] = e.event()
+	}
+	d.current = revision
+	d.generation++
+
+	d.hub.Notify(events)
+}
+
+func (d *Driver) Compact(ctx context.Context, revision int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if revision <= d.compact {
+		return driver.ErrCompacted
+	}
+	if revision > d.current {
+		return driver.ErrFutureRevision
+	}
+
+	// Keep the latest version of every key at revision unless it is an
+	// older tombstone.
+	removed := map[*entry]struct{}{}
+	var empty []*keyHistory
+	d.keys.Ascend(func(h *keyHistory) bool {
+		i := sort.Search(len(h.entries), func(i int) bool {
+			return h.entries[i].kv.ModRevision > revision
+		}) - 1
+		if i < 0 {
+			return true
+		}
+		keep := i
+		if e := h.entries[i]; e.deleted && e.kv.ModRevision < revision {
+			keep++
+		}
+		for _, e := range h.entries[:keep] {
+			removed[e] = struct{}{}
+		}
+		h.entries = append([]*entry(nil), h.entries[keep:]...)
+		if len(h.entries) == 0 {
+			empty = append(empty, h)
+		} else {
+			h.entries[0].prev = nil
+		}
+		return true
+	})
+	for _, h := range empty {
+		d.keys.Delete(h)
+	}
+
+	changes := make([]*entry, 0, len(d.changes)-len(removed))
+	for _, e := range d.changes {
+		if _, ok := removed[e]; !ok {
+			changes = append(changes, e)
+		}
+	}
+	d.changes = changes
+	d.compact = revision
+	d.generation++
+
+	return nil
+}
+
+func (d *Driver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	if startRevision > 0 {
+		if compact, _ := d.CompactRevision(ctx); startRevision < compact {
+			return nil, driver.ErrCompacted
+		}
+	}
+
+	return d.hub.Watch(ctx, key, end, startRevision, d.History), nil
+}
+
+func (d *Driver) RequestProgress(ctx context.Context) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	d.hub.Progress(d.current)
+
+	return nil
+}
+
+func (d *Driver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	var lastSeq int64
+	for {
+		d.mu.RLock()
+		i := sort.Search(len(d.changes), func(i int) bool {
+			e := d.changes[i]
+			return e.kv.ModRevision >= startRevision && e.seq > lastSeq
+		})
+		var events []*driver.WatchEvent
+		for ; i < len(d.changes) && len(events) < historyBatchSize; i++ {
+			events = append(events, d.changes[i].event())
+			lastSeq = d.changes[i].seq
+		}
+		d.mu.RUnlock()
+
+		for _, ev := range events {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		if len(events) < historyBatchSize {
+			return nil
+		}
+	}
+}
+
+func (d *Driver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t := d.newTxn()
+	for _, ev := range events {
+		if ev.KV.ModRevision <= d.current || ev.KV.ModRevision > revision {
+			return fmt.Errorf("memory.Restore: event revision %d out of order", ev.KV.ModRevision)
+		}
+		e := &entry{
+			kv:      driver.KeyValue{Key: clone(ev.KV.Key), ModRevision: ev.KV.ModRevision},
+			deleted: ev.Deleted,
+		}
+		if !ev.Deleted {
+			e.kv = cloneKeyValue(ev.KV)
+		}
+		t.add(e)
+	}
+	d.commit(t.pending, revision)
+
+	return nil
+}
+
+func (d *Driver) Buckets(ctx context.Context) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	buckets := make([]string, 0, len(d.buckets))
+	for name := range d.buckets {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+
+	return buckets, nil
+}
+
+func (d *Driver) BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if b, ok := d.buckets[bucket]; ok {
+		if item, ok := b.Get(bucketItem{key: key}); ok {
+			return clone(item.value), nil
+		}
+	}
+
+	return nil, fmt.Errorf("memory.BucketGet: %w", driver.ErrKeyNotFound)
+}
+
+func (d *Driver) BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.buckets[bucket]
+	if !ok {
+		b = newBucketTree()
+		d.buckets[bucket] = b
+	}
+	b.ReplaceOrInsert(bucketItem{key: clone(key), value: clone(value)})
+	d.generation++
+
+	return nil
+}
+
+func (d *Driver) BucketDelete(ctx context.Context, bucket string, key []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	b.Delete(bucketItem{key: key})
+	if b.Len() == 0 {
+		delete(d.buckets, bucket)
+	}
+	d.generation++
+
+	return nil
+}
+
+func (d *Driver) BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error {
+	d.mu.RLock()
+	var items []bucketItem
+	if b, ok := d.buckets[bucket]; ok {
+		items = make([]bucketItem, 0, b.Len())
+		b.Ascend(func(item bucketItem) bool {
+			items = append(items, item)
+			return true
+		})
+	}
+	d.mu.RUnlock()
+
+	for _, item := range items {
+		if err := fn(clone(item.key), clone(item.value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func cloneKeyValue(kv *driver.KeyValue) driver.KeyValue {
+	c := *kv
+	c.Key = clone(kv.Key)
+	c.Value = clone(kv.Value)
+	return c
+}
@@ -0,0 +1,158 @@
+package memory
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// snapshot is the on-disk form of a Driver. Changes holds every retained
+// version in commit order.
+type snapshot struct {
+	Revision int64
+	Compact  int64
+	Changes  []snapshotEntry
+	Buckets  map[string][]snapshotBucketItem
+}
+
+type snapshotEntry struct {
+	KV      driver.KeyValue
+	Deleted bool
+}
+
+type snapshotBucketItem struct {
+	Key   []byte
+	Value []byte
+}
+
+func (d *Driver) snapshotLoop() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.opts.SnapshotInterval)
+	defer ticker.Stop()
+
+	var written int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+
+		d.mu.RLock()
+		generation := d.generation
+		d.mu.RUnlock()
+		if generation == written {
+			continue
+		}
+		if err := d.Snapshot(); err != nil {
+			d.log.Error("memory.snapshotLoop: failed to write snapshot", "error", err)
+			continue
+		}
+		written = generation
+	}
+}
+
+// Snapshot writes the contents of the driver to opts.SnapshotPath,
+// replacing the previous snapshot atomically.
+func (d *Driver) Snapshot() error {
+	if d.opts.SnapshotPath == "" {
+		return fmt.Errorf("memory.Snapshot: no snapshot path configured")
+	}
+
+	// Committed keys and values are never modified, so the encoding can
+	// happen after the lock is released.
+	d.mu.RLock()
+	s := &snapshot{
+		Revision: d.current,
+		Compact:  d.compact,
+		Changes:  make([]snapshotEntry, len(d.changes)),
+		Buckets:  make(map[string][]snapshotBucketItem, len(d.buckets)),
+	}
+	for i, e := range d.changes {
+		s.Changes[i] = snapshotEntry{KV: e.kv, Deleted: e.deleted}
+	}
+	for name, b := range d.buckets {
+		items := make([]snapshotBucketItem, 0, b.Len())
+		b.Ascend(func(item bucketItem) bool {
+			items = append(items, snapshotBucketItem{Key: item.key, Value: item.value})
+			return true
+		})
+		s.Buckets[name] = items
+	}
+	d.mu.RUnlock()
+
+	if err := writeSnapshot(d.opts.SnapshotPath, s); err != nil {
+		return fmt.Errorf("memory.Snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func writeSnapshot(path string, s *snapshot) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(s); err != nil {
+		return fmt.Errorf("failed to encode: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) loadSnapshot() error {
+	f, err := os.Open(d.opts.SnapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var s snapshot
+	if err := gob.NewDecoder(f).Decode(&s); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	t := d.newTxn()
+	for _, se := range s.Changes {
+		t.add(&entry{kv: se.KV, deleted: se.Deleted})
+	}
+	d.commit(t.pending, s.Revision)
+	d.compact = s.Compact
+	for name, items := range s.Buckets {
+		b := newBucketTree()
+		for _, item := range items {
+			b.ReplaceOrInsert(bucketItem{key: item.Key, value: item.Value})
+		}
+		d.buckets[name] = b
+	}
+
+	d.log.Info("memory: loaded snapshot", "path", d.opts.SnapshotPath, "revision", s.Revision)
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package memory
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// memTxn reads and writes the driver while its mutex is held. Writes are
+// collected in pending and only added to the driver on commit.
+type memTxn struct {
+	d *Driver
+	// current is the last committed revision and revision the one writes
+	// in this transaction are made at.
+	current  int64
+	compact  int64
+	revision int64
+	pending  []*entry
+	// latest holds the newest pending version per key.
+	latest map[string]*entry
+}
+
+func (d *Driver) newTxn() *memTxn {
+	return &memTxn{
+		d:        d,
+		current:  d.current,
+		compact:  d.compact,
+		revision: d.current + 1,
+		latest:   map[string]*entry{},
+	}
+}
+
+func (t *memTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	if opts.Revision > t.current {
+		return nil, driver.ErrFutureRevision
+	}
+	if opts.Revision > 0 && opts.Revision < t.compact {
+		return nil, driver.ErrCompacted
+	}
+
+	// Reading at the transaction's own revision includes its writes.
+	revision := opts.Revision
+	if revision <= 0 {
+		revision = t.current
+		if len(t.pending) > 0 {
+			revision = t.revision
+		}
+	}
+
+	entries := t.live(key, end, revision)
+	result := &driver.RangeResult{
+		Count:    int64(len(entries)),
+		Revision: t.current,
+	}
+	if opts.CountOnly {
+		return result, nil
+	}
+	if opts.Limit > 0 && int64(len(entries)) > opts.Limit {
+		entries = entries[:opts.Limit]
+	}
+	if len(entries) > 0 {
+		result.KVs = make([]driver.KeyValue, len(entries))
+		for i, e := range entries {
+			result.KVs[i] = e.kv
+			if opts.KeysOnly {
+				result.KVs[i].Value = nil
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// live returns the versions of the keys in [key, end) that exist at
+// revision, in key order.
+func (t *memTxn) live(key []byte, end []byte, revision int64) []*entry {
+	overlay := revision == t.revision && len(t.latest) > 0
+
+	var entries []*entry
+	visit := func(h *keyHistory) bool {
+		if overlay {
+			if _, ok := t.latest[string(h.key)]; ok {
+				return true
+			}
+		}
+		if e := h.at(revision); e != nil && !e.deleted {
+			entries = append(entries, e)
+		}
+		return true
+	}
+	switch {
+	case len(end) == 0:
+		if h, ok := t.d.keys.Get(&keyHistory{key: key}); ok {
+			visit(h)
+		}
+	case driver.IsOpenEnd(end):
+		t.d.keys.AscendGreaterOrEqual(&keyHistory{key: key}, visit)
+	default:
+		t.d.keys.AscendRange(&keyHistory{key: key}, &keyHistory{key: end}, visit)
+	}
+
+	if overlay {
+		for k, e := range t.latest {
+			if !e.deleted && driver.InRange([]byte(k), key, end) {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].kv.Key, entries[j].kv.Key) < 0
+		})
+	}
+
+	return entries
+}
+
+// newest returns the newest version of key as this transaction sees it,
+// which may be a tombstone.
+func (t *memTxn) newest(key []byte) *entry {
+	if e, ok := t.latest[string(key)]; ok {
+		return e
+	}
+	if h, ok := t.d.keys.Get(&keyHistory{key: key}); ok {
+		return h.entries[len(h.entries)-1]
+	}
+	return nil
+}
+
+func (t *memTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	e := &entry{
+		kv: driver.KeyValue{
+			Key:            clone(key),
+			Value:          clone(value),
+			CreateRevision: t.revision,
+			ModRevision:    t.revision,
+			Version:        1,
+			Lease:          lease,
+		},
+	}
+	prev := t.add(e)
+	if prev == nil || prev.deleted {
+		return nil, nil
+	}
+	e.kv.CreateRevision = prev.kv.CreateRevision
+	e.kv.Version = prev.kv.Version + 1
+
+	kv := prev.kv
+	return &kv, nil
+}
+
+func (t *memTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	entries := t.live(key, end, t.revision)
+
+	deleted := make([]driver.KeyValue, len(entries))
+	for i, prev := range entries {
+		t.add(&entry{
+			kv: driver.KeyValue{
+				Key:         prev.kv.Key,
+				ModRevision: t.revision,
+			},
+			deleted: true,
+		})
+		deleted[i] = prev.kv
+	}
+
+	return deleted, nil
+}
+
+// add queues e, linking it to the version it supersedes, which is
+// returned.
+func (t *memTxn) add(e *entry) *entry {
+	e.prev = t.newest(e.kv.Key)
+	t.pending = append(t.pending, e)
+	t.latest[string(e.kv.Key)] = e
+	return e.prev
+}
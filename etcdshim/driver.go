@@ -0,0 +1,92 @@
+package etcdshim
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
+	_ "github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	_ "github.com/aplulu/etcd-shim/internal/driver/mysql"
+	_ "github.com/aplulu/etcd-shim/internal/driver/postgres"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	_ "github.com/aplulu/etcd-shim/internal/driver/sqlite"
+)
+
+// The types a Driver is written against. See the Driver interface for the
+// contract.
+type (
+	Txn               = driver.Txn
+	RangeOptions      = driver.RangeOptions
+	RangeResult       = driver.RangeResult
+	KeyValue          = driver.KeyValue
+	WatchEvent        = driver.WatchEvent
+	ProgressRequester = driver.ProgressRequester
+	Sizer             = driver.Sizer
+
+	// WatchHub fans the writes of a driver out to its watchers.
+	WatchHub    = driver.WatchHub
+	HistoryFunc = driver.HistoryFunc
+)
+
+// The errors drivers return, which the server maps to etcd's.
+var (
+	ErrCompacted       = driver.ErrCompacted
+	ErrFutureRevision  = driver.ErrFutureRevision
+	ErrKeyNotFound     = driver.ErrKeyNotFound
+	ErrConflict        = driver.ErrConflict
+	ErrNoSpace         = driver.ErrNoSpace
+	ErrRequestTooLarge = driver.ErrRequestTooLarge
+
+	ErrDriverNotFound = registry.ErrDriverNotFound
+)
+
+// DriverConfig holds the settings of the built-in drivers, as read from
+// the ETCD_SHIM_ environment by the etcd-shim command.
+type (
+	DriverConfig   = config.DriverConfig
+	BadgerConfig   = config.BadgerConfig
+	SQLiteConfig   = config.SQLiteConfig
+	PostgresConfig = config.PostgresConfig
+	MySQLConfig    = config.MySQLConfig
+	BboltConfig    = config.BboltConfig
+	MemoryConfig   = config.MemoryConfig
+)
+
+// DefaultDriverConfig returns the defaults the etcd-shim command starts
+// from, e.g. data/badger as the badger data directory.
+func DefaultDriverConfig() DriverConfig {
+	return config.DefaultDriverConfig()
+}
+
+func NewWatchHub() *WatchHub {
+	return driver.NewWatchHub()
+}
+
+// InRange reports whether k falls into the etcd style range [key, end).
+func InRange(k []byte, key []byte, end []byte) bool {
+	return driver.InRange(k, key, end)
+}
+
+// IsOpenEnd reports whether end is the "\x00" range end meaning no upper
+// bound.
+func IsOpenEnd(end []byte) bool {
+	return driver.IsOpenEnd(end)
+}
+
+// Drivers returns the names of the built-in drivers.
+func Drivers() []string {
+	return registry.Drivers()
+}
+
+// NewDriver opens the built-in driver of name, e.g. badger, with conf,
+// which is best started from DefaultDriverConfig.
+func NewDriver(ctx context.Context, name string, log *slog.Logger, conf DriverConfig) (Driver, error) {
+	d, err := registry.NewDriver(name, ctx, log, conf)
+	if err != nil {
+		return nil, fmt.Errorf("etcdshim.NewDriver: %w", err)
+	}
+	return d, nil
+}
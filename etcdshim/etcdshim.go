@@ -0,0 +1,164 @@
+// Package etcdshim embeds an etcd-compatible server, e.g. for tests that
+// need a real etcd endpoint:
+//
+//	srv, err := etcdshim.New(etcdshim.Options{})
+//	...
+//	if err := srv.Start(); err != nil { ... }
+//	defer srv.Stop(context.Background())
+//	<-srv.Ready()
+//	client, err := clientv3.New(clientv3.Config{Endpoints: []string{srv.ClientURL()}})
+package etcdshim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/server"
+)
+
+// Driver stores the data of a Server, e.g. a *memory.Driver.
+type Driver = driver.Driver
+
+var ErrAlreadyStarted = errors.New("server already started")
+
+type Options struct {
+	// Driver defaults to a new in-memory driver, which is closed by Stop.
+	// A driver passed in is left open.
+	Driver Driver
+	// Listener defaults to a listener on a random port of 127.0.0.1 and is
+	// closed by Stop either way.
+	Listener net.Listener
+	// Logger defaults to discarding all output.
+	Logger *slog.Logger
+}
+
+type Server struct {
+	server   *server.Server
+	listener net.Listener
+	// closeDriver closes a driver created by New.
+	closeDriver func() error
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	served  chan error
+}
+
+func New(opts Options) (*Server, error) {
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	s := &Server{
+		served: make(chan error, 1),
+	}
+	if opts.Driver == nil {
+		d, err := memory.New(memory.Options{Logger: opts.Logger})
+		if err != nil {
+			return nil, fmt.Errorf("etcdshim.New: failed to create driver: %w", err)
+		}
+		opts.Driver = d
+		s.closeDriver = d.Close
+	}
+	if opts.Listener == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("etcdshim.New: failed to listen: %w", err)
+		}
+		opts.Listener = l
+	}
+	s.listener = opts.Listener
+
+	srv, err := server.New(context.Background(), server.Options{
+		Driver:   opts.Driver,
+		Listener: opts.Listener,
+		Logger:   opts.Logger,
+		// MemberList reports it, which clientv3 syncs its endpoints from.
+		AdvertiseClientURLs: []string{clientURL(opts.Listener)},
+	})
+	if err != nil {
+		opts.Listener.Close()
+		return nil, fmt.Errorf("etcdshim.New: %w", err)
+	}
+	s.server = srv
+
+	return s, nil
+}
+
+// Start serves in the background. Ready is closed once clients can
+// connect.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return ErrAlreadyStarted
+	}
+	s.started = true
+
+	go func() {
+		s.served <- s.server.Serve()
+	}()
+
+	return nil
+}
+
+// Stop closes the listener, cancels the open watches and waits for open
+// requests until ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.stopped = true
+	started := s.started
+	s.mu.Unlock()
+
+	var errs []error
+	if err := s.server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down: %w", err))
+	}
+	if started {
+		if err := <-s.served; err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		s.listener.Close()
+	}
+	if s.closeDriver != nil {
+		if err := s.closeDriver(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close driver: %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("etcdshim.Stop: %w", err)
+	}
+
+	return nil
+}
+
+// ClientURL is the endpoint to hand to clientv3, e.g. http://127.0.0.1:2379.
+func (s *Server) ClientURL() string {
+	return clientURL(s.listener)
+}
+
+func clientURL(l net.Listener) string {
+	addr := l.Addr()
+	if addr.Network() == "unix" {
+		return "unix://" + addr.String()
+	}
+	return "http://" + addr.String()
+}
+
+// Ready is closed once the server accepts connections.
+func (s *Server) Ready() <-chan struct{} {
+	return s.server.Ready()
+}
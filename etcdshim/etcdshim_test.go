@@ -0,0 +1,99 @@
+package etcdshim_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/aplulu/etcd-shim/etcdshim"
+)
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	conf := etcdshim.DefaultDriverConfig()
+	conf.Bbolt.Path = filepath.Join(t.TempDir(), "db")
+	d, err := etcdshim.NewDriver(ctx, "bbolt", log, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	srv, err := etcdshim.New(etcdshim.Options{Driver: d, Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	<-srv.Ready()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{srv.ClientURL()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Put(ctx, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Range(ctx, []byte("foo"), nil, etcdshim.RangeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.KVs) != 1 || string(res.KVs[0].Value) != "bar" {
+		t.Fatalf("the driver holds %v, want foo=bar", res.KVs)
+	}
+}
+
+func TestMemberList(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv, err := etcdshim.New(etcdshim.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	<-srv.Ready()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{srv.ClientURL()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	res, err := client.MemberList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Members) != 1 || len(res.Members[0].ClientURLs) != 1 || res.Members[0].ClientURLs[0] != srv.ClientURL() {
+		t.Fatalf("MemberList returned %v, want one member at %s", res.Members, srv.ClientURL())
+	}
+	// Sync replaces the endpoints with the advertised ones.
+	if err := client.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if eps := client.Endpoints(); len(eps) != 1 || eps[0] != srv.ClientURL() {
+		t.Fatalf("endpoints after Sync are %v", eps)
+	}
+}
+
+func TestNewDriverNotFound(t *testing.T) {
+	_, err := etcdshim.NewDriver(context.Background(), "nope", nil, etcdshim.DefaultDriverConfig())
+	if !errors.Is(err, etcdshim.ErrDriverNotFound) {
+		t.Fatalf("NewDriver of an unknown driver returned %v", err)
+	}
+}
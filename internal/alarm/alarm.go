@@ -0,0 +1,65 @@
+// Package alarm tracks the alarms raised on the member, like etcd's alarm
+// store. Alarms are kept in memory, so a restart clears them.
+package alarm
+
+import (
+	"sort"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+type Store struct {
+	mu     sync.Mutex
+	alarms map[etcdserverpb.AlarmType]struct{}
+}
+
+func New() *Store {
+	return &Store{alarms: map[etcdserverpb.AlarmType]struct{}{}}
+}
+
+// Activate raises alarm and reports whether it was not active yet.
+func (s *Store) Activate(alarm etcdserverpb.AlarmType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.alarms[alarm]; ok {
+		return false
+	}
+	s.alarms[alarm] = struct{}{}
+	return true
+}
+
+// Deactivate clears alarm and reports whether it was active.
+func (s *Store) Deactivate(alarm etcdserverpb.AlarmType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.alarms[alarm]; !ok {
+		return false
+	}
+	delete(s.alarms, alarm)
+	return true
+}
+
+// Active reports whether alarm is raised.
+func (s *Store) Active(alarm etcdserverpb.AlarmType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.alarms[alarm]
+	return ok
+}
+
+// List returns the active alarms in a stable order.
+func (s *Store) List() []etcdserverpb.AlarmType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alarms := make([]etcdserverpb.AlarmType, 0, len(s.alarms))
+	for a := range s.alarms {
+		alarms = append(alarms, a)
+	}
+	sort.Slice(alarms, func(i, j int) bool { return alarms[i] < alarms[j] })
+	return alarms
+}
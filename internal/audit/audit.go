@@ -0,0 +1,102 @@
+// Package audit writes an append-only log of the mutations a server applies,
+// separate from its operational log. Every record is one JSON line.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record is one line of the audit log. KV records are written per key or
+// range written, so a Txn yields a record for every write of the branch it
+// took.
+type Record struct {
+	Time time.Time `json:"time"`
+	// User is the authenticated user, empty while auth is disabled.
+	User string `json:"user,omitempty"`
+	// Tenant is the tenant of the client. Key and RangeEnd are as it sees
+	// them, without its prefix.
+	Tenant string `json:"tenant,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// Method is the RPC, e.g. Put, Txn or UserAdd.
+	Method string `json:"method"`
+	// Op is put or delete for KV records.
+	Op       string `json:"op,omitempty"`
+	Key      string `json:"key,omitempty"`
+	RangeEnd string `json:"range_end,omitempty"`
+	Revision int64  `json:"revision,omitempty"`
+	Lease    int64  `json:"lease,omitempty"`
+	TTL      int64  `json:"ttl,omitempty"`
+	// Name and Role are the user and role an auth change applies to.
+	Name       string `json:"name,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Permission string `json:"permission,omitempty"`
+}
+
+type Options struct {
+	// Prefixes limits the KV records to keys under one of them, as the
+	// client sees them. Empty records every key. Lease and auth records are
+	// always written.
+	Prefixes []string
+}
+
+// Logger writes records to its sink. A nil *Logger writes nothing.
+type Logger struct {
+	prefixes []string
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func New(w io.Writer, opts Options) *Logger {
+	return &Logger{prefixes: opts.Prefixes, enc: json.NewEncoder(w)}
+}
+
+// Log writes recs, skipping KV records outside the configured prefixes.
+func (l *Logger) Log(recs ...Record) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, rec := range recs {
+		if rec.Op != "" && !l.covers([]byte(rec.Key), []byte(rec.RangeEnd)) {
+			continue
+		}
+		rec.Time = now
+		if err := l.enc.Encode(&rec); err != nil {
+			return fmt.Errorf("audit.Log: failed to write record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// covers reports whether [key, end) overlaps one of the prefixes.
+func (l *Logger) covers(key []byte, end []byte) bool {
+	if len(l.prefixes) == 0 {
+		return true
+	}
+	for _, p := range l.prefixes {
+		prefix := []byte(p)
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+		if len(end) == 0 {
+			continue
+		}
+		// A range starting before the prefix overlaps it unless it ends at
+		// or before it.
+		if bytes.Compare(key, prefix) < 0 && (bytes.Equal(end, []byte{0}) || bytes.Compare(end, prefix) > 0) {
+			return true
+		}
+	}
+	return false
+}
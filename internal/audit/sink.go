@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type SinkOptions struct {
+	// Path is the file written to, or - for stdout.
+	Path string
+	// MaxSize is the size in megabytes at which the file is rotated.
+	MaxSize int
+	// MaxBackups is the number of rotated files kept; zero keeps all.
+	MaxBackups int
+	// MaxAge is the number of days rotated files are kept; zero keeps them
+	// regardless of age.
+	MaxAge   int
+	Compress bool
+}
+
+// NewSink opens the sink described by opts. Rotated files are renamed with a
+// timestamp and never modified again.
+func NewSink(opts SinkOptions) (io.WriteCloser, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("audit.NewSink: path is required")
+	}
+	if opts.Path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	return &lumberjack.Logger{
+		Filename:   opts.Path,
+		MaxSize:    opts.MaxSize,
+		MaxBackups: opts.MaxBackups,
+		MaxAge:     opts.MaxAge,
+		Compress:   opts.Compress,
+	}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
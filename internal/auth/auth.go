@@ -0,0 +1,602 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// The buckets of etcd's auth store.
+const (
+	Bucket      = "auth"
+	UsersBucket = "authUsers"
+	RolesBucket = "authRoles"
+
+	RootUser = "root"
+	RootRole = "root"
+
+	// TokenTTL is how long a simple token stays valid after its last use.
+	TokenTTL = 5 * time.Minute
+)
+
+var (
+	enabledKey  = []byte("authEnabled")
+	revisionKey = []byte("authRevision")
+)
+
+var (
+	ErrRootUserNotExist     = errors.New("root user does not exist")
+	ErrRootRoleNotExist     = errors.New("root user does not have root role")
+	ErrUserAlreadyExist     = errors.New("user name already exists")
+	ErrUserEmpty            = errors.New("user name is empty")
+	ErrUserNotFound         = errors.New("user name not found")
+	ErrRoleAlreadyExist     = errors.New("role name already exists")
+	ErrRoleEmpty            = errors.New("role name is empty")
+	ErrRoleNotFound         = errors.New("role name not found")
+	ErrRoleNotGranted       = errors.New("role is not granted to the user")
+	ErrPermissionNotGranted = errors.New("permission is not granted to the role")
+	ErrPermissionDenied     = errors.New("permission denied")
+	ErrAuthFailed           = errors.New("authentication failed, invalid user ID or password")
+	ErrAuthNotEnabled       = errors.New("authentication is not enabled")
+	ErrInvalidAuthToken     = errors.New("invalid auth token")
+	ErrInvalidAuthMgmt      = errors.New("invalid auth management")
+)
+
+type token struct {
+	user   string
+	expiry time.Time
+}
+
+// Store implements etcd's users, roles and simple tokens. Its state lives
+// in the driver's auth buckets, in etcd's format, and is cached in memory.
+type Store struct {
+	log *slog.Logger
+	drv driver.Driver
+
+	mu       sync.RWMutex
+	enabled  bool
+	revision uint64
+	users    map[string]*authpb.User
+	roles    map[string]*authpb.Role
+	tokens   map[string]*token
+}
+
+func New(ctx context.Context, log *slog.Logger, drv driver.Driver) (*Store, error) {
+	s := &Store{
+		log:    log,
+		drv:    drv,
+		users:  map[string]*authpb.User{},
+		roles:  map[string]*authpb.Role{},
+		tokens: map[string]*token{},
+	}
+
+	if err := drv.BucketForEach(ctx, Bucket, func(key []byte, value []byte) error {
+		switch {
+		case bytes.Equal(key, enabledKey):
+			s.enabled = len(value) == 1 && value[0] == 1
+		case bytes.Equal(key, revisionKey) && len(value) == 8:
+			s.revision = binary.BigEndian.Uint64(value)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("auth.New: failed to load auth state: %w", err)
+	}
+	if err := drv.BucketForEach(ctx, UsersBucket, func(key []byte, value []byte) error {
+		u := &authpb.User{}
+		if err := u.Unmarshal(value); err != nil {
+			return fmt.Errorf("failed to decode user %q: %w", key, err)
+		}
+		s.users[string(u.Name)] = u
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("auth.New: failed to load users: %w", err)
+	}
+	if err := drv.BucketForEach(ctx, RolesBucket, func(key []byte, value []byte) error {
+		r := &authpb.Role{}
+		if err := r.Unmarshal(value); err != nil {
+			return fmt.Errorf("failed to decode role %q: %w", key, err)
+		}
+		s.roles[string(r.Name)] = r
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("auth.New: failed to load roles: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *Store) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.enabled
+}
+
+func (s *Store) Revision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.revision
+}
+
+func (s *Store) Enable(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled {
+		return nil
+	}
+	root, ok := s.users[RootUser]
+	if !ok {
+		return ErrRootUserNotExist
+	}
+	if !hasRole(root, RootRole) {
+		return ErrRootRoleNotExist
+	}
+
+	s.enabled = true
+	return s.commit(ctx)
+}
+
+func (s *Store) Disable(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.enabled {
+		return nil
+	}
+	s.enabled = false
+	s.tokens = map[string]*token{}
+	return s.commit(ctx)
+}
+
+// Authenticate checks the password of user and returns a new token.
+func (s *Store) Authenticate(name string, password string) (string, error) {
+	s.mu.RLock()
+	enabled := s.enabled
+	u, ok := s.users[name]
+	s.mu.RUnlock()
+
+	if !enabled {
+		return "", ErrAuthNotEnabled
+	}
+	if !ok || (u.Options != nil && u.Options.NoPassword) {
+		return "", ErrAuthFailed
+	}
+	if err := bcrypt.CompareHashAndPassword(u.Password, []byte(password)); err != nil {
+		return "", ErrAuthFailed
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("auth.Authenticate: failed to generate token: %w", err)
+	}
+	t := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	s.tokens[t] = &token{user: name, expiry: time.Now().Add(TokenTTL)}
+	s.mu.Unlock()
+
+	return t, nil
+}
+
+// User returns the user a token belongs to, extending the token's life.
+func (s *Store) User(t string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, ok := s.tokens[t]
+	if !ok || time.Now().After(tok.expiry) {
+		delete(s.tokens, t)
+		return "", ErrInvalidAuthToken
+	}
+	if _, ok := s.users[tok.user]; !ok {
+		delete(s.tokens, t)
+		return "", ErrInvalidAuthToken
+	}
+	tok.expiry = time.Now().Add(TokenTTL)
+
+	return tok.user, nil
+}
+
+func (s *Store) UserAdd(ctx context.Context, name string, password string, noPassword bool) error {
+	if name == "" {
+		return ErrUserEmpty
+	}
+
+	var hashed []byte
+	if !noPassword {
+		var err error
+		if hashed, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("auth.UserAdd: failed to hash password: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[name]; ok {
+		return ErrUserAlreadyExist
+	}
+	u := &authpb.User{
+		Name:     []byte(name),
+		Password: hashed,
+		Options:  &authpb.UserAddOptions{NoPassword: noPassword},
+	}
+	if err := s.putUser(ctx, u); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+func (s *Store) UserDelete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled && name == RootUser {
+		return ErrInvalidAuthMgmt
+	}
+	if _, ok := s.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	if err := s.drv.BucketDelete(ctx, UsersBucket, []byte(name)); err != nil {
+		return fmt.Errorf("auth.UserDelete: failed to delete user: %w", err)
+	}
+	delete(s.users, name)
+	s.dropTokens(name)
+	return s.commit(ctx)
+}
+
+func (s *Store) UserChangePassword(ctx context.Context, name string, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("auth.UserChangePassword: failed to hash password: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	c := cloneUser(u)
+	c.Password = hashed
+	if err := s.putUser(ctx, c); err != nil {
+		return err
+	}
+	s.dropTokens(name)
+	return s.commit(ctx)
+}
+
+func (s *Store) UserGrantRole(ctx context.Context, name string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := s.roles[role]; !ok && role != RootRole {
+		return ErrRoleNotFound
+	}
+	if hasRole(u, role) {
+		return nil
+	}
+	c := cloneUser(u)
+	c.Roles = append(c.Roles, role)
+	sort.Strings(c.Roles)
+	if err := s.putUser(ctx, c); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+func (s *Store) UserRevokeRole(ctx context.Context, name string, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled && name == RootUser && role == RootRole {
+		return ErrInvalidAuthMgmt
+	}
+	u, ok := s.users[name]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if !hasRole(u, role) {
+		return ErrRoleNotGranted
+	}
+	c := cloneUser(u)
+	c.Roles = c.Roles[:0]
+	for _, r := range u.Roles {
+		if r != role {
+			c.Roles = append(c.Roles, r)
+		}
+	}
+	if err := s.putUser(ctx, c); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+// UserGet returns the roles of a user.
+func (s *Store) UserGet(name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return append([]string(nil), u.Roles...), nil
+}
+
+func (s *Store) UserList() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Store) RoleAdd(ctx context.Context, name string) error {
+	if name == "" {
+		return ErrRoleEmpty
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[name]; ok {
+		return ErrRoleAlreadyExist
+	}
+	if err := s.putRole(ctx, &authpb.Role{Name: []byte(name)}); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+func (s *Store) RoleDelete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled && name == RootRole {
+		return ErrInvalidAuthMgmt
+	}
+	if _, ok := s.roles[name]; !ok {
+		return ErrRoleNotFound
+	}
+	if err := s.drv.BucketDelete(ctx, RolesBucket, []byte(name)); err != nil {
+		return fmt.Errorf("auth.RoleDelete: failed to delete role: %w", err)
+	}
+	delete(s.roles, name)
+
+	for _, u := range s.users {
+		if !hasRole(u, name) {
+			continue
+		}
+		c := cloneUser(u)
+		c.Roles = c.Roles[:0]
+		for _, r := range u.Roles {
+			if r != name {
+				c.Roles = append(c.Roles, r)
+			}
+		}
+		if err := s.putUser(ctx, c); err != nil {
+			return err
+		}
+	}
+	return s.commit(ctx)
+}
+
+// RoleGet returns the permissions of a role.
+func (s *Store) RoleGet(name string) ([]*authpb.Permission, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.roles[name]
+	if !ok {
+		return nil, ErrRoleNotFound
+	}
+	return append([]*authpb.Permission(nil), r.KeyPermission...), nil
+}
+
+func (s *Store) RoleList() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.roles))
+	for name := range s.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoleGrantPermission adds perm to the role, replacing the type of an
+// existing permission on the same range.
+func (s *Store) RoleGrantPermission(ctx context.Context, name string, perm *authpb.Permission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.roles[name]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	c := &authpb.Role{Name: r.Name}
+	replaced := false
+	for _, p := range r.KeyPermission {
+		if bytes.Equal(p.Key, perm.Key) && bytes.Equal(p.RangeEnd, perm.RangeEnd) {
+			p = &authpb.Permission{PermType: perm.PermType, Key: p.Key, RangeEnd: p.RangeEnd}
+			replaced = true
+		}
+		c.KeyPermission = append(c.KeyPermission, p)
+	}
+	if !replaced {
+		c.KeyPermission = append(c.KeyPermission, &authpb.Permission{PermType: perm.PermType, Key: perm.Key, RangeEnd: perm.RangeEnd})
+	}
+	sort.Slice(c.KeyPermission, func(i, j int) bool {
+		return bytes.Compare(c.KeyPermission[i].Key, c.KeyPermission[j].Key) < 0
+	})
+	if err := s.putRole(ctx, c); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+func (s *Store) RoleRevokePermission(ctx context.Context, name string, key []byte, end []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.roles[name]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	c := &authpb.Role{Name: r.Name}
+	for _, p := range r.KeyPermission {
+		if bytes.Equal(p.Key, key) && bytes.Equal(p.RangeEnd, end) {
+			continue
+		}
+		c.KeyPermission = append(c.KeyPermission, p)
+	}
+	if len(c.KeyPermission) == len(r.KeyPermission) {
+		return ErrPermissionNotGranted
+	}
+	if err := s.putRole(ctx, c); err != nil {
+		return err
+	}
+	return s.commit(ctx)
+}
+
+// IsAdmin reports whether user holds the root role.
+func (s *Store) IsAdmin(user string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[user]
+	return ok && hasRole(u, RootRole)
+}
+
+// IsPermitted reports whether user may access every key in the etcd style
+// range [key, end) with the given permission. Write checks accept READWRITE
+// and WRITE grants, read checks READWRITE and READ grants.
+func (s *Store) IsPermitted(user string, key []byte, end []byte, write bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[user]
+	if !ok {
+		return false
+	}
+	if hasRole(u, RootRole) {
+		return true
+	}
+
+	var granted []interval
+	for _, name := range u.Roles {
+		r, ok := s.roles[name]
+		if !ok {
+			continue
+		}
+		for _, p := range r.KeyPermission {
+			if p.PermType == authpb.READWRITE ||
+				(write && p.PermType == authpb.WRITE) ||
+				(!write && p.PermType == authpb.READ) {
+				granted = append(granted, newInterval(p.Key, p.RangeEnd))
+			}
+		}
+	}
+
+	return covers(granted, newInterval(key, end))
+}
+
+// putUser must be called with mu held.
+func (s *Store) putUser(ctx context.Context, u *authpb.User) error {
+	b, err := u.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode user: %w", err)
+	}
+	if err := s.drv.BucketPut(ctx, UsersBucket, u.Name, b); err != nil {
+		return fmt.Errorf("failed to save user: %w", err)
+	}
+	s.users[string(u.Name)] = u
+	return nil
+}
+
+// putRole must be called with mu held.
+func (s *Store) putRole(ctx context.Context, r *authpb.Role) error {
+	b, err := r.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode role: %w", err)
+	}
+	if err := s.drv.BucketPut(ctx, RolesBucket, r.Name, b); err != nil {
+		return fmt.Errorf("failed to save role: %w", err)
+	}
+	s.roles[string(r.Name)] = r
+	return nil
+}
+
+// commit bumps and persists the auth revision and the enabled flag. It must
+// be called with mu held.
+func (s *Store) commit(ctx context.Context) error {
+	s.revision++
+
+	var rev [8]byte
+	binary.BigEndian.PutUint64(rev[:], s.revision)
+	if err := s.drv.BucketPut(ctx, Bucket, revisionKey, rev[:]); err != nil {
+		return fmt.Errorf("failed to save auth revision: %w", err)
+	}
+	enabled := []byte{0}
+	if s.enabled {
+		enabled[0] = 1
+	}
+	if err := s.drv.BucketPut(ctx, Bucket, enabledKey, enabled); err != nil {
+		return fmt.Errorf("failed to save auth state: %w", err)
+	}
+
+	return nil
+}
+
+// dropTokens must be called with mu held.
+func (s *Store) dropTokens(user string) {
+	for t, tok := range s.tokens {
+		if tok.user == user {
+			delete(s.tokens, t)
+		}
+	}
+}
+
+func hasRole(u *authpb.User, role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneUser(u *authpb.User) *authpb.User {
+	return &authpb.User{
+		Name:     u.Name,
+		Password: u.Password,
+		Roles:    append([]string(nil), u.Roles...),
+		Options:  u.Options,
+	}
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+func newStore(t *testing.T, drv driver.Driver) *Store {
+	t.Helper()
+	s, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newDriver(t *testing.T) driver.Driver {
+	t.Helper()
+	d, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestEnable(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t, newDriver(t))
+
+	if err := s.Enable(ctx); !errors.Is(err, ErrRootUserNotExist) {
+		t.Fatalf("Enable without root returned %v", err)
+	}
+	if err := s.UserAdd(ctx, RootUser, "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enable(ctx); !errors.Is(err, ErrRootRoleNotExist) {
+		t.Fatalf("Enable without the root role returned %v", err)
+	}
+	if err := s.UserGrantRole(ctx, RootUser, RootRole); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UserDelete(ctx, RootUser); !errors.Is(err, ErrInvalidAuthMgmt) {
+		t.Fatalf("deleting root while enabled returned %v", err)
+	}
+
+	if _, err := s.Authenticate(RootUser, "wrong"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Authenticate with a wrong password returned %v", err)
+	}
+	token, err := s.Authenticate(RootUser, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := s.User(token); err != nil || user != RootUser {
+		t.Fatalf("User of the token is %q, %v", user, err)
+	}
+
+	if err := s.Disable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User(token); !errors.Is(err, ErrInvalidAuthToken) {
+		t.Fatalf("a token outlived Disable: %v", err)
+	}
+}
+
+func TestIsPermitted(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t, newDriver(t))
+
+	for _, err := range []error{
+		s.UserAdd(ctx, "alice", "", true),
+		s.RoleAdd(ctx, "apps"),
+		s.RoleGrantPermission(ctx, "apps", &authpb.Permission{PermType: authpb.READWRITE, Key: []byte("/apps/"), RangeEnd: []byte("/apps0")}),
+		s.RoleGrantPermission(ctx, "apps", &authpb.Permission{PermType: authpb.READ, Key: []byte("/config")}),
+		s.UserGrantRole(ctx, "alice", "apps"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		key, end string
+		write    bool
+		want     bool
+	}{
+		{"/apps/a", "", true, true},
+		{"/apps/", "/apps0", false, true},
+		{"/apps/", "\x00", false, false},
+		{"/config", "", false, true},
+		{"/config", "", true, false},
+		{"/other", "", false, false},
+	} {
+		if got := s.IsPermitted("alice", []byte(c.key), []byte(c.end), c.write); got != c.want {
+			t.Errorf("IsPermitted(%q, %q, write %v) = %v, want %v", c.key, c.end, c.write, got, c.want)
+		}
+	}
+
+	if _, err := s.Authenticate("alice", ""); !errors.Is(err, ErrAuthNotEnabled) {
+		t.Errorf("Authenticate while disabled returned %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	drv := newDriver(t)
+	s := newStore(t, drv)
+
+	for _, err := range []error{
+		s.UserAdd(ctx, RootUser, "secret", false),
+		s.UserGrantRole(ctx, RootUser, RootRole),
+		s.RoleAdd(ctx, "apps"),
+		s.Enable(ctx),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := newStore(t, drv)
+	if !reloaded.Enabled() {
+		t.Error("auth is disabled after reloading")
+	}
+	if reloaded.Revision() != s.Revision() {
+		t.Errorf("revision is %d after reloading, want %d", reloaded.Revision(), s.Revision())
+	}
+	if !reloaded.IsAdmin(RootUser) {
+		t.Error("root is not an admin after reloading")
+	}
+	if roles := reloaded.RoleList(); len(roles) != 1 || roles[0] != "apps" {
+		t.Errorf("roles are %v after reloading", roles)
+	}
+	if _, err := reloaded.Authenticate(RootUser, "secret"); err != nil {
+		t.Errorf("Authenticate after reloading returned %v", err)
+	}
+}
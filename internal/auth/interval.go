@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// interval is the half-open key range [begin, end). A nil end is
+// unbounded.
+type interval struct {
+	begin []byte
+	end   []byte
+}
+
+// newInterval converts an etcd style range, where an empty end selects a
+// single key and "\x00" every key from key on.
+func newInterval(key []byte, end []byte) interval {
+	switch {
+	case len(end) == 0:
+		return interval{begin: key, end: append(append([]byte{}, key...), 0)}
+	case driver.IsOpenEnd(end):
+		return interval{begin: key}
+	default:
+		return interval{begin: key, end: end}
+	}
+}
+
+// lessEnd orders ends with nil as the largest.
+func lessEnd(a []byte, b []byte) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// covers reports whether the union of granted contains want.
+func covers(granted []interval, want interval) bool {
+	if want.end != nil && bytes.Compare(want.begin, want.end) >= 0 {
+		return true
+	}
+
+	sort.Slice(granted, func(i, j int) bool {
+		return bytes.Compare(granted[i].begin, granted[j].begin) < 0
+	})
+
+	// Extend the covered prefix of want through the sorted grants.
+	pos := want.begin
+	for _, g := range granted {
+		if bytes.Compare(g.begin, pos) > 0 {
+			break
+		}
+		if lessEnd(pos, g.end) || g.end == nil {
+			if g.end == nil {
+				return true
+			}
+			pos = g.end
+		}
+		if want.end != nil && bytes.Compare(pos, want.end) >= 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,35 +1,347 @@
 package config
 
 import (
+	"flag"
 	"fmt"
-
-	"github.com/kelseyhightower/envconfig"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+// config holds the settings of the server. Each is read from the config
+// file, an ETCD_SHIM_ environment variable and a flag, named after its env
+// tag: level in LogConfig is log-level in the file, ETCD_SHIM_LOG_LEVEL in
+// the environment and --log-level on the command line. A flag tag overrides
+// the flag name, to follow etcd's. Fields tagged secret are redacted when
+// printed.
 type config struct {
-	Listen             string `envconfig:"listen" default:""`
-	Port               string `envconfig:"port" default:"2379"`
-	ETCDVersion        string `envconfig:"etcd_version" default:"3.5.0"`
-	ETCDClusterVersion string `envconfig:"etcd_cluster_version" default:"3.5.0"`
-	Driver             string `envconfig:"driver" default:"badger"`
+	Listen string `env:"listen" default:""`
+	Port   string `env:"port" default:"2379"`
+	// ListenClientURLs replaces Listen and Port with http://, https://,
+	// unix:// or unixs:// URLs, e.g.
+	// http://0.0.0.0:2379,unix:///run/etcd-shim.sock.
+	ListenClientURLs []string `env:"listen_client_urls" default:""`
+	// ListenMetricsURLs serve only the metrics, health and version endpoints.
+	ListenMetricsURLs []string `env:"listen_metrics_urls" default:""`
+	// AdvertiseClientURLs are reported by MemberList. Defaults to the
+	// client URLs listened on.
+	AdvertiseClientURLs []string  `env:"advertise_client_urls" default:""`
+	TLS                 TLSConfig `env:"tls"`
+
+	ETCDVersion        string `env:"etcd_version" default:"3.5.0"`
+	ETCDClusterVersion string `env:"etcd_cluster_version" default:"3.5.0"`
+	Driver             string `env:"driver" default:"badger"`
+	// DataDir, like etcd's --data-dir, holds the files of the badger, sqlite
+	// and bbolt drivers whose paths are not set.
+	DataDir string `env:"data_dir" default:""`
+	// TraceFile, if set, records the KV, Watch and Lease traffic to the file
+	// for replaying against another server. Recording serializes requests.
+	TraceFile string `env:"trace_file" default:""`
+
+	Log       LogConfig       `env:"log"`
+	Audit     AuditConfig     `env:"audit"`
+	Tracing   TracingConfig   `env:"tracing"`
+	RateLimit RateLimitConfig `env:"rate_limit"`
+	Tenant    TenantConfig    `env:"tenant"`
+
+	LimitsConfig
+	DriverConfig
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	Level string `env:"level" default:"info"`
+	// Format is json or text.
+	Format string `env:"format" default:"json"`
+	// RequestLevel is the level requests are logged at, or off.
+	RequestLevel string `env:"request_level" default:"debug"`
+	// MethodLevels overrides RequestLevel per method, e.g.
+	// Put:info,LeaseKeepAlive:off. Requests not served over gRPC are
+	// configured as HTTP.
+	MethodLevels map[string]string `env:"method_levels" default:""`
+	// MethodSample logs one in every n requests of a method, e.g. Range:100.
+	MethodSample map[string]int `env:"method_sample" default:""`
+	// SlowThreshold logs requests taking longer at warn level. Zero disables
+	// it.
+	SlowThreshold time.Duration `env:"slow_threshold" default:"500ms"`
+	// ValuePrefixes are the key prefixes whose values may be logged; all
+	// other values are redacted.
+	ValuePrefixes []string `env:"value_prefixes" default:""`
+}
+
+type AuditConfig struct {
+	// Path is the audit log file, or - for stdout. Leaving it empty disables
+	// the audit log.
+	Path string `env:"path" default:""`
+	// MaxSize is the size in megabytes at which the file is rotated.
+	MaxSize    int  `env:"max_size" default:"100"`
+	MaxBackups int  `env:"max_backups" default:"10"`
+	MaxAge     int  `env:"max_age" default:"0"`
+	Compress   bool `env:"compress" default:"false"`
+	// Prefixes limits the audited keys, e.g. /apisix/ssls/. Empty audits
+	// every key.
+	Prefixes []string `env:"prefixes" default:""`
+}
+
+type TracingConfig struct {
+	// Endpoint is the host:port of an OTLP/gRPC collector. Leaving it empty
+	// disables tracing.
+	Endpoint string `env:"endpoint" default:""`
+	Insecure bool   `env:"insecure" default:"false"`
+	// SampleRatio is the fraction of traces sampled when the caller has not
+	// decided already.
+	SampleRatio float64 `env:"sample_ratio" default:"1"`
 }
 
-var conf config
+// TLSConfig is used by the https:// and unixs:// listeners.
+type TLSConfig struct {
+	CertFile string `env:"cert_file" flag:"cert-file" default:""`
+	KeyFile  string `env:"key_file" flag:"key-file" default:""`
+	// TrustedCAFile verifies client certificates.
+	TrustedCAFile string `env:"trusted_ca_file" flag:"trusted-ca-file" default:""`
+	// ClientCertAuth requires clients to present a certificate.
+	ClientCertAuth bool `env:"client_cert_auth" flag:"client-cert-auth" default:"false"`
+}
+
+type RateLimitConfig struct {
+	// Key is what clients are told apart by: ip, user or cn.
+	Key string `env:"key" default:"ip"`
+	// ReadRate, WriteRate and WatchRate are the requests per second, and
+	// watchers created per second, a client may make. Zero is unlimited.
+	ReadRate   float64 `env:"read_rate" default:"0"`
+	ReadBurst  int     `env:"read_burst" default:"100"`
+	WriteRate  float64 `env:"write_rate" default:"0"`
+	WriteBurst int     `env:"write_burst" default:"50"`
+	WatchRate  float64 `env:"watch_rate" default:"0"`
+	WatchBurst int     `env:"watch_burst" default:"100"`
+	// MaxInFlight caps the unary requests a client may have in flight. Zero
+	// is unlimited.
+	MaxInFlight int `env:"max_in_flight" default:"0"`
+}
+
+// TenantConfig confines clients to key prefixes.
+type TenantConfig struct {
+	// Key is what clients are mapped by: user or cn.
+	Key string `env:"key" default:"user"`
+	// Prefixes maps users or common names to the prefix of their keys, e.g.
+	// apisix-a:/tenants/a,admin:. An empty prefix grants the whole key
+	// space. Leaving it empty disables tenants.
+	Prefixes map[string]string `env:"prefixes" default:""`
+	// QuotaBytes bounds the keys and values of every tenant, and Quotas
+	// those of the named ones, e.g. apisix-a:1073741824. Zero is unlimited.
+	QuotaBytes int64            `env:"quota_bytes" default:"0"`
+	Quotas     map[string]int64 `env:"quotas" default:""`
+}
+
+// LimitsConfig bounds the requests and data the server accepts. The names
+// follow etcd's flags, e.g. --max-request-bytes.
+type LimitsConfig struct {
+	// MaxRequestBytes and MaxTxnOps are disabled by negative values.
+	MaxRequestBytes int `env:"max_request_bytes" default:"1572864"`
+	MaxTxnOps       int `env:"max_txn_ops" default:"128"`
+	// MaxRangeBytes bounds the encoded size of a Range response. Zero is
+	// unlimited.
+	MaxRangeBytes int `env:"max_range_bytes" default:"0"`
+	// MaxKeyBytes and MaxValueBytes bound the keys and values written. Zero
+	// is unlimited.
+	MaxKeyBytes   int `env:"max_key_bytes" default:"0"`
+	MaxValueBytes int `env:"max_value_bytes" default:"0"`
+	// GRPCMaxRecvMsgBytes defaults to MaxRequestBytes plus 512 KiB.
+	// GRPCMaxSendMsgBytes defaults to gRPC's limit.
+	GRPCMaxRecvMsgBytes int `env:"grpc_max_recv_msg_bytes" default:"0"`
+	GRPCMaxSendMsgBytes int `env:"grpc_max_send_msg_bytes" default:"0"`
+	// QuotaBackendBytes rejects puts once the database reaches the size,
+	// raising the NOSPACE alarm. Zero is unlimited; the memory driver does
+	// not support it.
+	QuotaBackendBytes int64 `env:"quota_backend_bytes" default:"0"`
+}
+
+// DriverConfig holds the settings of every driver. It is handed to the
+// driver factory so drivers never read the global configuration.
+type DriverConfig struct {
+	Badger   BadgerConfig   `env:"badger"`
+	SQLite   SQLiteConfig   `env:"sqlite"`
+	Postgres PostgresConfig `env:"postgres"`
+	MySQL    MySQLConfig    `env:"mysql"`
+	Bbolt    BboltConfig    `env:"bbolt"`
+	Memory   MemoryConfig   `env:"memory"`
+}
 
-func LoadConf() error {
-	if err := envconfig.Process("", &conf); err != nil {
-		return fmt.Errorf("config.LoadConf: failed to load conf: %w", err)
+type BadgerConfig struct {
+	DataDir          string `env:"data_dir" default:"data/badger"`
+	InMemory         bool   `env:"in_memory" default:"false"`
+	SyncWrites       bool   `env:"sync_writes" default:"false"`
+	ValueLogFileSize int64  `env:"value_log_file_size" default:"1073741823"`
+	MemTableSize     int64  `env:"mem_table_size" default:"67108864"`
+	// Compression is one of none, snappy or zstd.
+	Compression    string `env:"compression" default:"snappy"`
+	BlockCacheSize int64  `env:"block_cache_size" default:"268435456"`
+	// EncryptionKey is an AES-128, 192 or 256 master key, either raw or hex
+	// encoded. EncryptionKeyFile reads it from a file instead. Leaving both
+	// empty disables encryption.
+	EncryptionKey     string `env:"encryption_key" default:"" secret:"true"`
+	EncryptionKeyFile string `env:"encryption_key_file" default:""`
+	// EncryptionKeyRotationDuration is how long a data key is used before
+	// Badger generates a new one.
+	EncryptionKeyRotationDuration time.Duration `env:"encryption_key_rotation_duration" default:"240h"`
+}
+
+type SQLiteConfig struct {
+	// Path is the database file, or :memory: for a throwaway database.
+	Path string `env:"path" default:"data/etcd-shim.db"`
+	// PollInterval is how often the log is polled for writes made by other
+	// processes sharing the file.
+	PollInterval time.Duration `env:"poll_interval" default:"1s"`
+}
+
+type PostgresConfig struct {
+	// DSN is a libpq connection string or postgres:// URL.
+	DSN          string `env:"dsn" default:"" secret:"true"`
+	MaxOpenConns int    `env:"max_open_conns" default:"10"`
+	// PollInterval is the fallback poll for writes made by other processes;
+	// LISTEN/NOTIFY normally delivers them immediately.
+	PollInterval time.Duration `env:"poll_interval" default:"10s"`
+}
+
+type MySQLConfig struct {
+	// DSN is a go-sql-driver/mysql data source name, e.g.
+	// user:password@tcp(127.0.0.1:3306)/etcd.
+	DSN          string `env:"dsn" default:"" secret:"true"`
+	MaxOpenConns int    `env:"max_open_conns" default:"10"`
+	// PollInterval is how often the log is polled for writes made by other
+	// processes.
+	PollInterval time.Duration `env:"poll_interval" default:"1s"`
+}
+
+type BboltConfig struct {
+	// Path is the database file. It uses etcd's mvcc layout, so etcd's
+	// member/snap/db or a snapshot file can be used directly.
+	Path   string `env:"path" default:"data/bbolt/db"`
+	NoSync bool   `env:"no_sync" default:"false"`
+}
+
+type MemoryConfig struct {
+	// SnapshotPath, if set, persists the data across restarts by writing a
+	// snapshot every SnapshotInterval and on shutdown.
+	SnapshotPath     string        `env:"snapshot_path" default:""`
+	SnapshotInterval time.Duration `env:"snapshot_interval" default:"1m"`
+}
+
+var (
+	conf config
+	// sources are where the settings of conf were read from.
+	sources map[string]source
+	// flags are the flags set on the command line, by name.
+	flags map[string]string
+)
+
+// LoadConf reads the configuration from, in increasing precedence, the
+// defaults, the config file, the environment and the flags of fs that were
+// set. fs is parsed already and had RegisterFlags called on it; it may be
+// nil.
+func LoadConf(fs *flag.FlagSet) error {
+	set := map[string]string{}
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = f.Value.String()
+		})
 	}
 
+	var c config
+	s, err := load(&c, EnvPrefix, configFile(set), set, true)
+	if err != nil {
+		return fmt.Errorf("config.LoadConf: %w", err)
+	}
+	applyDataDir(&c, s)
+	conf, sources, flags = c, s, set
+
 	return nil
 }
 
-func Listen() string {
-	return conf.Listen
+// LoadDriverConfig loads a DriverConfig from environment variables carrying
+// prefix, e.g. ETCD_SHIM_SOURCE_BADGER_DATA_DIR for the prefix "source".
+func LoadDriverConfig(prefix string) (DriverConfig, error) {
+	var c DriverConfig
+	if prefix != "" {
+		prefix = strings.ToUpper(prefix) + "_"
+	}
+	if _, err := load(&c, EnvPrefix+prefix, "", nil, false); err != nil {
+		return DriverConfig{}, fmt.Errorf("config.LoadDriverConfig: %w", err)
+	}
+
+	return c, nil
+}
+
+// DefaultDriverConfig returns the defaults of the driver settings, without
+// reading the environment.
+func DefaultDriverConfig() DriverConfig {
+	var c DriverConfig
+	for _, s := range settings(&c) {
+		if err := s.set(s.def); err != nil {
+			panic(fmt.Sprintf("config.DefaultDriverConfig: invalid default of %s: %v", s.name, err))
+		}
+	}
+	return c
+}
+
+// Store returns what identifies the store the driver of name opens with c:
+// its file, directory or DSN. It is empty for stores only the process sees,
+// which are never shared.
+func (c DriverConfig) Store(name string) string {
+	var path string
+	switch name {
+	case "badger":
+		if c.Badger.InMemory {
+			return ""
+		}
+		path = c.Badger.DataDir
+	case "sqlite":
+		if c.SQLite.Path == ":memory:" {
+			return ""
+		}
+		path = c.SQLite.Path
+	case "bbolt":
+		path = c.Bbolt.Path
+	case "memory":
+		path = c.Memory.SnapshotPath
+	case "postgres":
+		return c.Postgres.DSN
+	case "mysql":
+		return c.MySQL.DSN
+	}
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
 }
 
-func Port() string {
-	return conf.Port
+// ListenClientURLs returns --listen-client-urls, or the URL of --listen and
+// --port when it is not set.
+func ListenClientURLs() []string {
+	if len(conf.ListenClientURLs) > 0 {
+		return conf.ListenClientURLs
+	}
+	return []string{"http://" + net.JoinHostPort(conf.Listen, conf.Port)}
+}
+
+func ListenMetricsURLs() []string {
+	return conf.ListenMetricsURLs
+}
+
+func AdvertiseClientURLs() []string {
+	if len(conf.AdvertiseClientURLs) > 0 {
+		return conf.AdvertiseClientURLs
+	}
+	return ListenClientURLs()
+}
+
+func TLS() TLSConfig {
+	return conf.TLS
 }
 
 func ETCDVersion() string {
@@ -40,6 +352,51 @@ func ETCDClusterVersion() string {
 	return conf.ETCDClusterVersion
 }
 
+func TraceFile() string {
+	return conf.TraceFile
+}
+
+func Log() LogConfig {
+	return conf.Log
+}
+
+func Audit() AuditConfig {
+	return conf.Audit
+}
+
+func Tracing() TracingConfig {
+	return conf.Tracing
+}
+
+func RateLimit() RateLimitConfig {
+	return conf.RateLimit
+}
+
+func Tenant() TenantConfig {
+	return conf.Tenant
+}
+
+func Limits() LimitsConfig {
+	return conf.LimitsConfig
+}
+
 func Driver() string {
 	return conf.Driver
 }
+
+func Drivers() DriverConfig {
+	return conf.DriverConfig
+}
+
+// DeprecatedEnv returns the settings read from environment variables
+// without EnvPrefix, e.g. PORT, in sorted order.
+func DeprecatedEnv() []string {
+	var names []string
+	for name, src := range sources {
+		if src == sourceLegacyEnv {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
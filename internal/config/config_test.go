@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDriverConfigStore(t *testing.T) {
+	a := DriverConfig{Bbolt: BboltConfig{Path: "data/bbolt/db"}, SQLite: SQLiteConfig{Path: ":memory:"}}
+	b := DriverConfig{Bbolt: BboltConfig{Path: "./data/bbolt/../bbolt/db"}, SQLite: SQLiteConfig{Path: ":memory:"}}
+
+	if a.Store("bbolt") != b.Store("bbolt") {
+		t.Errorf("paths to one bbolt file resolve to %q and %q", a.Store("bbolt"), b.Store("bbolt"))
+	}
+	if s := a.Store("sqlite"); s != "" {
+		t.Errorf("an in-memory sqlite database resolves to %q", s)
+	}
+	if s := a.Store("memory"); s != "" {
+		t.Errorf("a memory driver without a snapshot resolves to %q", s)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "etcd-shim.yaml")
+	if err := os.WriteFile(path, []byte("log-level: info\nport: \"2379\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"--config-file", path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConf(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("log-level: debug\nport: \"2380\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := Reload(func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Reload reported %v, want LOG_LEVEL and PORT", changes)
+	}
+	if Log().Level != "debug" {
+		t.Errorf("reloaded LOG_LEVEL is %q, want debug", Log().Level)
+	}
+	// PORT takes a restart, so the running configuration keeps it.
+	if urls := ListenClientURLs(); urls[0] != "http://:2379" {
+		t.Errorf("client URLs after a reload are %v", urls)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	// A Service named etcd-shim links itself as ETCD_SHIM_PORT.
+	t.Setenv(EnvPrefix+"PORT", "tcp://10.0.0.1:2379")
+	t.Setenv("DRIVER", "bbolt")
+	t.Setenv(EnvPrefix+"LOG_LEVEL", "warn")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("DATA_DIR", "/var/lib/etcd-shim")
+	t.Setenv(EnvPrefix+"AUDIT_PREFIXES", `/a\,b/,/c/`)
+	t.Setenv(EnvPrefix+"LOG_METHOD_LEVELS", `Put:info,Range:debug`)
+
+	if err := LoadConf(nil); err != nil {
+		t.Fatal(err)
+	}
+	if urls := ListenClientURLs(); urls[0] != "http://:2379" {
+		t.Errorf("client URLs with a service link are %v", urls)
+	}
+	if Driver() != "bbolt" {
+		t.Errorf("DRIVER read as %q, want bbolt", Driver())
+	}
+	if Log().Level != "warn" {
+		t.Errorf("LOG_LEVEL read as %q, want the prefixed warn", Log().Level)
+	}
+	if conf.DataDir != "" {
+		t.Errorf("DATA_DIR, added with the prefix, read as %q", conf.DataDir)
+	}
+	if names := DeprecatedEnv(); len(names) != 1 || names[0] != "DRIVER" {
+		t.Errorf("DeprecatedEnv returned %v, want DRIVER", names)
+	}
+	if p := Audit().Prefixes; len(p) != 2 || p[0] != "/a,b/" || p[1] != "/c/" {
+		t.Errorf("AUDIT_PREFIXES read as %q", p)
+	}
+	if m := Log().MethodLevels; len(m) != 2 || m["Put"] != "info" {
+		t.Errorf("LOG_METHOD_LEVELS read as %v", m)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	for _, items := range [][]string{
+		{"a"},
+		{"a", "b"},
+		{"a,b", "", `c\d`},
+	} {
+		if got := splitList(joinList(items)); !slices.Equal(got, items) {
+			t.Errorf("splitList(joinList(%q)) = %q", items, got)
+		}
+	}
+}
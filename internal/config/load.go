@@ -0,0 +1,383 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix namespaces the environment variables of the settings, e.g.
+// ETCD_SHIM_LOG_LEVEL. In Kubernetes a Service named etcd-shim injects
+// ETCD_SHIM_PORT=tcp://10.0.0.1:2379 and the like into the pods of its
+// namespace. No setting takes a tcp://, udp:// or sctp:// URL, so such
+// values are ignored and the prefix is kept.
+const EnvPrefix = "ETCD_SHIM_"
+
+// serviceLinkSchemes are the schemes of the Kubernetes service links.
+var serviceLinkSchemes = []string{"tcp://", "udp://", "sctp://"}
+
+// prefixedOnly are the settings added after EnvPrefix, by name or by
+// prefix ending in _. The others are still read without EnvPrefix when it
+// is not set, e.g. PORT for ETCD_SHIM_PORT, which is deprecated.
+var prefixedOnly = []string{"DATA_DIR", "TENANT_"}
+
+// configFileFlag names the YAML config file, also read from
+// ETCD_SHIM_CONFIG_FILE. Its keys are the flag names, as in etcd's.
+const configFileFlag = "config-file"
+
+// source is where the value of a setting was read from, in increasing
+// precedence.
+type source int
+
+const (
+	sourceDefault source = iota
+	sourceFile
+	// sourceLegacyEnv is an environment variable without EnvPrefix.
+	sourceLegacyEnv
+	sourceEnv
+	sourceFlag
+)
+
+// setting is a field of a configuration struct.
+type setting struct {
+	// name is the environment variable without EnvPrefix, e.g. LOG_LEVEL.
+	name string
+	// flag is the flag and the key of the config file, e.g. log-level. It
+	// is derived from name unless the field has a flag tag.
+	flag   string
+	def    string
+	secret bool
+	value  reflect.Value
+}
+
+// settings returns the settings of the struct v points to, in declaration
+// order. Nested structs prefix the names of their settings with their own;
+// embedded ones do not.
+func settings(v any) []*setting {
+	var s []*setting
+	walk("", reflect.ValueOf(v).Elem(), &s)
+	return s
+}
+
+func walk(prefix string, v reflect.Value, out *[]*setting) {
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Anonymous {
+			walk(prefix, v.Field(i), out)
+			continue
+		}
+		name := prefix + strings.ToUpper(f.Tag.Get("env"))
+		if f.Type.Kind() == reflect.Struct {
+			walk(name+"_", v.Field(i), out)
+			continue
+		}
+
+		flagName := f.Tag.Get("flag")
+		if flagName == "" {
+			flagName = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+		}
+		*out = append(*out, &setting{
+			name:   name,
+			flag:   flagName,
+			def:    f.Tag.Get("default"),
+			secret: f.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+}
+
+// set parses value into the setting. Lists are comma separated and maps
+// are comma separated key:value pairs; \, is a comma within an item. An
+// empty string is the zero value.
+func (s *setting) set(value string) error {
+	v := s.value
+	if value == "" {
+		v.SetZero()
+		return nil
+	}
+
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitList(value)))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range splitList(value) {
+			key, elem, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("expected key:value, got %q", pair)
+			}
+			e := &setting{value: reflect.New(v.Type().Elem()).Elem()}
+			if err := e.set(elem); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(key), e.value)
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// splitList splits value at the commas not escaped as \,. Other
+// backslashes are kept.
+func splitList(value string) []string {
+	var (
+		items []string
+		item  strings.Builder
+	)
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == ',':
+			item.WriteByte(',')
+			i++
+		case value[i] == ',':
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(value[i])
+		}
+	}
+	return append(items, item.String())
+}
+
+// joinList joins items, escaping their commas for splitList.
+func joinList(items []string) string {
+	escaped := make([]string, len(items))
+	for i, item := range items {
+		escaped[i] = strings.ReplaceAll(item, ",", `\,`)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// flagValue records a flag as given, to be parsed with the other sources.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(s string) error {
+	f.value = s
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// RegisterFlags defines --config-file and a flag for every setting on fs,
+// to be handed to LoadConf after parsing.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.String(configFileFlag, "", fmt.Sprintf("YAML file of settings keyed by flag name; env %sCONFIG_FILE", EnvPrefix))
+
+	var c config
+	for _, s := range settings(&c) {
+		v := &flagValue{isBool: s.value.Kind() == reflect.Bool}
+		fs.Var(v, s.flag, "env "+EnvPrefix+s.name)
+		// The help leaves out the defaults that are zero values.
+		if err := s.set(s.def); err == nil && !s.value.IsZero() {
+			fs.Lookup(s.flag).DefValue = s.def
+		}
+	}
+}
+
+// load reads the settings of c from, in increasing precedence, their
+// defaults, the config file at path if any, the environment variables
+// carrying prefix and flags, which maps flag names to values. With legacy,
+// the variables without prefix are read for the settings prefix leaves
+// unset. It returns where each setting was read from.
+func load(c any, prefix string, path string, flags map[string]string, legacy bool) (map[string]source, error) {
+	all := settings(c)
+	sources := make(map[string]source, len(all))
+	byFlag := make(map[string]*setting, len(all))
+	for _, s := range all {
+		if err := s.set(s.def); err != nil {
+			return nil, fmt.Errorf("invalid default of %s: %w", s.name, err)
+		}
+		sources[s.name] = sourceDefault
+		byFlag[s.flag] = s
+	}
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			s, ok := byFlag[key]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+			}
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("%s: invalid %s: %w", path, key, err)
+			}
+			sources[s.name] = sourceFile
+		}
+	}
+
+	for _, s := range all {
+		name, src := prefix+s.name, sourceEnv
+		value, ok := lookupEnv(name)
+		if !ok && legacy && !matches(s.name, prefixedOnly) {
+			name, src = s.name, sourceLegacyEnv
+			value, ok = lookupEnv(name)
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		sources[s.name] = src
+	}
+
+	for name, value := range flags {
+		s, ok := byFlag[name]
+		if !ok {
+			continue
+		}
+		if err := s.set(value); err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", name, err)
+		}
+		sources[s.name] = sourceFlag
+	}
+
+	return sources, nil
+}
+
+// lookupEnv returns the environment variable name unless it is a
+// Kubernetes service link.
+func lookupEnv(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", false
+	}
+	for _, scheme := range serviceLinkSchemes {
+		if strings.HasPrefix(value, scheme) {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// matches reports whether name is in list, whose entries ending in _ match
+// by prefix.
+func matches(name string, list []string) bool {
+	for _, l := range list {
+		if name == l || (strings.HasSuffix(l, "_") && strings.HasPrefix(name, l)) {
+			return true
+		}
+	}
+	return false
+}
+
+// configFile returns the path of the config file, if any.
+func configFile(flags map[string]string) string {
+	if path, ok := flags[configFileFlag]; ok {
+		return path
+	}
+	return os.Getenv(EnvPrefix + "CONFIG_FILE")
+}
+
+// readFile returns the settings of the YAML file at path as they would be
+// written in the environment.
+func readFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	values := make(map[string]string, len(doc))
+	for key, v := range doc {
+		switch v := v.(type) {
+		case nil:
+			values[key] = ""
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = joinList(items)
+		case map[string]any:
+			pairs := make([]string, 0, len(v))
+			for k, item := range v {
+				pairs = append(pairs, k+":"+fmt.Sprint(item))
+			}
+			sort.Strings(pairs)
+			values[key] = joinList(pairs)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// applyDataDir places the files of the drivers under DATA_DIR, as etcd's
+// --data-dir does, unless their paths are set on their own.
+func applyDataDir(c *config, sources map[string]source) {
+	if c.DataDir == "" {
+		return
+	}
+	for _, p := range []struct {
+		name string
+		path *string
+		rel  string
+	}{
+		{"BADGER_DATA_DIR", &c.Badger.DataDir, "badger"},
+		{"SQLITE_PATH", &c.SQLite.Path, "etcd-shim.db"},
+		{"BBOLT_PATH", &c.Bbolt.Path, filepath.Join("bbolt", "db")},
+	} {
+		if sources[p.name] == sourceDefault {
+			*p.path = filepath.Join(c.DataDir, p.rel)
+		}
+	}
+}
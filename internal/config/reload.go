@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reloadable are the settings Reload applies without a restart, by name or
+// by prefix ending in _.
+var reloadable = []string{"LOG_LEVEL", "TLS_", "RATE_LIMIT_"}
+
+// Change is a setting that differs after Reload.
+type Change struct {
+	// Name is the environment variable of the setting without EnvPrefix,
+	// e.g. LOG_LEVEL.
+	Name string
+	Old  string
+	New  string
+}
+
+// Reloadable reports whether the change takes effect without a restart.
+func (c Change) Reloadable() bool {
+	return matches(c.Name, reloadable)
+}
+
+// Reload reads the configuration again and returns what changed. Only the
+// config file can have changed, as the environment and the flags are those
+// the process started with. check runs with the new configuration in place,
+// and if it fails the previous one is restored. Otherwise only the
+// reloadable settings are kept, so the others read as the process uses
+// them until a restart. Reload must not run concurrently with the other
+// functions of the package.
+func Reload(check func() error) ([]Change, error) {
+	var next config
+	nextSources, err := load(&next, EnvPrefix, configFile(flags), flags, true)
+	if err != nil {
+		return nil, fmt.Errorf("config.Reload: %w", err)
+	}
+	applyDataDir(&next, nextSources)
+
+	prev, prevSources := conf, sources
+	conf, sources = next, nextSources
+	if err := check(); err != nil {
+		conf, sources = prev, prevSources
+		return nil, fmt.Errorf("config.Reload: %w", err)
+	}
+
+	applied, appliedSources := prev, make(map[string]source, len(prevSources))
+	for name, src := range prevSources {
+		appliedSources[name] = src
+	}
+	var changes []Change
+	p, n, a := settings(&prev), settings(&next), settings(&applied)
+	for i := range p {
+		if matches(p[i].name, reloadable) {
+			a[i].value.Set(n[i].value)
+			appliedSources[p[i].name] = nextSources[p[i].name]
+		}
+		old, cur := p[i].value.Interface(), n[i].value.Interface()
+		if !reflect.DeepEqual(old, cur) {
+			changes = append(changes, Change{Name: p[i].name, Old: fmt.Sprint(old), New: fmt.Sprint(cur)})
+		}
+	}
+	conf, sources = applied, appliedSources
+	return changes, nil
+}
+
+// Write writes the configuration in effect as a config file, commenting
+// where each setting not at its default was read from. Secrets are
+// redacted.
+func Write(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings(&conf) {
+		value := &yaml.Node{}
+		switch v := s.value.Interface().(type) {
+		case time.Duration:
+			value.SetString(v.String())
+		default:
+			if s.secret && !s.value.IsZero() {
+				value.SetString("REDACTED")
+			} else if err := value.Encode(v); err != nil {
+				return fmt.Errorf("config.Write: failed to encode %s: %w", s.name, err)
+			}
+		}
+
+		key := &yaml.Node{}
+		key.SetString(s.flag)
+		switch sources[s.name] {
+		case sourceFile:
+			key.LineComment = configFileFlag
+		case sourceLegacyEnv:
+			key.LineComment = s.name
+		case sourceEnv:
+			key.LineComment = EnvPrefix + s.name
+		case sourceFlag:
+			key.LineComment = "--" + s.flag
+		}
+		doc.Content = append(doc.Content, key, value)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("config.Write: %w", err)
+	}
+	return enc.Close()
+}
@@ -0,0 +1,139 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	rootPassword = "conformance-root"
+	userPassword = "conformance-user"
+)
+
+// checkAuth enables auth for the duration of the check and disables it
+// again, removing the users and roles it added.
+func checkAuth(ctx context.Context, env *Env, prefix string) (err error) {
+	c := env.Client
+	user, role := "conformance-user", "conformance-role"
+
+	if _, err := c.UserAdd(ctx, "root", rootPassword); err != nil {
+		return fmt.Errorf("add root: %w", err)
+	}
+	if _, err := c.UserGrantRole(ctx, "root", "root"); err != nil {
+		return fmt.Errorf("grant root role: %w", err)
+	}
+	if _, err := c.UserAdd(ctx, user, userPassword); err != nil {
+		return fmt.Errorf("add user: %w", err)
+	}
+	if _, err := c.RoleAdd(ctx, role); err != nil {
+		return fmt.Errorf("add role: %w", err)
+	}
+	if _, err := c.RoleGrantPermission(ctx, role, prefix, clientv3.GetPrefixRangeEnd(prefix), clientv3.PermissionType(clientv3.PermReadWrite)); err != nil {
+		return fmt.Errorf("grant permission: %w", err)
+	}
+	if _, err := c.UserGrantRole(ctx, user, role); err != nil {
+		return fmt.Errorf("grant role: %w", err)
+	}
+
+	users, err := c.UserList(ctx)
+	if err != nil {
+		return fmt.Errorf("list users: %w", err)
+	}
+	if err := expect(len(users.Users) >= 2, "user list = %v, want root and %s", users.Users, user); err != nil {
+		return err
+	}
+	perms, err := c.RoleGet(ctx, role)
+	if err != nil {
+		return fmt.Errorf("get role: %w", err)
+	}
+	if err := expect(len(perms.Perm) == 1 && string(perms.Perm[0].Key) == prefix, "role permissions = %v, want %s", perms.Perm, prefix); err != nil {
+		return err
+	}
+
+	if _, err := c.AuthEnable(ctx); err != nil {
+		return fmt.Errorf("enable auth: %w", err)
+	}
+
+	root, err := newClient(env.Endpoints, "root", rootPassword)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	defer func() {
+		if cleanupErr := cleanupAuth(ctx, root, user, role); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	status, err := root.AuthStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("auth status: %w", err)
+	}
+	if err := expect(status.Enabled, "auth status reports disabled"); err != nil {
+		return err
+	}
+
+	// Requests without a token are rejected.
+	if _, err := c.Get(ctx, prefix); !errors.Is(err, rpctypes.ErrUserEmpty) {
+		return fmt.Errorf("get without credentials: err = %v, want %v", err, rpctypes.ErrUserEmpty)
+	}
+
+	if _, err := newClient(env.Endpoints, user, "wrong"); !errors.Is(err, rpctypes.ErrAuthFailed) {
+		return fmt.Errorf("login with a wrong password: err = %v, want %v", err, rpctypes.ErrAuthFailed)
+	}
+
+	limited, err := newClient(env.Endpoints, user, userPassword)
+	if err != nil {
+		return err
+	}
+	defer limited.Close()
+
+	if _, err := limited.Put(ctx, prefix+"key", "1"); err != nil {
+		return fmt.Errorf("put within the granted range: %w", err)
+	}
+	if _, err := limited.Get(ctx, prefix, clientv3.WithPrefix()); err != nil {
+		return fmt.Errorf("get within the granted range: %w", err)
+	}
+	outside := prefix[:len(prefix)-1] + "-outside"
+	if _, err := limited.Put(ctx, outside, "1"); !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return fmt.Errorf("put outside the granted range: err = %v, want %v", err, rpctypes.ErrPermissionDenied)
+	}
+	if _, err := limited.Txn(ctx).Then(clientv3.OpGet(outside)).Commit(); !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return fmt.Errorf("txn outside the granted range: err = %v, want %v", err, rpctypes.ErrPermissionDenied)
+	}
+	if _, err := limited.UserAdd(ctx, "intruder", "x"); !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return fmt.Errorf("user add without the root role: err = %v, want %v", err, rpctypes.ErrPermissionDenied)
+	}
+	if _, err := root.UserDelete(ctx, "root"); !errors.Is(err, rpctypes.ErrInvalidAuthMgmt) {
+		return fmt.Errorf("delete root while auth is enabled: err = %v, want %v", err, rpctypes.ErrInvalidAuthMgmt)
+	}
+
+	// Root can do anything.
+	if _, err := root.Put(ctx, outside, "1"); err != nil {
+		return fmt.Errorf("put as root: %w", err)
+	}
+	if _, err := root.Delete(ctx, outside); err != nil {
+		return fmt.Errorf("delete as root: %w", err)
+	}
+
+	return nil
+}
+
+func cleanupAuth(ctx context.Context, root *clientv3.Client, user string, role string) error {
+	if _, err := root.AuthDisable(ctx); err != nil {
+		return fmt.Errorf("disable auth: %w", err)
+	}
+	for _, name := range []string{user, "root"} {
+		if _, err := root.UserDelete(ctx, name); err != nil {
+			return fmt.Errorf("delete user %s: %w", name, err)
+		}
+	}
+	if _, err := root.RoleDelete(ctx, role); err != nil {
+		return fmt.Errorf("delete role: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func checkCompaction(ctx context.Context, env *Env, prefix string) error {
+	c := env.Client
+	key := prefix + "key"
+
+	var revisions []int64
+	for _, v := range []string{"1", "2", "3"} {
+		res, err := c.Put(ctx, key, v)
+		if err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+		revisions = append(revisions, res.Header.Revision)
+	}
+
+	if _, err := c.Compact(ctx, revisions[1], clientv3.WithCompactPhysical()); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+
+	// Reads below the compaction revision fail, reads at it still work.
+	if _, err := c.Get(ctx, key, clientv3.WithRev(revisions[0])); err == nil {
+		return fmt.Errorf("get below the compaction revision succeeded")
+	}
+	at, err := c.Get(ctx, key, clientv3.WithRev(revisions[1]))
+	if err != nil {
+		return fmt.Errorf("get at the compaction revision: %w", err)
+	}
+	if err := expect(len(at.Kvs) == 1 && string(at.Kvs[0].Value) == "2", "get at the compaction revision = %v, want 2", at.Kvs); err != nil {
+		return err
+	}
+	latest, err := c.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	// Compaction keeps the version and create revision of live keys.
+	if err := expect(len(latest.Kvs) == 1 && latest.Kvs[0].Version == 3 && latest.Kvs[0].CreateRevision == revisions[0],
+		"key after compaction = %v, want version 3 created at %d", latest.Kvs, revisions[0]); err != nil {
+		return err
+	}
+
+	// Watching from a compacted revision is canceled with the compaction
+	// revision.
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wch := c.Watch(watchCtx, key, clientv3.WithRev(revisions[0]))
+	for {
+		res, ok := <-wch
+		if !ok {
+			return fmt.Errorf("watch closed without reporting the compaction")
+		}
+		if res.CompactRevision != 0 {
+			return expect(res.CompactRevision == revisions[1] && res.Err() != nil,
+				"watch compact revision = %d, want %d", res.CompactRevision, revisions[1])
+		}
+		if len(res.Events) > 0 {
+			return fmt.Errorf("watch from a compacted revision delivered events")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const sessionTTL = 10
+
+func checkElection(ctx context.Context, env *Env, prefix string) error {
+	s1, err := concurrency.NewSession(env.Client, concurrency.WithTTL(sessionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	defer s1.Close()
+	s2, err := concurrency.NewSession(env.Client, concurrency.WithTTL(sessionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	defer s2.Close()
+
+	e1 := concurrency.NewElection(s1, prefix)
+	e2 := concurrency.NewElection(s2, prefix)
+
+	if err := e1.Campaign(ctx, "one"); err != nil {
+		return fmt.Errorf("campaign: %w", err)
+	}
+	leader, err := e2.Leader(ctx)
+	if err != nil {
+		return fmt.Errorf("leader: %w", err)
+	}
+	if err := expect(len(leader.Kvs) == 1 && string(leader.Kvs[0].Value) == "one", "leader = %v, want one", leader.Kvs); err != nil {
+		return err
+	}
+
+	observeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	observed := e2.Observe(observeCtx)
+
+	campaigned := make(chan error, 1)
+	go func() {
+		campaigned <- e2.Campaign(ctx, "two")
+	}()
+
+	// The second candidate waits until the first resigns.
+	select {
+	case err := <-campaigned:
+		return fmt.Errorf("second campaign returned while the first leader held office: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := e1.Proclaim(ctx, "one again"); err != nil {
+		return fmt.Errorf("proclaim: %w", err)
+	}
+	if err := e1.Resign(ctx); err != nil {
+		return fmt.Errorf("resign: %w", err)
+	}
+	select {
+	case err := <-campaigned:
+		if err != nil {
+			return fmt.Errorf("second campaign: %w", err)
+		}
+	case <-time.After(watchTimeout):
+		return fmt.Errorf("second campaign did not win after the first leader resigned")
+	}
+
+	// Observers see every leader value in order.
+	want := []string{"one", "one again", "two"}
+	for len(want) > 0 {
+		select {
+		case res, ok := <-observed:
+			if !ok {
+				return fmt.Errorf("observe closed, still waiting for %q", want)
+			}
+			if len(res.Kvs) == 1 && string(res.Kvs[0].Value) == want[0] {
+				want = want[1:]
+			}
+		case <-time.After(watchTimeout):
+			return fmt.Errorf("observe did not report %q", want)
+		}
+	}
+
+	return e2.Resign(ctx)
+}
+
+func checkLock(ctx context.Context, env *Env, prefix string) error {
+	s1, err := concurrency.NewSession(env.Client, concurrency.WithTTL(sessionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	defer s1.Close()
+	s2, err := concurrency.NewSession(env.Client, concurrency.WithTTL(sessionTTL), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	defer s2.Close()
+
+	m1 := concurrency.NewMutex(s1, prefix)
+	m2 := concurrency.NewMutex(s2, prefix)
+
+	if err := m1.Lock(ctx); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	if err := m2.TryLock(ctx); !errors.Is(err, concurrency.ErrLocked) {
+		return fmt.Errorf("try lock of a held lock: err = %v, want %v", err, concurrency.ErrLocked)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		locked <- m2.Lock(ctx)
+	}()
+	select {
+	case err := <-locked:
+		return fmt.Errorf("second lock returned while the first was held: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := m1.Unlock(ctx); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			return fmt.Errorf("second lock: %w", err)
+		}
+	case <-time.After(watchTimeout):
+		return fmt.Errorf("second lock not acquired after unlock")
+	}
+	if err := m2.Unlock(ctx); err != nil {
+		return fmt.Errorf("unlock: %w", err)
+	}
+
+	// A lock held by an expired session is released with it.
+	if err := m1.Lock(ctx); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	if _, err := env.Client.Revoke(ctx, s1.Lease()); err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, watchTimeout)
+	defer cancel()
+	if err := m2.Lock(lockCtx); err != nil {
+		return fmt.Errorf("lock after the holder's session ended: %w", err)
+	}
+
+	return m2.Unlock(ctx)
+}
@@ -0,0 +1,103 @@
+// Package conformance checks a running server against etcd's documented
+// semantics through the official clientv3 client. go test runs it against
+// every driver in-process; cmd/conformance also checks running servers.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// Env is what a check runs against.
+type Env struct {
+	// Client talks to the server without credentials.
+	Client *clientv3.Client
+	// Endpoints lets checks create clients of their own, e.g. to log in.
+	Endpoints []string
+}
+
+type Check struct {
+	Name string
+	Run  func(ctx context.Context, env *Env, prefix string) error
+}
+
+// Checks run in order. Each gets a key prefix of its own, but they share
+// one server, so the global ones (compaction, auth) restore what they
+// change.
+var Checks = []Check{
+	{Name: "KV", Run: checkKV},
+	{Name: "Txn", Run: checkTxn},
+	{Name: "Watch", Run: checkWatch},
+	{Name: "Lease", Run: checkLease},
+	{Name: "Compaction", Run: checkCompaction},
+	{Name: "Auth", Run: checkAuth},
+	{Name: "Election", Run: checkElection},
+	{Name: "Lock", Run: checkLock},
+	{Name: "Kubernetes", Run: checkKubernetes},
+}
+
+type Result struct {
+	Check    string
+	Err      error
+	Duration time.Duration
+}
+
+var runs atomic.Int64
+
+// Run executes checks, usually Checks, against endpoints and returns one
+// result per check.
+func Run(ctx context.Context, endpoints []string, checks []Check) ([]Result, error) {
+	client, err := newClient(endpoints, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("conformance.Run: %w", err)
+	}
+	defer client.Close()
+
+	env := &Env{
+		Client:    client,
+		Endpoints: endpoints,
+	}
+	run := runs.Add(1)
+
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		start := time.Now()
+		err := c.Run(checkCtx, env, fmt.Sprintf("/conformance/%d/%d/%s/", time.Now().UnixNano(), run, c.Name))
+		cancel()
+		results = append(results, Result{
+			Check:    c.Name,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+	}
+
+	return results, nil
+}
+
+func newClient(endpoints []string, username string, password string) (*clientv3.Client, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+		Username:    username,
+		Password:    password,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return client, nil
+}
+
+// expect returns an error built from format unless ok holds.
+func expect(ok bool, format string, args ...any) error {
+	if ok {
+		return nil
+	}
+	return fmt.Errorf(format, args...)
+}
@@ -0,0 +1,109 @@
+package conformance_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/conformance"
+	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
+	_ "github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	_ "github.com/aplulu/etcd-shim/internal/driver/mysql"
+	_ "github.com/aplulu/etcd-shim/internal/driver/postgres"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	_ "github.com/aplulu/etcd-shim/internal/driver/sqlite"
+	"github.com/aplulu/etcd-shim/internal/server"
+)
+
+// TestConformance runs the checks against an in-process server for every
+// driver. postgres and mysql run against the databases of
+// ETCD_SHIM_TEST_POSTGRES_DSN and ETCD_SHIM_TEST_MYSQL_DSN, which the
+// postgres and mysql profiles of compose.yaml provide; see the TestDriver of
+// those drivers.
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the checks take several seconds per driver")
+	}
+
+	for _, name := range registry.Drivers() {
+		t.Run(name, func(t *testing.T) {
+			conf := config.DefaultDriverConfig()
+			dir := t.TempDir()
+			conf.Badger.DataDir = filepath.Join(dir, "badger")
+			conf.SQLite.Path = filepath.Join(dir, "etcd-shim.db")
+			conf.Bbolt.Path = filepath.Join(dir, "bbolt", "db")
+			conf.Postgres.DSN = os.Getenv("ETCD_SHIM_TEST_POSTGRES_DSN")
+			conf.MySQL.DSN = os.Getenv("ETCD_SHIM_TEST_MYSQL_DSN")
+			if (name == "postgres" && conf.Postgres.DSN == "") || (name == "mysql" && conf.MySQL.DSN == "") {
+				t.Skip("no DSN is set")
+			}
+
+			endpoint := serve(t, name, conf)
+			results, err := conformance.Run(context.Background(), []string{endpoint}, conformance.Checks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				t.Run(r.Check, func(t *testing.T) {
+					if r.Err != nil {
+						t.Error(r.Err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// serve starts a server on the driver of name until the test ends and
+// returns its endpoint.
+func serve(t *testing.T, name string, conf config.DriverConfig) string {
+	t.Helper()
+
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	drv, err := registry.NewDriver(name, ctx, log, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := drv.Close(); err != nil {
+			t.Errorf("close driver: %v", err)
+		}
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := server.New(ctx, server.Options{
+		Driver:   drv,
+		Listener: listener,
+		Logger:   log,
+	})
+	if err != nil {
+		listener.Close()
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	t.Cleanup(func() {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	<-srv.Ready()
+
+	return "http://" + listener.Addr().String()
+}
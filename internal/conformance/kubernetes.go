@@ -0,0 +1,77 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/aplulu/etcd-shim/internal/trace"
+)
+
+// kubeAPIServerTrace holds the calls kube-apiserver's storage layer makes:
+// create with a mod_revision == 0 compare, guaranteed updates and deletes
+// with mod_revision preconditions, paginated and count_only lists at a
+// revision, leased events, a watch with prev_kv and progress_notify plus
+// progress requests, and compaction through the compact_rev_key txn.
+//
+//go:embed testdata/kube-apiserver.jsonl
+var kubeAPIServerTrace []byte
+
+// progressWrites is how many writes a progress request has to wait for.
+const progressWrites = 200
+
+// checkKubernetes replays the kube-apiserver trace and checks the guarantee
+// consistent reads from its watch cache rely on: a progress notification
+// follows every event up to its revision.
+func checkKubernetes(ctx context.Context, env *Env, prefix string) error {
+	if err := TraceCheck("", kubeAPIServerTrace).Run(ctx, env, prefix+"trace"); err != nil {
+		return err
+	}
+
+	c := env.Client
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wch := c.Watch(watchCtx, prefix+"progress/", clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	if _, err := nextWatch(wch); err != nil {
+		return fmt.Errorf("watch created: %w", err)
+	}
+	var last int64
+	for i := 0; i < progressWrites; i++ {
+		res, err := c.Put(ctx, fmt.Sprintf("%sprogress/%d", prefix, i), "v")
+		if err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+		last = res.Header.Revision
+	}
+	if err := c.RequestProgress(watchCtx); err != nil {
+		return fmt.Errorf("request progress: %w", err)
+	}
+
+	events := 0
+	for {
+		res, err := nextWatch(wch)
+		if err != nil {
+			return fmt.Errorf("after %d events: %w", events, err)
+		}
+		if res.IsProgressNotify() {
+			return expect(events == progressWrites && res.Header.Revision >= last,
+				"progress at revision %d after %d of %d events up to revision %d", res.Header.Revision, events, progressWrites, last)
+		}
+		events += len(res.Events)
+	}
+}
+
+// TraceCheck replays a trace recorded with package trace. The trace keys
+// are put under the prefix of the check.
+func TraceCheck(name string, data []byte) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context, env *Env, prefix string) error {
+			return trace.Replay(ctx, env.Client.ActiveConnection(), bytes.NewReader(data), prefix)
+		},
+	}
+}
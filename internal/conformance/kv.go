@@ -0,0 +1,149 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func checkKV(ctx context.Context, env *Env, prefix string) error {
+	c := env.Client
+	a, b, d := prefix+"a", prefix+"b", prefix+"c"
+
+	first, err := c.Put(ctx, a, "1")
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	rev := first.Header.Revision
+
+	// Every write allocates the next revision.
+	second, err := c.Put(ctx, a, "2", clientv3.WithPrevKV())
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if err := expect(second.Header.Revision == rev+1, "put revision = %d, want %d", second.Header.Revision, rev+1); err != nil {
+		return err
+	}
+	if err := expect(second.PrevKv != nil && string(second.PrevKv.Value) == "1", "prev_kv = %v, want value 1", second.PrevKv); err != nil {
+		return err
+	}
+
+	get, err := c.Get(ctx, a)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := expect(len(get.Kvs) == 1, "get returned %d keys, want 1", len(get.Kvs)); err != nil {
+		return err
+	}
+	kv := get.Kvs[0]
+	if err := expect(string(kv.Value) == "2" && kv.Version == 2 && kv.CreateRevision == rev && kv.ModRevision == rev+1,
+		"get = %s v%d create %d mod %d, want 2 v2 create %d mod %d", kv.Value, kv.Version, kv.CreateRevision, kv.ModRevision, rev, rev+1); err != nil {
+		return err
+	}
+
+	// Reads at an older revision see the older value.
+	old, err := c.Get(ctx, a, clientv3.WithRev(rev))
+	if err != nil {
+		return fmt.Errorf("get at revision: %w", err)
+	}
+	if err := expect(len(old.Kvs) == 1 && string(old.Kvs[0].Value) == "1", "get at %d = %v, want 1", rev, old.Kvs); err != nil {
+		return err
+	}
+
+	missing, err := c.Get(ctx, prefix+"missing")
+	if err != nil {
+		return fmt.Errorf("get missing: %w", err)
+	}
+	if err := expect(len(missing.Kvs) == 0 && missing.Count == 0, "get missing returned %d keys", len(missing.Kvs)); err != nil {
+		return err
+	}
+
+	for _, k := range []string{b, d} {
+		if _, err := c.Put(ctx, k, k); err != nil {
+			return fmt.Errorf("put: %w", err)
+		}
+	}
+
+	all, err := c.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("get prefix: %w", err)
+	}
+	if err := expect(all.Count == 3 && len(all.Kvs) == 3 && string(all.Kvs[0].Key) == a && string(all.Kvs[2].Key) == d,
+		"get prefix returned %d keys, want a, b, c", len(all.Kvs)); err != nil {
+		return err
+	}
+
+	limited, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithLimit(2))
+	if err != nil {
+		return fmt.Errorf("get with limit: %w", err)
+	}
+	if err := expect(len(limited.Kvs) == 2 && limited.More && limited.Count == 3,
+		"get with limit returned %d keys, more %v, count %d, want 2, true, 3", len(limited.Kvs), limited.More, limited.Count); err != nil {
+		return err
+	}
+
+	desc, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	if err != nil {
+		return fmt.Errorf("get sorted: %w", err)
+	}
+	if err := expect(len(desc.Kvs) == 3 && string(desc.Kvs[0].Key) == d, "get sorted descending did not start with c"); err != nil {
+		return err
+	}
+
+	keysOnly, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return fmt.Errorf("get keys only: %w", err)
+	}
+	if err := expect(len(keysOnly.Kvs) == 3 && len(keysOnly.Kvs[0].Value) == 0, "get keys only returned values"); err != nil {
+		return err
+	}
+
+	count, err := c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return fmt.Errorf("get count only: %w", err)
+	}
+	if err := expect(count.Count == 3 && len(count.Kvs) == 0, "get count only = %d with %d keys, want 3 with none", count.Count, len(count.Kvs)); err != nil {
+		return err
+	}
+
+	// Writing a missing key with ignore_value fails.
+	if _, err := c.Put(ctx, prefix+"missing", "", clientv3.WithIgnoreValue()); !errors.Is(err, rpctypes.ErrKeyNotFound) {
+		return fmt.Errorf("put with ignore_value on a missing key: err = %v, want %v", err, rpctypes.ErrKeyNotFound)
+	}
+
+	del, err := c.Delete(ctx, prefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	if err != nil {
+		return fmt.Errorf("delete prefix: %w", err)
+	}
+	if err := expect(del.Deleted == 3 && len(del.PrevKvs) == 3, "delete prefix removed %d keys, want 3", del.Deleted); err != nil {
+		return err
+	}
+
+	// A recreated key starts over at version 1.
+	if _, err := c.Put(ctx, a, "3"); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	get, err = c.Get(ctx, a)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := expect(len(get.Kvs) == 1 && get.Kvs[0].Version == 1 && get.Kvs[0].CreateRevision == get.Kvs[0].ModRevision,
+		"recreated key = %v, want version 1", get.Kvs); err != nil {
+		return err
+	}
+
+	// Deleting nothing does not allocate a revision.
+	before, err := c.Get(ctx, a)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	none, err := c.Delete(ctx, prefix+"missing")
+	if err != nil {
+		return fmt.Errorf("delete missing: %w", err)
+	}
+	return expect(none.Deleted == 0 && none.Header.Revision == before.Header.Revision,
+		"delete missing = %d at revision %d, want 0 at %d", none.Deleted, none.Header.Revision, before.Header.Revision)
+}
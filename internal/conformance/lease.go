@@ -0,0 +1,122 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func checkLease(ctx context.Context, env *Env, prefix string) error {
+	c := env.Client
+	a, b := prefix+"a", prefix+"b"
+
+	grant, err := c.Grant(ctx, 60)
+	if err != nil {
+		return fmt.Errorf("grant: %w", err)
+	}
+	if err := expect(grant.ID != 0 && grant.TTL == 60, "grant = %d with TTL %d, want TTL 60", grant.ID, grant.TTL); err != nil {
+		return err
+	}
+
+	if _, err := c.Put(ctx, a, "1", clientv3.WithLease(grant.ID)); err != nil {
+		return fmt.Errorf("put with lease: %w", err)
+	}
+	get, err := c.Get(ctx, a)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := expect(len(get.Kvs) == 1 && get.Kvs[0].Lease == int64(grant.ID), "key lease = %v, want %d", get.Kvs, grant.ID); err != nil {
+		return err
+	}
+
+	ttl, err := c.TimeToLive(ctx, grant.ID, clientv3.WithAttachedKeys())
+	if err != nil {
+		return fmt.Errorf("time to live: %w", err)
+	}
+	if err := expect(ttl.GrantedTTL == 60 && ttl.TTL > 0 && ttl.TTL <= 60 && len(ttl.Keys) == 1 && string(ttl.Keys[0]) == a,
+		"time to live = %d of %d with keys %q, want up to 60 with %s", ttl.TTL, ttl.GrantedTTL, ttl.Keys, a); err != nil {
+		return err
+	}
+
+	keepAlive, err := c.KeepAliveOnce(ctx, grant.ID)
+	if err != nil {
+		return fmt.Errorf("keep alive: %w", err)
+	}
+	if err := expect(keepAlive.TTL == 60, "keep alive TTL = %d, want 60", keepAlive.TTL); err != nil {
+		return err
+	}
+
+	leases, err := c.Leases(ctx)
+	if err != nil {
+		return fmt.Errorf("leases: %w", err)
+	}
+	found := false
+	for _, l := range leases.Leases {
+		found = found || l.ID == grant.ID
+	}
+	if err := expect(found, "leases does not list %d", grant.ID); err != nil {
+		return err
+	}
+
+	// Revoking deletes the attached keys.
+	if _, err := c.Revoke(ctx, grant.ID); err != nil {
+		return fmt.Errorf("revoke: %w", err)
+	}
+	get, err = c.Get(ctx, a)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := expect(len(get.Kvs) == 0, "key survived the revoke of its lease"); err != nil {
+		return err
+	}
+
+	// An unknown lease is reported as such.
+	if _, err := c.Revoke(ctx, grant.ID); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return fmt.Errorf("revoke of a revoked lease: err = %v, want %v", err, rpctypes.ErrLeaseNotFound)
+	}
+	if _, err := c.Put(ctx, a, "1", clientv3.WithLease(grant.ID)); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return fmt.Errorf("put with a revoked lease: err = %v, want %v", err, rpctypes.ErrLeaseNotFound)
+	}
+	ttl, err = c.TimeToLive(ctx, grant.ID)
+	if err != nil {
+		return fmt.Errorf("time to live of a revoked lease: %w", err)
+	}
+	if err := expect(ttl.TTL == -1, "time to live of a revoked lease = %d, want -1", ttl.TTL); err != nil {
+		return err
+	}
+
+	// Leases run out unless kept alive. TTLs are raised to the minimum of 2s.
+	short, err := c.Grant(ctx, 1)
+	if err != nil {
+		return fmt.Errorf("grant: %w", err)
+	}
+	if err := expect(short.TTL >= 1, "grant TTL = %d", short.TTL); err != nil {
+		return err
+	}
+	if _, err := c.Put(ctx, b, "1", clientv3.WithLease(short.ID)); err != nil {
+		return fmt.Errorf("put with lease: %w", err)
+	}
+	deadline := time.Now().Add(time.Duration(short.TTL)*time.Second + 5*time.Second)
+	for {
+		get, err := c.Get(ctx, b)
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if len(get.Kvs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("key of an expired lease still exists")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	ttl, err = c.TimeToLive(ctx, short.ID)
+	if err != nil {
+		return fmt.Errorf("time to live of an expired lease: %w", err)
+	}
+	return expect(ttl.TTL == -1, "time to live of an expired lease = %d, want -1", ttl.TTL)
+}
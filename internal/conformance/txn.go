@@ -0,0 +1,141 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func checkTxn(ctx context.Context, env *Env, prefix string) error {
+	c := env.Client
+	key, other := prefix+"key", prefix+"other"
+
+	// Create if absent: a missing key has create revision 0.
+	created, err := c.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "1")).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("create txn: %w", err)
+	}
+	if err := expect(created.Succeeded, "create txn on a missing key failed"); err != nil {
+		return err
+	}
+
+	again, err := c.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "2")).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("create txn: %w", err)
+	}
+	if err := expect(!again.Succeeded, "create txn on an existing key succeeded"); err != nil {
+		return err
+	}
+	got := again.Responses[0].GetResponseRange()
+	if err := expect(got != nil && len(got.Kvs) == 1 && string(got.Kvs[0].Value) == "1", "else branch read %v, want 1", got); err != nil {
+		return err
+	}
+	// A read-only txn does not allocate a revision.
+	if err := expect(again.Header.Revision == created.Header.Revision, "read-only txn revision = %d, want %d", again.Header.Revision, created.Header.Revision); err != nil {
+		return err
+	}
+
+	// Compare-and-swap on the value and mod revision, writing two keys at
+	// one revision.
+	swapped, err := c.Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.Value(key), "=", "1"),
+			clientv3.Compare(clientv3.ModRevision(key), "=", created.Header.Revision),
+		).
+		Then(clientv3.OpPut(key, "2"), clientv3.OpPut(other, "x"), clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("swap txn: %w", err)
+	}
+	if err := expect(swapped.Succeeded && swapped.Header.Revision == created.Header.Revision+1,
+		"swap txn succeeded %v at revision %d, want true at %d", swapped.Succeeded, swapped.Header.Revision, created.Header.Revision+1); err != nil {
+		return err
+	}
+	// Reads inside a txn see its earlier writes.
+	got = swapped.Responses[2].GetResponseRange()
+	if err := expect(got != nil && len(got.Kvs) == 1 && string(got.Kvs[0].Value) == "2", "txn read its own write as %v, want 2", got); err != nil {
+		return err
+	}
+	both, err := c.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	for _, kv := range both.Kvs {
+		if err := expect(kv.ModRevision == swapped.Header.Revision, "%s mod revision = %d, want %d", kv.Key, kv.ModRevision, swapped.Header.Revision); err != nil {
+			return err
+		}
+	}
+
+	// A failed compare runs the else branch.
+	failed, err := c.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version(key), ">", 5)).
+		Then(clientv3.OpPut(key, "never")).
+		Else(clientv3.OpDelete(other)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failing txn: %w", err)
+	}
+	if err := expect(!failed.Succeeded, "txn comparing version > 5 succeeded"); err != nil {
+		return err
+	}
+	deleted := failed.Responses[0].GetResponseDeleteRange()
+	if err := expect(deleted != nil && deleted.Deleted == 1, "else branch deleted %v keys, want 1", deleted); err != nil {
+		return err
+	}
+
+	// Nested txns.
+	nested, err := c.Txn(ctx).
+		Then(clientv3.OpTxn(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.Value(key), "=", "2")},
+			[]clientv3.Op{clientv3.OpPut(other, "nested")},
+			nil,
+		)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("nested txn: %w", err)
+	}
+	inner := nested.Responses[0].GetResponseTxn()
+	if err := expect(inner != nil && inner.Succeeded, "nested txn did not succeed"); err != nil {
+		return err
+	}
+	get, err := c.Get(ctx, other)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if err := expect(len(get.Kvs) == 1 && string(get.Kvs[0].Value) == "nested", "nested put wrote %v, want nested", get.Kvs); err != nil {
+		return err
+	}
+
+	// A key may be written once per txn, at any level of nesting.
+	for _, dup := range []struct {
+		name string
+		ops  []clientv3.Op
+	}{
+		{"put and put", []clientv3.Op{clientv3.OpPut(key, "a"), clientv3.OpPut(key, "b")}},
+		{"put and delete", []clientv3.Op{clientv3.OpPut(key, "a"), clientv3.OpDelete(prefix, clientv3.WithPrefix())}},
+		{"put and nested put", []clientv3.Op{clientv3.OpPut(key, "a"), clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpPut(key, "b")}, nil)}},
+	} {
+		if _, err := c.Txn(ctx).Then(dup.ops...).Commit(); !errors.Is(err, rpctypes.ErrDuplicateKey) {
+			return fmt.Errorf("txn with a %s of one key: err = %v, want %v", dup.name, err, rpctypes.ErrDuplicateKey)
+		}
+	}
+	// The branches of a nested txn exclude each other.
+	_, err = c.Txn(ctx).
+		Then(clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpPut(key, "a")}, []clientv3.Op{clientv3.OpPut(key, "b")})).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("nested txn putting a key in both branches: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const watchTimeout = 5 * time.Second
+
+func checkWatch(ctx context.Context, env *Env, prefix string) error {
+	c := env.Client
+	a, b := prefix+"a", prefix+"b"
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wch := c.Watch(watchCtx, prefix, clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithCreatedNotify())
+	if _, err := nextWatch(wch); err != nil {
+		return fmt.Errorf("watch created: %w", err)
+	}
+
+	first, err := c.Put(ctx, a, "1")
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if _, err := c.Put(ctx, a, "2"); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if _, err := c.Delete(ctx, a); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if _, err := c.Put(ctx, strings.TrimSuffix(prefix, "/")+"-outside", "x"); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	events, err := collectEvents(wch, 3)
+	if err != nil {
+		return err
+	}
+	if err := expectEvent(events[0], mvccpb.PUT, a, "1", first.Header.Revision); err != nil {
+		return err
+	}
+	if err := expect(events[0].PrevKv == nil, "first put has prev_kv %v", events[0].PrevKv); err != nil {
+		return err
+	}
+	if err := expectEvent(events[1], mvccpb.PUT, a, "2", first.Header.Revision+1); err != nil {
+		return err
+	}
+	if err := expect(events[1].PrevKv != nil && string(events[1].PrevKv.Value) == "1", "second put prev_kv = %v, want 1", events[1].PrevKv); err != nil {
+		return err
+	}
+	if err := expectEvent(events[2], mvccpb.DELETE, a, "", first.Header.Revision+2); err != nil {
+		return err
+	}
+	if err := expect(events[2].PrevKv != nil && string(events[2].PrevKv.Value) == "2", "delete prev_kv = %v, want 2", events[2].PrevKv); err != nil {
+		return err
+	}
+
+	// Watching from a past revision replays the history.
+	replay := c.Watch(watchCtx, a, clientv3.WithRev(first.Header.Revision))
+	events, err = collectEvents(replay, 3)
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	if err := expectEvent(events[0], mvccpb.PUT, a, "1", first.Header.Revision); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+
+	// Filters drop the filtered event types.
+	noPut := c.Watch(watchCtx, b, clientv3.WithFilterPut(), clientv3.WithCreatedNotify())
+	if _, err := nextWatch(noPut); err != nil {
+		return fmt.Errorf("filtered watch created: %w", err)
+	}
+	if _, err := c.Put(ctx, b, "1"); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if _, err := c.Delete(ctx, b); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	events, err = collectEvents(noPut, 1)
+	if err != nil {
+		return fmt.Errorf("filtered watch: %w", err)
+	}
+	if err := expect(events[0].Type == mvccpb.DELETE, "filtered watch got a %s event, want DELETE", events[0].Type); err != nil {
+		return err
+	}
+
+	// The events of one revision arrive in one response, however many
+	// there are.
+	many := prefix + "many/"
+	for i := 0; i < 12; i++ {
+		ops := make([]clientv3.Op, 100)
+		for j := range ops {
+			ops[j] = clientv3.OpPut(fmt.Sprintf("%s%04d", many, i*100+j), "v")
+		}
+		if _, err := c.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return fmt.Errorf("txn: %w", err)
+		}
+	}
+	bulk := c.Watch(watchCtx, many, clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+	if _, err := nextWatch(bulk); err != nil {
+		return fmt.Errorf("bulk watch created: %w", err)
+	}
+	deleted, err := c.Txn(ctx).Then(clientv3.OpDelete(many, clientv3.WithPrefix())).Commit()
+	if err != nil {
+		return fmt.Errorf("txn: %w", err)
+	}
+	res, err := nextWatch(bulk)
+	if err != nil {
+		return fmt.Errorf("bulk watch: %w", err)
+	}
+	if err := expect(len(res.Events) == 1200 && res.Events[1199].Kv.ModRevision == deleted.Header.Revision,
+		"deleting 1200 keys in one txn sent a response with %d events", len(res.Events)); err != nil {
+		return err
+	}
+
+	// Progress requests report the current revision.
+	progressCtx, progressCancel := context.WithCancel(ctx)
+	defer progressCancel()
+	progress := c.Watch(progressCtx, prefix+"idle", clientv3.WithCreatedNotify())
+	if _, err := nextWatch(progress); err != nil {
+		return fmt.Errorf("idle watch created: %w", err)
+	}
+	if err := c.RequestProgress(progressCtx); err != nil {
+		return fmt.Errorf("request progress: %w", err)
+	}
+	res, err = nextWatch(progress)
+	if err != nil {
+		return fmt.Errorf("progress: %w", err)
+	}
+	if err := expect(res.IsProgressNotify() && res.Header.Revision >= first.Header.Revision+4,
+		"progress response = %+v, want a progress notification", res); err != nil {
+		return err
+	}
+
+	// Canceling the context closes the channel.
+	cancel()
+	timer := time.NewTimer(watchTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-wch:
+			if !ok {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("watch channel not closed after cancel")
+		}
+	}
+}
+
+func nextWatch(wch clientv3.WatchChan) (clientv3.WatchResponse, error) {
+	select {
+	case res, ok := <-wch:
+		if !ok {
+			return res, fmt.Errorf("watch channel closed")
+		}
+		if err := res.Err(); err != nil {
+			return res, err
+		}
+		return res, nil
+	case <-time.After(watchTimeout):
+		return clientv3.WatchResponse{}, fmt.Errorf("no watch response within %s", watchTimeout)
+	}
+}
+
+func collectEvents(wch clientv3.WatchChan, n int) ([]*clientv3.Event, error) {
+	var events []*clientv3.Event
+	for len(events) < n {
+		res, err := nextWatch(wch)
+		if err != nil {
+			return nil, fmt.Errorf("got %d of %d events: %w", len(events), n, err)
+		}
+		events = append(events, res.Events...)
+	}
+	return events, nil
+}
+
+func expectEvent(ev *clientv3.Event, typ mvccpb.Event_EventType, key string, value string, revision int64) error {
+	return expect(ev.Type == typ && string(ev.Kv.Key) == key && string(ev.Kv.Value) == value && ev.Kv.ModRevision == revision,
+		"event = %s %s=%s at %d, want %s %s=%s at %d", ev.Type, ev.Kv.Key, ev.Kv.Value, ev.Kv.ModRevision, typ, key, value, revision)
+}
@@ -1,12 +1,18 @@
 package badger
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
 
 	"github.com/dgraph-io/badger/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/aplulu/etcd-shim/internal/config"
 	"github.com/aplulu/etcd-shim/internal/driver"
 	"github.com/aplulu/etcd-shim/internal/driver/registry"
 )
@@ -14,14 +20,39 @@ import (
 const (
 	internalPrefix = "_etcd-shim/"
 	revisionKey    = "revision"
+	compactKey     = "compact"
+
+	// kvPrefix holds the latest live version of every key.
+	kvPrefix = "k/"
+	// indexPrefix holds an entry per key version, ordered by key then revision.
+	indexPrefix = "i/"
+	// historyPrefix holds every version ordered by revision.
+	historyPrefix = "h/"
+	bucketPrefix  = "b/"
+
+	maxTxnAttempts   = 5
+	historyBatchSize = 1000
 )
 
 func init() {
 	registry.Register("badger", New)
+	registry.RegisterCheck("badger", check)
 }
 
-func New(ctx context.Context, log *slog.Logger) (driver.Driver, error) {
-	db, err := badger.Open(badger.DefaultOptions("/tmp/badger"))
+func check(conf config.DriverConfig) error {
+	if _, err := badgerOptions(conf.Badger); err != nil {
+		return fmt.Errorf("badger.check: %w", err)
+	}
+	return nil
+}
+
+func New(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	opts, err := badgerOptions(conf.Badger)
+	if err != nil {
+		return nil, fmt.Errorf("badger.New: failed to build options: %w", err)
+	}
+
+	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, fmt.Errorf("badger.New: failed to open badger: %w", err)
 	}
@@ -29,131 +60,536 @@ func New(ctx context.Context, log *slog.Logger) (driver.Driver, error) {
 	return &badgerDriver{
 		log: log,
 		db:  db,
+		hub: driver.NewWatchHub(),
 	}, nil
 }
 
 type badgerDriver struct {
 	log *slog.Logger
 	db  *badger.DB
+	hub *driver.WatchHub
+	// mu serializes writers so revisions are allocated and published in order.
+	mu sync.Mutex
 }
 
-func (d *badgerDriver) Watch(ctx context.Context, key []byte, startRevision int64) chan *driver.WatchEvent {
-	ch := make(chan *driver.WatchEvent)
+func (d *badgerDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	go func() {
-		defer close(ch)
+	d.hub.Close()
+	if err := d.db.Close(); err != nil {
+		return fmt.Errorf("badgerDriver.Close: failed to close badger: %w", err)
+	}
 
-		err := d.db.View(func(txn *badger.Txn) error {
-			opts := badger.DefaultIteratorOptions
-			opts.PrefetchSize = 10
-			it := txn.NewIterator(opts)
-			defer it.Close()
+	return nil
+}
 
-			for it.Seek(key); it.Valid(); it.Next() {
-				item := it.Item()
-				k := item.Key()
-				v, err := item.ValueCopy(nil)
-				if err != nil {
-					return fmt.Errorf("badgerDriver.Watch: failed to copy value: %w", err)
-				}
+func (d *badgerDriver) CurrentRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	if err := d.db.View(func(txn *badger.Txn) error {
+		var err error
+		revision, err = getInt(txn, internalPrefix+revisionKey)
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("badgerDriver.CurrentRevision: failed to view: %w", err)
+	}
 
-				ch <- &driver.WatchEvent{
-					KV: &driver.KeyValue{
-						Key:   k,
-						Value: v,
-					},
-				}
+	return revision, nil
+}
+
+func (d *badgerDriver) CompactRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	if err := d.db.View(func(txn *badger.Txn) error {
+		var err error
+		revision, err = getInt(txn, internalPrefix+compactKey)
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("badgerDriver.CompactRevision: failed to view: %w", err)
+	}
+
+	return revision, nil
+}
+
+func (d *badgerDriver) Size(ctx context.Context) (int64, error) {
+	lsm, vlog := d.db.Size()
+	return lsm + vlog, nil
+}
+
+func (d *badgerDriver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	var result *driver.RangeResult
+	if err := d.db.View(func(txn *badger.Txn) error {
+		t, err := newBadgerTxn(txn)
+		if err != nil {
+			return err
+		}
+		result, err = t.Range(key, end, opts)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("badgerDriver.Range: failed to view: %w", err)
+	}
+
+	return result, nil
+}
+
+func (d *badgerDriver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		revision int64
+		events   []*driver.WatchEvent
+	)
+	for attempt := 1; ; attempt++ {
+		err := d.db.Update(func(txn *badger.Txn) error {
+			t, err := newBadgerTxn(txn)
+			if err != nil {
+				return err
+			}
+			if err := fn(t); err != nil {
+				return err
 			}
 
-			return nil
+			revision = t.current
+			events = t.events
+			if len(t.events) == 0 {
+				return nil
+			}
+			revision = t.revision
+
+			return txn.Set([]byte(internalPrefix+revisionKey), encodeInt(t.revision))
 		})
+		if errors.Is(err, badger.ErrConflict) && attempt < maxTxnAttempts {
+			d.log.WarnContext(ctx, "badgerDriver.Txn: transaction conflict, retrying", "attempt", attempt)
+			trace.SpanFromContext(ctx).AddEvent("transaction conflict", trace.WithAttributes(attribute.Int("attempt", attempt)))
+			continue
+		}
+		if errors.Is(err, badger.ErrConflict) {
+			return 0, fmt.Errorf("badgerDriver.Txn: %w after %d attempts", driver.ErrConflict, attempt)
+		}
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			return 0, fmt.Errorf("badgerDriver.Txn: %w", driver.ErrRequestTooLarge)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("badgerDriver.Txn: failed to update: %w", err)
+		}
+		break
+	}
+
+	d.hub.Notify(events)
+
+	return revision, nil
+}
+
+func (d *badgerDriver) Compact(ctx context.Context, revision int64) error {
+	d.mu.Lock()
+	err := d.db.Update(func(txn *badger.Txn) error {
+		current, err := getInt(txn, internalPrefix+revisionKey)
 		if err != nil {
-			d.log.Error("badgerDriver.Watch: failed to view", "error", err)
+			return err
+		}
+		compact, err := getInt(txn, internalPrefix+compactKey)
+		if err != nil {
+			return err
+		}
+		if revision <= compact {
+			return driver.ErrCompacted
+		}
+		if revision > current {
+			return driver.ErrFutureRevision
 		}
-	}()
 
-	return ch
+		return txn.Set([]byte(internalPrefix+compactKey), encodeInt(revision))
+	})
+	d.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("badgerDriver.Compact: failed to update compact revision: %w", err)
+	}
+
+	// Versions at or below the compact revision are never rewritten, so the
+	// sweep can run without blocking writers.
+	if err := d.sweep(revision); err != nil {
+		return fmt.Errorf("badgerDriver.Compact: failed to sweep: %w", err)
+	}
+
+	return nil
+}
+
+type indexEntry struct {
+	indexKey []byte
+	revision int64
+	sub      int64
+	deleted  bool
 }
 
-func (d *badgerDriver) Range(ctx context.Context, key []byte, end []byte) ([]driver.KeyValue, int64, error) {
-	var results []driver.KeyValue
+// sweep removes the versions superseded at or before revision. The latest
+// version of each key at revision is kept unless it is an older tombstone.
+func (d *badgerDriver) sweep(revision int64) error {
+	wb := d.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	var (
+		groupKey   []byte
+		candidates []indexEntry
+	)
+	flush := func() error {
+		if len(candidates) == 0 {
+			return nil
+		}
+		drop := candidates[:len(candidates)-1]
+		if last := candidates[len(candidates)-1]; last.deleted && last.revision < revision {
+			drop = candidates
+		}
+		for _, e := range drop {
+			if err := wb.Delete(e.indexKey); err != nil {
+				return err
+			}
+			if err := wb.Delete(historyKey(e.revision, e.sub)); err != nil {
+				return err
+			}
+		}
+		candidates = candidates[:0]
+		return nil
+	}
 
-	err := d.db.View(func(txn *badger.Txn) error {
+	if err := d.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
+		opts.Prefix = []byte(indexPrefix)
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		for it.Seek(key); it.Valid(); it.Next() {
+		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
-			k := item.Key()
-			v, err := item.ValueCopy(nil)
+			k, rest, err := decodeKey(item.Key()[len(indexPrefix):])
+			if err != nil {
+				return err
+			}
+			rev, sub, err := decodeRevision(rest)
 			if err != nil {
-				return fmt.Errorf("badgerDriver.Range: failed to copy value: %w", err)
+				return err
+			}
+			if groupKey == nil || !bytes.Equal(k, groupKey) {
+				if err := flush(); err != nil {
+					return err
+				}
+				groupKey = k
+			}
+			if rev > revision {
+				continue
 			}
 
-			results = append(results, driver.KeyValue{
-				Key:   k,
-				Value: v,
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, indexEntry{
+				indexKey: item.KeyCopy(nil),
+				revision: rev,
+				sub:      sub,
+				deleted:  len(v) > 0 && v[0] == 1,
 			})
+		}
+
+		return flush()
+	}); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+func (d *badgerDriver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	if startRevision > 0 {
+		compact, err := d.CompactRevision(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("badgerDriver.Watch: failed to get compact revision: %w", err)
+		}
+		if startRevision < compact {
+			return nil, driver.ErrCompacted
+		}
+	}
+
+	return d.hub.Watch(ctx, key, end, startRevision, d.History), nil
+}
+
+func (d *badgerDriver) RequestProgress(ctx context.Context) error {
+	// Holding mu orders the progress event after the events of every
+	// committed transaction.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	revision, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("badgerDriver.RequestProgress: failed to get current revision: %w", err)
+	}
+	d.hub.Progress(revision)
+
+	return nil
+}
+
+func (d *badgerDriver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	seek := historyKey(startRevision, 0)
+	for {
+		var events []*driver.WatchEvent
+		if err := d.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(historyPrefix)
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Seek(seek); it.Valid() && len(events) < historyBatchSize; it.Next() {
+				v, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				r, err := unmarshalRecord(v)
+				if err != nil {
+					return err
+				}
+				ev, err := eventFromRecord(txn, r)
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+				seek = historyKey(r.modRevision, r.sub+1)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("badgerDriver.History: failed to view: %w", err)
+		}
 
-			if end != nil && string(k) == string(end) {
-				break
+		for _, ev := range events {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(ev); err != nil {
+				return err
 			}
 		}
+		if len(events) < historyBatchSize {
+			return nil
+		}
+	}
+}
+
+func (d *badgerDriver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.db.Update(func(txn *badger.Txn) error {
+		current, err := getInt(txn, internalPrefix+revisionKey)
+		if err != nil {
+			return err
+		}
+
+		t := &badgerTxn{txn: txn}
+		for _, ev := range events {
+			if ev.KV.ModRevision <= current || ev.KV.ModRevision > revision {
+				return fmt.Errorf("event revision %d out of order", ev.KV.ModRevision)
+			}
+			if ev.KV.ModRevision != t.revision {
+				t.revision = ev.KV.ModRevision
+				t.sub = 0
+			}
 
+			prev, err := getRecord(txn, kvKey(ev.KV.Key))
+			if err != nil {
+				return err
+			}
+			r := &record{
+				key:         ev.KV.Key,
+				modRevision: ev.KV.ModRevision,
+				sub:         t.sub,
+				deleted:     ev.Deleted,
+			}
+			if !ev.Deleted {
+				r.value = ev.KV.Value
+				r.createRevision = ev.KV.CreateRevision
+				r.version = ev.KV.Version
+				r.lease = ev.KV.Lease
+			}
+			if prev != nil {
+				r.prevRevision = prev.modRevision
+				r.prevSub = prev.sub
+			}
+			if err := t.write(r); err != nil {
+				return err
+			}
+			t.sub++
+		}
+
+		return txn.Set([]byte(internalPrefix+revisionKey), encodeInt(revision))
+	}); err != nil {
+		return fmt.Errorf("badgerDriver.Restore: failed to update: %w", err)
+	}
+
+	d.hub.Notify(events)
+
+	return nil
+}
+
+func (d *badgerDriver) Buckets(ctx context.Context) ([]string, error) {
+	var buckets []string
+	if err := d.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(bucketPrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); {
+			name, _, err := decodeKey(it.Item().Key()[len(bucketPrefix):])
+			if err != nil {
+				return err
+			}
+			buckets = append(buckets, string(name))
+
+			// Skip the remaining entries of the bucket.
+			next := append([]byte(bucketPrefix), encodeKey(name)...)
+			next[len(next)-1]++
+			it.Seek(next)
+		}
 		return nil
-	})
-	if err != nil {
-		return nil, 0, fmt.Errorf("badgerDriver.Range: failed to view: %w", err)
+	}); err != nil {
+		return nil, fmt.Errorf("badgerDriver.Buckets: failed to view: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (d *badgerDriver) BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	if err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(bucketKey(bucket, key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return driver.ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("badgerDriver.BucketGet: failed to view: %w", err)
+	}
+
+	return value, nil
+}
+
+func (d *badgerDriver) BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error {
+	if err := d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(bucketKey(bucket, key), value)
+	}); err != nil {
+		return fmt.Errorf("badgerDriver.BucketPut: failed to update: %w", err)
 	}
 
-	return results, 0, nil
+	return nil
 }
 
-func (d *badgerDriver) Put(ctx context.Context, key []byte, value []byte) (int64, error) {
+func (d *badgerDriver) BucketDelete(ctx context.Context, bucket string, key []byte) error {
 	if err := d.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, value)
+		return txn.Delete(bucketKey(bucket, key))
+	}); err != nil {
+		return fmt.Errorf("badgerDriver.BucketDelete: failed to update: %w", err)
+	}
+
+	return nil
+}
+
+func (d *badgerDriver) BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error {
+	prefix := bucketKey(bucket, nil)
+	if err := d.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil)[len(prefix):], v); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
-		return 0, fmt.Errorf("badgerDriver.Put: failed to update: %w", err)
+		return fmt.Errorf("badgerDriver.BucketForEach: failed to view: %w", err)
 	}
 
-	revision, err := d.incrementRevision(ctx)
+	return nil
+}
+
+func eventFromRecord(txn *badger.Txn, r *record) (*driver.WatchEvent, error) {
+	ev := &driver.WatchEvent{
+		KV:      r.keyValue(),
+		Deleted: r.deleted,
+		Created: !r.deleted && r.version == 1,
+	}
+	if r.prevRevision == 0 {
+		return ev, nil
+	}
+
+	prev, err := getRecord(txn, historyKey(r.prevRevision, r.prevSub))
 	if err != nil {
-		return 0, fmt.Errorf("badgerDriver.Put: failed to increment revision: %w", err)
+		return nil, err
+	}
+	if prev != nil && !prev.deleted {
+		ev.PrevKV = prev.keyValue()
 	}
 
-	return revision, nil
+	return ev, nil
 }
 
-func (d *badgerDriver) incrementRevision(ctx context.Context) (int64, error) {
-	seq, err := d.db.GetSequence([]byte(internalPrefix+revisionKey), 1)
+func getInt(txn *badger.Txn, key string) (int64, error) {
+	item, err := txn.Get([]byte(key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
 	if err != nil {
-		return 0, fmt.Errorf("badgerDriver.incrementRevision: failed to get sequence: %w", err)
+		return 0, err
+	}
+
+	var v int64
+	err = item.Value(func(val []byte) error {
+		v, err = decodeInt(val)
+		return err
+	})
+	return v, err
+}
+
+func getRecord(txn *badger.Txn, key []byte) (*record, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
 	}
-	revision, err := seq.Next()
 	if err != nil {
-		return 0, fmt.Errorf("badgerDriver.incrementRevision: failed to increment sequence: %w", err)
+		return nil, err
 	}
 
-	return int64(revision), nil
+	var r *record
+	err = item.Value(func(val []byte) error {
+		r, err = unmarshalRecord(val)
+		return err
+	})
+	return r, err
 }
 
-func (d *badgerDriver) getRevision(ctx context.Context) (int64, error) {
-	var revision int64
-	if err := d.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(internalPrefix + revisionKey))
-		if err != nil {
-			return fmt.Errorf("badgerDriver.getRevision: failed to get revision: %w", err)
-		}
+func kvKey(key []byte) []byte {
+	return append([]byte(kvPrefix), key...)
+}
 
-		return item.Value(func(val []byte) error {
-			revision = int64(val[0])
-			return nil
-		})
-	}); err != nil {
-		return 0, fmt.Errorf("badgerDriver.getRevision: failed to view: %w", err)
-	}
+func indexKey(key []byte, revision int64, sub int64) []byte {
+	buf := append([]byte(indexPrefix), encodeKey(key)...)
+	return append(buf, encodeRevision(revision, sub)...)
+}
 
-	return revision, nil
+func historyKey(revision int64, sub int64) []byte {
+	return append([]byte(historyPrefix), encodeRevision(revision, sub)...)
+}
+
+func bucketKey(bucket string, key []byte) []byte {
+	buf := append([]byte(bucketPrefix), encodeKey([]byte(bucket))...)
+	return append(buf, key...)
 }
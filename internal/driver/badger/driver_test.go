@@ -0,0 +1,50 @@
+package badger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/drivertest"
+)
+
+func TestDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.Driver {
+		conf := config.DefaultDriverConfig()
+		conf.Badger.DataDir = t.TempDir()
+		d, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
+
+func TestCheck(t *testing.T) {
+	for name, set := range map[string]func(*config.BadgerConfig){
+		"compression": func(c *config.BadgerConfig) { c.Compression = "lz4" },
+		"missing key file": func(c *config.BadgerConfig) {
+			c.EncryptionKeyFile = filepath.Join(t.TempDir(), "missing")
+		},
+	} {
+		conf := config.DefaultDriverConfig()
+		conf.Badger.DataDir = filepath.Join(t.TempDir(), "badger")
+		set(&conf.Badger)
+		if err := check(conf); err == nil {
+			t.Errorf("check accepted a bad %s", name)
+		}
+		if _, err := os.Stat(conf.Badger.DataDir); !os.IsNotExist(err) {
+			t.Errorf("check with a bad %s created the data directory", name)
+		}
+	}
+
+	if err := check(config.DefaultDriverConfig()); err != nil {
+		t.Errorf("check rejected the defaults: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+// encryptionKey returns the master key configured through the environment
+// or a key file. It returns nil when encryption is disabled.
+func encryptionKey(value string, file string) ([]byte, error) {
+	if value != "" && file != "" {
+		return nil, fmt.Errorf("%w: key and key file are mutually exclusive", ErrInvalidEncryptionKey)
+	}
+	if file != "" {
+		return ReadKeyFile(file)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	return parseKey([]byte(value))
+}
+
+// ReadKeyFile reads a master key stored raw or hex encoded in path.
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("badger.ReadKeyFile: failed to read key file: %w", err)
+	}
+
+	key, err := parseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("badger.ReadKeyFile: %w", err)
+	}
+
+	return key, nil
+}
+
+func parseKey(b []byte) ([]byte, error) {
+	if validKeyLength(len(b)) {
+		return b, nil
+	}
+
+	// Key files written with a text editor or echo end with a newline.
+	trimmed := bytes.TrimSpace(b)
+	if validKeyLength(len(trimmed)) {
+		return trimmed, nil
+	}
+	if decoded, err := hex.DecodeString(string(trimmed)); err == nil && validKeyLength(len(decoded)) {
+		return decoded, nil
+	}
+
+	return nil, fmt.Errorf("%w: key must be 16, 24 or 32 bytes, raw or hex encoded", ErrInvalidEncryptionKey)
+}
+
+func validKeyLength(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// Rekey re-encrypts the data keys of the Badger directory dir with newKey.
+// The table and value log contents are encrypted with the data keys, so only
+// the key registry is rewritten. The directory must not be in use.
+//
+// Encrypting a plaintext directory or decrypting an encrypted one requires
+// rewriting every table; use the migration command for that instead.
+func Rekey(dir string, oldKey []byte, newKey []byte, rotationDuration time.Duration) error {
+	if len(oldKey) == 0 || len(newKey) == 0 {
+		return fmt.Errorf("badger.Rekey: %w: both the old and the new key are required", ErrInvalidEncryptionKey)
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return fmt.Errorf("badger.Rekey: %w: the new key equals the old key", ErrInvalidEncryptionKey)
+	}
+
+	// Opening the database takes the directory lock, so this fails while a
+	// server is running, and checks that oldKey is the current master key.
+	db, err := badger.Open(badger.DefaultOptions(dir).
+		WithEncryptionKey(oldKey).
+		WithEncryptionKeyRotationDuration(rotationDuration).
+		WithIndexCacheSize(1 << 20).
+		WithLogger(nil))
+	if err != nil {
+		return fmt.Errorf("badger.Rekey: failed to open badger: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("badger.Rekey: failed to close badger: %w", err)
+	}
+
+	opts := badger.KeyRegistryOptions{
+		Dir:                           dir,
+		ReadOnly:                      true,
+		EncryptionKey:                 oldKey,
+		EncryptionKeyRotationDuration: rotationDuration,
+	}
+	kr, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return fmt.Errorf("badger.Rekey: failed to open key registry: %w", err)
+	}
+	defer kr.Close()
+
+	opts.EncryptionKey = newKey
+	if err := badger.WriteKeyRegistry(kr, opts); err != nil {
+		return fmt.Errorf("badger.Rekey: failed to write key registry: %w", err)
+	}
+
+	return nil
+}
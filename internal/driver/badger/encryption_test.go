@@ -0,0 +1,133 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// openEncrypted opens dir with the hex encoded master key, or unencrypted
+// without one. Compression is off, so plaintext would show in the files.
+func openEncrypted(dir string, key string) (driver.Driver, error) {
+	conf := config.DefaultDriverConfig()
+	conf.Badger.DataDir = dir
+	conf.Badger.Compression = "none"
+	conf.Badger.EncryptionKey = key
+	return New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+}
+
+// putAndClose writes key=value to dir and closes it.
+func putAndClose(t *testing.T, dir string, encryptionKey string, key string, value string) {
+	t.Helper()
+
+	d, err := openEncrypted(dir, encryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), []byte(value), 0)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stored reports whether any file under dir holds s.
+func stored(t *testing.T, dir string, s string) bool {
+	t.Helper()
+
+	found := false
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found = found || bytes.Contains(b, []byte(s))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// checkValues opens dir with key and checks that it holds want.
+func checkValues(t *testing.T, dir string, key string, want map[string]string) {
+	t.Helper()
+
+	d, err := openEncrypted(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for k, v := range want {
+		res, err := d.Range(context.Background(), []byte(k), nil, driver.RangeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.KVs) != 1 || string(res.KVs[0].Value) != v {
+			t.Errorf("%s = %v, want %s", k, res.KVs, v)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	oldKey := hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := hex.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	const before, after = "written-before-the-rekey", "written-after-the-rekey"
+
+	// Without a key the values are stored as they are, which is what the
+	// checks below rely on.
+	plain := t.TempDir()
+	putAndClose(t, plain, "", "secret", before)
+	if !stored(t, plain, before) {
+		t.Fatal("the value of an unencrypted directory is not found in its files")
+	}
+
+	dir := t.TempDir()
+	putAndClose(t, dir, oldKey, "secret", before)
+	if stored(t, dir, before) {
+		t.Error("the value is stored in plaintext")
+	}
+
+	oldRaw, _ := hex.DecodeString(oldKey)
+	newRaw, _ := hex.DecodeString(newKey)
+	if err := Rekey(dir, oldRaw, newRaw, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openEncrypted(dir, oldKey); err == nil {
+		t.Error("the directory opened with the replaced key")
+	}
+	checkValues(t, dir, newKey, map[string]string{"secret": before})
+
+	putAndClose(t, dir, newKey, "new", after)
+	if stored(t, dir, after) {
+		t.Error("the value written after the rekey is stored in plaintext")
+	}
+	checkValues(t, dir, newKey, map[string]string{"secret": before, "new": after})
+
+	wrongKey := hex.EncodeToString(bytes.Repeat([]byte{3}, 32))
+	if _, err := openEncrypted(dir, wrongKey); err == nil {
+		t.Error("the directory opened with a wrong key")
+	}
+	if err := Rekey(dir, oldRaw, newRaw, time.Hour); err == nil {
+		t.Error("Rekey accepted a wrong old key")
+	}
+	checkValues(t, dir, newKey, map[string]string{"secret": before, "new": after})
+}
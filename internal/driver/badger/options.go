@@ -0,0 +1,71 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+)
+
+var ErrInvalidOption = errors.New("invalid badger option")
+
+func badgerOptions(conf config.BadgerConfig) (badger.Options, error) {
+	var opts badger.Options
+	if conf.InMemory {
+		opts = badger.DefaultOptions("").WithInMemory(true)
+	} else {
+		if conf.DataDir == "" {
+			return opts, fmt.Errorf("%w: data directory is required unless in-memory mode is enabled", ErrInvalidOption)
+		}
+		opts = badger.DefaultOptions(conf.DataDir)
+	}
+
+	compression, err := parseCompression(conf.Compression)
+	if err != nil {
+		return opts, err
+	}
+
+	opts = opts.
+		WithSyncWrites(conf.SyncWrites).
+		WithValueLogFileSize(conf.ValueLogFileSize).
+		WithMemTableSize(conf.MemTableSize).
+		WithCompression(compression).
+		WithBlockCacheSize(conf.BlockCacheSize)
+
+	key, err := encryptionKey(conf.EncryptionKey, conf.EncryptionKeyFile)
+	if err != nil {
+		return opts, err
+	}
+	if key != nil {
+		// Encrypted table indices have to be decrypted on every access unless
+		// they are cached.
+		opts = opts.
+			WithEncryptionKey(key).
+			WithEncryptionKeyRotationDuration(conf.EncryptionKeyRotationDuration).
+			WithIndexCacheSize(conf.BlockCacheSize / 2)
+	}
+
+	// Badger panics instead of returning an error for this combination.
+	if (compression != options.None || key != nil) && conf.BlockCacheSize <= 0 {
+		return opts, fmt.Errorf("%w: block cache size must be set when compression or encryption is enabled", ErrInvalidOption)
+	}
+
+	return opts, nil
+}
+
+func parseCompression(s string) (options.CompressionType, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return options.None, nil
+	case "snappy":
+		return options.Snappy, nil
+	case "zstd":
+		return options.ZSTD, nil
+	default:
+		return options.None, fmt.Errorf("%w: unknown compression %q", ErrInvalidOption, s)
+	}
+}
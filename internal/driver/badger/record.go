@@ -0,0 +1,159 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+const recordDeleted = 1 << 0
+
+// record is a single version of a key as stored in the history log.
+type record struct {
+	key            []byte
+	value          []byte
+	createRevision int64
+	modRevision    int64
+	sub            int64
+	version        int64
+	lease          int64
+	deleted        bool
+	// prevRevision and prevSub locate the version this record superseded.
+	prevRevision int64
+	prevSub      int64
+}
+
+func (r *record) marshal() []byte {
+	buf := make([]byte, 0, 1+7*binary.MaxVarintLen64+len(r.key)+len(r.value))
+
+	var flags byte
+	if r.deleted {
+		flags |= recordDeleted
+	}
+	buf = append(buf, flags)
+	buf = binary.AppendVarint(buf, r.createRevision)
+	buf = binary.AppendVarint(buf, r.modRevision)
+	buf = binary.AppendVarint(buf, r.sub)
+	buf = binary.AppendVarint(buf, r.version)
+	buf = binary.AppendVarint(buf, r.lease)
+	buf = binary.AppendVarint(buf, r.prevRevision)
+	buf = binary.AppendVarint(buf, r.prevSub)
+	buf = binary.AppendUvarint(buf, uint64(len(r.key)))
+	buf = append(buf, r.key...)
+	buf = append(buf, r.value...)
+
+	return buf
+}
+
+func unmarshalRecord(buf []byte) (*record, error) {
+	if len(buf) < 1 {
+		return nil, errCorruptRecord
+	}
+	r := &record{
+		deleted: buf[0]&recordDeleted != 0,
+	}
+	buf = buf[1:]
+
+	for _, v := range []*int64{&r.createRevision, &r.modRevision, &r.sub, &r.version, &r.lease, &r.prevRevision, &r.prevSub} {
+		n, size := binary.Varint(buf)
+		if size <= 0 {
+			return nil, errCorruptRecord
+		}
+		*v = n
+		buf = buf[size:]
+	}
+
+	keyLen, size := binary.Uvarint(buf)
+	if size <= 0 || uint64(len(buf)-size) < keyLen {
+		return nil, errCorruptRecord
+	}
+	buf = buf[size:]
+	r.key = append([]byte(nil), buf[:keyLen]...)
+	r.value = append([]byte(nil), buf[keyLen:]...)
+
+	return r, nil
+}
+
+func (r *record) keyValue() *driver.KeyValue {
+	if r.deleted {
+		return &driver.KeyValue{
+			Key:         r.key,
+			ModRevision: r.modRevision,
+		}
+	}
+	return &driver.KeyValue{
+		Key:            r.key,
+		Value:          r.value,
+		CreateRevision: r.createRevision,
+		ModRevision:    r.modRevision,
+		Version:        r.version,
+		Lease:          r.lease,
+	}
+}
+
+// encodeKey escapes k so that encoded keys sort like the originals and no
+// encoded key is a prefix of another.
+func encodeKey(k []byte) []byte {
+	buf := make([]byte, 0, len(k)+2)
+	for _, b := range k {
+		if b == 0 {
+			buf = append(buf, 0, 0xff)
+			continue
+		}
+		buf = append(buf, b)
+	}
+	return append(buf, 0, 1)
+}
+
+func decodeKey(buf []byte) ([]byte, []byte, error) {
+	var k []byte
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != 0 {
+			k = append(k, buf[i])
+			continue
+		}
+		if i+1 >= len(buf) {
+			return nil, nil, errCorruptRecord
+		}
+		switch buf[i+1] {
+		case 0xff:
+			k = append(k, 0)
+			i++
+		case 1:
+			return k, buf[i+2:], nil
+		default:
+			return nil, nil, errCorruptRecord
+		}
+	}
+	return nil, nil, errCorruptRecord
+}
+
+func encodeRevision(revision int64, sub int64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(revision))
+	binary.BigEndian.PutUint64(buf[8:], uint64(sub))
+	return buf
+}
+
+func decodeRevision(buf []byte) (int64, int64, error) {
+	if len(buf) != 16 {
+		return 0, 0, errCorruptRecord
+	}
+	return int64(binary.BigEndian.Uint64(buf)), int64(binary.BigEndian.Uint64(buf[8:])), nil
+}
+
+func encodeInt(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func decodeInt(buf []byte) (int64, error) {
+	if len(buf) != 8 {
+		return 0, errCorruptRecord
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
@@ -0,0 +1,299 @@
+package badger
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+type badgerTxn struct {
+	txn *badger.Txn
+	// current is the last committed revision and revision the one writes
+	// in this transaction are made at.
+	current  int64
+	compact  int64
+	revision int64
+	sub      int64
+	events   []*driver.WatchEvent
+}
+
+func newBadgerTxn(txn *badger.Txn) (*badgerTxn, error) {
+	current, err := getInt(txn, internalPrefix+revisionKey)
+	if err != nil {
+		return nil, err
+	}
+	compact, err := getInt(txn, internalPrefix+compactKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &badgerTxn{
+		txn:      txn,
+		current:  current,
+		compact:  compact,
+		revision: current + 1,
+	}, nil
+}
+
+func (t *badgerTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	if opts.Revision > t.current {
+		return nil, driver.ErrFutureRevision
+	}
+	if opts.Revision > 0 && opts.Revision < t.compact {
+		return nil, driver.ErrCompacted
+	}
+
+	var (
+		records []*record
+		count   int64
+		err     error
+	)
+	if opts.Revision <= 0 || opts.Revision == t.current {
+		records, count, err = t.currentRecords(key, end, opts.Limit, opts.CountOnly)
+	} else {
+		records, count, err = t.historicalRecords(key, end, opts.Revision, opts.Limit, opts.CountOnly)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &driver.RangeResult{
+		Count:    count,
+		Revision: t.current,
+	}
+	if len(records) > 0 {
+		result.KVs = make([]driver.KeyValue, len(records))
+		for i, r := range records {
+			result.KVs[i] = *r.keyValue()
+			if opts.KeysOnly {
+				result.KVs[i].Value = nil
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (t *badgerTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	prev, err := getRecord(t.txn, kvKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &record{
+		key:            key,
+		value:          value,
+		createRevision: t.revision,
+		modRevision:    t.revision,
+		sub:            t.sub,
+		version:        1,
+		lease:          lease,
+	}
+	var prevKV *driver.KeyValue
+	if prev != nil {
+		r.createRevision = prev.createRevision
+		r.version = prev.version + 1
+		r.prevRevision = prev.modRevision
+		r.prevSub = prev.sub
+		prevKV = prev.keyValue()
+	}
+	if err := t.write(r); err != nil {
+		return nil, err
+	}
+	t.sub++
+
+	t.events = append(t.events, &driver.WatchEvent{
+		KV:      r.keyValue(),
+		PrevKV:  prevKV,
+		Created: prev == nil,
+	})
+
+	return prevKV, nil
+}
+
+func (t *badgerTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	records, _, err := t.currentRecords(key, end, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]driver.KeyValue, 0, len(records))
+	for _, prev := range records {
+		r := &record{
+			key:          prev.key,
+			modRevision:  t.revision,
+			sub:          t.sub,
+			deleted:      true,
+			prevRevision: prev.modRevision,
+			prevSub:      prev.sub,
+		}
+		if err := t.write(r); err != nil {
+			return nil, err
+		}
+		t.sub++
+
+		prevKV := prev.keyValue()
+		deleted = append(deleted, *prevKV)
+		t.events = append(t.events, &driver.WatchEvent{
+			KV:      r.keyValue(),
+			PrevKV:  prevKV,
+			Deleted: true,
+		})
+	}
+
+	return deleted, nil
+}
+
+// write stores r as the latest version of its key.
+func (t *badgerTxn) write(r *record) error {
+	if r.deleted {
+		if err := t.txn.Delete(kvKey(r.key)); err != nil {
+			return err
+		}
+	} else {
+		if err := t.txn.Set(kvKey(r.key), r.marshal()); err != nil {
+			return err
+		}
+	}
+
+	var flag byte
+	if r.deleted {
+		flag = 1
+	}
+	if err := t.txn.Set(indexKey(r.key, r.modRevision, r.sub), []byte{flag}); err != nil {
+		return err
+	}
+
+	return t.txn.Set(historyKey(r.modRevision, r.sub), r.marshal())
+}
+
+func (t *badgerTxn) currentRecords(key []byte, end []byte, limit int64, countOnly bool) ([]*record, int64, error) {
+	if len(end) == 0 {
+		r, err := getRecord(t.txn, kvKey(key))
+		if err != nil || r == nil {
+			return nil, 0, err
+		}
+		if countOnly {
+			return nil, 1, nil
+		}
+		return []*record{r}, 1, nil
+	}
+
+	var stop []byte
+	if !driver.IsOpenEnd(end) {
+		stop = kvKey(end)
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(kvPrefix)
+	opts.PrefetchValues = !countOnly
+	opts.PrefetchSize = 10
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	var (
+		records []*record
+		count   int64
+	)
+	for it.Seek(kvKey(key)); it.Valid(); it.Next() {
+		item := it.Item()
+		if stop != nil && bytes.Compare(item.Key(), stop) >= 0 {
+			break
+		}
+		count++
+		if countOnly || (limit > 0 && int64(len(records)) >= limit) {
+			continue
+		}
+
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := unmarshalRecord(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, r)
+	}
+
+	return records, count, nil
+}
+
+func (t *badgerTxn) historicalRecords(key []byte, end []byte, revision int64, limit int64, countOnly bool) ([]*record, int64, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(indexPrefix)
+	var stop []byte
+	if len(end) == 0 {
+		opts.Prefix = append([]byte(indexPrefix), encodeKey(key)...)
+	} else if !driver.IsOpenEnd(end) {
+		stop = append([]byte(indexPrefix), encodeKey(end)...)
+	}
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	var (
+		records []*record
+		count   int64
+		group   []byte
+		best    *indexEntry
+	)
+	flush := func() error {
+		if best == nil || best.deleted {
+			return nil
+		}
+		count++
+		if countOnly || (limit > 0 && int64(len(records)) >= limit) {
+			return nil
+		}
+		r, err := getRecord(t.txn, historyKey(best.revision, best.sub))
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			records = append(records, r)
+		}
+		return nil
+	}
+
+	for it.Seek(append([]byte(indexPrefix), encodeKey(key)...)); it.Valid(); it.Next() {
+		item := it.Item()
+		if stop != nil && bytes.Compare(item.Key(), stop) >= 0 {
+			break
+		}
+		k, rest, err := decodeKey(item.Key()[len(indexPrefix):])
+		if err != nil {
+			return nil, 0, err
+		}
+		if group == nil || !bytes.Equal(k, group) {
+			if err := flush(); err != nil {
+				return nil, 0, err
+			}
+			group = k
+			best = nil
+		}
+
+		rev, sub, err := decodeRevision(rest)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rev > revision {
+			continue
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		best = &indexEntry{
+			revision: rev,
+			sub:      sub,
+			deleted:  len(v) > 0 && v[0] == 1,
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, 0, err
+	}
+
+	return records, count, nil
+}
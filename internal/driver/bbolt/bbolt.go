@@ -0,0 +1,497 @@
+package bbolt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+)
+
+const (
+	historyBatchSize = 1000
+
+	openTimeout = 10 * time.Second
+)
+
+// The buckets of etcd's mvcc backend. key and meta hold the key space and
+// are not exposed through the Bucket methods.
+var (
+	keyBucket       = []byte("key")
+	metaBucket      = []byte("meta")
+	etcdBuckets     = [][]byte{keyBucket, metaBucket, []byte("lease"), []byte("auth"), []byte("authUsers"), []byte("authRoles")}
+	reservedBuckets = map[string]bool{string(keyBucket): true, string(metaBucket): true}
+
+	scheduledCompactKey = []byte("scheduledCompactRev")
+	finishedCompactKey  = []byte("finishedCompactRev")
+)
+
+// ErrReservedBucket is returned when the Bucket methods are used on a
+// bucket holding the key space.
+var ErrReservedBucket = errors.New("bucket is reserved")
+
+func init() {
+	registry.Register("bbolt", New)
+}
+
+func New(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	if err := os.MkdirAll(filepath.Dir(conf.Bbolt.Path), 0o700); err != nil {
+		return nil, fmt.Errorf("bbolt.New: failed to create directory: %w", err)
+	}
+
+	db, err := bolt.Open(conf.Bbolt.Path, 0o600, &bolt.Options{
+		Timeout: openTimeout,
+		NoSync:  conf.Bbolt.NoSync,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bbolt.New: failed to open bbolt: %w", err)
+	}
+
+	d := &bboltDriver{
+		log:   log,
+		db:    db,
+		hub:   driver.NewWatchHub(),
+		index: newIndex(),
+	}
+	if err := d.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bbolt.New: %w", err)
+	}
+
+	return d, nil
+}
+
+// bboltDriver stores the key space exactly as etcd's mvcc backend does:
+// every version is a mvccpb.KeyValue in the key bucket under its encoded
+// revision, and the compaction progress is kept in the meta bucket. A data
+// file can therefore be inspected with etcdutl and restored into etcd, and
+// an etcd snapshot can be served by the shim.
+type bboltDriver struct {
+	log *slog.Logger
+	db  *bolt.DB
+	hub *driver.WatchHub
+
+	// writeMu serializes writers so revisions are allocated and published
+	// in order.
+	writeMu sync.Mutex
+	// mu guards the index and the revisions below, which are only updated
+	// after the transaction that wrote them has committed.
+	mu      sync.RWMutex
+	index   *index
+	current int64
+	compact int64
+}
+
+func (d *bboltDriver) Close() error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.hub.Close()
+	if err := d.db.Close(); err != nil {
+		return fmt.Errorf("bboltDriver.Close: failed to close bbolt: %w", err)
+	}
+
+	return nil
+}
+
+// load creates the etcd buckets and rebuilds the index from the key bucket.
+func (d *bboltDriver) load() error {
+	var scheduled int64
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range etcdBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", name, err)
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if v := meta.Get(finishedCompactKey); len(v) >= revBytesLen {
+			d.compact = bytesToRev(v).main
+		}
+		if v := meta.Get(scheduledCompactKey); len(v) >= revBytesLen {
+			scheduled = bytesToRev(v).main
+		}
+
+		return tx.Bucket(keyBucket).ForEach(func(k, v []byte) error {
+			kv, err := unmarshalKeyValue(v)
+			if err != nil {
+				return err
+			}
+			rev := bytesToRev(k)
+			d.index.put(kv.Key, rev, isTombstone(k))
+			d.current = rev.main
+			return nil
+		})
+	}); err != nil {
+		return fmt.Errorf("failed to load: %w", err)
+	}
+	d.current = max(d.current, d.compact)
+
+	// Finish a compaction interrupted by a crash, as etcd does on startup.
+	if scheduled > d.compact {
+		d.log.Info("bbolt: resuming interrupted compaction", "revision", scheduled)
+		if err := d.Compact(context.Background(), scheduled); err != nil {
+			return fmt.Errorf("failed to resume compaction: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *bboltDriver) revisions() (int64, int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.current, d.compact
+}
+
+func (d *bboltDriver) CurrentRevision(ctx context.Context) (int64, error) {
+	current, _ := d.revisions()
+	return current, nil
+}
+
+func (d *bboltDriver) CompactRevision(ctx context.Context) (int64, error) {
+	_, compact := d.revisions()
+	return compact, nil
+}
+
+func (d *bboltDriver) Size(ctx context.Context) (int64, error) {
+	var size int64
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("bboltDriver.Size: failed to view: %w", err)
+	}
+
+	return size, nil
+}
+
+func (d *bboltDriver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	// Everything up to current has committed, so a read transaction begun
+	// afterwards sees all of it.
+	current, compact := d.revisions()
+
+	var result *driver.RangeResult
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = d.newTxn(tx, current, compact).Range(key, end, opts)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("bboltDriver.Range: failed to view: %w", err)
+	}
+
+	return result, nil
+}
+
+func (d *bboltDriver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return 0, fmt.Errorf("bboltDriver.Txn: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, compact := d.revisions()
+	t := d.newTxn(tx, current, compact)
+	if err := fn(t); err != nil {
+		return 0, fmt.Errorf("bboltDriver.Txn: %w", err)
+	}
+	if len(t.events) == 0 {
+		return t.current, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("bboltDriver.Txn: failed to commit: %w", err)
+	}
+
+	d.apply(t.updates, t.revision)
+	d.hub.Notify(t.events)
+
+	return t.revision, nil
+}
+
+// apply adds committed versions to the index and advances the revision.
+func (d *bboltDriver) apply(updates []indexUpdate, revision int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, u := range updates {
+		d.index.put(u.key, u.revision, u.tombstone)
+	}
+	d.current = revision
+}
+
+func (d *bboltDriver) Compact(ctx context.Context, atRev int64) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	// Raising the compact revision first stops new reads below it, and the
+	// versions removed are never the ones read at or above it.
+	d.mu.Lock()
+	if atRev <= d.compact {
+		d.mu.Unlock()
+		return driver.ErrCompacted
+	}
+	if atRev > d.current {
+		d.mu.Unlock()
+		return driver.ErrFutureRevision
+	}
+	d.compact = atRev
+	removed := d.index.compact(atRev)
+	d.mu.Unlock()
+
+	compactRev := revToBytes(revision{main: atRev}, false)
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(scheduledCompactKey, compactRev)
+	}); err != nil {
+		return fmt.Errorf("bboltDriver.Compact: failed to schedule: %w", err)
+	}
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keyBucket)
+		for _, r := range removed {
+			if err := b.Delete(revToBytes(r.revision, r.tombstone)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(finishedCompactKey, compactRev)
+	}); err != nil {
+		return fmt.Errorf("bboltDriver.Compact: failed to delete superseded versions: %w", err)
+	}
+
+	return nil
+}
+
+func (d *bboltDriver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	if startRevision > 0 {
+		if _, compact := d.revisions(); startRevision < compact {
+			return nil, driver.ErrCompacted
+		}
+	}
+
+	return d.hub.Watch(ctx, key, end, startRevision, d.History), nil
+}
+
+func (d *bboltDriver) RequestProgress(ctx context.Context) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	current, _ := d.revisions()
+	d.hub.Progress(current)
+
+	return nil
+}
+
+func (d *bboltDriver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	seek := revToBytes(revision{main: startRevision}, false)
+	for {
+		var events []*driver.WatchEvent
+		if err := d.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(keyBucket).Cursor()
+			for k, v := c.Seek(seek); k != nil && len(events) < historyBatchSize; k, v = c.Next() {
+				ev, err := d.event(tx, k, v)
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+
+				rev := bytesToRev(k)
+				seek = revToBytes(revision{main: rev.main, sub: rev.sub + 1}, false)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("bboltDriver.History: failed to view: %w", err)
+		}
+
+		for _, ev := range events {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		if len(events) < historyBatchSize {
+			return nil
+		}
+	}
+}
+
+// event builds the watch event for an entry of the key bucket, looking up
+// the previous version through the index.
+func (d *bboltDriver) event(tx *bolt.Tx, k []byte, v []byte) (*driver.WatchEvent, error) {
+	kv, err := unmarshalKeyValue(v)
+	if err != nil {
+		return nil, err
+	}
+	rev := bytesToRev(k)
+
+	ev := &driver.WatchEvent{KV: kv}
+	if isTombstone(k) {
+		ev.KV = &driver.KeyValue{Key: kv.Key, ModRevision: rev.main}
+		ev.Deleted = true
+	} else {
+		ev.Created = kv.Version == 1
+	}
+
+	d.mu.RLock()
+	prev, ok := d.index.before(kv.Key, rev)
+	d.mu.RUnlock()
+	if ok && !prev.tombstone {
+		// The previous version may already have been compacted away.
+		if ev.PrevKV, err = getKeyValue(tx, prev.revision); err != nil {
+			return nil, err
+		}
+	}
+
+	return ev, nil
+}
+
+func (d *bboltDriver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("bboltDriver.Restore: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, compact := d.revisions()
+	t := d.newTxn(tx, current, compact)
+	for _, ev := range events {
+		if ev.KV.ModRevision <= current || ev.KV.ModRevision > revision {
+			return fmt.Errorf("bboltDriver.Restore: event revision %d out of order", ev.KV.ModRevision)
+		}
+		if ev.KV.ModRevision != t.revision {
+			t.revision = ev.KV.ModRevision
+			t.sub = 0
+		}
+		kv := &driver.KeyValue{
+			Key:         ev.KV.Key,
+			ModRevision: ev.KV.ModRevision,
+		}
+		if !ev.Deleted {
+			kv = ev.KV
+		}
+		if err := t.write(kv, ev.Deleted); err != nil {
+			return fmt.Errorf("bboltDriver.Restore: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("bboltDriver.Restore: failed to commit: %w", err)
+	}
+
+	d.apply(t.updates, revision)
+	d.hub.Notify(events)
+
+	return nil
+}
+
+func (d *bboltDriver) Buckets(ctx context.Context) ([]string, error) {
+	var buckets []string
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			// Other drivers have no notion of an empty bucket.
+			if reservedBuckets[string(name)] || b.Stats().KeyN == 0 {
+				return nil
+			}
+			buckets = append(buckets, string(name))
+			return nil
+		})
+	}); err != nil {
+		return nil, fmt.Errorf("bboltDriver.Buckets: failed to view: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (d *bboltDriver) BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error) {
+	if reservedBuckets[bucket] {
+		return nil, fmt.Errorf("bboltDriver.BucketGet: %w", ErrReservedBucket)
+	}
+
+	var value []byte
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return driver.ErrKeyNotFound
+		}
+		v := b.Get(key)
+		if v == nil {
+			return driver.ErrKeyNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("bboltDriver.BucketGet: failed to view: %w", err)
+	}
+
+	return value, nil
+}
+
+func (d *bboltDriver) BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error {
+	if reservedBuckets[bucket] {
+		return fmt.Errorf("bboltDriver.BucketPut: %w", ErrReservedBucket)
+	}
+
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	}); err != nil {
+		return fmt.Errorf("bboltDriver.BucketPut: failed to update: %w", err)
+	}
+
+	return nil
+}
+
+func (d *bboltDriver) BucketDelete(ctx context.Context, bucket string, key []byte) error {
+	if reservedBuckets[bucket] {
+		return fmt.Errorf("bboltDriver.BucketDelete: %w", ErrReservedBucket)
+	}
+
+	if err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(key)
+	}); err != nil {
+		return fmt.Errorf("bboltDriver.BucketDelete: failed to update: %w", err)
+	}
+
+	return nil
+}
+
+func (d *bboltDriver) BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error {
+	if reservedBuckets[bucket] {
+		return fmt.Errorf("bboltDriver.BucketForEach: %w", ErrReservedBucket)
+	}
+
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(append([]byte(nil), k...), append([]byte(nil), v...))
+		})
+	}); err != nil {
+		return fmt.Errorf("bboltDriver.BucketForEach: failed to view: %w", err)
+	}
+
+	return nil
+}
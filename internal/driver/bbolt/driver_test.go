@@ -0,0 +1,26 @@
+package bbolt
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/drivertest"
+)
+
+func TestDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.Driver {
+		conf := config.DefaultDriverConfig()
+		conf.Bbolt.Path = filepath.Join(t.TempDir(), "db")
+		d, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
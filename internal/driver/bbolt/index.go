@@ -0,0 +1,115 @@
+package bbolt
+
+import (
+	"bytes"
+
+	"github.com/google/btree"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// index maps every key to its versions, like etcd's treeIndex. The key
+// bucket is ordered by revision only, so the index is rebuilt from it on
+// startup.
+type index struct {
+	tree *btree.BTreeG[*keyIndex]
+}
+
+type keyIndex struct {
+	key []byte
+	// revs is ordered oldest first.
+	revs []indexRev
+}
+
+type indexRev struct {
+	revision
+	tombstone bool
+}
+
+func newIndex() *index {
+	return &index{
+		tree: btree.NewG(32, func(a, b *keyIndex) bool {
+			return bytes.Compare(a.key, b.key) < 0
+		}),
+	}
+}
+
+// put records a new version of key. Versions must be added in revision
+// order.
+func (x *index) put(key []byte, rev revision, tombstone bool) {
+	ki, ok := x.tree.Get(&keyIndex{key: key})
+	if !ok {
+		ki = &keyIndex{key: key}
+		x.tree.ReplaceOrInsert(ki)
+	}
+	ki.revs = append(ki.revs, indexRev{revision: rev, tombstone: tombstone})
+}
+
+// ascend calls fn for every key in the etcd style range [key, end) in key
+// order until fn returns false.
+func (x *index) ascend(key []byte, end []byte, fn func(ki *keyIndex) bool) {
+	switch {
+	case len(end) == 0:
+		if ki, ok := x.tree.Get(&keyIndex{key: key}); ok {
+			fn(ki)
+		}
+	case driver.IsOpenEnd(end):
+		x.tree.AscendGreaterOrEqual(&keyIndex{key: key}, fn)
+	default:
+		x.tree.AscendRange(&keyIndex{key: key}, &keyIndex{key: end}, fn)
+	}
+}
+
+// before returns the version of key preceding rev.
+func (x *index) before(key []byte, rev revision) (indexRev, bool) {
+	ki, ok := x.tree.Get(&keyIndex{key: key})
+	if !ok {
+		return indexRev{}, false
+	}
+	for i := len(ki.revs) - 1; i >= 0; i-- {
+		if rev.greaterThan(ki.revs[i].revision) {
+			return ki.revs[i], true
+		}
+	}
+	return indexRev{}, false
+}
+
+// compact drops the versions superseded at atRev and returns them. The
+// latest version of each key at atRev is kept unless it is an older
+// tombstone.
+func (x *index) compact(atRev int64) []indexRev {
+	var (
+		removed []indexRev
+		empty   []*keyIndex
+	)
+	x.tree.Ascend(func(ki *keyIndex) bool {
+		keep := ki.at(atRev)
+		if keep < 0 {
+			return true
+		}
+		if ki.revs[keep].tombstone && ki.revs[keep].main < atRev {
+			keep++
+		}
+		removed = append(removed, ki.revs[:keep]...)
+		ki.revs = append([]indexRev(nil), ki.revs[keep:]...)
+		if len(ki.revs) == 0 {
+			empty = append(empty, ki)
+		}
+		return true
+	})
+	for _, ki := range empty {
+		x.tree.Delete(ki)
+	}
+
+	return removed
+}
+
+// at returns the position of the latest version at or before atRev, or -1.
+func (ki *keyIndex) at(atRev int64) int {
+	for i := len(ki.revs) - 1; i >= 0; i-- {
+		if ki.revs[i].main <= atRev {
+			return i
+		}
+	}
+	return -1
+}
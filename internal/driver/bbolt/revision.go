@@ -0,0 +1,49 @@
+package bbolt
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// revBytesLen is the length of a key in the key bucket: the main
+	// revision, an underscore and the sub revision, as etcd writes them.
+	revBytesLen = 8 + 1 + 8
+	// markTombstone is appended to the keys of deletions.
+	markTombstone byte = 't'
+)
+
+// revision identifies a single version: main is the etcd revision and sub
+// orders the changes made within it.
+type revision struct {
+	main int64
+	sub  int64
+}
+
+func (r revision) greaterThan(o revision) bool {
+	if r.main != o.main {
+		return r.main > o.main
+	}
+	return r.sub > o.sub
+}
+
+func revToBytes(rev revision, tombstone bool) []byte {
+	b := make([]byte, revBytesLen, revBytesLen+1)
+	binary.BigEndian.PutUint64(b, uint64(rev.main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(rev.sub))
+	if tombstone {
+		b = append(b, markTombstone)
+	}
+	return b
+}
+
+func bytesToRev(b []byte) revision {
+	return revision{
+		main: int64(binary.BigEndian.Uint64(b[0:8])),
+		sub:  int64(binary.BigEndian.Uint64(b[9:])),
+	}
+}
+
+func isTombstone(b []byte) bool {
+	return len(b) == revBytesLen+1 && b[revBytesLen] == markTombstone
+}
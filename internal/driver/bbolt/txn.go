@@ -0,0 +1,285 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+type bboltTxn struct {
+	d  *bboltDriver
+	tx *bolt.Tx
+	// current is the last committed revision and revision the one writes
+	// in this transaction are made at.
+	current  int64
+	compact  int64
+	revision int64
+	sub      int64
+	// writes holds the latest version written by this transaction per key,
+	// nil for deletions, until the index is updated on commit.
+	writes  map[string]*driver.KeyValue
+	updates []indexUpdate
+	events  []*driver.WatchEvent
+}
+
+type indexUpdate struct {
+	key []byte
+	indexRev
+}
+
+func (d *bboltDriver) newTxn(tx *bolt.Tx, current int64, compact int64) *bboltTxn {
+	return &bboltTxn{
+		d:        d,
+		tx:       tx,
+		current:  current,
+		compact:  compact,
+		revision: current + 1,
+		writes:   map[string]*driver.KeyValue{},
+	}
+}
+
+func (t *bboltTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	if opts.Revision > t.current {
+		return nil, driver.ErrFutureRevision
+	}
+	if opts.Revision > 0 && opts.Revision < t.compact {
+		return nil, driver.ErrCompacted
+	}
+
+	// Reading at the transaction's own revision includes its writes.
+	revision := opts.Revision
+	if revision <= 0 {
+		revision = t.current
+		if len(t.events) > 0 {
+			revision = t.revision
+		}
+	}
+
+	kvs, err := t.live(key, end, revision, opts.Limit, opts.CountOnly)
+	if err != nil {
+		return nil, err
+	}
+	if opts.KeysOnly {
+		for i := range kvs.kvs {
+			kvs.kvs[i].Value = nil
+		}
+	}
+
+	return &driver.RangeResult{
+		KVs:      kvs.kvs,
+		Count:    kvs.count,
+		Revision: t.current,
+	}, nil
+}
+
+type liveResult struct {
+	kvs   []driver.KeyValue
+	count int64
+}
+
+// live returns the keys in [key, end) that exist at atRev, reading them
+// from the key bucket unless countOnly is set.
+func (t *bboltTxn) live(key []byte, end []byte, atRev int64, limit int64, countOnly bool) (*liveResult, error) {
+	type candidate struct {
+		key []byte
+		rev revision
+		kv  *driver.KeyValue
+	}
+
+	var candidates []candidate
+	t.d.mu.RLock()
+	t.d.index.ascend(key, end, func(ki *keyIndex) bool {
+		if atRev == t.revision {
+			if _, ok := t.writes[string(ki.key)]; ok {
+				return true
+			}
+		}
+		i := ki.at(atRev)
+		if i < 0 || ki.revs[i].tombstone {
+			return true
+		}
+		candidates = append(candidates, candidate{key: ki.key, rev: ki.revs[i].revision})
+		return true
+	})
+	t.d.mu.RUnlock()
+
+	if atRev == t.revision && len(t.writes) > 0 {
+		for k, kv := range t.writes {
+			if kv != nil && driver.InRange([]byte(k), key, end) {
+				candidates = append(candidates, candidate{key: kv.Key, kv: kv})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return bytes.Compare(candidates[i].key, candidates[j].key) < 0
+		})
+	}
+
+	result := &liveResult{count: int64(len(candidates))}
+	if countOnly {
+		return result, nil
+	}
+	if limit > 0 && int64(len(candidates)) > limit {
+		candidates = candidates[:limit]
+	}
+
+	result.kvs = make([]driver.KeyValue, 0, len(candidates))
+	for _, c := range candidates {
+		kv := c.kv
+		if kv == nil {
+			var err error
+			if kv, err = getKeyValue(t.tx, c.rev); err != nil {
+				return nil, err
+			}
+			if kv == nil {
+				return nil, fmt.Errorf("revision %d of %q missing from key bucket", c.rev.main, c.key)
+			}
+		}
+		result.kvs = append(result.kvs, *kv)
+	}
+
+	return result, nil
+}
+
+// latest returns the live version of key as this transaction sees it.
+func (t *bboltTxn) latest(key []byte) (*driver.KeyValue, error) {
+	if kv, ok := t.writes[string(key)]; ok {
+		return kv, nil
+	}
+
+	result, err := t.live(key, nil, t.current, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.kvs) == 0 {
+		return nil, nil
+	}
+	return &result.kvs[0], nil
+}
+
+func (t *bboltTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	prev, err := t.latest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := &driver.KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: t.revision,
+		ModRevision:    t.revision,
+		Version:        1,
+		Lease:          lease,
+	}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	if err := t.write(kv, false); err != nil {
+		return nil, err
+	}
+	t.events = append(t.events, &driver.WatchEvent{
+		KV:      kv,
+		PrevKV:  prev,
+		Created: prev == nil,
+	})
+
+	return prev, nil
+}
+
+func (t *bboltTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	result, err := t.live(key, end, t.revision, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result.kvs {
+		prev := &result.kvs[i]
+		kv := &driver.KeyValue{
+			Key:         prev.Key,
+			ModRevision: t.revision,
+		}
+		if err := t.write(kv, true); err != nil {
+			return nil, err
+		}
+		t.events = append(t.events, &driver.WatchEvent{
+			KV:      kv,
+			PrevKV:  prev,
+			Deleted: true,
+		})
+	}
+
+	return result.kvs, nil
+}
+
+// write stores kv in the key bucket at the next sub revision.
+func (t *bboltTxn) write(kv *driver.KeyValue, tombstone bool) error {
+	rev := revision{main: kv.ModRevision, sub: t.sub}
+	if err := putKeyValue(t.tx, rev, kv, tombstone); err != nil {
+		return err
+	}
+	t.sub++
+
+	if tombstone {
+		t.writes[string(kv.Key)] = nil
+	} else {
+		t.writes[string(kv.Key)] = kv
+	}
+	t.updates = append(t.updates, indexUpdate{
+		key:      kv.Key,
+		indexRev: indexRev{revision: rev, tombstone: tombstone},
+	})
+
+	return nil
+}
+
+// putKeyValue writes kv the way etcd does: a mvccpb.KeyValue under the
+// revision, holding only the key for deletions.
+func putKeyValue(tx *bolt.Tx, rev revision, kv *driver.KeyValue, tombstone bool) error {
+	pb := &mvccpb.KeyValue{Key: kv.Key}
+	if !tombstone {
+		pb.Value = kv.Value
+		pb.CreateRevision = kv.CreateRevision
+		pb.ModRevision = kv.ModRevision
+		pb.Version = kv.Version
+		pb.Lease = kv.Lease
+	}
+	v, err := pb.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := tx.Bucket(keyBucket).Put(revToBytes(rev, tombstone), v); err != nil {
+		return fmt.Errorf("failed to put: %w", err)
+	}
+
+	return nil
+}
+
+// getKeyValue reads the live version stored at rev, or nil.
+func getKeyValue(tx *bolt.Tx, rev revision) (*driver.KeyValue, error) {
+	v := tx.Bucket(keyBucket).Get(revToBytes(rev, false))
+	if v == nil {
+		return nil, nil
+	}
+	return unmarshalKeyValue(v)
+}
+
+func unmarshalKeyValue(v []byte) (*driver.KeyValue, error) {
+	var pb mvccpb.KeyValue
+	if err := pb.Unmarshal(v); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+
+	return &driver.KeyValue{
+		Key:            pb.Key,
+		Value:          pb.Value,
+		CreateRevision: pb.CreateRevision,
+		ModRevision:    pb.ModRevision,
+		Version:        pb.Version,
+		Lease:          pb.Lease,
+	}, nil
+}
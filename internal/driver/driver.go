@@ -1,17 +1,104 @@
 package driver
 
-import "context"
+import (
+	"bytes"
+	"context"
+	"errors"
+)
 
+var (
+	ErrCompacted      = errors.New("required revision has been compacted")
+	ErrFutureRevision = errors.New("required revision is a future revision")
+	ErrKeyNotFound    = errors.New("key not found")
+	// ErrConflict is returned by Txn when concurrent transactions kept
+	// conflicting. Nothing was written, so the caller may retry.
+	ErrConflict = errors.New("transaction conflict")
+	// ErrNoSpace is returned when the storage is out of space.
+	ErrNoSpace = errors.New("database space exceeded")
+	// ErrRequestTooLarge is returned when a transaction exceeds what the
+	// storage can commit at once.
+	ErrRequestTooLarge = errors.New("request is too large")
+)
+
+// Driver is a revisioned key-value store backing the etcd API.
+//
+// Every committed Txn that writes at least one key allocates a new revision.
+// All writes in the same Txn share that revision, which is what etcd calls
+// the main revision.
 type Driver interface {
-	Put(ctx context.Context, key []byte, value []byte) (int64, error)
-	Range(ctx context.Context, key []byte, end []byte) ([]KeyValue, int64, error)
-	Watch(ctx context.Context, key []byte, revision int64) chan *WatchEvent
+	// CurrentRevision returns the revision of the last committed write.
+	CurrentRevision(ctx context.Context) (int64, error)
+	// CompactRevision returns the revision the history has been compacted to.
+	CompactRevision(ctx context.Context) (int64, error)
+
+	// Range reads the keys in [key, end) as of opts.Revision.
+	Range(ctx context.Context, key []byte, end []byte, opts RangeOptions) (*RangeResult, error)
+	// Txn runs fn in a serializable read-write transaction and returns the
+	// revision it committed at. Read-only transactions return the current
+	// revision. fn may be invoked more than once if the transaction is retried.
+	Txn(ctx context.Context, fn func(txn Txn) error) (int64, error)
+	// Compact discards history superseded before revision.
+	Compact(ctx context.Context, revision int64) error
+	// Watch streams events for [key, end) starting at startRevision. The
+	// channel is closed when ctx is done or the watcher can no longer be served.
+	Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *WatchEvent, error)
+
+	// History calls fn for every retained event at or after startRevision in
+	// commit order. Events older than the compaction revision are included
+	// when they are still needed to serve reads. PrevKV is populated when
+	// the previous version is still available.
+	History(ctx context.Context, startRevision int64, fn func(ev *WatchEvent) error) error
+	// Restore appends events verbatim, keeping their revisions and versions,
+	// and advances the current revision to revision. Events must be in commit
+	// order and newer than the current revision.
+	Restore(ctx context.Context, events []*WatchEvent, revision int64) error
+
+	// Buckets returns the names of the non-revisioned buckets that hold
+	// state such as leases and auth data.
+	Buckets(ctx context.Context) ([]string, error)
+	// BucketGet returns ErrKeyNotFound when key is not in bucket.
+	BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error)
+	BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error
+	BucketDelete(ctx context.Context, bucket string, key []byte) error
+	// BucketForEach calls fn for every entry of bucket in key order.
+	BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error
+
+	// Close waits for the writes in progress, closes every watch channel
+	// and releases the storage. No other method may be called after it.
+	Close() error
+}
+
+// Txn is the view of the store inside Driver.Txn. Reads observe the writes
+// made earlier in the same transaction.
+type Txn interface {
+	Range(key []byte, end []byte, opts RangeOptions) (*RangeResult, error)
+	Put(key []byte, value []byte, lease int64) (*KeyValue, error)
+	DeleteRange(key []byte, end []byte) ([]KeyValue, error)
+}
+
+type RangeOptions struct {
+	// Revision is the revision to read at. Zero means the current revision.
+	Revision  int64
+	Limit     int64
+	CountOnly bool
+	// KeysOnly leaves Value out of the results, letting drivers skip
+	// reading the values.
+	KeysOnly bool
+}
+
+type RangeResult struct {
+	KVs      []KeyValue
+	Count    int64
+	Revision int64
 }
 
 type KeyValue struct {
-	Key     []byte
-	Value   []byte
-	Version int64
+	Key            []byte
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Lease          int64
 }
 
 type WatchEvent struct {
@@ -19,4 +106,43 @@ type WatchEvent struct {
 	PrevKV  *KeyValue
 	Deleted bool
 	Created bool
+	// Last is set on the last event of its revision on a watch channel, so
+	// consumers can keep the events of one revision together.
+	Last bool
+	// Progress is set on events without KV, which report that every event
+	// up to this revision has been delivered. See ProgressRequester.
+	Progress int64
+}
+
+// ProgressRequester is implemented by drivers that can confirm how far their
+// watchers have been served.
+type ProgressRequester interface {
+	// RequestProgress queues a progress event at the current revision or
+	// later on every watch channel of the driver.
+	RequestProgress(ctx context.Context) error
+}
+
+// Sizer is implemented by drivers that can report the size of their
+// database.
+type Sizer interface {
+	// Size returns the size of the database in bytes.
+	Size(ctx context.Context) (int64, error)
+}
+
+// InRange reports whether k falls into the etcd style range [key, end).
+// An empty end selects key alone and a single zero byte selects every key
+// greater than or equal to key.
+func InRange(k []byte, key []byte, end []byte) bool {
+	if len(end) == 0 {
+		return bytes.Equal(k, key)
+	}
+	if bytes.Compare(k, key) < 0 {
+		return false
+	}
+	return IsOpenEnd(end) || bytes.Compare(k, end) < 0
+}
+
+// IsOpenEnd reports whether end is the "\x00" range end meaning no upper bound.
+func IsOpenEnd(end []byte) bool {
+	return len(end) == 1 && end[0] == 0
 }
@@ -0,0 +1,90 @@
+package drivertest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	writers          = 8
+	writesPerWriter  = 25
+	concurrentPrefix = "counter"
+)
+
+// testConcurrentWriters increments a counter from several goroutines with
+// read-modify-write transactions. Serializable transactions lose no update
+// and give every commit a revision of its own.
+func testConcurrentWriters(t *testing.T, d driver.Driver) {
+	ctx := context.Background()
+	start := put(t, d, concurrentPrefix, "0")
+
+	var (
+		mu        sync.Mutex
+		revisions = map[int64]bool{}
+		wg        sync.WaitGroup
+	)
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			own := concurrentPrefix + "/" + strconv.Itoa(w)
+			for i := 0; i < writesPerWriter; i++ {
+				revision, err := d.Txn(ctx, func(txn driver.Txn) error {
+					result, err := txn.Range([]byte(concurrentPrefix), nil, driver.RangeOptions{})
+					if err != nil {
+						return err
+					}
+					n, err := strconv.Atoi(string(result.KVs[0].Value))
+					if err != nil {
+						return err
+					}
+					if _, err := txn.Put([]byte(concurrentPrefix), []byte(strconv.Itoa(n+1)), 0); err != nil {
+						return err
+					}
+					_, err = txn.Put([]byte(own), []byte(strconv.Itoa(i)), 0)
+					return err
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				mu.Lock()
+				if revisions[revision] {
+					t.Errorf("revision %d committed twice", revision)
+				}
+				revisions[revision] = true
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("txn: %v", err)
+	}
+
+	total := writers * writesPerWriter
+	result := rangeKeys(t, d, concurrentPrefix, "", driver.RangeOptions{})
+	if got := string(result.KVs[0].Value); got != strconv.Itoa(total) {
+		t.Errorf("counter = %s, want %d", got, total)
+	}
+	if got := result.KVs[0].Version; got != int64(total+1) {
+		t.Errorf("counter version = %d, want %d", got, total+1)
+	}
+	// The revisions are contiguous.
+	for r := start + 1; r <= start+int64(total); r++ {
+		if !revisions[r] {
+			t.Errorf("revision %d was not committed", r)
+		}
+	}
+	if current := currentRevision(t, d); current != start+int64(total) {
+		t.Errorf("current revision = %d, want %d", current, start+int64(total))
+	}
+}
@@ -0,0 +1,120 @@
+// Package drivertest verifies that a driver.Driver implements the contract
+// the etcd API relies on. Drivers call Run from their own tests:
+//
+//	func TestDriver(t *testing.T) {
+//		drivertest.Run(t, func(t *testing.T) driver.Driver {
+//			conf := config.DefaultDriverConfig()
+//			conf.Badger.DataDir = t.TempDir()
+//			d, err := New(context.Background(), log, conf)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { d.Close() })
+//			return d
+//		})
+//	}
+package drivertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// NewFunc returns an empty driver for one test. Cleanup, e.g. closing the
+// driver, is registered with t.Cleanup.
+type NewFunc func(t *testing.T) driver.Driver
+
+// Run runs every contract test in its own subtest with its own driver.
+func Run(t *testing.T, newDriver NewFunc) {
+	t.Run("Revisions", func(t *testing.T) { testRevisions(t, newDriver(t)) })
+	t.Run("RangeEnd", func(t *testing.T) { testRangeEnd(t, newDriver(t)) })
+	t.Run("Tombstones", func(t *testing.T) { testTombstones(t, newDriver(t)) })
+	t.Run("Compaction", func(t *testing.T) { testCompaction(t, newDriver(t)) })
+	t.Run("WatchOrdering", func(t *testing.T) { testWatchOrdering(t, newDriver(t)) })
+	t.Run("WatchProgress", func(t *testing.T) { testWatchProgress(t, newDriver(t)) })
+	t.Run("LeaseExpiry", func(t *testing.T) { testLeaseExpiry(t, newDriver(t)) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, newDriver(t)) })
+	t.Run("Model", func(t *testing.T) { testModel(t, newDriver(t)) })
+}
+
+func testLogger(t *testing.T) *slog.Logger {
+	return slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{Level: slog.LevelWarn}))
+}
+
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(p))
+	return len(p), nil
+}
+
+// put writes key in a transaction of its own and returns the revision.
+func put(t *testing.T, d driver.Driver, key string, value string) int64 {
+	t.Helper()
+
+	revision, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), []byte(value), 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	return revision
+}
+
+func deleteRange(t *testing.T, d driver.Driver, key string, end string) int64 {
+	t.Helper()
+
+	revision, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.DeleteRange([]byte(key), []byte(end))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("delete %s: %v", key, err)
+	}
+	return revision
+}
+
+func rangeKeys(t *testing.T, d driver.Driver, key string, end string, opts driver.RangeOptions) *driver.RangeResult {
+	t.Helper()
+
+	result, err := d.Range(context.Background(), []byte(key), []byte(end), opts)
+	if err != nil {
+		t.Fatalf("range [%q, %q) at %d: %v", key, end, opts.Revision, err)
+	}
+	return result
+}
+
+func currentRevision(t *testing.T, d driver.Driver) int64 {
+	t.Helper()
+
+	revision, err := d.CurrentRevision(context.Background())
+	if err != nil {
+		t.Fatalf("current revision: %v", err)
+	}
+	return revision
+}
+
+// keys formats the keys and values of kvs for comparison.
+func keys(kvs []driver.KeyValue) string {
+	s := ""
+	for _, kv := range kvs {
+		s += fmt.Sprintf("%s=%s ", kv.Key, kv.Value)
+	}
+	return s
+}
+
+func expectErr(t *testing.T, err error, want error, format string, args ...any) {
+	t.Helper()
+
+	if !errors.Is(err, want) {
+		t.Errorf("%s: err = %v, want %v", fmt.Sprintf(format, args...), err, want)
+	}
+}
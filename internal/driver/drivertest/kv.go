@@ -0,0 +1,235 @@
+package drivertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+func testRevisions(t *testing.T, d driver.Driver) {
+	ctx := context.Background()
+	start := currentRevision(t, d)
+
+	// Every writing transaction allocates exactly the next revision.
+	for i := int64(1); i <= 3; i++ {
+		if revision := put(t, d, "a", "v"); revision != start+i {
+			t.Fatalf("put %d revision = %d, want %d", i, revision, start+i)
+		}
+	}
+	current := start + 3
+	if got := currentRevision(t, d); got != current {
+		t.Fatalf("current revision = %d, want %d", got, current)
+	}
+
+	// All writes of one transaction share its revision.
+	revision, err := d.Txn(ctx, func(txn driver.Txn) error {
+		for _, k := range []string{"b", "c", "b"} {
+			if _, err := txn.Put([]byte(k), []byte("v"), 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("txn: %v", err)
+	}
+	current++
+	if revision != current {
+		t.Fatalf("multi-put txn revision = %d, want %d", revision, current)
+	}
+	result := rangeKeys(t, d, "b", "d", driver.RangeOptions{})
+	for _, kv := range result.KVs {
+		if kv.ModRevision != current {
+			t.Errorf("%s mod revision = %d, want %d", kv.Key, kv.ModRevision, current)
+		}
+	}
+	if keys(result.KVs) != "b=v c=v " {
+		t.Errorf("multi-put txn wrote %q, want b and c", keys(result.KVs))
+	}
+
+	// Read-only, failed and no-op transactions allocate nothing.
+	if revision, err := d.Txn(ctx, func(txn driver.Txn) error {
+		_, err := txn.Range([]byte("a"), nil, driver.RangeOptions{})
+		return err
+	}); err != nil || revision != current {
+		t.Errorf("read-only txn = %d, %v, want %d", revision, err, current)
+	}
+	errAbort := errors.New("abort")
+	if _, err := d.Txn(ctx, func(txn driver.Txn) error {
+		if _, err := txn.Put([]byte("a"), []byte("aborted"), 0); err != nil {
+			return err
+		}
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Errorf("failed txn err = %v, want %v", err, errAbort)
+	}
+	if got := rangeKeys(t, d, "a", "", driver.RangeOptions{}); string(got.KVs[0].Value) != "v" {
+		t.Errorf("failed txn wrote %s", got.KVs[0].Value)
+	}
+	if revision := deleteRange(t, d, "missing", ""); revision != current {
+		t.Errorf("deleting nothing = revision %d, want %d", revision, current)
+	}
+	if got := currentRevision(t, d); got != current {
+		t.Errorf("current revision = %d, want %d", got, current)
+	}
+
+	// Reads inside a transaction see its earlier writes.
+	if _, err := d.Txn(ctx, func(txn driver.Txn) error {
+		if _, err := txn.Put([]byte("a"), []byte("own"), 0); err != nil {
+			return err
+		}
+		result, err := txn.Range([]byte("a"), nil, driver.RangeOptions{})
+		if err != nil {
+			return err
+		}
+		if len(result.KVs) != 1 || string(result.KVs[0].Value) != "own" {
+			t.Errorf("txn read its own write as %q", keys(result.KVs))
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("txn: %v", err)
+	}
+
+	expectErr(t, rangeErr(d, "a", driver.RangeOptions{Revision: current + 5}), driver.ErrFutureRevision, "range at a future revision")
+}
+
+func testRangeEnd(t *testing.T, d driver.Driver) {
+	for _, k := range []string{"a", "b", "c", "c\x00", "d", "e"} {
+		put(t, d, k, k)
+	}
+
+	tests := []struct {
+		key, end string
+		want     string
+	}{
+		{"c", "", "c=c "},
+		{"x", "", ""},
+		{"b", "d", "b=b c=c c\x00=c\x00 "},
+		{"c", "c\x00", "c=c "},
+		{"d", "\x00", "d=d e=e "},
+		{"\x00", "\x00", "a=a b=b c=c c\x00=c\x00 d=d e=e "},
+		{"d", "b", ""},
+		{"b", "b", ""},
+	}
+	for _, tt := range tests {
+		result := rangeKeys(t, d, tt.key, tt.end, driver.RangeOptions{})
+		if got := keys(result.KVs); got != tt.want {
+			t.Errorf("range [%q, %q) = %q, want %q", tt.key, tt.end, got, tt.want)
+		}
+		if n := int64(len(result.KVs)); result.Count != n {
+			t.Errorf("range [%q, %q) count = %d, want %d", tt.key, tt.end, result.Count, n)
+		}
+	}
+
+	// Limits cut the keys but not the count.
+	limited := rangeKeys(t, d, "a", "\x00", driver.RangeOptions{Limit: 2})
+	if got := keys(limited.KVs); got != "a=a b=b " || limited.Count != 6 {
+		t.Errorf("range with limit 2 = %q count %d, want a, b count 6", got, limited.Count)
+	}
+	count := rangeKeys(t, d, "a", "\x00", driver.RangeOptions{CountOnly: true})
+	if len(count.KVs) != 0 || count.Count != 6 {
+		t.Errorf("count only range = %d keys count %d, want none count 6", len(count.KVs), count.Count)
+	}
+	keysOnly := rangeKeys(t, d, "a", "\x00", driver.RangeOptions{Limit: 2, KeysOnly: true})
+	if got := keys(keysOnly.KVs); got != "a= b= " || keysOnly.Count != 6 || keysOnly.KVs[0].ModRevision == 0 {
+		t.Errorf("keys only range = %q count %d, want a, b without values count 6", got, keysOnly.Count)
+	}
+}
+
+func testTombstones(t *testing.T, d driver.Driver) {
+	created := put(t, d, "k", "1")
+	updated := put(t, d, "k", "2")
+
+	var deleted []driver.KeyValue
+	deletedAt, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		var err error
+		deleted, err = txn.DeleteRange([]byte("k"), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if len(deleted) != 1 || string(deleted[0].Value) != "2" || deleted[0].ModRevision != updated {
+		t.Errorf("delete returned %q, want the version written at %d", keys(deleted), updated)
+	}
+
+	if result := rangeKeys(t, d, "k", "", driver.RangeOptions{}); len(result.KVs) != 0 {
+		t.Errorf("deleted key still visible: %q", keys(result.KVs))
+	}
+	// History before the tombstone stays readable.
+	if result := rangeKeys(t, d, "k", "", driver.RangeOptions{Revision: deletedAt - 1}); keys(result.KVs) != "k=2 " {
+		t.Errorf("range before the delete = %q, want k=2", keys(result.KVs))
+	}
+
+	// A recreated key starts a new generation.
+	recreated := put(t, d, "k", "3")
+	result := rangeKeys(t, d, "k", "", driver.RangeOptions{})
+	if len(result.KVs) != 1 {
+		t.Fatalf("recreated key missing")
+	}
+	kv := result.KVs[0]
+	if kv.Version != 1 || kv.CreateRevision != recreated || kv.ModRevision != recreated {
+		t.Errorf("recreated key = version %d create %d mod %d, want 1, %d, %d", kv.Version, kv.CreateRevision, kv.ModRevision, recreated, recreated)
+	}
+
+	// History reports the tombstone as a delete event.
+	var events []*driver.WatchEvent
+	if err := d.History(context.Background(), created, func(ev *driver.WatchEvent) error {
+		if string(ev.KV.Key) == "k" {
+			events = append(events, ev)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("history has %d events, want 4", len(events))
+	}
+	if !events[2].Deleted || events[2].KV.ModRevision != deletedAt {
+		t.Errorf("third event = deleted %v at %d, want a delete at %d", events[2].Deleted, events[2].KV.ModRevision, deletedAt)
+	}
+	if events[0].Deleted || events[1].Deleted || events[3].Deleted {
+		t.Errorf("put events reported as deletes")
+	}
+}
+
+func testCompaction(t *testing.T, d driver.Driver) {
+	ctx := context.Background()
+	r1 := put(t, d, "k", "1")
+	r2 := put(t, d, "k", "2")
+	put(t, d, "gone", "x")
+	deleteRange(t, d, "gone", "")
+	r3 := put(t, d, "k", "3")
+
+	if err := d.Compact(ctx, r2); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if compact, err := d.CompactRevision(ctx); err != nil || compact != r2 {
+		t.Errorf("compact revision = %d, %v, want %d", compact, err, r2)
+	}
+
+	expectErr(t, rangeErr(d, "k", driver.RangeOptions{Revision: r1}), driver.ErrCompacted, "range below the compaction")
+	if result := rangeKeys(t, d, "k", "", driver.RangeOptions{Revision: r2}); keys(result.KVs) != "k=2 " {
+		t.Errorf("range at the compaction = %q, want k=2", keys(result.KVs))
+	}
+	result := rangeKeys(t, d, "k", "", driver.RangeOptions{})
+	if len(result.KVs) != 1 || result.KVs[0].Version != 3 || result.KVs[0].CreateRevision != r1 || result.KVs[0].ModRevision != r3 {
+		t.Errorf("key after compaction = %+v, want version 3 created at %d", result.KVs, r1)
+	}
+	if result := rangeKeys(t, d, "gone", "", driver.RangeOptions{}); len(result.KVs) != 0 {
+		t.Errorf("deleted key came back after compaction")
+	}
+
+	expectErr(t, d.Compact(ctx, r1), driver.ErrCompacted, "compact below the compaction")
+	expectErr(t, d.Compact(ctx, r3+10), driver.ErrFutureRevision, "compact a future revision")
+
+	_, err := d.Watch(ctx, []byte("k"), nil, r1)
+	expectErr(t, err, driver.ErrCompacted, "watch below the compaction")
+}
+
+func rangeErr(d driver.Driver, key string, opts driver.RangeOptions) error {
+	_, err := d.Range(context.Background(), []byte(key), nil, opts)
+	return err
+}
@@ -0,0 +1,233 @@
+package drivertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	modelOps  = 400
+	modelKeys = 10
+)
+
+// model is the reference implementation the driver is compared against: a
+// plain list of every version of every key.
+type model struct {
+	versions map[string][]driver.KeyValue
+	// deleted holds the revisions at which each key was deleted.
+	deleted  map[string][]int64
+	current  int64
+	compact  int64
+	revision int64
+	pending  map[string]*driver.KeyValue
+	order    []string
+}
+
+func newModel(current int64) *model {
+	return &model{
+		versions: map[string][]driver.KeyValue{},
+		deleted:  map[string][]int64{},
+		current:  current,
+	}
+}
+
+// at returns the version of key visible at revision.
+func (m *model) at(key string, revision int64) *driver.KeyValue {
+	var kv *driver.KeyValue
+	for i := range m.versions[key] {
+		if v := &m.versions[key][i]; v.ModRevision <= revision {
+			kv = v
+		}
+	}
+	for _, r := range m.deleted[key] {
+		if kv != nil && r > kv.ModRevision && r <= revision {
+			kv = nil
+		}
+	}
+	return kv
+}
+
+func (m *model) rangeAt(key string, end string, revision int64) []driver.KeyValue {
+	var names []string
+	for k := range m.versions {
+		if driver.InRange([]byte(k), []byte(key), []byte(end)) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var kvs []driver.KeyValue
+	for _, k := range names {
+		if kv := m.at(k, revision); kv != nil {
+			kvs = append(kvs, *kv)
+		}
+	}
+	return kvs
+}
+
+func (m *model) begin() {
+	m.revision = m.current + 1
+	m.pending = map[string]*driver.KeyValue{}
+	m.order = nil
+}
+
+// latest returns the live version of key including the pending writes.
+func (m *model) latest(key string) *driver.KeyValue {
+	if kv, ok := m.pending[key]; ok {
+		return kv
+	}
+	return m.at(key, m.current)
+}
+
+func (m *model) put(key string, value string) {
+	kv := &driver.KeyValue{
+		Key:            []byte(key),
+		Value:          []byte(value),
+		CreateRevision: m.revision,
+		ModRevision:    m.revision,
+		Version:        1,
+	}
+	if prev := m.latest(key); prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	if _, ok := m.pending[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.pending[key] = kv
+}
+
+func (m *model) deleteRange(key string, end string) {
+	var names []string
+	for k := range m.versions {
+		names = append(names, k)
+	}
+	for k := range m.pending {
+		names = append(names, k)
+	}
+	for _, k := range names {
+		if !driver.InRange([]byte(k), []byte(key), []byte(end)) || m.latest(k) == nil {
+			continue
+		}
+		if _, ok := m.pending[k]; !ok {
+			m.order = append(m.order, k)
+		}
+		m.pending[k] = nil
+	}
+}
+
+func (m *model) commit() {
+	if len(m.order) == 0 {
+		return
+	}
+	for _, k := range m.order {
+		if kv := m.pending[k]; kv != nil {
+			m.versions[k] = append(m.versions[k], *kv)
+		} else {
+			m.deleted[k] = append(m.deleted[k], m.revision)
+		}
+	}
+	m.current = m.revision
+}
+
+// testModel applies random transactions to the driver and to the model and
+// compares their reads at random retained revisions. The seed is logged so
+// failures can be replayed.
+func testModel(t *testing.T, d driver.Driver) {
+	ctx := context.Background()
+	seed := uint64(time.Now().UnixNano())
+	t.Logf("seed %d", seed)
+	rnd := rand.New(rand.NewPCG(seed, seed))
+
+	m := newModel(currentRevision(t, d))
+	key := func() string {
+		return fmt.Sprintf("m/%d", rnd.IntN(modelKeys))
+	}
+
+	for op := 0; op < modelOps; op++ {
+		if rnd.IntN(20) == 0 && m.current > m.compact+1 {
+			revision := m.compact + 1 + rnd.Int64N(m.current-m.compact)
+			if err := d.Compact(ctx, revision); err != nil {
+				t.Fatalf("op %d: compact %d: %v", op, revision, err)
+			}
+			m.compact = revision
+			continue
+		}
+
+		// Like etcd's API, a transaction touches every key at most once.
+		m.begin()
+		revision, err := d.Txn(ctx, func(txn driver.Txn) error {
+			if rnd.IntN(4) == 0 {
+				k, end := key(), key()
+				if end < k {
+					k, end = end, k
+				}
+				if _, err := txn.DeleteRange([]byte(k), []byte(end)); err != nil {
+					return err
+				}
+				m.deleteRange(k, end)
+				return nil
+			}
+
+			for _, i := range rnd.Perm(modelKeys)[:1+rnd.IntN(3)] {
+				k := fmt.Sprintf("m/%d", i)
+				if rnd.IntN(3) == 0 {
+					if _, err := txn.DeleteRange([]byte(k), nil); err != nil {
+						return err
+					}
+					m.deleteRange(k, "")
+					continue
+				}
+				v := fmt.Sprint(rnd.Int())
+				if _, err := txn.Put([]byte(k), []byte(v), 0); err != nil {
+					return err
+				}
+				m.put(k, v)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("op %d: txn: %v", op, err)
+		}
+		m.commit()
+		if revision != m.current {
+			t.Fatalf("op %d: txn revision = %d, want %d", op, revision, m.current)
+		}
+
+		at := int64(0)
+		if rnd.IntN(2) == 0 && m.current > m.compact {
+			at = m.compact + rnd.Int64N(m.current-m.compact+1)
+		}
+		want := m.rangeAt("m/", "m0", m.current)
+		if at > 0 {
+			want = m.rangeAt("m/", "m0", at)
+		}
+		result := rangeKeys(t, d, "m/", "m0", driver.RangeOptions{Revision: at})
+		if err := compareKVs(result.KVs, want); err != nil {
+			t.Fatalf("op %d: range at %d (current %d, compacted %d): %v", op, at, m.current, m.compact, err)
+		}
+	}
+}
+
+func compareKVs(got []driver.KeyValue, want []driver.KeyValue) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("got %q, want %q", keys(got), keys(want))
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if !bytes.Equal(g.Key, w.Key) || !bytes.Equal(g.Value, w.Value) ||
+			g.CreateRevision != w.CreateRevision || g.ModRevision != w.ModRevision || g.Version != w.Version {
+			return fmt.Errorf("key %d = %s=%s create %d mod %d version %d, want %s=%s create %d mod %d version %d",
+				i, g.Key, g.Value, g.CreateRevision, g.ModRevision, g.Version,
+				w.Key, w.Value, w.CreateRevision, w.ModRevision, w.Version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/lease"
+)
+
+const eventTimeout = 10 * time.Second
+
+func testWatchOrdering(t *testing.T, d driver.Driver) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := put(t, d, "w/a", "0")
+	put(t, d, "other", "x")
+
+	// A watcher from the past replays history and then continues live.
+	replay, err := d.Watch(ctx, []byte("w/"), []byte("w0"), first)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	live, err := d.Watch(ctx, []byte("w/"), []byte("w0"), currentRevision(t, d)+1)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	type write struct {
+		key     string
+		deleted bool
+	}
+	var want []write
+	for i := 0; i < 20; i++ {
+		// Events of one transaction follow the order of its writes.
+		keys := []string{"w/a", fmt.Sprintf("w/%02d", i+1), fmt.Sprintf("w/%02d", i)}
+		if _, err := d.Txn(ctx, func(txn driver.Txn) error {
+			for _, k := range keys {
+				if _, err := txn.Put([]byte(k), []byte(fmt.Sprint(i)), 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("txn: %v", err)
+		}
+		for _, k := range keys {
+			want = append(want, write{key: k})
+		}
+		if i%5 == 4 {
+			deleteRange(t, d, "w/a", "")
+			want = append(want, write{key: "w/a", deleted: true})
+		}
+	}
+
+	check := func(name string, ch <-chan *driver.WatchEvent, want []write) {
+		t.Helper()
+
+		var prev *driver.WatchEvent
+		for i, w := range want {
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					t.Fatalf("%s: channel closed after %d of %d events", name, i, len(want))
+				}
+				if string(ev.KV.Key) != w.key || ev.Deleted != w.deleted {
+					t.Fatalf("%s: event %d = %s deleted %v, want %s deleted %v", name, i, ev.KV.Key, ev.Deleted, w.key, w.deleted)
+				}
+				if prev != nil {
+					if ev.KV.ModRevision < prev.KV.ModRevision {
+						t.Fatalf("%s: event %d at revision %d after %d", name, i, ev.KV.ModRevision, prev.KV.ModRevision)
+					}
+					// Only the last event of a revision is marked.
+					if ends := ev.KV.ModRevision != prev.KV.ModRevision; prev.Last != ends {
+						t.Fatalf("%s: event %d marked last %v, want %v", name, i-1, prev.Last, ends)
+					}
+				}
+				prev = ev
+			case <-time.After(eventTimeout):
+				t.Fatalf("%s: no event %d of %d within %s", name, i, len(want), eventTimeout)
+			}
+		}
+		if !prev.Last {
+			t.Fatalf("%s: the last event is not marked last", name)
+		}
+	}
+	check("live", live, want)
+	check("replay", replay, append([]write{{key: "w/a"}}, want...))
+}
+
+// testWatchProgress checks that a progress event follows every event up to
+// its revision, which consistent reads from a watch cache rely on.
+func testWatchProgress(t *testing.T, d driver.Driver) {
+	pr, ok := d.(driver.ProgressRequester)
+	if !ok {
+		t.Skip("driver does not implement driver.ProgressRequester")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := d.Watch(ctx, []byte("p/"), []byte("p0"), currentRevision(t, d)+1)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	var last int64
+	for i := 0; i < 50; i++ {
+		last = put(t, d, fmt.Sprintf("p/%d", i), "v")
+		// Writes outside the range must not hold the progress back.
+		put(t, d, "other", "v")
+	}
+	if err := pr.RequestProgress(ctx); err != nil {
+		t.Fatalf("request progress: %v", err)
+	}
+
+	events := 0
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d events", events)
+			}
+			if ev.KV != nil {
+				events++
+				continue
+			}
+			if events != 50 || ev.Progress < last {
+				t.Fatalf("progress at %d after %d of 50 events up to %d", ev.Progress, events, last)
+			}
+			return
+		case <-time.After(eventTimeout):
+			t.Fatalf("no progress event within %s", eventTimeout)
+		}
+	}
+}
+
+func testLeaseExpiry(t *testing.T, d driver.Driver) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lessor, err := lease.New(ctx, testLogger(t), d, nil)
+	if err != nil {
+		t.Fatalf("lease.New: %v", err)
+	}
+
+	id, ttl, err := lessor.Grant(ctx, 0, lease.MinTTL)
+	if err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if err := lessor.Attach([]int64{id}, func() error {
+		_, err := d.Txn(ctx, func(txn driver.Txn) error {
+			_, err := txn.Put([]byte("leased"), []byte("v"), id)
+			return err
+		})
+		return err
+	}); err != nil {
+		t.Fatalf("put with lease: %v", err)
+	}
+	put(t, d, "unleased", "v")
+
+	deadline := time.Now().Add(time.Duration(ttl)*time.Second + eventTimeout)
+	for {
+		result := rangeKeys(t, d, "leased", "", driver.RangeOptions{})
+		if len(result.KVs) == 0 {
+			break
+		}
+		if result.KVs[0].Lease != id {
+			t.Fatalf("key lease = %d, want %d", result.KVs[0].Lease, id)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("key of an expired lease still exists")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, _, err := lessor.TimeToLive(id); err == nil {
+		t.Errorf("expired lease still exists")
+	}
+	if result := rangeKeys(t, d, "unleased", "", driver.RangeOptions{}); len(result.KVs) != 1 {
+		t.Errorf("expiry deleted a key without a lease")
+	}
+
+	// The lease bucket no longer holds the lease, so a new lessor does not
+	// bring it back.
+	reloaded, err := lease.New(ctx, testLogger(t), d, nil)
+	if err != nil {
+		t.Fatalf("lease.New: %v", err)
+	}
+	if leases := reloaded.Leases(); len(leases) != 0 {
+		t.Errorf("reloaded leases = %v, want none", leases)
+	}
+}
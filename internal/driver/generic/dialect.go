@@ -0,0 +1,53 @@
+package generic
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect describes the differences between the SQL databases the generic
+// driver runs on. Queries are written with ? placeholders and rewritten by
+// Rebind.
+type Dialect struct {
+	Name string
+	// Schema is run on startup. Every statement must be idempotent.
+	Schema []string
+	// LockRevision is run first in every write transaction to serialize
+	// writers across processes. Empty when the database serializes writers
+	// itself.
+	LockRevision string
+	// Notify, if set, is run before every commit that advances the revision
+	// to wake the pollers of other processes, e.g. NOTIFY on Postgres.
+	Notify string
+	// UpsertBucket inserts or replaces a (bucket, name, value) row.
+	UpsertBucket string
+	// Size returns the size of the database in bytes.
+	Size string
+	// NumberedPlaceholders selects $1, $2, ... instead of ?.
+	NumberedPlaceholders bool
+	// IsRetryable reports whether a failed transaction may be retried.
+	IsRetryable func(err error) bool
+	// IsNoSpace reports whether a write failed because the database is full.
+	IsNoSpace func(err error) bool
+}
+
+func (d *Dialect) Rebind(query string) string {
+	if !d.NumberedPlaceholders {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
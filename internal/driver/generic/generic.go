@@ -0,0 +1,617 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	maxTxnAttempts   = 5
+	historyBatchSize = 1000
+
+	kvColumns = "kv.id, kv.name, kv.revision, kv.create_revision, kv.prev_revision, kv.prev_id, kv.version, kv.lease, kv.deleted, kv.value"
+	// kvKeyColumns are kvColumns without the value, for keys-only reads.
+	kvKeyColumns = "kv.id, kv.name, kv.revision, kv.create_revision, kv.prev_revision, kv.prev_id, kv.version, kv.lease, kv.deleted, NULL"
+)
+
+// Driver implements driver.Driver on top of a SQL database. Every version
+// of every key is a row of the kv log table, in the style of kine; the row
+// id orders the log and the revision column groups the rows written by one
+// transaction.
+//
+// Row ids come from an auto-increment column or sequence and have gaps
+// wherever a transaction rolled back, so the log is only ever walked by id
+// order, never by counting ids. Revisions are allocated from the meta table
+// under LockRevision and so stay gapless.
+type Driver struct {
+	log     *slog.Logger
+	db      *sql.DB
+	dialect *Dialect
+	hub     *driver.WatchHub
+
+	// mu serializes the writers of this process.
+	mu sync.Mutex
+
+	// publishMu serializes publishing to the watch hub and guards published.
+	publishMu sync.Mutex
+	// published is the last revision handed to the watch hub.
+	published    int64
+	pollInterval time.Duration
+	pollCh       chan struct{}
+	// stop ends the poll loop, which closes polled when it returns.
+	stop   chan struct{}
+	polled chan struct{}
+}
+
+func New(ctx context.Context, log *slog.Logger, db *sql.DB, dialect *Dialect, pollInterval time.Duration) (*Driver, error) {
+	for _, stmt := range dialect.Schema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("generic.New: failed to migrate schema: %w", err)
+		}
+	}
+
+	d := &Driver{
+		log:          log,
+		db:           db,
+		dialect:      dialect,
+		hub:          driver.NewWatchHub(),
+		pollInterval: pollInterval,
+		pollCh:       make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		polled:       make(chan struct{}),
+	}
+
+	current, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generic.New: failed to get current revision: %w", err)
+	}
+	d.published = current
+
+	go d.poll()
+
+	return d, nil
+}
+
+// Close stops polling, closes the watch channels and the database.
+func (d *Driver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	close(d.stop)
+	<-d.polled
+	d.hub.Close()
+	if err := d.db.Close(); err != nil {
+		return fmt.Errorf("generic.Close: failed to close database: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) query(ctx context.Context, q queryer, query string, args ...any) (*sql.Rows, error) {
+	return q.QueryContext(ctx, d.dialect.Rebind(query), args...)
+}
+
+func (d *Driver) queryRow(ctx context.Context, q queryer, query string, args ...any) *sql.Row {
+	return q.QueryRowContext(ctx, d.dialect.Rebind(query), args...)
+}
+
+func (d *Driver) exec(ctx context.Context, q queryer, query string, args ...any) (sql.Result, error) {
+	return q.ExecContext(ctx, d.dialect.Rebind(query), args...)
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (d *Driver) CurrentRevision(ctx context.Context) (int64, error) {
+	revision, err := d.meta(ctx, d.db, "revision")
+	if err != nil {
+		return 0, fmt.Errorf("generic.CurrentRevision: %w", err)
+	}
+
+	return revision, nil
+}
+
+func (d *Driver) CompactRevision(ctx context.Context) (int64, error) {
+	revision, err := d.meta(ctx, d.db, "compact")
+	if err != nil {
+		return 0, fmt.Errorf("generic.CompactRevision: %w", err)
+	}
+
+	return revision, nil
+}
+
+func (d *Driver) Size(ctx context.Context) (int64, error) {
+	var size int64
+	if err := d.queryRow(ctx, d.db, d.dialect.Size).Scan(&size); err != nil {
+		return 0, fmt.Errorf("generic.Size: failed to query size: %w", err)
+	}
+
+	return size, nil
+}
+
+func (d *Driver) meta(ctx context.Context, q queryer, name string) (int64, error) {
+	var v int64
+	if err := d.queryRow(ctx, q, "SELECT value FROM meta WHERE name = ?", name).Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	return v, nil
+}
+
+func (d *Driver) setMeta(ctx context.Context, q queryer, name string, value int64) error {
+	if _, err := d.exec(ctx, q, "UPDATE meta SET value = ? WHERE name = ?", value, name); err != nil {
+		return fmt.Errorf("failed to update %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (d *Driver) notify(ctx context.Context, q queryer) error {
+	if d.dialect.Notify == "" {
+		return nil
+	}
+	if _, err := d.exec(ctx, q, d.dialect.Notify); err != nil {
+		return fmt.Errorf("failed to notify: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	tx, err := d.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("generic.Range: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := d.newTxn(ctx, tx)
+	if err != nil {
+		return nil, fmt.Errorf("generic.Range: %w", err)
+	}
+	result, err := t.Range(key, end, opts)
+	if err != nil {
+		return nil, fmt.Errorf("generic.Range: %w", err)
+	}
+
+	return result, nil
+}
+
+func (d *Driver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		revision, written, err := d.txn(ctx, fn)
+		if err != nil && d.dialect.IsRetryable != nil && d.dialect.IsRetryable(err) && attempt < maxTxnAttempts {
+			d.log.Warn("generic.Txn: transaction conflict, retrying", "attempt", attempt, "error", err)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("generic.Txn: %w", d.classify(err))
+		}
+		if written {
+			d.Poll()
+		}
+		return revision, nil
+	}
+}
+
+// classify wraps err in the driver error describing it, if any.
+func (d *Driver) classify(err error) error {
+	switch {
+	case d.dialect.IsRetryable != nil && d.dialect.IsRetryable(err):
+		return fmt.Errorf("%w: %w", driver.ErrConflict, err)
+	case d.dialect.IsNoSpace != nil && d.dialect.IsNoSpace(err):
+		return fmt.Errorf("%w: %w", driver.ErrNoSpace, err)
+	}
+	return err
+}
+
+func (d *Driver) txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, bool, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if d.dialect.LockRevision != "" {
+		if _, err := d.exec(ctx, tx, d.dialect.LockRevision); err != nil {
+			return 0, false, fmt.Errorf("failed to lock revision: %w", err)
+		}
+	}
+
+	t, err := d.newTxn(ctx, tx)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := fn(t); err != nil {
+		return 0, false, err
+	}
+	if !t.written {
+		return t.current, false, nil
+	}
+
+	if err := d.setMeta(ctx, tx, "revision", t.revision); err != nil {
+		return 0, false, err
+	}
+	if err := d.notify(ctx, tx); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	return t.revision, true, nil
+}
+
+func (d *Driver) Compact(ctx context.Context, revision int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("generic.Compact: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if d.dialect.LockRevision != "" {
+		if _, err := d.exec(ctx, tx, d.dialect.LockRevision); err != nil {
+			return fmt.Errorf("generic.Compact: failed to lock revision: %w", err)
+		}
+	}
+	current, err := d.meta(ctx, tx, "revision")
+	if err != nil {
+		return fmt.Errorf("generic.Compact: %w", err)
+	}
+	compact, err := d.meta(ctx, tx, "compact")
+	if err != nil {
+		return fmt.Errorf("generic.Compact: %w", err)
+	}
+	if revision <= compact {
+		return driver.ErrCompacted
+	}
+	if revision > current {
+		return driver.ErrFutureRevision
+	}
+
+	// Keep the latest version of every key at revision, then drop it too if
+	// it is a tombstone from before revision.
+	if _, err := d.exec(ctx, tx,
+		"DELETE FROM kv WHERE revision <= ? AND id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM kv WHERE revision <= ? GROUP BY name) AS latest)",
+		revision, revision,
+	); err != nil {
+		return fmt.Errorf("generic.Compact: failed to delete superseded versions: %w", err)
+	}
+	if _, err := d.exec(ctx, tx, "DELETE FROM kv WHERE revision < ? AND deleted = 1", revision); err != nil {
+		return fmt.Errorf("generic.Compact: failed to delete tombstones: %w", err)
+	}
+	if err := d.setMeta(ctx, tx, "compact", revision); err != nil {
+		return fmt.Errorf("generic.Compact: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("generic.Compact: failed to commit: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	if startRevision > 0 {
+		compact, err := d.CompactRevision(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("generic.Watch: %w", err)
+		}
+		if startRevision < compact {
+			return nil, driver.ErrCompacted
+		}
+	} else {
+		// Events reach the hub from the poller, which may lag behind the
+		// database, so pin the start to what is committed now.
+		current, err := d.CurrentRevision(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("generic.Watch: %w", err)
+		}
+		startRevision = current + 1
+	}
+
+	return d.hub.Watch(ctx, key, end, startRevision, d.History), nil
+}
+
+func (d *Driver) RequestProgress(ctx context.Context) error {
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+
+	// Publishing first makes the progress event cover every revision
+	// committed so far, including those of other processes.
+	if err := d.publish(ctx); err != nil {
+		return fmt.Errorf("generic.RequestProgress: failed to publish events: %w", err)
+	}
+	d.hub.Progress(d.published)
+
+	return nil
+}
+
+func (d *Driver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	var lastID int64
+	for {
+		events, id, err := d.historyBatch(ctx, startRevision, lastID)
+		if err != nil {
+			return fmt.Errorf("generic.History: %w", err)
+		}
+		for _, ev := range events {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		if len(events) < historyBatchSize {
+			return nil
+		}
+		lastID = id
+	}
+}
+
+func (d *Driver) historyBatch(ctx context.Context, startRevision int64, afterID int64) ([]*driver.WatchEvent, int64, error) {
+	rows, err := d.query(ctx, d.db,
+		"SELECT "+kvColumns+", p.value, p.create_revision, p.revision, p.version, p.lease, p.deleted"+
+			" FROM kv LEFT JOIN kv p ON p.id = kv.prev_id"+
+			" WHERE kv.revision >= ? AND kv.id > ? ORDER BY kv.id LIMIT ?",
+		startRevision, afterID, historyBatchSize,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		events []*driver.WatchEvent
+		lastID int64
+	)
+	for rows.Next() {
+		var (
+			r    row
+			prev struct {
+				value                                    []byte
+				createRevision, revision, version, lease sql.NullInt64
+				deleted                                  sql.NullInt64
+			}
+		)
+		if err := rows.Scan(
+			&r.id, &r.name, &r.revision, &r.createRevision, &r.prevRevision, &r.prevID, &r.version, &r.lease, &r.deleted, &r.value,
+			&prev.value, &prev.createRevision, &prev.revision, &prev.version, &prev.lease, &prev.deleted,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan history: %w", err)
+		}
+
+		ev := &driver.WatchEvent{
+			KV:      r.keyValue(),
+			Deleted: r.deleted != 0,
+			Created: r.deleted == 0 && r.version == 1,
+		}
+		if prev.revision.Valid && prev.deleted.Int64 == 0 {
+			ev.PrevKV = &driver.KeyValue{
+				Key:            r.name,
+				Value:          prev.value,
+				CreateRevision: prev.createRevision.Int64,
+				ModRevision:    prev.revision.Int64,
+				Version:        prev.version.Int64,
+				Lease:          prev.lease.Int64,
+			}
+		}
+		events = append(events, ev)
+		lastID = r.id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	return events, lastID, nil
+}
+
+func (d *Driver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("generic.Restore: failed to begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if d.dialect.LockRevision != "" {
+		if _, err := d.exec(ctx, tx, d.dialect.LockRevision); err != nil {
+			return fmt.Errorf("generic.Restore: failed to lock revision: %w", err)
+		}
+	}
+	t, err := d.newTxn(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("generic.Restore: %w", err)
+	}
+
+	for _, ev := range events {
+		if ev.KV.ModRevision <= t.current || ev.KV.ModRevision > revision {
+			return fmt.Errorf("generic.Restore: event revision %d out of order", ev.KV.ModRevision)
+		}
+		r := &row{
+			name:     ev.KV.Key,
+			revision: ev.KV.ModRevision,
+		}
+		if ev.Deleted {
+			r.deleted = 1
+		} else {
+			r.value = ev.KV.Value
+			r.createRevision = ev.KV.CreateRevision
+			r.version = ev.KV.Version
+			r.lease = ev.KV.Lease
+		}
+		prev, err := t.latest(r.name)
+		if err != nil {
+			return fmt.Errorf("generic.Restore: %w", err)
+		}
+		if err := t.insert(r, prev); err != nil {
+			return fmt.Errorf("generic.Restore: %w", err)
+		}
+	}
+
+	if err := d.setMeta(ctx, tx, "revision", revision); err != nil {
+		return fmt.Errorf("generic.Restore: %w", err)
+	}
+	if err := d.notify(ctx, tx); err != nil {
+		return fmt.Errorf("generic.Restore: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("generic.Restore: failed to commit: %w", err)
+	}
+
+	d.Poll()
+
+	return nil
+}
+
+func (d *Driver) Buckets(ctx context.Context) ([]string, error) {
+	rows, err := d.query(ctx, d.db, "SELECT DISTINCT bucket FROM bucket ORDER BY bucket")
+	if err != nil {
+		return nil, fmt.Errorf("generic.Buckets: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []string
+	for rows.Next() {
+		var bucket string
+		if err := rows.Scan(&bucket); err != nil {
+			return nil, fmt.Errorf("generic.Buckets: failed to scan: %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("generic.Buckets: failed to read: %w", err)
+	}
+
+	return buckets, nil
+}
+
+func (d *Driver) BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	err := d.queryRow(ctx, d.db, "SELECT value FROM bucket WHERE bucket = ? AND name = ?", bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("generic.BucketGet: %w", driver.ErrKeyNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generic.BucketGet: failed to query: %w", err)
+	}
+
+	return value, nil
+}
+
+func (d *Driver) BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error {
+	if _, err := d.exec(ctx, d.db, d.dialect.UpsertBucket, bucket, key, value); err != nil {
+		return fmt.Errorf("generic.BucketPut: failed to upsert: %w", d.classify(err))
+	}
+
+	return nil
+}
+
+func (d *Driver) BucketDelete(ctx context.Context, bucket string, key []byte) error {
+	if _, err := d.exec(ctx, d.db, "DELETE FROM bucket WHERE bucket = ? AND name = ?", bucket, key); err != nil {
+		return fmt.Errorf("generic.BucketDelete: failed to delete: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Driver) BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error {
+	rows, err := d.query(ctx, d.db, "SELECT name, value FROM bucket WHERE bucket = ? ORDER BY name", bucket)
+	if err != nil {
+		return fmt.Errorf("generic.BucketForEach: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return fmt.Errorf("generic.BucketForEach: failed to scan: %w", err)
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("generic.BucketForEach: failed to read: %w", err)
+	}
+
+	return nil
+}
+
+// Poll asks the poller to publish new revisions now rather than at the
+// next interval.
+func (d *Driver) Poll() {
+	select {
+	case d.pollCh <- struct{}{}:
+	default:
+	}
+}
+
+// poll publishes committed revisions to the watch hub. Local commits
+// trigger it immediately; the interval picks up writes made by other
+// processes sharing the database.
+func (d *Driver) poll() {
+	defer close(d.polled)
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.pollCh:
+		case <-d.stop:
+			return
+		}
+
+		d.publishMu.Lock()
+		err := d.publish(context.Background())
+		d.publishMu.Unlock()
+		if err != nil {
+			d.log.Error("generic.poll: failed to publish events", "error", err)
+		}
+	}
+}
+
+// publish hands the events committed since the last call to the watch hub.
+// It must be called with publishMu held.
+func (d *Driver) publish(ctx context.Context) error {
+	current, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if current <= d.published {
+		return nil
+	}
+
+	var events []*driver.WatchEvent
+	if err := d.History(ctx, d.published+1, func(ev *driver.WatchEvent) error {
+		if ev.KV.ModRevision > current {
+			return errStopHistory
+		}
+		events = append(events, ev)
+		return nil
+	}); err != nil && !errors.Is(err, errStopHistory) {
+		return err
+	}
+
+	d.hub.Notify(events)
+	d.published = current
+
+	return nil
+}
+
+var errStopHistory = errors.New("stop history")
@@ -0,0 +1,255 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// row is a single version of a key in the kv log table.
+type row struct {
+	id             int64
+	name           []byte
+	revision       int64
+	createRevision int64
+	prevRevision   int64
+	prevID         int64
+	version        int64
+	lease          int64
+	deleted        int64
+	value          []byte
+}
+
+func (r *row) keyValue() *driver.KeyValue {
+	if r.deleted != 0 {
+		return &driver.KeyValue{
+			Key:         r.name,
+			ModRevision: r.revision,
+		}
+	}
+	return &driver.KeyValue{
+		Key:            r.name,
+		Value:          r.value,
+		CreateRevision: r.createRevision,
+		ModRevision:    r.revision,
+		Version:        r.version,
+		Lease:          r.lease,
+	}
+}
+
+type sqlTxn struct {
+	ctx context.Context
+	d   *Driver
+	tx  *sql.Tx
+	// current is the last committed revision and revision the one writes
+	// in this transaction are made at.
+	current  int64
+	compact  int64
+	revision int64
+	written  bool
+}
+
+func (d *Driver) newTxn(ctx context.Context, tx *sql.Tx) (*sqlTxn, error) {
+	current, err := d.meta(ctx, tx, "revision")
+	if err != nil {
+		return nil, err
+	}
+	compact, err := d.meta(ctx, tx, "compact")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTxn{
+		ctx:      ctx,
+		d:        d,
+		tx:       tx,
+		current:  current,
+		compact:  compact,
+		revision: current + 1,
+	}, nil
+}
+
+func (t *sqlTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	if opts.Revision > t.current {
+		return nil, driver.ErrFutureRevision
+	}
+	if opts.Revision > 0 && opts.Revision < t.compact {
+		return nil, driver.ErrCompacted
+	}
+
+	// Reading at the transaction's own revision includes its writes. Without
+	// writes, stop at current: a read-only transaction may not be a snapshot
+	// and could otherwise see a revision committed after current was read.
+	revision := opts.Revision
+	if revision <= 0 {
+		revision = t.current
+		if t.written {
+			revision = t.revision
+		}
+	}
+
+	latest, args := latestQuery(key, end, revision)
+
+	result := &driver.RangeResult{
+		Revision: t.current,
+	}
+	if err := t.d.queryRow(t.ctx, t.tx,
+		"SELECT COUNT(*) FROM kv JOIN ("+latest+") latest ON kv.id = latest.id WHERE kv.deleted = 0",
+		args...,
+	).Scan(&result.Count); err != nil {
+		return nil, fmt.Errorf("failed to count: %w", err)
+	}
+	if opts.CountOnly || result.Count == 0 {
+		return result, nil
+	}
+
+	rows, err := t.liveRows(latest, args, opts.Limit, opts.KeysOnly)
+	if err != nil {
+		return nil, err
+	}
+	result.KVs = make([]driver.KeyValue, len(rows))
+	for i, r := range rows {
+		result.KVs[i] = *r.keyValue()
+	}
+
+	return result, nil
+}
+
+func (t *sqlTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	prev, err := t.latest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &row{
+		name:           key,
+		revision:       t.revision,
+		createRevision: t.revision,
+		version:        1,
+		lease:          lease,
+		value:          value,
+	}
+	var prevKV *driver.KeyValue
+	if prev != nil && prev.deleted == 0 {
+		r.createRevision = prev.createRevision
+		r.version = prev.version + 1
+		prevKV = prev.keyValue()
+	}
+	if err := t.insert(r, prev); err != nil {
+		return nil, err
+	}
+
+	return prevKV, nil
+}
+
+func (t *sqlTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	latest, args := latestQuery(key, end, t.revision)
+	rows, err := t.liveRows(latest, args, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]driver.KeyValue, 0, len(rows))
+	for _, prev := range rows {
+		if err := t.insert(&row{
+			name:     prev.name,
+			revision: t.revision,
+			deleted:  1,
+		}, prev); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, *prev.keyValue())
+	}
+
+	return deleted, nil
+}
+
+// insert appends r to the log, linking it to prev, the version it supersedes.
+func (t *sqlTxn) insert(r *row, prev *row) error {
+	if prev != nil {
+		r.prevRevision = prev.revision
+		r.prevID = prev.id
+	}
+
+	if _, err := t.d.exec(t.ctx, t.tx,
+		"INSERT INTO kv (name, revision, create_revision, prev_revision, prev_id, version, lease, deleted, value) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.name, r.revision, r.createRevision, r.prevRevision, r.prevID, r.version, r.lease, r.deleted, r.value,
+	); err != nil {
+		return fmt.Errorf("failed to insert: %w", err)
+	}
+	t.written = true
+
+	return nil
+}
+
+// latest returns the newest version of key, which may be a tombstone.
+func (t *sqlTxn) latest(key []byte) (*row, error) {
+	rows, err := t.scan("SELECT "+kvColumns+" FROM kv WHERE name = ? ORDER BY id DESC LIMIT 1", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0], nil
+}
+
+// liveRows reads the rows latest selects, leaving the values out with
+// keysOnly.
+func (t *sqlTxn) liveRows(latest string, args []any, limit int64, keysOnly bool) ([]*row, error) {
+	columns := kvColumns
+	if keysOnly {
+		columns = kvKeyColumns
+	}
+	query := "SELECT " + columns + " FROM kv JOIN (" + latest + ") latest ON kv.id = latest.id WHERE kv.deleted = 0 ORDER BY kv.name"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return t.scan(query, args...)
+}
+
+func (t *sqlTxn) scan(query string, args ...any) ([]*row, error) {
+	rows, err := t.d.query(t.ctx, t.tx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	var result []*row
+	for rows.Next() {
+		r := &row{}
+		if err := rows.Scan(&r.id, &r.name, &r.revision, &r.createRevision, &r.prevRevision, &r.prevID, &r.version, &r.lease, &r.deleted, &r.value); err != nil {
+			return nil, fmt.Errorf("failed to scan: %w", err)
+		}
+		result = append(result, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+
+	return result, nil
+}
+
+// latestQuery selects the id of the newest version at or before revision of
+// every key in the etcd style range [key, end).
+func latestQuery(key []byte, end []byte, revision int64) (string, []any) {
+	var (
+		cond string
+		args []any
+	)
+	switch {
+	case len(end) == 0:
+		cond, args = "name = ?", []any{key}
+	case driver.IsOpenEnd(end):
+		cond, args = "name >= ?", []any{key}
+	default:
+		cond, args = "name >= ? AND name < ?", []any{key, end}
+	}
+
+	return "SELECT MAX(id) AS id FROM kv WHERE " + cond + " AND revision <= ? GROUP BY name", append(args, revision)
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"sort"
+)
+
+var errStopHistory = errors.New("stop history")
+
+// HashKV returns a CRC-32C checksum over the keys as of compactRevision
+// followed by the events after it, up to and including revision. Drivers
+// retain different amounts of history before their compaction, so two
+// drivers only hash alike at a compactRevision both have reached. A zero
+// compactRevision hashes the whole history.
+func HashKV(ctx context.Context, d Driver, compactRevision int64, revision int64) (uint32, error) {
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+
+	if compactRevision > 0 {
+		res, err := d.Range(ctx, []byte{0}, []byte{0}, RangeOptions{Revision: compactRevision})
+		if err != nil {
+			return 0, fmt.Errorf("driver.HashKV: failed to read keys at revision %d: %w", compactRevision, err)
+		}
+		for i := range res.KVs {
+			writeKV(h, &res.KVs[i], false)
+		}
+	}
+
+	err := d.History(ctx, compactRevision+1, func(ev *WatchEvent) error {
+		if ev.KV.ModRevision > revision {
+			return errStopHistory
+		}
+		if ev.KV.ModRevision <= compactRevision {
+			return nil
+		}
+		writeKV(h, ev.KV, ev.Deleted)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopHistory) {
+		return 0, fmt.Errorf("driver.HashKV: failed to read history: %w", err)
+	}
+
+	return h.Sum32(), nil
+}
+
+func writeKV(h hash.Hash32, kv *KeyValue, deleted bool) {
+	var flags byte
+	if deleted {
+		flags = 1
+	}
+	writeInt(h, kv.ModRevision)
+	writeBytes(h, kv.Key)
+	h.Write([]byte{flags})
+	if !deleted {
+		writeInt(h, kv.CreateRevision)
+		writeInt(h, kv.Version)
+		writeInt(h, kv.Lease)
+		writeBytes(h, kv.Value)
+	}
+}
+
+// HashBuckets returns a CRC-32C checksum over the contents of every bucket.
+func HashBuckets(ctx context.Context, d Driver) (uint32, error) {
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+
+	buckets, err := d.Buckets(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("driver.HashBuckets: failed to list buckets: %w", err)
+	}
+	sort.Strings(buckets)
+
+	for _, bucket := range buckets {
+		writeBytes(h, []byte(bucket))
+		if err := d.BucketForEach(ctx, bucket, func(key []byte, value []byte) error {
+			writeBytes(h, key)
+			writeBytes(h, value)
+			return nil
+		}); err != nil {
+			return 0, fmt.Errorf("driver.HashBuckets: failed to read bucket %q: %w", bucket, err)
+		}
+	}
+
+	return h.Sum32(), nil
+}
+
+func writeInt(h hash.Hash32, v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	h.Write(buf[:])
+}
+
+func writeBytes(h hash.Hash32, b []byte) {
+	writeInt(h, int64(len(b)))
+	h.Write(b)
+}
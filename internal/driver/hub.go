@@ -0,0 +1,208 @@
+package driver
+
+import (
+	"context"
+	"sync"
+)
+
+// maxPendingEvents bounds how far a watcher may fall behind before it is
+// dropped.
+const maxPendingEvents = 100000
+
+// HistoryFunc replays committed events, see Driver.History.
+type HistoryFunc func(ctx context.Context, startRevision int64, fn func(ev *WatchEvent) error) error
+
+// WatchHub fans committed events out to watchers. Drivers whose writes all
+// go through the local process can use it to implement Driver.Watch.
+type WatchHub struct {
+	mu       sync.Mutex
+	watchers map[*hubWatcher]struct{}
+	closed   bool
+}
+
+func NewWatchHub() *WatchHub {
+	return &WatchHub{
+		watchers: map[*hubWatcher]struct{}{},
+	}
+}
+
+type hubWatcher struct {
+	key     []byte
+	end     []byte
+	mu      sync.Mutex
+	pending []*WatchEvent
+	dropped bool
+	notify  chan struct{}
+}
+
+// Notify publishes the events committed by a transaction in commit order.
+func (h *WatchHub) Notify(events []*WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		w.push(events)
+	}
+}
+
+// Progress queues a progress event at revision for every watcher, after the
+// events already queued. All events up to revision must have been passed to
+// Notify.
+func (h *WatchHub) Progress(revision int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watchers {
+		w.push([]*WatchEvent{{Progress: revision}})
+	}
+}
+
+// Close drops every watcher, closing their channels, and refuses new ones.
+func (h *WatchHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for w := range h.watchers {
+		w.drop()
+	}
+}
+
+// Watch registers a watcher for [key, end). When startRevision is set the
+// events committed before registration are replayed through history first.
+func (h *WatchHub) Watch(ctx context.Context, key []byte, end []byte, startRevision int64, history HistoryFunc) <-chan *WatchEvent {
+	w := &hubWatcher{
+		key:    key,
+		end:    end,
+		notify: make(chan struct{}, 1),
+	}
+	ch := make(chan *WatchEvent)
+
+	h.mu.Lock()
+	if h.closed {
+		w.dropped = true
+	}
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer func() {
+			h.mu.Lock()
+			delete(h.watchers, w)
+			h.mu.Unlock()
+		}()
+
+		send := func(ev *WatchEvent, last bool) bool {
+			if last {
+				marked := *ev
+				marked.Last = true
+				ev = &marked
+			}
+			select {
+			case ch <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var lastRevision int64
+		if startRevision > 0 {
+			lastRevision = startRevision - 1
+			// Each event is held back until the next one shows whether it
+			// ends its revision.
+			var held *WatchEvent
+			if err := history(ctx, startRevision, func(ev *WatchEvent) error {
+				if !InRange(ev.KV.Key, key, end) {
+					return nil
+				}
+				if held != nil && !send(held, held.KV.ModRevision != ev.KV.ModRevision) {
+					return ctx.Err()
+				}
+				held = ev
+				lastRevision = ev.KV.ModRevision
+				return nil
+			}); err != nil {
+				return
+			}
+			if held != nil && !send(held, true) {
+				return
+			}
+		}
+
+		for {
+			events, ok := w.take()
+			if !ok {
+				return
+			}
+			// Notify queues whole revisions, so the pending events end with
+			// the last event of a revision.
+			for i, ev := range events {
+				if ev.KV != nil && ev.KV.ModRevision <= lastRevision {
+					continue
+				}
+				last := ev.KV != nil && (i == len(events)-1 || events[i+1].KV == nil || events[i+1].KV.ModRevision != ev.KV.ModRevision)
+				if !send(ev, last) {
+					return
+				}
+			}
+
+			select {
+			case <-w.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (w *hubWatcher) push(events []*WatchEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.dropped {
+		return
+	}
+	for _, ev := range events {
+		if ev.KV == nil || InRange(ev.KV.Key, w.key, w.end) {
+			w.pending = append(w.pending, ev)
+		}
+	}
+	if len(w.pending) > maxPendingEvents {
+		w.pending = nil
+		w.dropped = true
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *hubWatcher) drop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = nil
+	w.dropped = true
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *hubWatcher) take() ([]*WatchEvent, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := w.pending
+	w.pending = nil
+	return events, !w.dropped
+}
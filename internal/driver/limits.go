@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultQuotaInterval is the default of Limits.QuotaInterval.
+const defaultQuotaInterval = time.Second
+
+// Limits bounds the keys and values written through a driver. Zero fields
+// are unlimited.
+type Limits struct {
+	MaxKeyBytes   int
+	MaxValueBytes int
+	// QuotaBytes rejects puts with ErrNoSpace once the database reaches the
+	// size, as etcd's --quota-backend-bytes does. Deletes are still allowed.
+	// It requires a driver implementing Sizer.
+	QuotaBytes int64
+	// QuotaInterval is how long the database size checked against the quota
+	// is reused before asking the driver again. Zero means a second.
+	QuotaInterval time.Duration
+}
+
+// WithLimits returns drv rejecting puts that exceed limits with
+// ErrRequestTooLarge or ErrNoSpace. Of the optional interfaces only
+// ProgressRequester is kept.
+func WithLimits(drv Driver, limits Limits) (Driver, error) {
+	if limits.MaxKeyBytes <= 0 && limits.MaxValueBytes <= 0 && limits.QuotaBytes <= 0 {
+		return drv, nil
+	}
+	d := &limitedDriver{Driver: drv, limits: limits}
+	if limits.QuotaBytes > 0 {
+		sizer, ok := drv.(Sizer)
+		if !ok {
+			return nil, fmt.Errorf("driver.WithLimits: the driver cannot report its size for the quota")
+		}
+		d.quota = &quota{sizer: sizer, bytes: limits.QuotaBytes, interval: limits.QuotaInterval}
+		if d.quota.interval <= 0 {
+			d.quota.interval = defaultQuotaInterval
+		}
+	}
+	if pr, ok := drv.(ProgressRequester); ok {
+		return &limitedProgressDriver{limitedDriver: d, pr: pr}, nil
+	}
+	return d, nil
+}
+
+type limitedDriver struct {
+	Driver
+	limits Limits
+	quota  *quota
+}
+
+func (d *limitedDriver) Txn(ctx context.Context, fn func(txn Txn) error) (int64, error) {
+	// The size is read before the transaction, as some drivers cannot
+	// report it while writing.
+	var full error
+	if d.quota != nil {
+		full = d.quota.check(ctx)
+	}
+	return d.Driver.Txn(ctx, func(txn Txn) error {
+		return fn(&limitedTxn{Txn: txn, limits: d.limits, quota: d.quota, full: full})
+	})
+}
+
+type limitedProgressDriver struct {
+	*limitedDriver
+	pr ProgressRequester
+}
+
+func (d *limitedProgressDriver) RequestProgress(ctx context.Context) error {
+	return d.pr.RequestProgress(ctx)
+}
+
+// quota caches the size of the database for interval, adding the puts
+// made meanwhile.
+type quota struct {
+	sizer    Sizer
+	bytes    int64
+	interval time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	checked time.Time
+}
+
+// check returns ErrNoSpace if the database has reached the quota.
+func (q *quota) check(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if time.Since(q.checked) >= q.interval {
+		size, err := q.sizer.Size(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check quota: %w", err)
+		}
+		q.size, q.checked = size, time.Now()
+	}
+	if q.size >= q.bytes {
+		return fmt.Errorf("%w: database size %d reached the quota of %d bytes", ErrNoSpace, q.size, q.bytes)
+	}
+	return nil
+}
+
+// add counts n bytes written since the size was read.
+func (q *quota) add(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size += int64(n)
+}
+
+type limitedTxn struct {
+	Txn
+	limits Limits
+	quota  *quota
+	// full is the error puts fail with when the quota is reached.
+	full error
+}
+
+func (t *limitedTxn) Put(key []byte, value []byte, lease int64) (*KeyValue, error) {
+	if n := t.limits.MaxKeyBytes; n > 0 && len(key) > n {
+		return nil, fmt.Errorf("%w: key of %d bytes exceeds %d", ErrRequestTooLarge, len(key), n)
+	}
+	if n := t.limits.MaxValueBytes; n > 0 && len(value) > n {
+		return nil, fmt.Errorf("%w: value of %d bytes exceeds %d", ErrRequestTooLarge, len(value), n)
+	}
+	if t.full != nil {
+		return nil, t.full
+	}
+	kv, err := t.Txn.Put(key, value, lease)
+	if err == nil && t.quota != nil {
+		t.quota.add(len(key) + len(value))
+	}
+	return kv, err
+}
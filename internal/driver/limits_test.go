@@ -0,0 +1,107 @@
+package driver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// sizedDriver reports a size set by the test.
+type sizedDriver struct {
+	driver.Driver
+	size atomic.Int64
+}
+
+func (d *sizedDriver) Size(ctx context.Context) (int64, error) {
+	return d.size.Load(), nil
+}
+
+func newMemory(t *testing.T) driver.Driver {
+	t.Helper()
+	d, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func put(d driver.Driver, key string, value []byte) error {
+	_, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), value, 0)
+		return err
+	})
+	return err
+}
+
+func TestWithLimits(t *testing.T) {
+	d, err := driver.WithLimits(newMemory(t), driver.Limits{MaxKeyBytes: 4, MaxValueBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(d, "k", bytes.Repeat([]byte("v"), 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(d, "kkkkk", nil); !errors.Is(err, driver.ErrRequestTooLarge) {
+		t.Errorf("put of a long key returned %v, want %v", err, driver.ErrRequestTooLarge)
+	}
+	if err := put(d, "k", bytes.Repeat([]byte("v"), 9)); !errors.Is(err, driver.ErrRequestTooLarge) {
+		t.Errorf("put of a long value returned %v, want %v", err, driver.ErrRequestTooLarge)
+	}
+
+	if _, err := driver.WithLimits(newMemory(t), driver.Limits{QuotaBytes: 1}); err == nil {
+		t.Error("WithLimits accepted a quota for a driver without Sizer")
+	}
+}
+
+func TestWithLimitsQuota(t *testing.T) {
+	sized := &sizedDriver{Driver: newMemory(t)}
+	sized.size.Store(50)
+	d, err := driver.WithLimits(sized, driver.Limits{QuotaBytes: 100, QuotaInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := put(d, "a", bytes.Repeat([]byte("v"), 60)); err != nil {
+		t.Fatalf("put under the quota: %v", err)
+	}
+	// The size is cached, but the bytes put since are counted.
+	if err := put(d, "b", nil); !errors.Is(err, driver.ErrNoSpace) {
+		t.Errorf("put over the quota returned %v, want %v", err, driver.ErrNoSpace)
+	}
+
+	_, err = d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.DeleteRange([]byte("a"), nil)
+		return err
+	})
+	if err != nil {
+		t.Errorf("delete over the quota: %v", err)
+	}
+}
+
+func TestWithLimitsQuotaInterval(t *testing.T) {
+	sized := &sizedDriver{Driver: newMemory(t)}
+	// Every transaction reads the size again.
+	d, err := driver.WithLimits(sized, driver.Limits{QuotaBytes: 100, QuotaInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sized.size.Store(100)
+	if err := put(d, "a", nil); !errors.Is(err, driver.ErrNoSpace) {
+		t.Errorf("put at the quota returned %v, want %v", err, driver.ErrNoSpace)
+	}
+	// Once the size is read again, the freed space can be used.
+	sized.size.Store(50)
+	if err := put(d, "a", nil); err != nil {
+		t.Errorf("put after space was freed: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/drivertest"
+)
+
+// TestDriver runs against the database of ETCD_SHIM_TEST_MYSQL_DSN,
+// dropping the tables of the driver before every test. The mysql profile of
+// compose.yaml starts one:
+//
+//	docker compose --profile mysql up -d mysql
+//	ETCD_SHIM_TEST_MYSQL_DSN='etcd:etcd@tcp(localhost:3306)/etcd' go test ./internal/driver/mysql
+func TestDriver(t *testing.T) {
+	dsn := os.Getenv("ETCD_SHIM_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("ETCD_SHIM_TEST_MYSQL_DSN is not set")
+	}
+
+	drivertest.Run(t, func(t *testing.T) driver.Driver {
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(`DROP TABLE IF EXISTS kv, meta, bucket`); err != nil {
+			t.Fatal(err)
+		}
+
+		var conf config.DriverConfig
+		conf.MySQL = config.MySQLConfig{DSN: dsn, MaxOpenConns: 10, PollInterval: time.Second}
+		d, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
@@ -0,0 +1,106 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/generic"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+)
+
+// Keys are limited to 2048 bytes so that the (name, id) index stays within
+// InnoDB's 3072 byte key limit.
+var dialect = &generic.Dialect{
+	Name: "mysql",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS kv (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			name VARBINARY(2048) NOT NULL,
+			revision BIGINT NOT NULL,
+			create_revision BIGINT NOT NULL,
+			prev_revision BIGINT NOT NULL,
+			prev_id BIGINT NOT NULL,
+			version BIGINT NOT NULL,
+			lease BIGINT NOT NULL,
+			deleted INTEGER NOT NULL,
+			value LONGBLOB,
+			INDEX kv_name_id (name, id),
+			INDEX kv_revision (revision)
+		) ENGINE=InnoDB`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			name VARCHAR(64) NOT NULL PRIMARY KEY,
+			value BIGINT NOT NULL
+		) ENGINE=InnoDB`,
+		`INSERT IGNORE INTO meta (name, value) VALUES ('revision', 0), ('compact', 0)`,
+		`CREATE TABLE IF NOT EXISTS bucket (
+			bucket VARBINARY(255) NOT NULL,
+			name VARBINARY(2048) NOT NULL,
+			value LONGBLOB,
+			PRIMARY KEY (bucket, name)
+		) ENGINE=InnoDB`,
+	},
+	LockRevision: `SELECT value FROM meta WHERE name = 'revision' FOR UPDATE`,
+	UpsertBucket: `INSERT INTO bucket (bucket, name, value) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)`,
+	Size:         `SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()`,
+	IsRetryable: func(err error) bool {
+		var e *mysql.MySQLError
+		if !errors.As(err, &e) {
+			return false
+		}
+		// ER_LOCK_DEADLOCK and ER_LOCK_WAIT_TIMEOUT.
+		return e.Number == 1213 || e.Number == 1205
+	},
+	IsNoSpace: func(err error) bool {
+		var e *mysql.MySQLError
+		// ER_DISK_FULL and ER_RECORD_FILE_FULL.
+		return errors.As(err, &e) && (e.Number == 1021 || e.Number == 1114)
+	},
+}
+
+func init() {
+	registry.Register("mysql", New)
+	registry.RegisterCheck("mysql", check)
+}
+
+func check(conf config.DriverConfig) error {
+	if conf.MySQL.DSN == "" {
+		return fmt.Errorf("mysql.check: a DSN is required")
+	}
+	if _, err := mysql.ParseDSN(conf.MySQL.DSN); err != nil {
+		return fmt.Errorf("mysql.check: failed to parse dsn: %w", err)
+	}
+	return nil
+}
+
+// New opens the MySQL driver. MySQL has no notification channel, so writes
+// made by other processes reach watchers on the next poll.
+func New(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	if conf.MySQL.DSN == "" {
+		return nil, fmt.Errorf("mysql.New: a DSN is required")
+	}
+
+	db, err := sql.Open("mysql", conf.MySQL.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("mysql.New: failed to open database: %w", err)
+	}
+	db.SetMaxOpenConns(conf.MySQL.MaxOpenConns)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mysql.New: failed to connect: %w", err)
+	}
+
+	d, err := generic.New(ctx, log, db, dialect, conf.MySQL.PollInterval)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mysql.New: %w", err)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/generic"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+)
+
+const (
+	channel = "etcd_shim"
+
+	listenRetryInterval = 5 * time.Second
+)
+
+var dialect = &generic.Dialect{
+	Name: "postgres",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS kv (
+			id BIGSERIAL PRIMARY KEY,
+			name BYTEA NOT NULL,
+			revision BIGINT NOT NULL,
+			create_revision BIGINT NOT NULL,
+			prev_revision BIGINT NOT NULL,
+			prev_id BIGINT NOT NULL,
+			version BIGINT NOT NULL,
+			lease BIGINT NOT NULL,
+			deleted INTEGER NOT NULL,
+			value BYTEA
+		)`,
+		`CREATE INDEX IF NOT EXISTS kv_name_id ON kv (name, id)`,
+		`CREATE INDEX IF NOT EXISTS kv_revision ON kv (revision)`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			name TEXT PRIMARY KEY,
+			value BIGINT NOT NULL
+		)`,
+		`INSERT INTO meta (name, value) VALUES ('revision', 0), ('compact', 0) ON CONFLICT (name) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS bucket (
+			bucket TEXT NOT NULL,
+			name BYTEA NOT NULL,
+			value BYTEA,
+			PRIMARY KEY (bucket, name)
+		)`,
+	},
+	LockRevision:         `SELECT value FROM meta WHERE name = 'revision' FOR UPDATE`,
+	Notify:               `NOTIFY ` + channel,
+	UpsertBucket:         `INSERT INTO bucket (bucket, name, value) VALUES (?, ?, ?) ON CONFLICT (bucket, name) DO UPDATE SET value = excluded.value`,
+	Size:                 `SELECT pg_database_size(current_database())`,
+	NumberedPlaceholders: true,
+	IsRetryable: func(err error) bool {
+		var e *pgconn.PgError
+		if !errors.As(err, &e) {
+			return false
+		}
+		// serialization_failure and deadlock_detected.
+		return e.Code == "40001" || e.Code == "40P01"
+	},
+	IsNoSpace: func(err error) bool {
+		var e *pgconn.PgError
+		// disk_full.
+		return errors.As(err, &e) && e.Code == "53100"
+	},
+}
+
+func init() {
+	registry.Register("postgres", New)
+	registry.RegisterCheck("postgres", check)
+}
+
+func check(conf config.DriverConfig) error {
+	if _, err := parseDSN(conf.Postgres.DSN); err != nil {
+		return fmt.Errorf("postgres.check: %w", err)
+	}
+	return nil
+}
+
+// parseDSN parses dsn, reading the TLS files it names.
+func parseDSN(dsn string) (*pgx.ConnConfig, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("a DSN is required")
+	}
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dsn: %w", err)
+	}
+	return connConfig, nil
+}
+
+func New(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	connConfig, err := parseDSN(conf.Postgres.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("postgres.New: %w", err)
+	}
+
+	db := stdlib.OpenDB(*connConfig)
+	db.SetMaxOpenConns(conf.Postgres.MaxOpenConns)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres.New: failed to connect: %w", err)
+	}
+
+	d, err := generic.New(ctx, log, db, dialect, conf.Postgres.PollInterval)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres.New: %w", err)
+	}
+
+	go listen(log, connConfig, d)
+
+	return d, nil
+}
+
+// listen wakes the poller whenever any process commits a revision, so
+// watchers see writes from other shims without waiting for the poll
+// interval. The interval remains the fallback while the listener is down.
+func listen(log *slog.Logger, connConfig *pgx.ConnConfig, d *generic.Driver) {
+	ctx := context.Background()
+	for {
+		if err := waitForNotifications(ctx, connConfig, d); err != nil {
+			log.Warn("postgres.listen: listener failed, retrying", "error", err)
+		}
+		time.Sleep(listenRetryInterval)
+	}
+}
+
+func waitForNotifications(ctx context.Context, connConfig *pgx.ConnConfig, d *generic.Driver) error {
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	// Notifications sent while reconnecting are lost.
+	d.Poll()
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		d.Poll()
+	}
+}
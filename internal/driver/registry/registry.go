@@ -4,26 +4,60 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"sort"
 
+	"github.com/aplulu/etcd-shim/internal/config"
 	"github.com/aplulu/etcd-shim/internal/driver"
 )
 
-type NewDriverFn func(ctx context.Context, log *slog.Logger) (driver.Driver, error)
+type NewDriverFn func(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error)
+
+// CheckFn validates the settings of a driver without opening its store.
+type CheckFn func(conf config.DriverConfig) error
 
 var (
 	ErrDriverNotFound = errors.New("driver not found")
 
 	driverRegistry = map[string]NewDriverFn{}
+	checkRegistry  = map[string]CheckFn{}
 )
 
 func Register(name string, fn NewDriverFn) {
 	driverRegistry[name] = fn
 }
 
-func NewDriver(name string, ctx context.Context, log *slog.Logger) (driver.Driver, error) {
+// RegisterCheck sets the check Check runs for the driver of name.
+func RegisterCheck(name string, fn CheckFn) {
+	checkRegistry[name] = fn
+}
+
+func NewDriver(name string, ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
 	fn, ok := driverRegistry[name]
 	if !ok {
 		return nil, ErrDriverNotFound
 	}
-	return fn(ctx, log)
+	return fn(ctx, log, conf)
+}
+
+// Check validates conf for the driver of name, so a bad setting is
+// reported before anything is opened. Drivers without a check accept any
+// settings here.
+func Check(name string, conf config.DriverConfig) error {
+	if _, ok := driverRegistry[name]; !ok {
+		return ErrDriverNotFound
+	}
+	if fn, ok := checkRegistry[name]; ok {
+		return fn(conf)
+	}
+	return nil
+}
+
+// Drivers returns the names of the registered drivers in sorted order.
+func Drivers() []string {
+	names := make([]string, 0, len(driverRegistry))
+	for name := range driverRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
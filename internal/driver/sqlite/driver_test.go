@@ -0,0 +1,26 @@
+package sqlite
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/drivertest"
+)
+
+func TestDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) driver.Driver {
+		conf := config.DefaultDriverConfig()
+		conf.SQLite.Path = filepath.Join(t.TempDir(), "etcd-shim.db")
+		d, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
@@ -0,0 +1,96 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/generic"
+	"github.com/aplulu/etcd-shim/internal/driver/registry"
+)
+
+const memoryPath = ":memory:"
+
+var dialect = &generic.Dialect{
+	Name: "sqlite",
+	Schema: []string{
+		`CREATE TABLE IF NOT EXISTS kv (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name BLOB NOT NULL,
+			revision INTEGER NOT NULL,
+			create_revision INTEGER NOT NULL,
+			prev_revision INTEGER NOT NULL,
+			prev_id INTEGER NOT NULL,
+			version INTEGER NOT NULL,
+			lease INTEGER NOT NULL,
+			deleted INTEGER NOT NULL,
+			value BLOB
+		)`,
+		`CREATE INDEX IF NOT EXISTS kv_name_id ON kv (name, id)`,
+		`CREATE INDEX IF NOT EXISTS kv_revision ON kv (revision)`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		)`,
+		`INSERT INTO meta (name, value) VALUES ('revision', 0), ('compact', 0) ON CONFLICT (name) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS bucket (
+			bucket TEXT NOT NULL,
+			name BLOB NOT NULL,
+			value BLOB,
+			PRIMARY KEY (bucket, name)
+		)`,
+	},
+	UpsertBucket: `INSERT INTO bucket (bucket, name, value) VALUES (?, ?, ?) ON CONFLICT (bucket, name) DO UPDATE SET value = excluded.value`,
+	Size:         `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`,
+	IsRetryable: func(err error) bool {
+		var e *sqlite.Error
+		if !errors.As(err, &e) {
+			return false
+		}
+		code := e.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	},
+	IsNoSpace: func(err error) bool {
+		var e *sqlite.Error
+		return errors.As(err, &e) && e.Code()&0xff == sqlite3.SQLITE_FULL
+	},
+}
+
+func init() {
+	registry.Register("sqlite", New)
+}
+
+func New(ctx context.Context, log *slog.Logger, conf config.DriverConfig) (driver.Driver, error) {
+	path := conf.SQLite.Path
+	if path != memoryPath {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("sqlite.New: failed to create directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("sqlite.New: failed to open database: %w", err)
+	}
+	if path == memoryPath {
+		// Every connection to :memory: opens a separate database.
+		db.SetMaxOpenConns(1)
+	}
+
+	d, err := generic.New(ctx, log, db, dialect, conf.SQLite.PollInterval)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite.New: %w", err)
+	}
+
+	return d, nil
+}
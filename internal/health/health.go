@@ -0,0 +1,156 @@
+// Package health checks that the server can serve requests, for the HTTP
+// probes and the grpc.health.v1 service. The checks follow etcd's /health:
+// active alarms fail them, and so does a read of the driver that errors or
+// times out.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/aplulu/etcd-shim/internal/alarm"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// grpcInterval is how often the status of the gRPC health service is
+// refreshed.
+const grpcInterval = 5 * time.Second
+
+// healthKey is the key read by the checks, as etcdctl endpoint health does.
+var healthKey = []byte("health")
+
+type Checker struct {
+	log     *slog.Logger
+	drv     driver.Driver
+	alarms  *alarm.Store
+	timeout time.Duration
+}
+
+func New(log *slog.Logger, drv driver.Driver, alarms *alarm.Store, timeout time.Duration) *Checker {
+	return &Checker{log: log, drv: drv, alarms: alarms, timeout: timeout}
+}
+
+type Options struct {
+	// Serializable skips confirming the current revision before the read.
+	Serializable bool
+	// SkipAlarms ignores every alarm, Exclude only the named ones, e.g.
+	// NOSPACE.
+	SkipAlarms bool
+	Exclude    map[string]bool
+}
+
+// optionsFromQuery reads the serializable and exclude parameters of etcd's
+// /health.
+func optionsFromQuery(r *http.Request, base Options) Options {
+	q := r.URL.Query()
+	opts := base
+	if q.Get("serializable") == "true" {
+		opts.Serializable = true
+	}
+	if exclude := q["exclude"]; len(exclude) > 0 {
+		opts.Exclude = map[string]bool{}
+		for _, a := range exclude {
+			opts.Exclude[a] = true
+		}
+	}
+	return opts
+}
+
+// Check returns why the server is unhealthy, or an empty string if it is
+// healthy. The reasons are etcd's.
+func (c *Checker) Check(ctx context.Context, opts Options) string {
+	if !opts.SkipAlarms {
+		for _, a := range c.alarms.List() {
+			if !opts.Exclude[a.String()] {
+				return "ALARM " + a.String()
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var revision int64
+	if !opts.Serializable {
+		var err error
+		if revision, err = c.drv.CurrentRevision(ctx); err != nil {
+			return "QGET ERROR:" + err.Error()
+		}
+	}
+	if _, err := c.drv.Range(ctx, healthKey, nil, driver.RangeOptions{Revision: revision, Limit: 1}); err != nil {
+		return "QGET ERROR:" + err.Error()
+	}
+
+	return ""
+}
+
+// HealthHandler serves etcd's /health JSON, with 503 when unhealthy.
+func (c *Checker) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := c.Check(r.Context(), optionsFromQuery(r, Options{}))
+		res := struct {
+			Health string `json:"health"`
+			Reason string `json:"reason"`
+		}{Health: "true", Reason: reason}
+		if reason != "" {
+			res.Health = "false"
+			c.log.WarnContext(r.Context(), "Health check failed", "reason", reason)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			c.log.ErrorContext(r.Context(), "failed to write response", "error", err)
+		}
+	})
+}
+
+// ProbeHandler serves a plain text probe checking with base: ok, or the
+// reason with 503.
+func (c *Checker) ProbeHandler(base Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "ok"
+		if reason := c.Check(r.Context(), optionsFromQuery(r, base)); reason != "" {
+			body = reason
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			c.log.ErrorContext(r.Context(), "failed to write response", "error", err)
+		}
+	})
+}
+
+// RegisterGRPC registers the grpc.health.v1 service on gs. Its status is
+// refreshed with the full check until ctx is done, and NOT_SERVING after.
+func (c *Checker) RegisterGRPC(ctx context.Context, gs *grpc.Server) {
+	hs := grpchealth.NewServer()
+	grpc_health_v1.RegisterHealthServer(gs, hs)
+
+	go func() {
+		ticker := time.NewTicker(grpcInterval)
+		defer ticker.Stop()
+		for {
+			status := grpc_health_v1.HealthCheckResponse_SERVING
+			if reason := c.Check(ctx, Options{}); reason != "" {
+				status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+			}
+			hs.SetServingStatus("", status)
+
+			select {
+			case <-ctx.Done():
+				hs.Shutdown()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
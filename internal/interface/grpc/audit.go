@@ -0,0 +1,70 @@
+package grpc
+
+import (
+	"context"
+	"log/slog"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/tenant"
+)
+
+// auditRecord starts a record of method with the user, tenant and address
+// of the client of ctx.
+func auditRecord(ctx context.Context, method string) audit.Record {
+	rec := audit.Record{Method: method}
+	rec.User, _ = ctx.Value(userKey{}).(string)
+	if t := tenant.FromContext(ctx); t != nil {
+		rec.Tenant = t.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		rec.Remote = p.Addr.String()
+	} else if md, ok := metadata.FromIncomingContext(ctx); ok {
+		// The gateway calls the servers directly, passing the address of
+		// its client as metadata.
+		if v := md.Get("x-forwarded-for"); len(v) > 0 {
+			rec.Remote = v[0]
+		}
+	}
+	return rec
+}
+
+// writeAudit writes recs. The mutation they describe has been applied, so a
+// failure is only logged.
+func writeAudit(ctx context.Context, log *slog.Logger, l *audit.Logger, recs ...audit.Record) {
+	if err := l.Log(recs...); err != nil {
+		log.ErrorContext(ctx, "failed to write audit log", "error", err)
+	}
+}
+
+// txnAuditRecords returns a record for every write of the branches res took,
+// including those of nested transactions.
+func txnAuditRecords(base audit.Record, req *etcdserverpb.TxnRequest, res *etcdserverpb.TxnResponse) []audit.Record {
+	ops := req.Success
+	if !res.Succeeded {
+		ops = req.Failure
+	}
+
+	var recs []audit.Record
+	for i, op := range ops {
+		rec := base
+		switch r := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestPut:
+			rec.Op, rec.Key, rec.Lease = "put", string(r.RequestPut.Key), r.RequestPut.Lease
+			recs = append(recs, rec)
+		case *etcdserverpb.RequestOp_RequestDeleteRange:
+			rec.Op, rec.Key, rec.RangeEnd = "delete", string(r.RequestDeleteRange.Key), string(r.RequestDeleteRange.RangeEnd)
+			recs = append(recs, rec)
+		case *etcdserverpb.RequestOp_RequestTxn:
+			if i < len(res.Responses) {
+				if nested := res.Responses[i].GetResponseTxn(); nested != nil {
+					recs = append(recs, txnAuditRecords(base, r.RequestTxn, nested)...)
+				}
+			}
+		}
+	}
+	return recs
+}
@@ -0,0 +1,468 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/member"
+	"github.com/aplulu/etcd-shim/internal/middleware"
+)
+
+type userKey struct{}
+
+// Methods that can be called without a token.
+var unauthenticatedMethods = map[string]bool{
+	"/etcdserverpb.Auth/Authenticate": true,
+	"/etcdserverpb.Auth/AuthStatus":   true,
+}
+
+// Gateway endpoints of unauthenticatedMethods.
+var unauthenticatedPaths = map[string]bool{
+	"/v3/auth/authenticate": true,
+	"/v3/auth/status":       true,
+}
+
+type authServer struct {
+	log    *slog.Logger
+	driver driver.Driver
+	store  *auth.Store
+	member *member.Member
+	audit  *audit.Logger
+}
+
+func (s *authServer) AuthEnable(ctx context.Context, req *etcdserverpb.AuthEnableRequest) (*etcdserverpb.AuthEnableResponse, error) {
+	if err := s.store.Enable(ctx); err != nil {
+		return nil, toGRPCError(err)
+	}
+	writeAudit(ctx, s.log, s.audit, auditRecord(ctx, "AuthEnable"))
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthEnableResponse{Header: header}, nil
+}
+
+func (s *authServer) AuthDisable(ctx context.Context, req *etcdserverpb.AuthDisableRequest) (*etcdserverpb.AuthDisableResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.Disable(ctx); err != nil {
+		return nil, toGRPCError(err)
+	}
+	writeAudit(ctx, s.log, s.audit, auditRecord(ctx, "AuthDisable"))
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthDisableResponse{Header: header}, nil
+}
+
+func (s *authServer) AuthStatus(ctx context.Context, req *etcdserverpb.AuthStatusRequest) (*etcdserverpb.AuthStatusResponse, error) {
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthStatusResponse{
+		Header:       header,
+		Enabled:      s.store.Enabled(),
+		AuthRevision: s.store.Revision(),
+	}, nil
+}
+
+func (s *authServer) Authenticate(ctx context.Context, req *etcdserverpb.AuthenticateRequest) (*etcdserverpb.AuthenticateResponse, error) {
+	token, err := s.store.Authenticate(req.Name, req.Password)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthenticateResponse{Header: header, Token: token}, nil
+}
+
+func (s *authServer) UserAdd(ctx context.Context, req *etcdserverpb.AuthUserAddRequest) (*etcdserverpb.AuthUserAddResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	noPassword := req.Options != nil && req.Options.NoPassword
+	if err := s.store.UserAdd(ctx, req.Name, req.Password, noPassword); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "UserAdd")
+	rec.Name = req.Name
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserAddResponse{Header: header}, nil
+}
+
+func (s *authServer) UserGet(ctx context.Context, req *etcdserverpb.AuthUserGetRequest) (*etcdserverpb.AuthUserGetResponse, error) {
+	if err := checkSelfOrAdmin(ctx, s.store, req.Name); err != nil {
+		return nil, err
+	}
+	roles, err := s.store.UserGet(req.Name)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserGetResponse{Header: header, Roles: roles}, nil
+}
+
+func (s *authServer) UserList(ctx context.Context, req *etcdserverpb.AuthUserListRequest) (*etcdserverpb.AuthUserListResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserListResponse{Header: header, Users: s.store.UserList()}, nil
+}
+
+func (s *authServer) UserDelete(ctx context.Context, req *etcdserverpb.AuthUserDeleteRequest) (*etcdserverpb.AuthUserDeleteResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.UserDelete(ctx, req.Name); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "UserDelete")
+	rec.Name = req.Name
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserDeleteResponse{Header: header}, nil
+}
+
+func (s *authServer) UserChangePassword(ctx context.Context, req *etcdserverpb.AuthUserChangePasswordRequest) (*etcdserverpb.AuthUserChangePasswordResponse, error) {
+	if err := checkSelfOrAdmin(ctx, s.store, req.Name); err != nil {
+		return nil, err
+	}
+	if err := s.store.UserChangePassword(ctx, req.Name, req.Password); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "UserChangePassword")
+	rec.Name = req.Name
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserChangePasswordResponse{Header: header}, nil
+}
+
+func (s *authServer) UserGrantRole(ctx context.Context, req *etcdserverpb.AuthUserGrantRoleRequest) (*etcdserverpb.AuthUserGrantRoleResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.UserGrantRole(ctx, req.User, req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "UserGrantRole")
+	rec.Name, rec.Role = req.User, req.Role
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserGrantRoleResponse{Header: header}, nil
+}
+
+func (s *authServer) UserRevokeRole(ctx context.Context, req *etcdserverpb.AuthUserRevokeRoleRequest) (*etcdserverpb.AuthUserRevokeRoleResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.UserRevokeRole(ctx, req.Name, req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "UserRevokeRole")
+	rec.Name, rec.Role = req.Name, req.Role
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthUserRevokeRoleResponse{Header: header}, nil
+}
+
+func (s *authServer) RoleAdd(ctx context.Context, req *etcdserverpb.AuthRoleAddRequest) (*etcdserverpb.AuthRoleAddResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.RoleAdd(ctx, req.Name); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "RoleAdd")
+	rec.Role = req.Name
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleAddResponse{Header: header}, nil
+}
+
+func (s *authServer) RoleGet(ctx context.Context, req *etcdserverpb.AuthRoleGetRequest) (*etcdserverpb.AuthRoleGetResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	perms, err := s.store.RoleGet(req.Role)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleGetResponse{Header: header, Perm: perms}, nil
+}
+
+func (s *authServer) RoleList(ctx context.Context, req *etcdserverpb.AuthRoleListRequest) (*etcdserverpb.AuthRoleListResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleListResponse{Header: header, Roles: s.store.RoleList()}, nil
+}
+
+func (s *authServer) RoleDelete(ctx context.Context, req *etcdserverpb.AuthRoleDeleteRequest) (*etcdserverpb.AuthRoleDeleteResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.RoleDelete(ctx, req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "RoleDelete")
+	rec.Role = req.Role
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleDeleteResponse{Header: header}, nil
+}
+
+func (s *authServer) RoleGrantPermission(ctx context.Context, req *etcdserverpb.AuthRoleGrantPermissionRequest) (*etcdserverpb.AuthRoleGrantPermissionResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if req.Perm == nil {
+		return nil, toGRPCError(auth.ErrPermissionNotGranted)
+	}
+	if err := s.store.RoleGrantPermission(ctx, req.Name, req.Perm); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "RoleGrantPermission")
+	rec.Role, rec.Permission = req.Name, req.Perm.PermType.String()
+	rec.Key, rec.RangeEnd = string(req.Perm.Key), string(req.Perm.RangeEnd)
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleGrantPermissionResponse{Header: header}, nil
+}
+
+func (s *authServer) RoleRevokePermission(ctx context.Context, req *etcdserverpb.AuthRoleRevokePermissionRequest) (*etcdserverpb.AuthRoleRevokePermissionResponse, error) {
+	if err := checkAdmin(ctx, s.store); err != nil {
+		return nil, err
+	}
+	if err := s.store.RoleRevokePermission(ctx, req.Role, req.Key, req.RangeEnd); err != nil {
+		return nil, toGRPCError(err)
+	}
+	rec := auditRecord(ctx, "RoleRevokePermission")
+	rec.Role = req.Role
+	rec.Key, rec.RangeEnd = string(req.Key), string(req.RangeEnd)
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdserverpb.AuthRoleRevokePermissionResponse{Header: header}, nil
+}
+
+func (s *authServer) header(ctx context.Context) (*etcdserverpb.ResponseHeader, error) {
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	return s.member.Header(revision), nil
+}
+
+func RegisterAuthServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, store *auth.Store, mb *member.Member, al *audit.Logger) error {
+	s := &authServer{
+		log:    l,
+		driver: drv,
+		store:  store,
+		member: mb,
+		audit:  al,
+	}
+	etcdserverpb.RegisterAuthServer(gs, s)
+	if err := gw.RegisterAuthHandlerServer(ctx, mux, s); err != nil {
+		return fmt.Errorf("failed to register AuthServer: %w", err)
+	}
+
+	return nil
+}
+
+// AuthUnaryInterceptor and AuthStreamInterceptor resolve the token of a
+// request to its user while auth is enabled.
+func AuthUnaryInterceptor(store *auth.Store) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticate(ctx, store, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func AuthStreamInterceptor(store *auth.Store) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), store, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, middleware.WrapServerStream(ss, ctx))
+	}
+}
+
+func authenticate(ctx context.Context, store *auth.Store, method string) (context.Context, error) {
+	if !store.Enabled() || unauthenticatedMethods[method] {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	for _, k := range []string{rpctypes.TokenFieldNameGRPC, "authorization"} {
+		if v := md.Get(k); len(v) > 0 {
+			token = v[0]
+			break
+		}
+	}
+	return withToken(ctx, store, token)
+}
+
+// withToken returns ctx carrying the user of token.
+func withToken(ctx context.Context, store *auth.Store, token string) (context.Context, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return nil, toGRPCError(auth.ErrUserEmpty)
+	}
+	user, err := store.User(token)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	return context.WithValue(ctx, userKey{}, user), nil
+}
+
+// AuthHTTPHandler resolves the token of the gateway requests h serves, which
+// clients send in the Authorization header, while auth is enabled. mux
+// writes the errors.
+func AuthHTTPHandler(store *auth.Store, mux *runtime.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !store.Enabled() || !strings.HasPrefix(r.URL.Path, "/v3/") || unauthenticatedPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, err := withToken(r.Context(), store, r.Header.Get("Authorization"))
+		if err != nil {
+			_, m := runtime.MarshalerForRequest(mux, r)
+			GatewayErrorHandler(r.Context(), mux, m, w, r, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UserFromContext returns the authenticated user of ctx, which is empty
+// while auth is disabled.
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// checkPermitted fails unless the user of ctx may read or write [key, end).
+// It allows everything while auth is disabled.
+func checkPermitted(ctx context.Context, store *auth.Store, key []byte, end []byte, write bool) error {
+	if !store.Enabled() {
+		return nil
+	}
+	user, _ := ctx.Value(userKey{}).(string)
+	if !store.IsPermitted(user, key, end, write) {
+		return toGRPCError(auth.ErrPermissionDenied)
+	}
+	return nil
+}
+
+func checkAdmin(ctx context.Context, store *auth.Store) error {
+	if !store.Enabled() {
+		return nil
+	}
+	user, _ := ctx.Value(userKey{}).(string)
+	if !store.IsAdmin(user) {
+		return toGRPCError(auth.ErrPermissionDenied)
+	}
+	return nil
+}
+
+// checkSelfOrAdmin lets users manage their own account.
+func checkSelfOrAdmin(ctx context.Context, store *auth.Store, name string) error {
+	if user, _ := ctx.Value(userKey{}).(string); store.Enabled() && user == name {
+		return nil
+	}
+	return checkAdmin(ctx, store)
+}
@@ -0,0 +1,81 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/auth"
+)
+
+func TestAuthUnaryInterceptor(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	drv, err := memory.New(memory.Options{Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drv.Close()
+	store, err := auth.New(ctx, log, drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intercept := AuthUnaryInterceptor(store)
+	call := func(ctx context.Context, method string) (string, error) {
+		user, err := intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, _ any) (any, error) {
+			return UserFromContext(ctx), nil
+		})
+		s, _ := user.(string)
+		return s, err
+	}
+
+	if _, err := call(ctx, "/etcdserverpb.KV/Range"); err != nil {
+		t.Fatalf("a call while auth is disabled failed: %v", err)
+	}
+
+	for _, err := range []error{
+		store.UserAdd(ctx, auth.RootUser, "secret", false),
+		store.UserGrantRole(ctx, auth.RootUser, auth.RootRole),
+		store.Enable(ctx),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := store.Authenticate(auth.RootUser, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		method string
+		md     metadata.MD
+		user   string
+		err    error
+	}{
+		{"no token", "/etcdserverpb.KV/Range", nil, "", rpctypes.ErrGRPCUserEmpty},
+		{"unknown token", "/etcdserverpb.KV/Range", metadata.Pairs(rpctypes.TokenFieldNameGRPC, "nope"), "", rpctypes.ErrGRPCInvalidAuthToken},
+		{"token", "/etcdserverpb.KV/Range", metadata.Pairs(rpctypes.TokenFieldNameGRPC, token), auth.RootUser, nil},
+		{"bearer token", "/etcdserverpb.KV/Range", metadata.Pairs("authorization", "Bearer "+token), auth.RootUser, nil},
+		{"unauthenticated method", "/etcdserverpb.Auth/Authenticate", nil, "", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			user, err := call(metadata.NewIncomingContext(ctx, c.md), c.method)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+			if user != c.user {
+				t.Errorf("user = %q, want %q", user, c.user)
+			}
+		})
+	}
+}
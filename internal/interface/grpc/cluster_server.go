@@ -9,10 +9,15 @@ import (
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
 	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/member"
 )
 
 type clusterServer struct {
-	log *slog.Logger
+	log    *slog.Logger
+	driver driver.Driver
+	member *member.Member
 }
 
 func (s *clusterServer) MemberAdd(ctx context.Context, req *etcdserverpb.MemberAddRequest) (*etcdserverpb.MemberAddResponse, error) {
@@ -28,14 +33,20 @@ func (s *clusterServer) MemberUpdate(ctx context.Context, req *etcdserverpb.Memb
 }
 
 func (s *clusterServer) MemberList(ctx context.Context, req *etcdserverpb.MemberListRequest) (*etcdserverpb.MemberListResponse, error) {
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		s.log.ErrorContext(ctx, "failed to get current revision", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to get current revision: %w", err))
+	}
+
 	return &etcdserverpb.MemberListResponse{
-		Header: &etcdserverpb.ResponseHeader{},
+		Header: s.member.Header(revision),
 		Members: []*etcdserverpb.Member{
 			{
-				ID:         0,
+				ID:         s.member.ID,
 				Name:       "etcd-shim",
 				PeerURLs:   nil,
-				ClientURLs: nil,
+				ClientURLs: s.member.ClientURLs,
 				IsLearner:  false,
 			},
 		},
@@ -46,9 +57,11 @@ func (s *clusterServer) MemberPromote(ctx context.Context, req *etcdserverpb.Mem
 	return nil, fmt.Errorf("not implemented: MemberPromote: %w", ErrNotImplemented)
 }
 
-func RegisterClusterServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger) error {
+func RegisterClusterServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, mb *member.Member) error {
 	s := &clusterServer{
-		log: l,
+		log:    l,
+		driver: drv,
+		member: mb,
 	}
 	etcdserverpb.RegisterClusterServer(gs, s)
 	if err := gw.RegisterClusterHandlerServer(ctx, mux, s); err != nil {
@@ -1,7 +1,132 @@
 package grpc
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"syscall"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/lease"
+	"github.com/aplulu/etcd-shim/internal/tenant"
+)
 
 var (
 	ErrNotImplemented = errors.New("not implemented")
+	// ErrDuplicateKey is returned for a Txn writing a key more than once.
+	ErrDuplicateKey = errors.New("duplicate key given in txn request")
 )
+
+// errGRPCConflict is returned when a transaction kept conflicting with
+// concurrent ones. It was not applied, so clients may retry it; Unavailable
+// is the code etcd clients retry on.
+var errGRPCConflict = status.Error(codes.Unavailable, "etcdserver: transaction conflict, please retry")
+
+// errGRPCRangeTooLarge is returned for Range responses over
+// Limits.MaxRangeBytes.
+var errGRPCRangeTooLarge = status.Error(codes.ResourceExhausted, "etcdserver: range response is too large, use a limit")
+
+// grpcErrors is checked in order, so a more specific error must precede any
+// error it wraps.
+var grpcErrors = []struct {
+	err     error
+	grpcErr error
+}{
+	{driver.ErrCompacted, rpctypes.ErrGRPCCompacted},
+	{driver.ErrFutureRevision, rpctypes.ErrGRPCFutureRev},
+	{driver.ErrKeyNotFound, rpctypes.ErrGRPCKeyNotFound},
+	{driver.ErrConflict, errGRPCConflict},
+	{driver.ErrNoSpace, rpctypes.ErrGRPCNoSpace},
+	{driver.ErrRequestTooLarge, rpctypes.ErrGRPCRequestTooLarge},
+	{ErrDuplicateKey, rpctypes.ErrGRPCDuplicateKey},
+	{syscall.ENOSPC, rpctypes.ErrGRPCNoSpace},
+
+	{lease.ErrLeaseNotFound, rpctypes.ErrGRPCLeaseNotFound},
+	{lease.ErrLeaseExists, rpctypes.ErrGRPCLeaseExist},
+	{lease.ErrLeaseTTLTooLarge, rpctypes.ErrGRPCLeaseTTLTooLarge},
+
+	{tenant.ErrQuotaExceeded, rpctypes.ErrGRPCNoSpace},
+	{tenant.ErrNotPermitted, rpctypes.ErrGRPCPermissionDenied},
+
+	{auth.ErrRootUserNotExist, rpctypes.ErrGRPCRootUserNotExist},
+	{auth.ErrRootRoleNotExist, rpctypes.ErrGRPCRootRoleNotExist},
+	{auth.ErrUserAlreadyExist, rpctypes.ErrGRPCUserAlreadyExist},
+	{auth.ErrUserEmpty, rpctypes.ErrGRPCUserEmpty},
+	{auth.ErrUserNotFound, rpctypes.ErrGRPCUserNotFound},
+	{auth.ErrRoleAlreadyExist, rpctypes.ErrGRPCRoleAlreadyExist},
+	{auth.ErrRoleEmpty, rpctypes.ErrGRPCRoleEmpty},
+	{auth.ErrRoleNotFound, rpctypes.ErrGRPCRoleNotFound},
+	{auth.ErrRoleNotGranted, rpctypes.ErrGRPCRoleNotGranted},
+	{auth.ErrPermissionNotGranted, rpctypes.ErrGRPCPermissionNotGranted},
+	{auth.ErrPermissionDenied, rpctypes.ErrGRPCPermissionDenied},
+	{auth.ErrAuthFailed, rpctypes.ErrGRPCAuthFailed},
+	{auth.ErrAuthNotEnabled, rpctypes.ErrGRPCAuthNotEnabled},
+	{auth.ErrInvalidAuthToken, rpctypes.ErrGRPCInvalidAuthToken},
+	{auth.ErrInvalidAuthMgmt, rpctypes.ErrGRPCInvalidAuthMgmt},
+}
+
+// toGRPCError replaces the errors etcd clients act on with their rpctypes
+// counterparts, and other known errors with a status of the matching code.
+// Unknown errors are returned unchanged. A wrapped gRPC status is unwrapped,
+// since clients match on its exact description.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Err()
+	}
+	for _, e := range grpcErrors {
+		if errors.Is(err, e.err) {
+			return e.grpcErr
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNotImplemented):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+// errorLevel is the level handlers log err at. Errors the client caused,
+// like a compacted revision or a missing lease, are only logged at debug.
+func errorLevel(err error) slog.Level {
+	switch status.Code(toGRPCError(err)) {
+	case codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.FailedPrecondition, codes.OutOfRange, codes.Unauthenticated:
+		return slog.LevelDebug
+	}
+	return slog.LevelError
+}
+
+// ErrorUnaryInterceptor translates the errors returned by handlers with
+// toGRPCError.
+func ErrorUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		res, err := handler(ctx, req)
+		return res, toGRPCError(err)
+	}
+}
+
+func ErrorStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return toGRPCError(handler(srv, ss))
+	}
+}
+
+// GatewayErrorHandler writes errors of the gateway, which calls the servers
+// directly and so bypasses ErrorUnaryInterceptor.
+func GatewayErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	runtime.DefaultHTTPError(ctx, mux, m, w, r, toGRPCError(err))
+}
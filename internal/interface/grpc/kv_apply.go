@@ -0,0 +1,395 @@
+package grpc
+
+import (
+	"bytes"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+type rangeFunc func(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error)
+
+func applyRange(fn rangeFunc, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	sortOrder := req.SortOrder
+	if sortOrder == etcdserverpb.RangeRequest_NONE && req.SortTarget != etcdserverpb.RangeRequest_KEY {
+		sortOrder = etcdserverpb.RangeRequest_ASCEND
+	}
+	sorted := sortOrder != etcdserverpb.RangeRequest_NONE &&
+		!(sortOrder == etcdserverpb.RangeRequest_ASCEND && req.SortTarget == etcdserverpb.RangeRequest_KEY)
+	filtered := req.MinModRevision > 0 || req.MaxModRevision > 0 || req.MinCreateRevision > 0 || req.MaxCreateRevision > 0
+
+	opts := driver.RangeOptions{
+		Revision:  req.Revision,
+		Limit:     req.Limit,
+		CountOnly: req.CountOnly,
+		KeysOnly:  req.KeysOnly,
+	}
+	if sorted || filtered {
+		opts.Limit = 0
+	}
+	if opts.Limit > 0 {
+		// Fetch one extra key so More can be reported without a count.
+		opts.Limit++
+	}
+
+	result, err := fn(req.Key, req.RangeEnd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := result.KVs
+	if filtered {
+		kvs = filterKVs(kvs, req)
+	}
+	if sorted {
+		sortKVs(kvs, sortOrder, req.SortTarget)
+	}
+
+	res := &etcdserverpb.RangeResponse{
+		// The caller completes the header with the member identity.
+		Header: &etcdserverpb.ResponseHeader{Revision: result.Revision},
+		Count:  result.Count,
+	}
+	if req.Limit > 0 && int64(len(kvs)) > req.Limit {
+		kvs = kvs[:req.Limit]
+		res.More = true
+	}
+	if req.CountOnly {
+		return res, nil
+	}
+
+	res.Kvs = make([]*mvccpb.KeyValue, len(kvs))
+	for i := range kvs {
+		res.Kvs[i] = toPBKeyValue(&kvs[i])
+		if req.KeysOnly {
+			res.Kvs[i].Value = nil
+		}
+	}
+
+	return res, nil
+}
+
+func filterKVs(kvs []driver.KeyValue, req *etcdserverpb.RangeRequest) []driver.KeyValue {
+	filtered := kvs[:0]
+	for _, kv := range kvs {
+		if req.MinModRevision > 0 && kv.ModRevision < req.MinModRevision {
+			continue
+		}
+		if req.MaxModRevision > 0 && kv.ModRevision > req.MaxModRevision {
+			continue
+		}
+		if req.MinCreateRevision > 0 && kv.CreateRevision < req.MinCreateRevision {
+			continue
+		}
+		if req.MaxCreateRevision > 0 && kv.CreateRevision > req.MaxCreateRevision {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+func sortKVs(kvs []driver.KeyValue, order etcdserverpb.RangeRequest_SortOrder, target etcdserverpb.RangeRequest_SortTarget) {
+	less := func(a, b *driver.KeyValue) bool {
+		switch target {
+		case etcdserverpb.RangeRequest_VERSION:
+			return a.Version < b.Version
+		case etcdserverpb.RangeRequest_CREATE:
+			return a.CreateRevision < b.CreateRevision
+		case etcdserverpb.RangeRequest_MOD:
+			return a.ModRevision < b.ModRevision
+		case etcdserverpb.RangeRequest_VALUE:
+			return bytes.Compare(a.Value, b.Value) < 0
+		default:
+			return bytes.Compare(a.Key, b.Key) < 0
+		}
+	}
+	sort.SliceStable(kvs, func(i, j int) bool {
+		if order == etcdserverpb.RangeRequest_DESCEND {
+			return less(&kvs[j], &kvs[i])
+		}
+		return less(&kvs[i], &kvs[j])
+	})
+}
+
+func applyPut(txn driver.Txn, req *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	value, lease := req.Value, req.Lease
+	if req.IgnoreValue || req.IgnoreLease {
+		prev, err := txn.Range(req.Key, nil, driver.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if len(prev.KVs) == 0 {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if req.IgnoreValue {
+			value = prev.KVs[0].Value
+		}
+		if req.IgnoreLease {
+			lease = prev.KVs[0].Lease
+		}
+	}
+
+	prev, err := txn.Put(req.Key, value, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &etcdserverpb.PutResponse{}
+	if req.PrevKv && prev != nil {
+		res.PrevKv = toPBKeyValue(prev)
+	}
+
+	return res, nil
+}
+
+func applyDeleteRange(txn driver.Txn, req *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
+	deleted, err := txn.DeleteRange(req.Key, req.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &etcdserverpb.DeleteRangeResponse{
+		Deleted: int64(len(deleted)),
+	}
+	if req.PrevKv {
+		res.PrevKvs = make([]*mvccpb.KeyValue, len(deleted))
+		for i := range deleted {
+			res.PrevKvs[i] = toPBKeyValue(&deleted[i])
+		}
+	}
+
+	return res, nil
+}
+
+func applyTxn(txn driver.Txn, req *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	succeeded := true
+	for _, c := range req.Compare {
+		ok, err := applyCompare(txn, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+
+	res := &etcdserverpb.TxnResponse{
+		Succeeded: succeeded,
+		Responses: make([]*etcdserverpb.ResponseOp, len(ops)),
+	}
+	for i, op := range ops {
+		switch r := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			rr, err := applyRange(txn.Range, r.RequestRange)
+			if err != nil {
+				return nil, err
+			}
+			res.Responses[i] = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: rr},
+			}
+		case *etcdserverpb.RequestOp_RequestPut:
+			pr, err := applyPut(txn, r.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			res.Responses[i] = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponsePut{ResponsePut: pr},
+			}
+		case *etcdserverpb.RequestOp_RequestDeleteRange:
+			dr, err := applyDeleteRange(txn, r.RequestDeleteRange)
+			if err != nil {
+				return nil, err
+			}
+			res.Responses[i] = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: dr},
+			}
+		case *etcdserverpb.RequestOp_RequestTxn:
+			tr, err := applyTxn(txn, r.RequestTxn)
+			if err != nil {
+				return nil, err
+			}
+			res.Responses[i] = &etcdserverpb.ResponseOp{
+				Response: &etcdserverpb.ResponseOp_ResponseTxn{ResponseTxn: tr},
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// setTxnHeader sets header on res and on every nested response, as etcd does.
+func setTxnHeader(res *etcdserverpb.TxnResponse, header *etcdserverpb.ResponseHeader) {
+	res.Header = header
+	for _, op := range res.Responses {
+		switch r := op.Response.(type) {
+		case *etcdserverpb.ResponseOp_ResponseRange:
+			r.ResponseRange.Header = header
+		case *etcdserverpb.ResponseOp_ResponsePut:
+			r.ResponsePut.Header = header
+		case *etcdserverpb.ResponseOp_ResponseDeleteRange:
+			r.ResponseDeleteRange.Header = header
+		case *etcdserverpb.ResponseOp_ResponseTxn:
+			setTxnHeader(r.ResponseTxn, header)
+		}
+	}
+}
+
+func applyCompare(txn driver.Txn, c *etcdserverpb.Compare) (bool, error) {
+	result, err := txn.Range(c.Key, c.RangeEnd, driver.RangeOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if len(result.KVs) == 0 {
+		if c.Target == etcdserverpb.Compare_VALUE {
+			return false, nil
+		}
+		return compareKV(c, &driver.KeyValue{}), nil
+	}
+	for i := range result.KVs {
+		if !compareKV(c, &result.KVs[i]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func compareKV(c *etcdserverpb.Compare, kv *driver.KeyValue) bool {
+	var r int
+	switch c.Target {
+	case etcdserverpb.Compare_VALUE:
+		r = bytes.Compare(kv.Value, c.GetValue())
+	case etcdserverpb.Compare_VERSION:
+		r = compareInt64(kv.Version, c.GetVersion())
+	case etcdserverpb.Compare_CREATE:
+		r = compareInt64(kv.CreateRevision, c.GetCreateRevision())
+	case etcdserverpb.Compare_MOD:
+		r = compareInt64(kv.ModRevision, c.GetModRevision())
+	case etcdserverpb.Compare_LEASE:
+		r = compareInt64(kv.Lease, c.GetLease())
+	}
+
+	switch c.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return r == 0
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return r != 0
+	case etcdserverpb.Compare_GREATER:
+		return r > 0
+	case etcdserverpb.Compare_LESS:
+		return r < 0
+	}
+
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toPBKeyValue(kv *driver.KeyValue) *mvccpb.KeyValue {
+	return &mvccpb.KeyValue{
+		Key:            kv.Key,
+		Value:          kv.Value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Lease:          kv.Lease,
+	}
+}
+
+// keyRange is a range [key, end) in the driver's terms.
+type keyRange struct {
+	key, end []byte
+}
+
+// checkTxnKeys returns ErrDuplicateKey if a branch of req puts a key twice,
+// or puts a key it also deletes, as etcd does. The branches of a nested Txn
+// exclude each other, so may put the same key.
+func checkTxnKeys(req *etcdserverpb.TxnRequest) error {
+	if _, _, err := checkOpKeys(req.Success); err != nil {
+		return err
+	}
+	_, _, err := checkOpKeys(req.Failure)
+	return err
+}
+
+// checkOpKeys returns the keys put and the ranges deleted by ops, including
+// those of nested transactions.
+func checkOpKeys(ops []*etcdserverpb.RequestOp) (map[string]bool, []keyRange, error) {
+	var dels []keyRange
+	for _, op := range ops {
+		if r := op.GetRequestDeleteRange(); r != nil {
+			dels = append(dels, keyRange{r.Key, r.RangeEnd})
+		}
+	}
+	deleted := func(k string) bool {
+		for _, d := range dels {
+			if driver.InRange([]byte(k), d.key, d.end) {
+				return true
+			}
+		}
+		return false
+	}
+
+	puts := map[string]bool{}
+	for _, op := range ops {
+		r := op.GetRequestTxn()
+		if r == nil {
+			continue
+		}
+		putsThen, delsThen, err := checkOpKeys(r.Success)
+		if err != nil {
+			return nil, nil, err
+		}
+		putsElse, delsElse, err := checkOpKeys(r.Failure)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k := range putsThen {
+			if puts[k] || deleted(k) {
+				return nil, nil, ErrDuplicateKey
+			}
+			puts[k] = true
+		}
+		for k := range putsElse {
+			if (puts[k] && !putsThen[k]) || deleted(k) {
+				return nil, nil, ErrDuplicateKey
+			}
+			puts[k] = true
+		}
+		dels = append(append(dels, delsThen...), delsElse...)
+	}
+
+	for _, op := range ops {
+		r := op.GetRequestPut()
+		if r == nil {
+			continue
+		}
+		k := string(r.Key)
+		if puts[k] || deleted(k) {
+			return nil, nil, ErrDuplicateKey
+		}
+		puts[k] = true
+	}
+	return puts, dels, nil
+}
@@ -2,109 +2,276 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/aplulu/etcd-shim/internal/driver"
-	"go.etcd.io/etcd/api/v3/mvccpb"
 	"log/slog"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/alarm"
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/lease"
+	"github.com/aplulu/etcd-shim/internal/member"
+	"github.com/aplulu/etcd-shim/internal/metrics"
+	"github.com/aplulu/etcd-shim/internal/tenant"
 )
 
 type kvServer struct {
-	log    *slog.Logger
-	driver driver.Driver
+	log     *slog.Logger
+	driver  driver.Driver
+	lessor  *lease.Lessor
+	auth    *auth.Store
+	member  *member.Member
+	limits  Limits
+	alarms  *alarm.Store
+	metrics *metrics.Metrics
+	audit   *audit.Logger
+	tenants *tenant.Tenants
 }
 
 func (s *kvServer) Range(ctx context.Context, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
-	s.log.Info(
-		"Range",
-		"key", string(req.Key),
-		"range_end", string(req.RangeEnd),
-	)
+	if err := checkPermitted(ctx, s.auth, req.Key, req.RangeEnd, false); err != nil {
+		return nil, err
+	}
 
-	results, err := s.driver.Range(ctx, req.Key, req.RangeEnd)
+	res, err := applyRange(func(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+		return s.driver.Range(ctx, key, end, opts)
+	}, req)
 	if err != nil {
-		s.log.Error("failed to range", "error", err)
-		return nil, fmt.Errorf("failed to range: %w", err)
+		s.log.Log(ctx, errorLevel(err), "failed to range", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to range: %w", err))
 	}
-
-	kvs := make([]*mvccpb.KeyValue, len(results))
-	for i, r := range results {
-		kvs[i] = &mvccpb.KeyValue{
-			Key:     r.Key,
-			Value:   r.Value,
-			Version: r.Version,
-		}
+	if err := s.limits.checkRangeSize(res); err != nil {
+		return nil, err
 	}
+	res.Header = s.member.Header(res.Header.Revision)
+	s.metrics.RangeTotal.Inc()
 
-	return &etcdserverpb.RangeResponse{
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: 1,
-		},
-		Kvs: nil,
-	}, nil
+	return res, nil
 }
 
 func (s *kvServer) Put(ctx context.Context, req *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
-	s.log.Info(
-		"Put",
-		"key", string(req.Key),
-		"value", string(req.Value),
-		"ignore_value", req.IgnoreValue,
-		"ignore_lease", req.IgnoreLease,
-		"lease", req.Lease,
-		"prev_kv", req.PrevKv,
-	)
-
-	revision, err := s.driver.Put(ctx, req.Key, req.Value)
+	if err := s.limits.checkRequestSize(req); err != nil {
+		return nil, err
+	}
+	if err := checkPermitted(ctx, s.auth, req.Key, nil, true); err != nil {
+		return nil, err
+	}
+	if err := s.checkSpace(); err != nil {
+		return nil, err
+	}
+
+	var res *etcdserverpb.PutResponse
+	revision, err := s.txn(ctx, putLeases(req), func(txn driver.Txn) error {
+		var err error
+		res, err = applyPut(txn, req)
+		return err
+	})
 	if err != nil {
-		s.log.Error("failed to put", "error", err)
-		return nil, fmt.Errorf("failed to put: %w", err)
+		s.log.Log(ctx, errorLevel(err), "failed to put", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to put: %w", err))
 	}
+	res.Header = s.member.Header(revision)
 
-	return &etcdserverpb.PutResponse{
-		Header: &etcdserverpb.ResponseHeader{
-			Revision: revision,
-		},
-		PrevKv: nil,
-	}, nil
+	rec := auditRecord(ctx, "Put")
+	rec.Op, rec.Key, rec.Lease, rec.Revision = "put", string(req.Key), req.Lease, revision
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	return res, nil
 }
 
 func (s *kvServer) DeleteRange(ctx context.Context, req *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
-	s.log.Info(
-		"DeleteRange",
-		"key", string(req.Key),
-		"range_end", string(req.RangeEnd),
-	)
-	return &etcdserverpb.DeleteRangeResponse{}, nil
+	if err := s.limits.checkRequestSize(req); err != nil {
+		return nil, err
+	}
+	if err := checkPermitted(ctx, s.auth, req.Key, req.RangeEnd, true); err != nil {
+		return nil, err
+	}
+	if req.PrevKv {
+		if err := checkPermitted(ctx, s.auth, req.Key, req.RangeEnd, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var res *etcdserverpb.DeleteRangeResponse
+	revision, err := s.txn(ctx, nil, func(txn driver.Txn) error {
+		var err error
+		res, err = applyDeleteRange(txn, req)
+		return err
+	})
+	if err != nil {
+		s.log.Log(ctx, errorLevel(err), "failed to delete range", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to delete range: %w", err))
+	}
+	res.Header = s.member.Header(revision)
+
+	rec := auditRecord(ctx, "DeleteRange")
+	rec.Op, rec.Key, rec.RangeEnd, rec.Revision = "delete", string(req.Key), string(req.RangeEnd), revision
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	return res, nil
 }
 
 func (s *kvServer) Txn(ctx context.Context, req *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
-	s.log.Info(
-		"Txn",
-		"compare", req.Compare,
-		"success", req.Success,
-	)
-	return &etcdserverpb.TxnResponse{}, nil
+	if err := s.limits.checkTxnOps(req); err != nil {
+		return nil, err
+	}
+	if err := s.limits.checkRequestSize(req); err != nil {
+		return nil, err
+	}
+	if err := checkTxnKeys(req); err != nil {
+		return nil, toGRPCError(err)
+	}
+	if err := s.checkTxnPermitted(ctx, req); err != nil {
+		return nil, err
+	}
+	if txnHasPuts(req) {
+		if err := s.checkSpace(); err != nil {
+			return nil, err
+		}
+	}
+
+	var res *etcdserverpb.TxnResponse
+	revision, err := s.txn(ctx, txnLeases(req, nil), func(txn driver.Txn) error {
+		var err error
+		res, err = applyTxn(txn, req)
+		return err
+	})
+	if err != nil {
+		s.log.Log(ctx, errorLevel(err), "failed to txn", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to txn: %w", err))
+	}
+	setTxnHeader(res, s.member.Header(revision))
+
+	rec := auditRecord(ctx, "Txn")
+	rec.Revision = revision
+	writeAudit(ctx, s.log, s.audit, txnAuditRecords(rec, req, res)...)
+
+	return res, nil
 }
 
 func (s *kvServer) Compact(ctx context.Context, req *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
-	s.log.Info(
-		"Compact",
-		"revision", req.Revision,
-		"physical", req.Physical,
-	)
+	if err := checkAdmin(ctx, s.auth); err != nil {
+		return nil, err
+	}
 
-	return &etcdserverpb.CompactionResponse{}, nil
+	if err := s.driver.Compact(ctx, req.Revision); err != nil {
+		s.log.Log(ctx, errorLevel(err), "failed to compact", "revision", req.Revision, "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to compact: %w", err))
+	}
+
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		return nil, toGRPCError(fmt.Errorf("failed to get current revision: %w", err))
+	}
+
+	rec := auditRecord(ctx, "Compact")
+	rec.Revision = req.Revision
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	return &etcdserverpb.CompactionResponse{
+		Header: s.member.Header(revision),
+	}, nil
 }
 
-func RegisterKV(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver) error {
+// txn runs fn in a driver transaction while the leases it attaches keys to
+// are guaranteed to exist. The operations of the attempt that commits are
+// counted in the metrics.
+func (s *kvServer) txn(ctx context.Context, leases []int64, fn func(txn driver.Txn) error) (int64, error) {
+	for _, id := range leases {
+		if !s.tenants.OwnsLease(ctx, id) {
+			return 0, lease.ErrLeaseNotFound
+		}
+	}
+
+	var counted *metrics.CountingTxn
+	run := func() (int64, error) {
+		return s.driver.Txn(ctx, func(txn driver.Txn) error {
+			counted = metrics.NewCountingTxn(txn)
+			return fn(counted)
+		})
+	}
+
+	var revision int64
+	var err error
+	if len(leases) == 0 {
+		revision, err = run()
+	} else {
+		err = s.lessor.Attach(leases, func() error {
+			var err error
+			revision, err = run()
+			return err
+		})
+	}
+	if err == nil {
+		s.metrics.ObserveTxn(counted)
+	}
+	if errors.Is(err, driver.ErrNoSpace) && s.alarms.Activate(etcdserverpb.AlarmType_NOSPACE) {
+		s.log.WarnContext(ctx, "Raised NOSPACE alarm", "error", err)
+	}
+
+	return revision, err
+}
+
+// checkSpace rejects writes that add data while the NOSPACE alarm is raised,
+// as etcd does until the alarm is disarmed. Deletes stay allowed to free
+// space.
+func (s *kvServer) checkSpace() error {
+	if s.alarms.Active(etcdserverpb.AlarmType_NOSPACE) {
+		return rpctypes.ErrGRPCNoSpace
+	}
+	return nil
+}
+
+func (s *kvServer) checkTxnPermitted(ctx context.Context, req *etcdserverpb.TxnRequest) error {
+	for _, c := range req.Compare {
+		if err := checkPermitted(ctx, s.auth, c.Key, c.RangeEnd, false); err != nil {
+			return err
+		}
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			var err error
+			switch r := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestRange:
+				err = checkPermitted(ctx, s.auth, r.RequestRange.Key, r.RequestRange.RangeEnd, false)
+			case *etcdserverpb.RequestOp_RequestPut:
+				err = checkPermitted(ctx, s.auth, r.RequestPut.Key, nil, true)
+			case *etcdserverpb.RequestOp_RequestDeleteRange:
+				err = checkPermitted(ctx, s.auth, r.RequestDeleteRange.Key, r.RequestDeleteRange.RangeEnd, true)
+				if err == nil && r.RequestDeleteRange.PrevKv {
+					err = checkPermitted(ctx, s.auth, r.RequestDeleteRange.Key, r.RequestDeleteRange.RangeEnd, false)
+				}
+			case *etcdserverpb.RequestOp_RequestTxn:
+				err = s.checkTxnPermitted(ctx, r.RequestTxn)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func RegisterKV(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, lessor *lease.Lessor, store *auth.Store, mb *member.Member, limits Limits, alarms *alarm.Store, m *metrics.Metrics, al *audit.Logger, tenants *tenant.Tenants) error {
 	s := &kvServer{
-		log:    l,
-		driver: drv,
+		log:     l,
+		driver:  drv,
+		lessor:  lessor,
+		auth:    store,
+		member:  mb,
+		limits:  limits,
+		alarms:  alarms,
+		metrics: m,
+		audit:   al,
+		tenants: tenants,
 	}
 	etcdserverpb.RegisterKVServer(gs, s)
 	if err := gw.RegisterKVHandlerServer(ctx, mux, s); err != nil {
@@ -113,3 +280,42 @@ func RegisterKV(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *
 
 	return nil
 }
+
+// putLeases returns the lease a put attaches its key to.
+func putLeases(req *etcdserverpb.PutRequest) []int64 {
+	if req.Lease == 0 || req.IgnoreLease {
+		return nil
+	}
+	return []int64{req.Lease}
+}
+
+// txnLeases appends the leases of the puts in either branch of req.
+func txnHasPuts(req *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			switch r := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestPut:
+				return true
+			case *etcdserverpb.RequestOp_RequestTxn:
+				if txnHasPuts(r.RequestTxn) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func txnLeases(req *etcdserverpb.TxnRequest, leases []int64) []int64 {
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			switch r := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestPut:
+				leases = append(leases, putLeases(r.RequestPut)...)
+			case *etcdserverpb.RequestOp_RequestTxn:
+				leases = txnLeases(r.RequestTxn, leases)
+			}
+		}
+	}
+	return leases
+}
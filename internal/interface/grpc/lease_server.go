@@ -2,50 +2,240 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/alarm"
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/lease"
+	"github.com/aplulu/etcd-shim/internal/member"
+	"github.com/aplulu/etcd-shim/internal/metrics"
+	"github.com/aplulu/etcd-shim/internal/tenant"
 )
 
 type leaseServer struct {
-	log *slog.Logger
+	log     *slog.Logger
+	driver  driver.Driver
+	lessor  *lease.Lessor
+	member  *member.Member
+	alarms  *alarm.Store
+	metrics *metrics.Metrics
+	audit   *audit.Logger
+	tenants *tenant.Tenants
+	// stopping is closed when the server shuts down.
+	stopping <-chan struct{}
 }
 
 func (s *leaseServer) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
+	// As in etcd, no lease can be granted until NOSPACE is disarmed.
+	if s.alarms.Active(etcdserverpb.AlarmType_NOSPACE) {
+		return nil, rpctypes.ErrGRPCNoSpace
+	}
+	id, ttl, err := s.lessor.Grant(ctx, req.ID, req.TTL)
+	if err != nil {
+		s.log.Log(ctx, errorLevel(err), "failed to grant lease", "error", err)
+		return nil, toGRPCError(err)
+	}
+	if err := s.tenants.GrantLease(ctx, id); err != nil {
+		s.log.ErrorContext(ctx, "failed to record lease owner", "error", err)
+		if err := s.lessor.Revoke(ctx, id); err != nil {
+			s.log.ErrorContext(ctx, "failed to revoke lease", "error", err)
+		}
+		return nil, toGRPCError(err)
+	}
+	s.metrics.LeaseGranted.Inc()
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := auditRecord(ctx, "LeaseGrant")
+	rec.Lease, rec.TTL, rec.Revision = id, ttl, header.Revision
+	writeAudit(ctx, s.log, s.audit, rec)
+
 	return &etcdserverpb.LeaseGrantResponse{
-		Header: &etcdserverpb.ResponseHeader{},
-		ID:     req.ID,
-		TTL:    req.TTL,
+		Header: header,
+		ID:     id,
+		TTL:    ttl,
 	}, nil
 }
 
 func (s *leaseServer) LeaseRevoke(ctx context.Context, req *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
-	return nil, fmt.Errorf("grpc.LeaseRevoke is not implemented: %w", ErrNotImplemented)
+	// The leases of other tenants do not exist for this one.
+	if !s.tenants.OwnsLease(ctx, req.ID) {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	if err := s.lessor.Revoke(ctx, req.ID); err != nil {
+		s.log.Log(ctx, errorLevel(err), "failed to revoke lease", "error", err)
+		return nil, toGRPCError(err)
+	}
+	if err := s.tenants.RevokeLease(ctx, req.ID); err != nil {
+		s.log.WarnContext(ctx, "failed to forget lease owner", "error", err)
+	}
+	s.metrics.LeaseRevoked.Inc()
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := auditRecord(ctx, "LeaseRevoke")
+	rec.Lease, rec.Revision = req.ID, header.Revision
+	writeAudit(ctx, s.log, s.audit, rec)
+
+	return &etcdserverpb.LeaseRevokeResponse{
+		Header: header,
+	}, nil
 }
 
 func (s *leaseServer) LeaseKeepAlive(server etcdserverpb.Lease_LeaseKeepAliveServer) error {
-	return fmt.Errorf("grpc.LeaseKeepAlive is not implemented: %w", ErrNotImplemented)
+	ctx := server.Context()
+
+	// Recv cannot be interrupted, so it runs until the stream ends.
+	reqs := make(chan *etcdserverpb.LeaseKeepAliveRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := server.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var req *etcdserverpb.LeaseKeepAliveRequest
+		select {
+		case req = <-reqs:
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-s.stopping:
+			// The client keeps the lease alive through another member, or
+			// through this one once it is back.
+			return rpctypes.ErrGRPCStopped
+		}
+
+		// An unknown lease is reported with a TTL of 0, as etcd does.
+		ttl, err := int64(0), lease.ErrLeaseNotFound
+		if s.tenants.OwnsLease(ctx, req.ID) {
+			ttl, err = s.lessor.Renew(req.ID)
+		}
+		if err != nil && !errors.Is(err, lease.ErrLeaseNotFound) {
+			return err
+		}
+		if err == nil {
+			s.metrics.LeaseRenewed.Inc()
+		}
+		header, err := s.header(ctx)
+		if err != nil {
+			return err
+		}
+		if err := server.Send(&etcdserverpb.LeaseKeepAliveResponse{
+			Header: header,
+			ID:     req.ID,
+			TTL:    ttl,
+		}); err != nil {
+			return err
+		}
+	}
 }
 
 func (s *leaseServer) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
-	return nil, fmt.Errorf("grpc.LeaseTimeToLive is not implemented: %w", ErrNotImplemented)
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, granted, err := int64(0), int64(0), lease.ErrLeaseNotFound
+	if s.tenants.OwnsLease(ctx, req.ID) {
+		remaining, granted, err = s.lessor.TimeToLive(req.ID)
+	}
+	if errors.Is(err, lease.ErrLeaseNotFound) {
+		// clientv3 expects a TTL of -1 rather than an error.
+		return &etcdserverpb.LeaseTimeToLiveResponse{
+			Header: header,
+			ID:     req.ID,
+			TTL:    -1,
+		}, nil
+	}
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	res := &etcdserverpb.LeaseTimeToLiveResponse{
+		Header:     header,
+		ID:         req.ID,
+		TTL:        remaining,
+		GrantedTTL: granted,
+	}
+	if req.Keys {
+		res.Keys = s.tenants.StripKeys(ctx, s.lessor.Keys(req.ID))
+	}
+
+	return res, nil
 }
 
 func (s *leaseServer) LeaseLeases(ctx context.Context, req *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
-	return nil, fmt.Errorf("grpc.LeaseLeases is not implemented: %w", ErrNotImplemented)
+	header, err := s.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &etcdserverpb.LeaseLeasesResponse{
+		Header: header,
+	}
+	for _, id := range s.lessor.Leases() {
+		if !s.tenants.OwnsLease(ctx, id) {
+			continue
+		}
+		res.Leases = append(res.Leases, &etcdserverpb.LeaseStatus{ID: id})
+	}
+
+	return res, nil
+}
+
+func (s *leaseServer) header(ctx context.Context) (*etcdserverpb.ResponseHeader, error) {
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	return s.member.Header(revision), nil
 }
 
-func RegisterLeaseServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger) error {
+// RegisterLeaseServer registers the Lease service. Keep-alive streams end
+// once stopping is closed.
+func RegisterLeaseServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, lessor *lease.Lessor, mb *member.Member, alarms *alarm.Store, m *metrics.Metrics, al *audit.Logger, tenants *tenant.Tenants, stopping <-chan struct{}) error {
 	s := &leaseServer{
-		log: l,
+		log:      l,
+		driver:   drv,
+		lessor:   lessor,
+		member:   mb,
+		alarms:   alarms,
+		metrics:  m,
+		audit:    al,
+		tenants:  tenants,
+		stopping: stopping,
 	}
 	etcdserverpb.RegisterLeaseServer(gs, s)
 	if err := gw.RegisterLeaseHandlerServer(ctx, mux, s); err != nil {
-		return fmt.Errorf("failed to register ClusterServer: %w", err)
+		return fmt.Errorf("failed to register LeaseServer: %w", err)
 	}
 
 	return nil
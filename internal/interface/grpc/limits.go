@@ -0,0 +1,53 @@
+package grpc
+
+import (
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// Limits bounds the requests the KV server accepts, as etcd's
+// --max-request-bytes and --max-txn-ops do. Zero fields are unlimited.
+type Limits struct {
+	MaxRequestBytes int
+	MaxTxnOps       int
+	// MaxRangeBytes bounds the encoded size of a Range response. Clients
+	// exceeding it have to page with a limit.
+	MaxRangeBytes int
+}
+
+// checkRequestSize rejects writes larger than MaxRequestBytes, which etcd
+// refuses to propose.
+func (l Limits) checkRequestSize(req interface{ Size() int }) error {
+	if l.MaxRequestBytes > 0 && req.Size() > l.MaxRequestBytes {
+		return rpctypes.ErrGRPCRequestTooLarge
+	}
+	return nil
+}
+
+// checkTxnOps rejects transactions with more than MaxTxnOps compares or ops
+// in a branch, at any level of nesting.
+func (l Limits) checkTxnOps(req *etcdserverpb.TxnRequest) error {
+	if l.MaxTxnOps <= 0 {
+		return nil
+	}
+	if len(req.Compare) > l.MaxTxnOps || len(req.Success) > l.MaxTxnOps || len(req.Failure) > l.MaxTxnOps {
+		return rpctypes.ErrGRPCTooManyOps
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if nested := op.GetRequestTxn(); nested != nil {
+				if err := l.checkTxnOps(nested); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (l Limits) checkRangeSize(res *etcdserverpb.RangeResponse) error {
+	if l.MaxRangeBytes > 0 && res.Size() > l.MaxRangeBytes {
+		return errGRPCRangeTooLarge
+	}
+	return nil
+}
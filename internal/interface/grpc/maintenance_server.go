@@ -9,25 +9,91 @@ import (
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
 	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/alarm"
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/member"
 )
 
 type maintenanceServer struct {
-	log *slog.Logger
+	log    *slog.Logger
+	driver driver.Driver
+	// sizer is nil when the driver cannot report its size.
+	sizer   driver.Sizer
+	auth    *auth.Store
+	member  *member.Member
+	alarms  *alarm.Store
+	version string
 }
 
 func (s *maintenanceServer) Alarm(ctx context.Context, request *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
-	return nil, fmt.Errorf("not implemented: Alarm: %w", ErrNotImplemented)
+	// Listing the alarms is open to every user.
+	if request.Action != etcdserverpb.AlarmRequest_GET {
+		if err := checkAdmin(ctx, s.auth); err != nil {
+			return nil, err
+		}
+	}
+
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		s.log.ErrorContext(ctx, "failed to get current revision", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to get current revision: %w", err))
+	}
+
+	res := &etcdserverpb.AlarmResponse{Header: s.member.Header(revision)}
+	alarmMember := func(a etcdserverpb.AlarmType) *etcdserverpb.AlarmMember {
+		return &etcdserverpb.AlarmMember{MemberID: s.member.ID, Alarm: a}
+	}
+	// As in etcd, the response lists the alarms the request changed.
+	switch request.Action {
+	case etcdserverpb.AlarmRequest_GET:
+		for _, a := range s.alarms.List() {
+			res.Alarms = append(res.Alarms, alarmMember(a))
+		}
+	case etcdserverpb.AlarmRequest_ACTIVATE:
+		if request.Alarm != etcdserverpb.AlarmType_NONE && s.alarms.Activate(request.Alarm) {
+			s.log.WarnContext(ctx, "Alarm activated", "alarm", request.Alarm.String())
+			res.Alarms = append(res.Alarms, alarmMember(request.Alarm))
+		}
+	case etcdserverpb.AlarmRequest_DEACTIVATE:
+		if s.alarms.Deactivate(request.Alarm) {
+			s.log.InfoContext(ctx, "Alarm deactivated", "alarm", request.Alarm.String())
+			res.Alarms = append(res.Alarms, alarmMember(request.Alarm))
+		}
+	}
+
+	return res, nil
 }
 
 func (s *maintenanceServer) Status(ctx context.Context, request *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
-	s.log.Info(
-		"Status",
-	)
+	revision, err := s.driver.CurrentRevision(ctx)
+	if err != nil {
+		s.log.ErrorContext(ctx, "failed to get current revision", "error", err)
+		return nil, toGRPCError(fmt.Errorf("failed to get current revision: %w", err))
+	}
+
+	var errs []string
+	for _, a := range s.alarms.List() {
+		errs = append(errs, (&etcdserverpb.AlarmMember{MemberID: s.member.ID, Alarm: a}).String())
+	}
+
+	// Drivers report the size they allocate, not the part in use.
+	var size int64
+	if s.sizer != nil {
+		if size, err = s.sizer.Size(ctx); err != nil {
+			s.log.WarnContext(ctx, "failed to get database size", "error", err)
+		}
+	}
 
 	return &etcdserverpb.StatusResponse{
-		Header:  &etcdserverpb.ResponseHeader{},
-		DbSize:  0,
-		Version: "3.5.0",
+		Header:      s.member.Header(revision),
+		DbSize:      size,
+		DbSizeInUse: size,
+		Version:     s.version,
+		Leader:      s.member.ID,
+		RaftTerm:    s.member.RaftTerm,
+		Errors:      errs,
 	}, nil
 }
 
@@ -55,9 +121,18 @@ func (s *maintenanceServer) Downgrade(ctx context.Context, request *etcdserverpb
 	return nil, fmt.Errorf("not implemented: Downgrade: %w", ErrNotImplemented)
 }
 
-func RegisterMaintenanceServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger) error {
+// RegisterMaintenanceServer registers the Maintenance service. Status
+// reports version, and the size of drv when it implements driver.Sizer.
+func RegisterMaintenanceServer(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, store *auth.Store, mb *member.Member, alarms *alarm.Store, version string) error {
+	sizer, _ := drv.(driver.Sizer)
 	s := &maintenanceServer{
-		log: l,
+		log:     l,
+		driver:  drv,
+		sizer:   sizer,
+		auth:    store,
+		member:  mb,
+		alarms:  alarms,
+		version: version,
 	}
 	etcdserverpb.RegisterMaintenanceServer(gs, s)
 	if err := gw.RegisterMaintenanceHandlerServer(ctx, mux, s); err != nil {
@@ -4,51 +4,132 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/etcdserverpb/gw"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/member"
+	"github.com/aplulu/etcd-shim/internal/metrics"
+	"github.com/aplulu/etcd-shim/internal/ratelimit"
+)
+
+const (
+	// progressNotifyInterval is how often idle watchers created with
+	// progress_notify are told the current revision, as etcd's default.
+	progressNotifyInterval = 10 * time.Minute
+	// maxEventsPerResponse bounds how many pending events are batched into
+	// one response. A response always ends with a whole revision, so a
+	// revision with more events is sent in one larger response, as in etcd.
+	maxEventsPerResponse = 1000
+	// drainTimeout is how long a drained stream waits for the client to
+	// close it.
+	drainTimeout = time.Second
 )
 
 type watchServer struct {
-	log *slog.Logger
+	log     *slog.Logger
+	driver  driver.Driver
+	auth    *auth.Store
+	member  *member.Member
+	metrics *metrics.Metrics
+	// stopping is closed when the server shuts down.
+	stopping <-chan struct{}
 }
 
-func (s *watchServer) Watch(server etcdserverpb.Watch_WatchServer) (err error) {
-	s.log.Info("Watch")
-	w := newWatcher(server)
+func (s *watchServer) Watch(server etcdserverpb.Watch_WatchServer) error {
+	ctx, cancel := context.WithCancel(server.Context())
+	defer cancel()
+
+	s.metrics.WatchStreams.Inc()
+	defer s.metrics.WatchStreams.Dec()
 
-	errCh := make(chan error, 1)
+	st := &watchStream{
+		log:      s.log,
+		driver:   s.driver,
+		auth:     s.auth,
+		member:   s.member,
+		metrics:  s.metrics,
+		ctx:      ctx,
+		send:     make(chan *etcdserverpb.WatchResponse),
+		watchers: map[int64]*streamWatcher{},
+	}
 
+	sendErr := make(chan error, 1)
+	sent := make(chan struct{})
 	go func() {
-		if err := w.Start(); err != nil {
-			errCh <- err
+		defer close(sent)
+		for {
+			select {
+			case res := <-st.send:
+				if err := server.Send(res); err != nil {
+					sendErr <- err
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
+	// Recv cannot be interrupted, so it is left to return once the stream
+	// ends.
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- st.recv(server)
+	}()
+
+	var err error
 	select {
-	case err = <-errCh:
-		if errors.Is(err, context.Canceled) {
-			err = rpctypes.ErrGRPCWatchCanceled
-		}
-	case <-server.Context().Done():
-		err = server.Context().Err()
-		if errors.Is(err, context.Canceled) {
-			err = rpctypes.ErrGRPCWatchCanceled
+	case err = <-recvErr:
+	case <-s.stopping:
+		st.drain()
+		// clientv3 closes the stream once its watchers are canceled. Ending
+		// the stream first races with the cancel responses, and the client
+		// may resume the watchers instead.
+		select {
+		case err = <-recvErr:
+		case <-time.After(drainTimeout):
+			err = rpctypes.ErrGRPCStopped
 		}
 	}
-	w.Stop()
+	cancel()
+	st.stopAll()
+	// Nothing may be sent once Watch has returned.
+	<-sent
+
+	select {
+	case err := <-sendErr:
+		return err
+	default:
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+		return nil
+	}
 
 	return err
 }
 
-func RegisterWatch(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger) error {
+// RegisterWatch registers the Watch service. Once stopping is closed, every
+// watcher is sent a cancel response and its stream ends.
+func RegisterWatch(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux, l *slog.Logger, drv driver.Driver, store *auth.Store, mb *member.Member, m *metrics.Metrics, stopping <-chan struct{}) error {
 	s := &watchServer{
-		log: l,
+		log:      l,
+		driver:   drv,
+		auth:     store,
+		member:   mb,
+		metrics:  m,
+		stopping: stopping,
 	}
 	etcdserverpb.RegisterWatchServer(gs, s)
 	if err := gw.RegisterWatchHandlerServer(ctx, mux, s); err != nil {
@@ -58,36 +139,482 @@ func RegisterWatch(ctx context.Context, gs *grpc.Server, mux *runtime.ServeMux,
 	return nil
 }
 
-func newWatcher(server etcdserverpb.Watch_WatchServer) *watcher {
-	return &watcher{
-		mutex:       sync.Mutex{},
-		watchServer: server,
-	}
+// watchStream multiplexes the watchers of one Watch stream. Responses are
+// serialized through send.
+type watchStream struct {
+	log     *slog.Logger
+	driver  driver.Driver
+	auth    *auth.Store
+	member  *member.Member
+	metrics *metrics.Metrics
+	ctx     context.Context
+	send    chan *etcdserverpb.WatchResponse
+
+	mu       sync.Mutex
+	nextID   int64
+	watchers map[int64]*streamWatcher
+	// awaiting holds the watchers a pending progress request waits for.
+	// Once each has passed a progress event at or after progressAt, the
+	// request is answered with progressAt.
+	awaiting   map[int64]struct{}
+	progressAt int64
+	// draining refuses new watchers once drain has started.
+	draining bool
 }
 
-type watcher struct {
-	mutex       sync.Mutex
-	watchServer etcdserverpb.Watch_WatchServer
+type streamWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// notifyAt, guarded by watchStream.mu, is the revision from which a
+	// progress event is sent as the progress notification of the watcher.
+	notifyAt int64
 }
 
-func (w *watcher) Start() error {
+func (st *watchStream) recv(server etcdserverpb.Watch_WatchServer) error {
 	for {
-		req, err := w.watchServer.Recv()
+		req, err := server.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch r := req.RequestUnion.(type) {
+		case *etcdserverpb.WatchRequest_CreateRequest:
+			if err := st.create(r.CreateRequest); err != nil {
+				return err
+			}
+		case *etcdserverpb.WatchRequest_CancelRequest:
+			if err := st.cancel(r.CancelRequest.WatchId); err != nil {
+				return err
+			}
+		case *etcdserverpb.WatchRequest_ProgressRequest:
+			if err := st.requestProgress(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (st *watchStream) create(req *etcdserverpb.WatchCreateRequest) error {
+	header, err := st.header()
+	if err != nil {
+		return err
+	}
+
+	err = checkPermitted(st.ctx, st.auth, req.Key, req.RangeEnd, false)
+	if err == nil {
+		err = ratelimit.AllowWatch(st.ctx)
+	}
+	if err != nil {
+		return st.respond(&etcdserverpb.WatchResponse{
+			Header:       header,
+			WatchId:      -1,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: err.Error(),
+		})
+	}
+
+	st.mu.Lock()
+	if st.draining {
+		st.mu.Unlock()
+		return st.respond(&etcdserverpb.WatchResponse{
+			Header:       header,
+			WatchId:      -1,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: rpctypes.ErrorDesc(rpctypes.ErrGRPCStopped),
+		})
+	}
+	id := req.WatchId
+	if id == 0 {
+		for st.watchers[st.nextID] != nil {
+			st.nextID++
+		}
+		id = st.nextID
+		st.nextID++
+	} else if st.watchers[id] != nil {
+		st.mu.Unlock()
+		return st.respond(&etcdserverpb.WatchResponse{
+			Header:       header,
+			WatchId:      -1,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: "watcher ID already exists",
+		})
+	}
+
+	startRevision := req.StartRevision
+	if startRevision == 0 {
+		startRevision = header.Revision + 1
+	}
+	ctx, cancel := context.WithCancel(st.ctx)
+	ch, err := st.driver.Watch(ctx, req.Key, req.RangeEnd, startRevision)
+	if errors.Is(err, driver.ErrCompacted) {
+		st.mu.Unlock()
+		cancel()
+		compact, err := st.driver.CompactRevision(st.ctx)
 		if err != nil {
+			return fmt.Errorf("failed to get compact revision: %w", err)
+		}
+		if err := st.respond(&etcdserverpb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+			return err
+		}
+		return st.respond(&etcdserverpb.WatchResponse{
+			Header:          header,
+			WatchId:         id,
+			Canceled:        true,
+			CompactRevision: compact,
+			CancelReason:    driver.ErrCompacted.Error(),
+		})
+	}
+	if err != nil {
+		st.mu.Unlock()
+		cancel()
+		st.log.Log(st.ctx, errorLevel(err), "failed to watch", "error", err)
+		return st.respond(&etcdserverpb.WatchResponse{
+			Header:       header,
+			WatchId:      id,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: err.Error(),
+		})
+	}
+	w := &streamWatcher{cancel: cancel, done: make(chan struct{})}
+	st.watchers[id] = w
+	st.mu.Unlock()
+
+	if err := st.respond(&etcdserverpb.WatchResponse{Header: header, WatchId: id, Created: true}); err != nil {
+		return err
+	}
+	st.metrics.Watchers.Inc()
+	go st.run(ctx, id, w, ch, req)
+
+	return nil
+}
+
+// run forwards the events of one watcher.
+func (st *watchStream) run(ctx context.Context, id int64, w *streamWatcher, ch <-chan *driver.WatchEvent, req *etcdserverpb.WatchCreateRequest) {
+	defer close(w.done)
+	defer st.metrics.Watchers.Dec()
+
+	var noPut, noDelete bool
+	for _, f := range req.Filters {
+		switch f {
+		case etcdserverpb.WatchCreateRequest_NOPUT:
+			noPut = true
+		case etcdserverpb.WatchCreateRequest_NODELETE:
+			noDelete = true
+		}
+	}
+
+	var progress <-chan time.Time
+	if req.ProgressNotify {
+		ticker := time.NewTicker(progressNotifyInterval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+
+	idle := true
+	for {
+		var ev *driver.WatchEvent
+		var ok bool
+		select {
+		case ev, ok = <-ch:
+		case <-progress:
+			if idle && st.notifyProgress(id, w) != nil {
+				return
+			}
+			idle = true
+			continue
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			break
+		}
+
+		// Batch whatever else is already pending, but wait for the rest of
+		// a revision so that its events are never split.
+		batch := []*driver.WatchEvent{ev}
+	drain:
+		for {
+			if ev.KV == nil || ev.Last {
+				if len(batch) >= maxEventsPerResponse {
+					break drain
+				}
+				select {
+				case ev, ok = <-ch:
+				default:
+					break drain
+				}
+			} else {
+				select {
+				case ev, ok = <-ch:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !ok {
+				break drain
+			}
+			batch = append(batch, ev)
+		}
+
+		// Progress events split the batch: the events before them must be
+		// sent before the progress is reported.
+		res := &etcdserverpb.WatchResponse{WatchId: id}
+		flush := func() error {
+			if len(res.Events) == 0 {
+				return nil
+			}
+			idle = false
+			sent := res
+			res = &etcdserverpb.WatchResponse{WatchId: id}
+			return st.respond(sent)
+		}
+		for _, ev := range batch {
+			if ev.KV == nil {
+				if flush() != nil || st.progressed(id, w, ev.Progress) != nil {
+					return
+				}
+				continue
+			}
+			if (ev.Deleted && noDelete) || (!ev.Deleted && noPut) {
+				continue
+			}
+			res.Header = st.member.Header(ev.KV.ModRevision)
+			res.Events = append(res.Events, toPBEvent(ev, req.PrevKv))
+		}
+		if flush() != nil {
+			return
+		}
+		if !ok {
+			break
+		}
+	}
+
+	// The driver gave up on the watcher, e.g. because it fell too far behind.
+	if ctx.Err() != nil {
+		return
+	}
+	st.mu.Lock()
+	delete(st.watchers, id)
+	st.mu.Unlock()
+	if st.forget(id) != nil {
+		return
+	}
+
+	header, err := st.header()
+	if err != nil {
+		return
+	}
+	_ = st.respond(&etcdserverpb.WatchResponse{
+		Header:       header,
+		WatchId:      id,
+		Canceled:     true,
+		CancelReason: "watcher was dropped",
+	})
+}
+
+func (st *watchStream) cancel(id int64) error {
+	st.mu.Lock()
+	w, ok := st.watchers[id]
+	delete(st.watchers, id)
+	st.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	w.cancel()
+	// Wait for in-flight events so none follow the cancellation.
+	<-w.done
+	if err := st.forget(id); err != nil {
+		return err
+	}
+
+	header, err := st.header()
+	if err != nil {
+		return err
+	}
+	return st.respond(&etcdserverpb.WatchResponse{Header: header, WatchId: id, Canceled: true})
+}
+
+// requestProgress answers a progress request once every event up to the
+// current revision has been sent on the stream. A request made while another
+// is pending is answered with it, as etcd does.
+func (st *watchStream) requestProgress() error {
+	header, err := st.header()
+	if err != nil {
+		return err
+	}
+	pr, ok := st.driver.(driver.ProgressRequester)
+
+	st.mu.Lock()
+	if !ok || len(st.watchers) == 0 {
+		st.mu.Unlock()
+		return st.respond(&etcdserverpb.WatchResponse{Header: header, WatchId: -1})
+	}
+	if st.awaiting != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.awaiting = make(map[int64]struct{}, len(st.watchers))
+	for id := range st.watchers {
+		st.awaiting[id] = struct{}{}
+	}
+	st.progressAt = header.Revision
+	st.mu.Unlock()
+
+	if err := pr.RequestProgress(st.ctx); err != nil {
+		st.mu.Lock()
+		st.awaiting = nil
+		st.mu.Unlock()
+		return fmt.Errorf("failed to request progress: %w", err)
+	}
+
+	return nil
+}
+
+// notifyProgress sends the progress notification of an idle watcher once
+// its events up to the current revision have been sent.
+func (st *watchStream) notifyProgress(id int64, w *streamWatcher) error {
+	header, err := st.header()
+	if err != nil {
+		return err
+	}
+	pr, ok := st.driver.(driver.ProgressRequester)
+	if !ok {
+		return st.respond(&etcdserverpb.WatchResponse{Header: header, WatchId: id})
+	}
+
+	st.mu.Lock()
+	w.notifyAt = header.Revision
+	st.mu.Unlock()
+
+	if err := pr.RequestProgress(st.ctx); err != nil {
+		return fmt.Errorf("failed to request progress: %w", err)
+	}
+
+	return nil
+}
+
+// progressed is called by watcher id once it has sent every event up to
+// revision.
+func (st *watchStream) progressed(id int64, w *streamWatcher, revision int64) error {
+	var responses []*etcdserverpb.WatchResponse
+	st.mu.Lock()
+	if w.notifyAt > 0 && revision >= w.notifyAt {
+		w.notifyAt = 0
+		responses = append(responses, &etcdserverpb.WatchResponse{Header: st.member.Header(revision), WatchId: id})
+	}
+	if res := st.passed(id, revision); res != nil {
+		responses = append(responses, res)
+	}
+	st.mu.Unlock()
+
+	for _, res := range responses {
+		if err := st.respond(res); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// forget stops a pending progress request from waiting for a removed
+// watcher.
+func (st *watchStream) forget(id int64) error {
+	st.mu.Lock()
+	res := st.passed(id, st.progressAt)
+	st.mu.Unlock()
+
+	if res == nil {
+		return nil
+	}
+	return st.respond(res)
+}
+
+// passed records that watcher id has sent every event up to revision and
+// returns the answer to the pending progress request once no watcher is left
+// to wait for. It must be called with mu held.
+func (st *watchStream) passed(id int64, revision int64) *etcdserverpb.WatchResponse {
+	if st.awaiting == nil || revision < st.progressAt {
+		return nil
+	}
+	delete(st.awaiting, id)
+	if len(st.awaiting) > 0 {
+		return nil
+	}
+	st.awaiting = nil
 
-		if req.GetCreateRequest() != nil {
-			w.handleCreateRequest(req.GetCreateRequest())
+	return &etcdserverpb.WatchResponse{Header: st.member.Header(st.progressAt), WatchId: -1}
+}
+
+// drain cancels every watcher, telling the client why, after the events in
+// flight have been sent.
+func (st *watchStream) drain() {
+	st.mu.Lock()
+	st.draining = true
+	watchers := st.watchers
+	st.watchers = map[int64]*streamWatcher{}
+	st.mu.Unlock()
+
+	header, err := st.header()
+	if err != nil {
+		st.log.ErrorContext(st.ctx, "failed to drain watchers", "error", err)
+		return
+	}
+	for id, w := range watchers {
+		w.cancel()
+		<-w.done
+		if err := st.respond(&etcdserverpb.WatchResponse{
+			Header:       header,
+			WatchId:      id,
+			Canceled:     true,
+			CancelReason: rpctypes.ErrorDesc(rpctypes.ErrGRPCStopped),
+		}); err != nil {
+			return
 		}
 	}
 }
 
-func (w *watcher) Stop() {
+func (st *watchStream) stopAll() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for id, w := range st.watchers {
+		w.cancel()
+		delete(st.watchers, id)
+	}
 }
 
-func (w *watcher) handleCreateRequest(req *etcdserverpb.WatchCreateRequest) {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
+func (st *watchStream) respond(res *etcdserverpb.WatchResponse) error {
+	select {
+	case st.send <- res:
+		return nil
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+}
+
+func (st *watchStream) header() (*etcdserverpb.ResponseHeader, error) {
+	revision, err := st.driver.CurrentRevision(st.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	return st.member.Header(revision), nil
+}
 
+func toPBEvent(ev *driver.WatchEvent, prevKV bool) *mvccpb.Event {
+	e := &mvccpb.Event{
+		Type: mvccpb.PUT,
+		Kv:   toPBKeyValue(ev.KV),
+	}
+	if ev.Deleted {
+		e.Type = mvccpb.DELETE
+	}
+	if prevKV && ev.PrevKV != nil {
+		e.PrevKv = toPBKeyValue(ev.PrevKV)
+	}
+	return e
 }
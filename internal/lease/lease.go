@@ -0,0 +1,572 @@
+package lease
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	// Bucket holds the leases in etcd's format: the ID as a big-endian
+	// int64 key and a leasepb.Lease value.
+	Bucket = "lease"
+
+	// MinTTL and MaxTTL bound granted TTLs in seconds, as etcd's defaults do.
+	MinTTL = 2
+	MaxTTL = 9000000000
+
+	expiryInterval = 500 * time.Millisecond
+	// catchUpTimeout bounds how long Revoke waits for the key attachments
+	// to reflect the latest writes.
+	catchUpTimeout = 5 * time.Second
+	resyncInterval = time.Second
+
+	// ExpiryActor is the user of the audit records of expired leases.
+	ExpiryActor = "lease-expiry"
+)
+
+var (
+	ErrLeaseNotFound    = errors.New("lease not found")
+	ErrLeaseExists      = errors.New("lease already exists")
+	ErrLeaseTTLTooLarge = errors.New("too large lease TTL")
+)
+
+var openKey = []byte{0}
+
+type lease struct {
+	id     int64
+	ttl    int64
+	expiry time.Time
+}
+
+// Lessor grants leases and revokes them, with the keys attached to them,
+// when they expire. Leases are persisted in the driver. Close checkpoints
+// their remaining TTLs, which the next start resumes from; leases of a
+// process that did not close restart with a full TTL, as etcd does after a
+// leader change.
+//
+// Attachments are learned by watching the driver, so keys written by any
+// path, including other processes sharing the database, are tracked.
+type Lessor struct {
+	log   *slog.Logger
+	drv   driver.Driver
+	audit *audit.Logger
+
+	// mu guards everything below. Writes of leased keys hold it for reading
+	// while they run, see Attach.
+	mu        sync.RWMutex
+	leases    map[int64]*lease
+	keyLeases map[string]int64
+	leaseKeys map[int64]map[string]struct{}
+	// processed is the revision the attachments reflect. progress is
+	// closed whenever it advances.
+	processed int64
+	progress  chan struct{}
+
+	expired atomic.Int64
+
+	// cancel stops the tracking and expiry, which signal done when they
+	// return.
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// New returns a Lessor of the leases persisted in drv. The expiry of a
+// lease and the deletion of its keys are recorded in al.
+func New(ctx context.Context, log *slog.Logger, drv driver.Driver, al *audit.Logger) (*Lessor, error) {
+	l := &Lessor{
+		log:       log,
+		drv:       drv,
+		audit:     al,
+		leases:    map[int64]*lease{},
+		keyLeases: map[string]int64{},
+		leaseKeys: map[int64]map[string]struct{}{},
+		progress:  make(chan struct{}),
+	}
+
+	now := time.Now()
+	var checkpointed []*lease
+	if err := drv.BucketForEach(ctx, Bucket, func(key []byte, value []byte) error {
+		id, ttl, remaining, err := unmarshalLease(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode lease %x: %w", key, err)
+		}
+		le := &lease{id: id, ttl: ttl, expiry: now.Add(time.Duration(ttl) * time.Second)}
+		if remaining > 0 && remaining < ttl {
+			le.expiry = now.Add(time.Duration(remaining) * time.Second)
+		}
+		if remaining != 0 {
+			checkpointed = append(checkpointed, le)
+		}
+		l.leases[id] = le
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("lease.New: failed to load leases: %w", err)
+	}
+	// A checkpoint is resumed once: a later crash restarts the lease with a
+	// full TTL rather than with this stale one.
+	for _, le := range checkpointed {
+		if err := drv.BucketPut(ctx, Bucket, leaseKey(le.id), marshalLease(le.id, le.ttl, 0)); err != nil {
+			return nil, fmt.Errorf("lease.New: failed to clear checkpoint of lease %d: %w", le.id, err)
+		}
+	}
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	ch, err := l.sync(ctx)
+	if err != nil {
+		l.cancel()
+		return nil, fmt.Errorf("lease.New: %w", err)
+	}
+	l.done.Add(2)
+	go func() {
+		defer l.done.Done()
+		l.track(ctx, ch)
+	}()
+	go func() {
+		defer l.done.Done()
+		l.expire(ctx)
+	}()
+
+	return l, nil
+}
+
+// Close stops expiring leases, waiting for a revocation in progress, and
+// checkpoints the remaining TTL of every lease, like etcd's lease
+// checkpoints, so a restart does not extend them.
+func (l *Lessor) Close(ctx context.Context) error {
+	l.cancel()
+	l.done.Wait()
+
+	l.mu.RLock()
+	leases := make([]lease, 0, len(l.leases))
+	for _, le := range l.leases {
+		leases = append(leases, *le)
+	}
+	l.mu.RUnlock()
+
+	now := time.Now()
+	for _, le := range leases {
+		remaining := int64(le.expiry.Sub(now).Round(time.Second) / time.Second)
+		// Zero means no checkpoint, so an expired lease keeps a second.
+		remaining = max(remaining, 1)
+		if err := l.drv.BucketPut(ctx, Bucket, leaseKey(le.id), marshalLease(le.id, le.ttl, remaining)); err != nil {
+			return fmt.Errorf("lease.Close: failed to checkpoint lease %d: %w", le.id, err)
+		}
+	}
+
+	return nil
+}
+
+// Grant creates a lease. An id of 0 picks a free one. The granted TTL is
+// returned.
+func (l *Lessor) Grant(ctx context.Context, id int64, ttl int64) (int64, int64, error) {
+	if ttl > MaxTTL {
+		return 0, 0, ErrLeaseTTLTooLarge
+	}
+	ttl = max(ttl, MinTTL)
+
+	l.mu.Lock()
+	if id == 0 {
+		for id == 0 || l.leases[id] != nil {
+			id = rand.Int64()
+		}
+	} else if l.leases[id] != nil {
+		l.mu.Unlock()
+		return 0, 0, ErrLeaseExists
+	}
+	le := &lease{id: id, ttl: ttl, expiry: time.Now().Add(time.Duration(ttl) * time.Second)}
+	l.leases[id] = le
+	l.mu.Unlock()
+
+	if err := l.drv.BucketPut(ctx, Bucket, leaseKey(id), marshalLease(id, ttl, 0)); err != nil {
+		l.mu.Lock()
+		delete(l.leases, id)
+		l.mu.Unlock()
+		return 0, 0, fmt.Errorf("lease.Grant: failed to persist lease: %w", err)
+	}
+
+	return id, ttl, nil
+}
+
+// Revoke removes the lease and deletes the keys attached to it.
+func (l *Lessor) Revoke(ctx context.Context, id int64) error {
+	_, _, err := l.remove(ctx, id)
+	return err
+}
+
+// remove is Revoke, returning the revision the attached keys were deleted
+// at and the keys.
+func (l *Lessor) remove(ctx context.Context, id int64) (int64, [][]byte, error) {
+	l.mu.Lock()
+	le, ok := l.leases[id]
+	if !ok {
+		l.mu.Unlock()
+		return 0, nil, ErrLeaseNotFound
+	}
+	// From here on writes using the lease fail, so once the attachments
+	// have caught up they are complete.
+	delete(l.leases, id)
+	l.mu.Unlock()
+
+	revision, deleted, err := l.revoke(ctx, id)
+	if err != nil {
+		l.mu.Lock()
+		l.leases[id] = le
+		l.mu.Unlock()
+		return 0, nil, fmt.Errorf("lease.Revoke: %w", err)
+	}
+
+	return revision, deleted, nil
+}
+
+func (l *Lessor) revoke(ctx context.Context, id int64) (int64, [][]byte, error) {
+	if err := l.catchUp(ctx); err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		revision int64
+		deleted  [][]byte
+	)
+	keys := l.Keys(id)
+	if len(keys) > 0 {
+		var err error
+		if revision, err = l.drv.Txn(ctx, func(txn driver.Txn) error {
+			deleted = deleted[:0]
+			for _, key := range keys {
+				result, err := txn.Range(key, nil, driver.RangeOptions{KeysOnly: true})
+				if err != nil {
+					return err
+				}
+				if len(result.KVs) == 0 || result.KVs[0].Lease != id {
+					continue
+				}
+				if _, err := txn.DeleteRange(key, nil); err != nil {
+					return err
+				}
+				deleted = append(deleted, key)
+			}
+			return nil
+		}); err != nil {
+			return 0, nil, fmt.Errorf("failed to delete attached keys: %w", err)
+		}
+	}
+
+	if err := l.drv.BucketDelete(ctx, Bucket, leaseKey(id)); err != nil {
+		return 0, nil, fmt.Errorf("failed to delete lease: %w", err)
+	}
+
+	return revision, deleted, nil
+}
+
+// catchUp waits until the attachments reflect the current revision.
+func (l *Lessor) catchUp(ctx context.Context) error {
+	current, err := l.drv.CurrentRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current revision: %w", err)
+	}
+
+	timer := time.NewTimer(catchUpTimeout)
+	defer timer.Stop()
+	for {
+		l.mu.RLock()
+		processed, progress := l.processed, l.progress
+		l.mu.RUnlock()
+		if processed >= current {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-timer.C:
+			l.log.Warn("lease.catchUp: attachments lag behind, revoking with what is known", "processed", processed, "current", current)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Renew restarts the TTL of the lease and returns it.
+func (l *Lessor) Renew(id int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	le, ok := l.leases[id]
+	if !ok {
+		return 0, ErrLeaseNotFound
+	}
+	le.expiry = time.Now().Add(time.Duration(le.ttl) * time.Second)
+
+	return le.ttl, nil
+}
+
+// TimeToLive returns the remaining and granted TTL in seconds.
+func (l *Lessor) TimeToLive(id int64) (int64, int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	le, ok := l.leases[id]
+	if !ok {
+		return 0, 0, ErrLeaseNotFound
+	}
+	remaining := int64(time.Until(le.expiry).Round(time.Second) / time.Second)
+
+	return max(remaining, 0), le.ttl, nil
+}
+
+// Keys returns the keys attached to the lease in key order.
+func (l *Lessor) Keys(id int64) [][]byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	keys := make([][]byte, 0, len(l.leaseKeys[id]))
+	for k := range l.leaseKeys[id] {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i]) < string(keys[j])
+	})
+
+	return keys
+}
+
+func (l *Lessor) Leases() []int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ids := make([]int64, 0, len(l.leases))
+	for id := range l.leases {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// Expired returns how many leases have expired since New.
+func (l *Lessor) Expired() int64 {
+	return l.expired.Load()
+}
+
+// Attach runs fn, which writes keys attached to ids, once every lease is
+// known to exist. No lease can be revoked while fn runs.
+func (l *Lessor) Attach(ids []int64, fn func() error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, id := range ids {
+		if _, ok := l.leases[id]; !ok {
+			return ErrLeaseNotFound
+		}
+	}
+
+	return fn()
+}
+
+// sync rebuilds the attachments from the current revision and watches the
+// writes after it.
+func (l *Lessor) sync(ctx context.Context) (<-chan *driver.WatchEvent, error) {
+	revision, err := l.drv.CurrentRevision(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current revision: %w", err)
+	}
+	result, err := l.drv.Range(ctx, openKey, openKey, driver.RangeOptions{Revision: revision, KeysOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	ch, err := l.drv.Watch(ctx, openKey, openKey, revision+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch keys: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.keyLeases = map[string]int64{}
+	l.leaseKeys = map[int64]map[string]struct{}{}
+	for _, kv := range result.KVs {
+		l.attach(string(kv.Key), kv.Lease)
+	}
+	l.advance(revision)
+
+	return ch, nil
+}
+
+// track follows the writes to keep the attachments current, starting over
+// whenever the watch ends.
+func (l *Lessor) track(ctx context.Context, ch <-chan *driver.WatchEvent) {
+	for {
+		for ev := range ch {
+			l.mu.Lock()
+			switch {
+			case ev.KV == nil:
+				l.advance(ev.Progress)
+			case ev.Deleted:
+				l.attach(string(ev.KV.Key), 0)
+				l.advance(ev.KV.ModRevision)
+			default:
+				l.attach(string(ev.KV.Key), ev.KV.Lease)
+				l.advance(ev.KV.ModRevision)
+			}
+			l.mu.Unlock()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(resyncInterval):
+			}
+
+			var err error
+			if ch, err = l.sync(ctx); err == nil {
+				break
+			}
+			l.log.Error("lease.track: failed to resync attachments", "error", err)
+		}
+	}
+}
+
+// attach records key as attached to id, or to no lease when id is 0. It
+// must be called with mu held.
+func (l *Lessor) attach(key string, id int64) {
+	if prev, ok := l.keyLeases[key]; ok {
+		delete(l.leaseKeys[prev], key)
+		if len(l.leaseKeys[prev]) == 0 {
+			delete(l.leaseKeys, prev)
+		}
+		delete(l.keyLeases, key)
+	}
+	if id == 0 {
+		return
+	}
+
+	l.keyLeases[key] = id
+	if l.leaseKeys[id] == nil {
+		l.leaseKeys[id] = map[string]struct{}{}
+	}
+	l.leaseKeys[id][key] = struct{}{}
+}
+
+// advance must be called with mu held.
+func (l *Lessor) advance(revision int64) {
+	if revision <= l.processed {
+		return
+	}
+	l.processed = revision
+	close(l.progress)
+	l.progress = make(chan struct{})
+}
+
+// expire revokes the leases whose TTL has run out.
+func (l *Lessor) expire(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var expired []int64
+		l.mu.RLock()
+		for id, le := range l.leases {
+			if now.After(le.expiry) {
+				expired = append(expired, id)
+			}
+		}
+		l.mu.RUnlock()
+
+		for _, id := range expired {
+			revision, deleted, err := l.remove(ctx, id)
+			if err == nil {
+				l.expired.Add(1)
+				l.auditExpiry(id, revision, deleted)
+			} else if !errors.Is(err, ErrLeaseNotFound) {
+				l.log.Error("lease.expire: failed to revoke lease", "lease", id, "error", err)
+			}
+		}
+	}
+}
+
+// auditExpiry records the revocation of an expired lease and the deletion
+// of its keys as made by ExpiryActor.
+func (l *Lessor) auditExpiry(id int64, revision int64, deleted [][]byte) {
+	recs := []audit.Record{{User: ExpiryActor, Method: "LeaseRevoke", Lease: id, Revision: revision}}
+	for _, key := range deleted {
+		recs = append(recs, audit.Record{User: ExpiryActor, Method: "LeaseRevoke", Op: "delete", Key: string(key), Revision: revision, Lease: id})
+	}
+	if err := l.audit.Log(recs...); err != nil {
+		l.log.Error("lease.expire: failed to write audit log", "lease", id, "error", err)
+	}
+}
+
+func leaseKey(id int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	return b[:]
+}
+
+// marshalLease encodes a leasepb.Lease{ID, TTL, RemainingTTL}. A zero
+// remaining TTL is left out, as in etcd.
+func marshalLease(id int64, ttl int64, remaining int64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(id))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(ttl))
+	if remaining != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(remaining))
+	}
+	return b
+}
+
+func unmarshalLease(b []byte) (int64, int64, int64, error) {
+	var id, ttl, remaining int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, 0, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ == protowire.VarintType && num >= 1 && num <= 3 {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, 0, 0, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				id = int64(v)
+			case 2:
+				ttl = int64(v)
+			case 3:
+				remaining = int64(v)
+			}
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return 0, 0, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return id, ttl, remaining, nil
+}
@@ -0,0 +1,210 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+func newDriver(t *testing.T) driver.Driver {
+	t.Helper()
+	d, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func newLessor(t *testing.T, drv driver.Driver) *Lessor {
+	t.Helper()
+	return newAuditedLessor(t, drv, nil)
+}
+
+func newAuditedLessor(t *testing.T, drv driver.Driver, al *audit.Logger) *Lessor {
+	t.Helper()
+	l, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), drv, al)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close(context.Background()) })
+	return l
+}
+
+func put(t *testing.T, drv driver.Driver, key string, lease int64) {
+	t.Helper()
+	if _, err := drv.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), []byte("v"), lease)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(t *testing.T, drv driver.Driver, key string) bool {
+	t.Helper()
+	res, err := drv.Range(context.Background(), []byte(key), nil, driver.RangeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(res.KVs) > 0
+}
+
+func TestGrant(t *testing.T) {
+	ctx := context.Background()
+	l := newLessor(t, newDriver(t))
+
+	id, ttl, err := l.Grant(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 0 || ttl != MinTTL {
+		t.Errorf("Grant returned lease %d with TTL %d, want a lease with TTL %d", id, ttl, MinTTL)
+	}
+	if _, _, err := l.Grant(ctx, id, 10); !errors.Is(err, ErrLeaseExists) {
+		t.Errorf("granting lease %d twice returned %v", id, err)
+	}
+	if _, _, err := l.Grant(ctx, 0, MaxTTL+1); !errors.Is(err, ErrLeaseTTLTooLarge) {
+		t.Errorf("granting a TTL over MaxTTL returned %v", err)
+	}
+	if _, _, err := l.TimeToLive(42); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("TimeToLive of an unknown lease returned %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	drv := newDriver(t)
+	l := newLessor(t, drv)
+
+	if _, _, err := l.Grant(ctx, 1, 60); err != nil {
+		t.Fatal(err)
+	}
+	put(t, drv, "a", 1)
+	put(t, drv, "b", 1)
+	put(t, drv, "c", 0)
+	// b is detached by being overwritten without the lease.
+	put(t, drv, "b", 0)
+
+	if err := l.Revoke(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if got := exists(t, drv, key); got != want {
+			t.Errorf("%s exists: %v, want %v", key, got, want)
+		}
+	}
+	if err := l.Revoke(ctx, 1); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("revoking twice returned %v", err)
+	}
+	if _, err := drv.BucketGet(ctx, Bucket, leaseKey(1)); !errors.Is(err, driver.ErrKeyNotFound) {
+		t.Errorf("the revoked lease is still persisted: %v", err)
+	}
+}
+
+// syncBuffer is written by the expiry while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	drv := newDriver(t)
+	var records syncBuffer
+	l := newAuditedLessor(t, drv, audit.New(&records, audit.Options{}))
+
+	id, _, err := l.Grant(ctx, 0, MinTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, drv, "a", id)
+
+	deadline := time.Now().Add(MinTTL*time.Second + 5*time.Second)
+	for exists(t, drv, "a") {
+		if time.Now().After(deadline) {
+			t.Fatal("the key of an expired lease was not deleted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if l.Expired() != 1 {
+		t.Errorf("Expired() = %d, want 1", l.Expired())
+	}
+
+	var recs []audit.Record
+	for time.Now().Before(deadline) {
+		if lines := records.lines(); len(lines) == 2 {
+			for _, line := range lines {
+				var rec audit.Record
+				if err := json.Unmarshal([]byte(line), &rec); err != nil {
+					t.Fatal(err)
+				}
+				recs = append(recs, rec)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("audit records of the expiry: %q", records.lines())
+	}
+	for _, rec := range recs {
+		if rec.User != ExpiryActor || rec.Lease != id {
+			t.Errorf("record %+v is not of lease %d by %s", rec, id, ExpiryActor)
+		}
+	}
+	if recs[1].Op != "delete" || recs[1].Key != "a" || recs[1].Revision == 0 {
+		t.Errorf("deletion record %+v, want a delete of a", recs[1])
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	drv := newDriver(t)
+	l := newLessor(t, drv)
+
+	if _, _, err := l.Grant(ctx, 1, 60); err != nil {
+		t.Fatal(err)
+	}
+	put(t, drv, "a", 1)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The attachments are rebuilt from the keys and the checkpointed TTL is
+	// resumed.
+	restarted := newLessor(t, drv)
+	remaining, ttl, err := restarted.TimeToLive(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 60 || remaining > 60 || remaining < 55 {
+		t.Errorf("TimeToLive after restarting is %d of %d", remaining, ttl)
+	}
+	if keys := restarted.Keys(1); len(keys) != 1 || string(keys[0]) != "a" {
+		t.Errorf("keys of the lease after restarting are %q", keys)
+	}
+}
@@ -0,0 +1,50 @@
+// Package logging builds the logger of the shim and logs the requests it
+// serves.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// NewHandler returns a handler writing records at level or above to w in
+// format, which is json or text. level may be changed while the handler is
+// in use.
+func NewHandler(w io.Writer, format string, level *slog.LevelVar) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("logging.NewHandler: unknown format %q", format)
+	}
+}
+
+// HandlerLevel parses the level of a handler: debug, info, warn or error.
+func HandlerLevel(s string) (slog.Level, error) {
+	level, off, err := ParseLevel(s)
+	if err != nil {
+		return 0, fmt.Errorf("logging.HandlerLevel: %w", err)
+	}
+	if off {
+		return 0, fmt.Errorf("logging.HandlerLevel: level off is only valid for requests")
+	}
+	return level, nil
+}
+
+// ParseLevel parses debug, info, warn or error. off reports the level that
+// disables logging.
+func ParseLevel(s string) (level slog.Level, off bool, err error) {
+	if strings.EqualFold(s, "off") {
+		return 0, true, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, false, fmt.Errorf("failed to parse level %q: %w", s, err)
+	}
+	return level, false, nil
+}
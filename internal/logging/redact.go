@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// redactor describes requests as log attributes. Values are only included
+// for keys under one of prefixes; passwords never are.
+type redactor struct {
+	prefixes []string
+}
+
+func (r *redactor) value(key []byte, value []byte) string {
+	for _, p := range r.prefixes {
+		if bytes.HasPrefix(key, []byte(p)) {
+			return string(value)
+		}
+	}
+	return fmt.Sprintf("<redacted %d bytes>", len(value))
+}
+
+func (r *redactor) request(req any) []slog.Attr {
+	switch q := req.(type) {
+	case *etcdserverpb.RangeRequest:
+		return []slog.Attr{
+			slog.String("key", string(q.Key)),
+			slog.String("range_end", string(q.RangeEnd)),
+			slog.Int64("revision", q.Revision),
+			slog.Int64("limit", q.Limit),
+			slog.Bool("count_only", q.CountOnly),
+		}
+	case *etcdserverpb.PutRequest:
+		return []slog.Attr{
+			slog.String("key", string(q.Key)),
+			slog.String("value", r.value(q.Key, q.Value)),
+			slog.Int64("lease", q.Lease),
+			slog.Bool("prev_kv", q.PrevKv),
+			slog.Bool("ignore_value", q.IgnoreValue),
+			slog.Bool("ignore_lease", q.IgnoreLease),
+		}
+	case *etcdserverpb.DeleteRangeRequest:
+		return []slog.Attr{
+			slog.String("key", string(q.Key)),
+			slog.String("range_end", string(q.RangeEnd)),
+			slog.Bool("prev_kv", q.PrevKv),
+		}
+	case *etcdserverpb.TxnRequest:
+		return []slog.Attr{
+			slog.Any("compare", r.compares(q.Compare)),
+			slog.Any("success", r.ops(q.Success)),
+			slog.Any("failure", r.ops(q.Failure)),
+		}
+	case *etcdserverpb.CompactionRequest:
+		return []slog.Attr{slog.Int64("revision", q.Revision), slog.Bool("physical", q.Physical)}
+	case *etcdserverpb.LeaseGrantRequest:
+		return []slog.Attr{slog.Int64("id", q.ID), slog.Int64("ttl", q.TTL)}
+	case *etcdserverpb.LeaseRevokeRequest:
+		return []slog.Attr{slog.Int64("id", q.ID)}
+	case *etcdserverpb.LeaseTimeToLiveRequest:
+		return []slog.Attr{slog.Int64("id", q.ID), slog.Bool("keys", q.Keys)}
+	case *etcdserverpb.AuthenticateRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthUserAddRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthUserGetRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthUserDeleteRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthUserChangePasswordRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthUserGrantRoleRequest:
+		return []slog.Attr{slog.String("user", q.User), slog.String("role", q.Role)}
+	case *etcdserverpb.AuthUserRevokeRoleRequest:
+		return []slog.Attr{slog.String("name", q.Name), slog.String("role", q.Role)}
+	case *etcdserverpb.AuthRoleAddRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthRoleGetRequest:
+		return []slog.Attr{slog.String("role", q.Role)}
+	case *etcdserverpb.AuthRoleDeleteRequest:
+		return []slog.Attr{slog.String("role", q.Role)}
+	case *etcdserverpb.AuthRoleGrantPermissionRequest:
+		return []slog.Attr{slog.String("name", q.Name)}
+	case *etcdserverpb.AuthRoleRevokePermissionRequest:
+		return []slog.Attr{slog.String("role", q.Role), slog.String("key", string(q.Key))}
+	}
+	return nil
+}
+
+func (r *redactor) compares(cmps []*etcdserverpb.Compare) []string {
+	out := make([]string, 0, len(cmps))
+	for _, c := range cmps {
+		var target string
+		switch t := c.TargetUnion.(type) {
+		case *etcdserverpb.Compare_Version:
+			target = fmt.Sprint(t.Version)
+		case *etcdserverpb.Compare_CreateRevision:
+			target = fmt.Sprint(t.CreateRevision)
+		case *etcdserverpb.Compare_ModRevision:
+			target = fmt.Sprint(t.ModRevision)
+		case *etcdserverpb.Compare_Value:
+			target = r.value(c.Key, t.Value)
+		case *etcdserverpb.Compare_Lease:
+			target = fmt.Sprint(t.Lease)
+		}
+		out = append(out, fmt.Sprintf("%s(%s) %s %s", c.Target, keyRange(c.Key, c.RangeEnd), c.Result, target))
+	}
+	return out
+}
+
+func (r *redactor) ops(ops []*etcdserverpb.RequestOp) []string {
+	out := make([]string, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			out = append(out, "range "+keyRange(o.RequestRange.Key, o.RequestRange.RangeEnd))
+		case *etcdserverpb.RequestOp_RequestPut:
+			out = append(out, fmt.Sprintf("put %s = %s", o.RequestPut.Key, r.value(o.RequestPut.Key, o.RequestPut.Value)))
+		case *etcdserverpb.RequestOp_RequestDeleteRange:
+			out = append(out, "delete "+keyRange(o.RequestDeleteRange.Key, o.RequestDeleteRange.RangeEnd))
+		case *etcdserverpb.RequestOp_RequestTxn:
+			out = append(out, fmt.Sprintf("txn (%d compares, %d success, %d failure)",
+				len(o.RequestTxn.Compare), len(o.RequestTxn.Success), len(o.RequestTxn.Failure)))
+		}
+	}
+	return out
+}
+
+func keyRange(key []byte, end []byte) string {
+	if len(end) == 0 {
+		return string(key)
+	}
+	return string(key) + ".." + string(end)
+}
@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRequestLevel = slog.LevelDebug
+	// httpMethod is the policy name of requests not served over gRPC.
+	httpMethod = "HTTP"
+)
+
+// streamingPaths are the gateway endpoints that stream, so are never slow.
+var streamingPaths = map[string]bool{
+	"/v3/watch":           true,
+	"/v3/lease/keepalive": true,
+}
+
+// RequestOptions configures the request log. The zero value logs every
+// request at debug level with values redacted and no slow-request warning.
+type RequestOptions struct {
+	// Level is the level requests are logged at, or off. Defaults to debug.
+	Level string
+	// Methods overrides Level per method, keyed by the short gRPC method
+	// name, e.g. Range or LeaseKeepAlive, or HTTP for the other requests.
+	Methods map[string]string
+	// Sample logs only one in every n requests of a method.
+	Sample map[string]int
+	// SlowThreshold, if positive, logs unary and HTTP requests taking
+	// longer at warn level regardless of the level and sampling.
+	SlowThreshold time.Duration
+	// ValuePrefixes are the key prefixes whose values are logged. Values of
+	// all other keys are redacted.
+	ValuePrefixes []string
+}
+
+// RequestLogger logs the requests passing its interceptors and handler.
+type RequestLogger struct {
+	log           *slog.Logger
+	level         slog.Level
+	off           bool
+	methods       map[string]methodPolicy
+	slowThreshold time.Duration
+	redactor      *redactor
+}
+
+type methodPolicy struct {
+	level slog.Level
+	off   bool
+	every uint64
+	// seen counts the requests of a sampled method.
+	seen *atomic.Uint64
+}
+
+func NewRequestLogger(log *slog.Logger, opts RequestOptions) (*RequestLogger, error) {
+	l := &RequestLogger{
+		log:           log,
+		level:         defaultRequestLevel,
+		methods:       map[string]methodPolicy{},
+		slowThreshold: opts.SlowThreshold,
+		redactor:      &redactor{prefixes: opts.ValuePrefixes},
+	}
+	if opts.Level != "" {
+		var err error
+		if l.level, l.off, err = ParseLevel(opts.Level); err != nil {
+			return nil, fmt.Errorf("logging.NewRequestLogger: %w", err)
+		}
+	}
+
+	for method, level := range opts.Methods {
+		p := l.methods[method]
+		var err error
+		if p.level, p.off, err = ParseLevel(level); err != nil {
+			return nil, fmt.Errorf("logging.NewRequestLogger: method %s: %w", method, err)
+		}
+		l.methods[method] = p
+	}
+	for method, n := range opts.Sample {
+		if n < 1 {
+			return nil, fmt.Errorf("logging.NewRequestLogger: method %s: sample must be positive, got %d", method, n)
+		}
+		p, ok := l.methods[method]
+		if !ok {
+			p.level, p.off = l.level, l.off
+		}
+		p.every, p.seen = uint64(n), &atomic.Uint64{}
+		l.methods[method] = p
+	}
+
+	return l, nil
+}
+
+// policy returns the level method is logged at and whether this request is
+// logged at all.
+func (l *RequestLogger) policy(method string) (slog.Level, bool) {
+	p, ok := l.methods[method]
+	if !ok {
+		return l.level, !l.off
+	}
+	if p.off {
+		return p.level, false
+	}
+	if p.every > 1 && (p.seen.Add(1)-1)%p.every != 0 {
+		return p.level, false
+	}
+	return p.level, true
+}
+
+// logRequest logs a request of method. attrs is only called when the request
+// is logged.
+func (l *RequestLogger) logRequest(ctx context.Context, method string, elapsed time.Duration, slowCheck bool, attrs func() []slog.Attr) {
+	slow := slowCheck && l.slowThreshold > 0 && elapsed > l.slowThreshold
+	level, ok := l.policy(method)
+	if slow {
+		level, ok = slog.LevelWarn, true
+	}
+	if !ok || !l.log.Enabled(ctx, level) {
+		return
+	}
+
+	msg := "Request"
+	if slow {
+		msg = "Slow request"
+	}
+	l.log.LogAttrs(ctx, level, msg, append([]slog.Attr{
+		slog.String("method", method),
+		slog.Duration("duration", elapsed),
+	}, attrs()...)...)
+}
+
+func (l *RequestLogger) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+
+		l.logRequest(ctx, shortMethod(info.FullMethod), time.Since(start), true, func() []slog.Attr {
+			return append(l.redactor.request(req), slog.String("code", status.Code(err).String()))
+		})
+
+		return res, err
+	}
+}
+
+// StreamInterceptor logs streams once they end. Streams live as long as
+// their clients, so they are never reported as slow.
+func (l *RequestLogger) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+
+		l.logRequest(ss.Context(), shortMethod(info.FullMethod), time.Since(start), false, func() []slog.Attr {
+			return []slog.Attr{slog.String("code", status.Code(err).String())}
+		})
+
+		return err
+	}
+}
+
+// HTTPHandler logs the requests h serves under the method HTTP.
+func (l *RequestLogger) HTTPHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+
+		l.logRequest(r.Context(), httpMethod, time.Since(start), !streamingPaths[r.URL.Path], func() []slog.Attr {
+			return []slog.Attr{
+				slog.String("http_method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("remote", r.RemoteAddr),
+			}
+		})
+	})
+}
+
+func shortMethod(method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
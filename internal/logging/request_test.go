@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+func TestUnaryInterceptor(t *testing.T) {
+	put := func(key string, value string) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{
+			RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte(value)},
+		}}
+	}
+	txn := &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte("secret/a"),
+			Target:      etcdserverpb.Compare_VALUE,
+			TargetUnion: &etcdserverpb.Compare_Value{Value: []byte("old-secret")},
+		}},
+		Success: []*etcdserverpb.RequestOp{put("secret/a", "new-secret"), put("config/a", "on")},
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts RequestOptions
+		// level is the level of the handler.
+		level   slog.Level
+		method  string
+		req     any
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "put redacted by default",
+			level:   slog.LevelDebug,
+			method:  "/etcdserverpb.KV/Put",
+			req:     &etcdserverpb.PutRequest{Key: []byte("config/a"), Value: []byte("on")},
+			want:    []string{`"level":"DEBUG"`, `"method":"Put"`, `"key":"config/a"`, `"value":"<redacted 2 bytes>"`},
+			notWant: []string{`"value":"on"`},
+		},
+		{
+			name:   "put under a value prefix",
+			opts:   RequestOptions{ValuePrefixes: []string{"config/"}},
+			level:  slog.LevelDebug,
+			method: "/etcdserverpb.KV/Put",
+			req:    &etcdserverpb.PutRequest{Key: []byte("config/a"), Value: []byte("on")},
+			want:   []string{`"value":"on"`},
+		},
+		{
+			name:    "put outside the value prefixes",
+			opts:    RequestOptions{ValuePrefixes: []string{"config/"}},
+			level:   slog.LevelDebug,
+			method:  "/etcdserverpb.KV/Put",
+			req:     &etcdserverpb.PutRequest{Key: []byte("secret/a"), Value: []byte("s3cret")},
+			want:    []string{`"value":"<redacted 6 bytes>"`},
+			notWant: []string{"s3cret"},
+		},
+		{
+			name:    "txn compares and puts",
+			opts:    RequestOptions{ValuePrefixes: []string{"config/"}},
+			level:   slog.LevelDebug,
+			method:  "/etcdserverpb.KV/Txn",
+			req:     txn,
+			want:    []string{"VALUE(secret/a) EQUAL <redacted 10 bytes>", "put secret/a = <redacted 10 bytes>", "put config/a = on"},
+			notWant: []string{"old-secret", "new-secret"},
+		},
+		{
+			name:    "passwords are never logged",
+			opts:    RequestOptions{ValuePrefixes: []string{""}},
+			level:   slog.LevelDebug,
+			method:  "/etcdserverpb.Auth/UserAdd",
+			req:     &etcdserverpb.AuthUserAddRequest{Name: "alice", Password: "hunter2"},
+			want:    []string{`"name":"alice"`},
+			notWant: []string{"hunter2"},
+		},
+		{
+			name:   "requests are debug by default",
+			level:  slog.LevelInfo,
+			method: "/etcdserverpb.KV/Range",
+			req:    &etcdserverpb.RangeRequest{Key: []byte("a")},
+		},
+		{
+			name:   "request level",
+			opts:   RequestOptions{Level: "info"},
+			level:  slog.LevelInfo,
+			method: "/etcdserverpb.KV/Range",
+			req:    &etcdserverpb.RangeRequest{Key: []byte("a")},
+			want:   []string{`"level":"INFO"`, `"method":"Range"`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := NewRequestLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: tt.level})), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = l.UnaryInterceptor()(context.Background(), tt.req, &grpc.UnaryServerInfo{FullMethod: tt.method}, func(ctx context.Context, req any) (any, error) {
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+			if len(tt.want) == 0 && out != "" {
+				t.Errorf("logged %s, want nothing", out)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("log %s does not contain %s", out, s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("log %s contains %s", out, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Package member holds the identity the server reports as the only member of
+// its etcd cluster.
+package member
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	// Bucket holds the cluster and member IDs and the raft term, each as a
+	// big-endian uint64.
+	Bucket = "member"
+)
+
+var (
+	clusterIDKey = []byte("clusterID")
+	memberIDKey  = []byte("memberID")
+	raftTermKey  = []byte("raftTerm")
+)
+
+// Member is the identity of the server. The IDs are generated once and kept
+// with the data, so they survive restarts; servers sharing a database report
+// the same IDs.
+type Member struct {
+	ClusterID uint64
+	ID        uint64
+	// RaftTerm is incremented on every start, as a restarted etcd member
+	// elects itself in a new term.
+	RaftTerm uint64
+	// ClientURLs are the advertised client URLs.
+	ClientURLs []string
+}
+
+// Load reads the identity stored in drv, generating the IDs on first start,
+// and starts a new raft term.
+func Load(ctx context.Context, drv driver.Driver) (*Member, error) {
+	clusterID, err := loadID(ctx, drv, clusterIDKey)
+	if err != nil {
+		return nil, fmt.Errorf("member.Load: %w", err)
+	}
+	id, err := loadID(ctx, drv, memberIDKey)
+	if err != nil {
+		return nil, fmt.Errorf("member.Load: %w", err)
+	}
+
+	term, err := get(ctx, drv, raftTermKey)
+	if err != nil {
+		return nil, fmt.Errorf("member.Load: %w", err)
+	}
+	term++
+	if err := put(ctx, drv, raftTermKey, term); err != nil {
+		return nil, fmt.Errorf("member.Load: %w", err)
+	}
+
+	return &Member{ClusterID: clusterID, ID: id, RaftTerm: term}, nil
+}
+
+// Header returns the header of a response served at revision.
+func (m *Member) Header(revision int64) *etcdserverpb.ResponseHeader {
+	return &etcdserverpb.ResponseHeader{
+		ClusterId: m.ClusterID,
+		MemberId:  m.ID,
+		Revision:  revision,
+		RaftTerm:  m.RaftTerm,
+	}
+}
+
+// loadID returns the ID stored under key, generating it if missing.
+func loadID(ctx context.Context, drv driver.Driver, key []byte) (uint64, error) {
+	id, err := get(ctx, drv, key)
+	if err != nil || id != 0 {
+		return id, err
+	}
+
+	var b [8]byte
+	for id == 0 {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, fmt.Errorf("failed to generate %s: %w", key, err)
+		}
+		id = binary.BigEndian.Uint64(b[:])
+	}
+	if err := put(ctx, drv, key, id); err != nil {
+		return 0, err
+	}
+	// Another server sharing the database may have stored its ID first.
+	return get(ctx, drv, key)
+}
+
+// get returns the value of key, or zero if it is missing.
+func get(ctx context.Context, drv driver.Driver, key []byte) (uint64, error) {
+	b, err := drv.BucketGet(ctx, Bucket, key)
+	if errors.Is(err, driver.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid %s: %x", key, b)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func put(ctx context.Context, drv driver.Driver, key []byte, v uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	if err := drv.BucketPut(ctx, Bucket, key, b[:]); err != nil {
+		return fmt.Errorf("failed to put %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Package metrics exposes the Prometheus metrics of a server, using etcd's
+// metric names where the shim has an equivalent. Every server has a registry
+// of its own, so several servers can run in one process.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	grpcprometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/lease"
+)
+
+// collectTimeout bounds the driver calls made while scraping.
+const collectTimeout = 5 * time.Second
+
+type Metrics struct {
+	registry *prometheus.Registry
+	grpc     *grpcprometheus.ServerMetrics
+
+	// Operations are counted as etcd's mvcc layer counts them: per range,
+	// put and delete call, including those within transactions and
+	// compares, and txns only when they hold more than one operation.
+	RangeTotal  prometheus.Counter
+	PutTotal    prometheus.Counter
+	DeleteTotal prometheus.Counter
+	TxnTotal    prometheus.Counter
+
+	WatchStreams prometheus.Gauge
+	Watchers     prometheus.Gauge
+
+	LeaseGranted prometheus.Counter
+	LeaseRevoked prometheus.Counter
+	LeaseRenewed prometheus.Counter
+}
+
+func New(drv driver.Driver, lessor *lease.Lessor) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		grpc:     grpcprometheus.NewServerMetrics(),
+
+		RangeTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd", Subsystem: "mvcc", Name: "range_total",
+			Help: "Total number of ranges seen by this member.",
+		}),
+		PutTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd", Subsystem: "mvcc", Name: "put_total",
+			Help: "Total number of puts seen by this member.",
+		}),
+		DeleteTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd", Subsystem: "mvcc", Name: "delete_total",
+			Help: "Total number of deletes seen by this member.",
+		}),
+		TxnTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd", Subsystem: "mvcc", Name: "txn_total",
+			Help: "Total number of txns seen by this member.",
+		}),
+
+		WatchStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "etcd_debugging", Subsystem: "mvcc", Name: "watch_stream_total",
+			Help: "Total number of watch streams.",
+		}),
+		Watchers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "etcd_debugging", Subsystem: "mvcc", Name: "watcher_total",
+			Help: "Total number of watchers.",
+		}),
+
+		LeaseGranted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd_debugging", Subsystem: "lease", Name: "granted_total",
+			Help: "The total number of granted leases.",
+		}),
+		LeaseRevoked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd_debugging", Subsystem: "lease", Name: "revoked_total",
+			Help: "The total number of revoked leases.",
+		}),
+		LeaseRenewed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etcd_debugging", Subsystem: "lease", Name: "renewed_total",
+			Help: "The number of renewed leases seen by the leader.",
+		}),
+	}
+	m.grpc.EnableHandlingTimeHistogram()
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.grpc,
+		m.RangeTotal, m.PutTotal, m.DeleteTotal, m.TxnTotal,
+		m.WatchStreams, m.Watchers,
+		m.LeaseGranted, m.LeaseRevoked, m.LeaseRenewed,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "etcd", Subsystem: "server", Name: "lease_expired_total",
+			Help: "The total number of expired leases.",
+		}, func() float64 { return float64(lessor.Expired()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "etcd_shim", Subsystem: "lease", Name: "active",
+			Help: "The number of leases that have been granted and not yet revoked or expired.",
+		}, func() float64 { return float64(len(lessor.Leases())) }),
+		newDriverCollector(drv),
+	)
+
+	return m
+}
+
+// MustRegister adds collectors of other packages to the registry.
+func (m *Metrics) MustRegister(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// UnaryInterceptor and StreamInterceptor record the per-method handling time
+// and status codes as grpc_server_* metrics.
+func (m *Metrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return m.grpc.UnaryServerInterceptor()
+}
+
+func (m *Metrics) StreamInterceptor() grpc.StreamServerInterceptor {
+	return m.grpc.StreamServerInterceptor()
+}
+
+// InitializeGRPC reports every method of gs with zero values, so that rates
+// of methods not called yet are defined. Call it once all services are
+// registered.
+func (m *Metrics) InitializeGRPC(gs *grpc.Server) {
+	m.grpc.InitializeMetrics(gs)
+}
+
+// ObserveTxn adds the operations of a committed transaction.
+func (m *Metrics) ObserveTxn(t *CountingTxn) {
+	if t == nil {
+		return
+	}
+	if t.ranges+t.puts+t.deletes > 1 {
+		m.TxnTotal.Inc()
+	}
+	m.RangeTotal.Add(float64(t.ranges))
+	m.PutTotal.Add(float64(t.puts))
+	m.DeleteTotal.Add(float64(t.deletes))
+}
+
+// CountingTxn counts the operations made through a driver.Txn.
+type CountingTxn struct {
+	driver.Txn
+	ranges, puts, deletes int
+}
+
+func NewCountingTxn(txn driver.Txn) *CountingTxn {
+	return &CountingTxn{Txn: txn}
+}
+
+func (t *CountingTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	t.ranges++
+	return t.Txn.Range(key, end, opts)
+}
+
+func (t *CountingTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	t.puts++
+	return t.Txn.Put(key, value, lease)
+}
+
+func (t *CountingTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	t.deletes++
+	return t.Txn.DeleteRange(key, end)
+}
+
+// driverCollector reads the state of the driver on every scrape.
+type driverCollector struct {
+	drv      driver.Driver
+	size     *prometheus.Desc
+	keys     *prometheus.Desc
+	current  *prometheus.Desc
+	compact  *prometheus.Desc
+	hasSizer bool
+}
+
+func newDriverCollector(drv driver.Driver) *driverCollector {
+	_, hasSizer := drv.(driver.Sizer)
+	return &driverCollector{
+		drv:      drv,
+		hasSizer: hasSizer,
+		size: prometheus.NewDesc("etcd_mvcc_db_total_size_in_bytes",
+			"Total size of the underlying database physically allocated in bytes.", nil, nil),
+		keys: prometheus.NewDesc("etcd_debugging_mvcc_keys_total",
+			"Total number of keys.", nil, nil),
+		current: prometheus.NewDesc("etcd_debugging_mvcc_current_revision",
+			"The current revision of store.", nil, nil),
+		compact: prometheus.NewDesc("etcd_debugging_mvcc_compact_revision",
+			"The revision of the last compaction in store.", nil, nil),
+	}
+}
+
+func (c *driverCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c.hasSizer {
+		ch <- c.size
+	}
+	ch <- c.keys
+	ch <- c.current
+	ch <- c.compact
+}
+
+func (c *driverCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	if sizer, ok := c.drv.(driver.Sizer); ok {
+		size, err := sizer.Size(ctx)
+		ch <- gauge(c.size, float64(size), err)
+	}
+	result, err := c.drv.Range(ctx, []byte{0}, []byte{0}, driver.RangeOptions{CountOnly: true})
+	var count int64
+	if err == nil {
+		count = result.Count
+	}
+	ch <- gauge(c.keys, float64(count), err)
+	current, err := c.drv.CurrentRevision(ctx)
+	ch <- gauge(c.current, float64(current), err)
+	compact, err := c.drv.CompactRevision(ctx)
+	ch <- gauge(c.compact, float64(compact), err)
+}
+
+func gauge(desc *prometheus.Desc, value float64, err error) prometheus.Metric {
+	if err != nil {
+		return prometheus.NewInvalidMetric(desc, err)
+	}
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+}
@@ -0,0 +1,51 @@
+// Package middleware holds the helpers shared by the interceptors and HTTP
+// handlers that guard the services, such as the rate limits and the
+// tenants.
+package middleware
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// WrapServerStream returns ss with ctx as its context, for stream
+// interceptors passing values to the handler.
+func WrapServerStream(ss grpc.ServerStream, ctx context.Context) grpc.ServerStream {
+	return &serverStream{ServerStream: ss, ctx: ctx}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// WriteHTTPError writes err in the format of the gateway errors, with the
+// HTTP status the gateway maps its code to.
+func WriteHTTPError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(runtime.HTTPStatusFromCode(st.Code()))
+	_ = json.NewEncoder(w).Encode(struct {
+		Error   string `json:"error"`
+		Code    int32  `json:"code"`
+		Message string `json:"message"`
+	}{st.Message(), int32(st.Code()), st.Message()})
+}
+
+// CommonName returns the common name of the leaf of certs, if any.
+func CommonName(certs []*x509.Certificate) string {
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteHTTPError(t *testing.T) {
+	for code, want := range map[codes.Code]int{
+		codes.PermissionDenied:  http.StatusForbidden,
+		codes.ResourceExhausted: http.StatusTooManyRequests,
+	} {
+		w := httptest.NewRecorder()
+		WriteHTTPError(w, status.Error(code, "etcdserver: denied"))
+		if w.Code != want {
+			t.Errorf("%s written with status %d, want %d", code, w.Code, want)
+		}
+		var body struct {
+			Code    codes.Code `json:"code"`
+			Message string     `json:"message"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != code || body.Message != "etcdserver: denied" {
+			t.Errorf("%s written as %+v", code, body)
+		}
+	}
+}
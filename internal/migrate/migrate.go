@@ -0,0 +1,271 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const defaultBatchSize = 500
+
+var (
+	ErrSourceCompacted  = errors.New("source compacted past target revision")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	errStopHistory = errors.New("stop history")
+)
+
+// Migrator copies the full history and bucket contents of one driver into
+// another. Copies are resumable: every pass continues from the target's
+// current revision.
+type Migrator struct {
+	log       *slog.Logger
+	src       driver.Driver
+	dst       driver.Driver
+	batchSize int
+}
+
+func New(log *slog.Logger, src driver.Driver, dst driver.Driver, batchSize int) *Migrator {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	return &Migrator{
+		log:       log,
+		src:       src,
+		dst:       dst,
+		batchSize: batchSize,
+	}
+}
+
+// Pass copies everything committed to the source since the previous pass and
+// returns the source revision the target has caught up to.
+func (m *Migrator) Pass(ctx context.Context) (int64, error) {
+	srcRevision, err := m.src.CurrentRevision(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to get source revision: %w", err)
+	}
+	srcCompact, err := m.src.CompactRevision(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to get source compact revision: %w", err)
+	}
+	dstRevision, err := m.dst.CurrentRevision(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to get target revision: %w", err)
+	}
+
+	if dstRevision > srcRevision {
+		return 0, fmt.Errorf("migrate.Pass: target revision %d is ahead of source revision %d", dstRevision, srcRevision)
+	}
+	// Compaction drops tombstones and superseded versions, so once the
+	// source has compacted past what the target holds the gap cannot be
+	// reproduced incrementally.
+	if dstRevision > 0 && srcCompact > dstRevision {
+		return 0, fmt.Errorf("migrate.Pass: %w: compact revision %d, target revision %d", ErrSourceCompacted, srcCompact, dstRevision)
+	}
+
+	copied, err := m.copyHistory(ctx, dstRevision+1, srcRevision)
+	if err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to copy history: %w", err)
+	}
+
+	dstCompact, err := m.dst.CompactRevision(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to get target compact revision: %w", err)
+	}
+	if srcCompact > dstCompact {
+		if err := m.dst.Compact(ctx, srcCompact); err != nil {
+			return 0, fmt.Errorf("migrate.Pass: failed to compact target: %w", err)
+		}
+	}
+
+	if err := m.syncBuckets(ctx); err != nil {
+		return 0, fmt.Errorf("migrate.Pass: failed to sync buckets: %w", err)
+	}
+
+	m.log.Info(
+		"Migration pass completed",
+		"revision", srcRevision,
+		"events", copied,
+		"compact_revision", srcCompact,
+	)
+
+	return srcRevision, nil
+}
+
+// copyHistory copies the events in [start, end] and leaves the target at end.
+// Batches are cut on revision boundaries so an interrupted copy never leaves
+// a revision half applied.
+func (m *Migrator) copyHistory(ctx context.Context, start int64, end int64) (int, error) {
+	var (
+		batch  []*driver.WatchEvent
+		copied int
+	)
+	flush := func(revision int64) error {
+		if err := m.dst.Restore(ctx, batch, revision); err != nil {
+			return err
+		}
+		copied += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		full := false
+		err := m.src.History(ctx, start, func(ev *driver.WatchEvent) error {
+			rev := ev.KV.ModRevision
+			if rev > end {
+				return errStopHistory
+			}
+			if len(batch) >= m.batchSize && batch[len(batch)-1].KV.ModRevision != rev {
+				full = true
+				return errStopHistory
+			}
+			batch = append(batch, &driver.WatchEvent{
+				KV:      ev.KV,
+				Deleted: ev.Deleted,
+				Created: ev.Created,
+			})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopHistory) {
+			return copied, err
+		}
+		if !full {
+			break
+		}
+
+		last := batch[len(batch)-1].KV.ModRevision
+		if err := flush(last); err != nil {
+			return copied, err
+		}
+		start = last + 1
+	}
+
+	// The final batch also carries the target to the source revision, which
+	// may be past the last retained event.
+	if err := flush(end); err != nil {
+		return copied, err
+	}
+
+	return copied, nil
+}
+
+// syncBuckets makes every bucket of the target equal to the source's.
+func (m *Migrator) syncBuckets(ctx context.Context) error {
+	buckets, err := m.src.Buckets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list source buckets: %w", err)
+	}
+	dstBuckets, err := m.dst.Buckets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list target buckets: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for _, bucket := range buckets {
+		seen[bucket] = true
+	}
+	for _, bucket := range dstBuckets {
+		if !seen[bucket] {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	for _, bucket := range buckets {
+		src := map[string][]byte{}
+		if err := m.src.BucketForEach(ctx, bucket, func(key []byte, value []byte) error {
+			src[string(key)] = value
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to read source bucket %q: %w", bucket, err)
+		}
+
+		var stale [][]byte
+		if err := m.dst.BucketForEach(ctx, bucket, func(key []byte, value []byte) error {
+			v, ok := src[string(key)]
+			if !ok {
+				stale = append(stale, key)
+			} else if bytes.Equal(v, value) {
+				delete(src, string(key))
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to read target bucket %q: %w", bucket, err)
+		}
+
+		for _, key := range stale {
+			if err := m.dst.BucketDelete(ctx, bucket, key); err != nil {
+				return fmt.Errorf("failed to delete from target bucket %q: %w", bucket, err)
+			}
+		}
+		for key, value := range src {
+			if err := m.dst.BucketPut(ctx, bucket, []byte(key), value); err != nil {
+				return fmt.Errorf("failed to write target bucket %q: %w", bucket, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Verify compares the history checksums of both drivers up to the target's
+// revision, and the bucket checksums. The histories are compared from the
+// later of both compactions, as drivers may retain different events before
+// it.
+func (m *Migrator) Verify(ctx context.Context) error {
+	revision, err := m.dst.CurrentRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to get target revision: %w", err)
+	}
+	srcCompact, err := m.src.CompactRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to get source compact revision: %w", err)
+	}
+	dstCompact, err := m.dst.CompactRevision(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to get target compact revision: %w", err)
+	}
+	compact := max(srcCompact, dstCompact)
+	if compact > revision {
+		return fmt.Errorf("migrate.Verify: %w: compact revision %d, target revision %d", ErrSourceCompacted, compact, revision)
+	}
+
+	srcHash, err := driver.HashKV(ctx, m.src, compact, revision)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to hash source: %w", err)
+	}
+	dstHash, err := driver.HashKV(ctx, m.dst, compact, revision)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to hash target: %w", err)
+	}
+	if srcHash != dstHash {
+		return fmt.Errorf("migrate.Verify: %w: history at revision %d: source %08x, target %08x", ErrChecksumMismatch, revision, srcHash, dstHash)
+	}
+
+	srcBucketHash, err := driver.HashBuckets(ctx, m.src)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to hash source buckets: %w", err)
+	}
+	dstBucketHash, err := driver.HashBuckets(ctx, m.dst)
+	if err != nil {
+		return fmt.Errorf("migrate.Verify: failed to hash target buckets: %w", err)
+	}
+	if srcBucketHash != dstBucketHash {
+		return fmt.Errorf("migrate.Verify: %w: buckets: source %08x, target %08x", ErrChecksumMismatch, srcBucketHash, dstBucketHash)
+	}
+
+	m.log.Info(
+		"Migration verified",
+		"revision", revision,
+		"compact_revision", compact,
+		"hash", srcHash,
+		"bucket_hash", srcBucketHash,
+	)
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+func newDriver(t *testing.T) *memory.Driver {
+	t.Helper()
+	d, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func put(t *testing.T, d driver.Driver, key string, value string) int64 {
+	t.Helper()
+	revision, err := d.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), []byte(value), 0)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return revision
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src, dst := newDriver(t), newDriver(t)
+	for i := range 10 {
+		put(t, src, fmt.Sprintf("k%d", i%3), fmt.Sprint(i))
+	}
+	if err := src.Compact(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.BucketPut(ctx, "leases", []byte("1"), []byte("lease")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(slog.New(slog.NewTextHandler(io.Discard, nil)), src, dst, 2)
+	revision, err := m.Pass(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 10 {
+		t.Fatalf("Pass caught up to %d, want 10", revision)
+	}
+	if err := m.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A source compacted past the last pass still verifies against the
+	// events both drivers keep.
+	put(t, src, "k0", "late")
+	if _, err := m.Pass(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Compact(ctx, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.BucketPut(ctx, "leases", []byte("2"), []byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(ctx); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Verify with a stray bucket entry returned %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestHashKVCompaction(t *testing.T) {
+	ctx := context.Background()
+	a, b := newDriver(t), newDriver(t)
+	for i := range 6 {
+		put(t, a, "k", fmt.Sprint(i))
+		put(t, b, "k", fmt.Sprint(i))
+	}
+	if err := a.Compact(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	ha, err := driver.HashKV(ctx, a, 4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, err := driver.HashKV(ctx, b, 4, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ha != hb {
+		t.Fatalf("hashes from the same compact revision differ: %08x, %08x", ha, hb)
+	}
+}
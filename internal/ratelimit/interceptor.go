@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/aplulu/etcd-shim/internal/middleware"
+)
+
+// writeMethods are the unary methods drawing from the write budget. The
+// other methods of the limited services draw from the read budget.
+var writeMethods = map[string]bool{
+	"/etcdserverpb.KV/Put":                    true,
+	"/etcdserverpb.KV/DeleteRange":            true,
+	"/etcdserverpb.KV/Compact":                true,
+	"/etcdserverpb.Lease/LeaseGrant":          true,
+	"/etcdserverpb.Lease/LeaseRevoke":         true,
+	"/etcdserverpb.Auth/AuthEnable":           true,
+	"/etcdserverpb.Auth/AuthDisable":          true,
+	"/etcdserverpb.Auth/UserAdd":              true,
+	"/etcdserverpb.Auth/UserDelete":           true,
+	"/etcdserverpb.Auth/UserChangePassword":   true,
+	"/etcdserverpb.Auth/UserGrantRole":        true,
+	"/etcdserverpb.Auth/UserRevokeRole":       true,
+	"/etcdserverpb.Auth/RoleAdd":              true,
+	"/etcdserverpb.Auth/RoleDelete":           true,
+	"/etcdserverpb.Auth/RoleGrantPermission":  true,
+	"/etcdserverpb.Auth/RoleRevokePermission": true,
+}
+
+// limitedServices are the services whose unary methods are limited.
+var limitedServices = []string{"/etcdserverpb.KV/", "/etcdserverpb.Lease/", "/etcdserverpb.Auth/"}
+
+// httpClasses are the budgets of the gateway endpoints. Other /v3 endpoints
+// draw from the read budget. Txn bodies are not inspected, so every Txn
+// counts as a write.
+var httpClasses = map[string]class{
+	"/v3/kv/range":           classRead,
+	"/v3/kv/put":             classWrite,
+	"/v3/kv/deleterange":     classWrite,
+	"/v3/kv/txn":             classWrite,
+	"/v3/kv/compaction":      classWrite,
+	"/v3/lease/grant":        classWrite,
+	"/v3/lease/revoke":       classWrite,
+	"/v3/kv/lease/revoke":    classWrite,
+	"/v3/auth/enable":        classWrite,
+	"/v3/auth/disable":       classWrite,
+	"/v3/auth/user/add":      classWrite,
+	"/v3/auth/user/delete":   classWrite,
+	"/v3/auth/user/changepw": classWrite,
+	"/v3/auth/user/grant":    classWrite,
+	"/v3/auth/user/revoke":   classWrite,
+	"/v3/auth/role/add":      classWrite,
+	"/v3/auth/role/delete":   classWrite,
+	"/v3/auth/role/grant":    classWrite,
+	"/v3/auth/role/revoke":   classWrite,
+	"/v3/watch":              classWatch,
+	// Keep-alives have to get through for leases to survive.
+	"/v3/lease/keepalive": classNone,
+}
+
+var errTooManyInFlight = status.Error(codes.ResourceExhausted, "etcdserver: too many requests in flight")
+
+// exhausted is the error of a request over budget. It carries a RetryInfo
+// detail telling the client when to retry.
+func exhausted(delay time.Duration) error {
+	delay = delay.Truncate(time.Millisecond) + time.Millisecond
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("etcdserver: too many requests, retry after %s", delay))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+func unaryClass(method string, req any) class {
+	if method == "/etcdserverpb.KV/Txn" {
+		if txn, ok := req.(*etcdserverpb.TxnRequest); ok && !hasWrites(txn) {
+			return classRead
+		}
+		return classWrite
+	}
+	if writeMethods[method] {
+		return classWrite
+	}
+	for _, s := range limitedServices {
+		if strings.HasPrefix(method, s) {
+			return classRead
+		}
+	}
+	return classNone
+}
+
+// hasWrites reports whether either branch of txn may write.
+func hasWrites(txn *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			switch r := op.Request.(type) {
+			case *etcdserverpb.RequestOp_RequestPut, *etcdserverpb.RequestOp_RequestDeleteRange:
+				return true
+			case *etcdserverpb.RequestOp_RequestTxn:
+				if hasWrites(r.RequestTxn) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// UnaryInterceptor limits the unary KV, Lease and Auth requests. It must run
+// after authentication for KeyUser to see the user.
+func (l *Limiter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		c := unaryClass(info.FullMethod, req)
+		if c == classNone || !l.Enabled() {
+			return handler(ctx, req)
+		}
+
+		key := l.grpcKey(ctx)
+		if ok, delay := l.allow(key, c); !ok {
+			return nil, exhausted(delay)
+		}
+		done, ok := l.acquire(key)
+		if !ok {
+			return nil, errTooManyInFlight
+		}
+		defer done()
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor lets the Watch server admit watchers with AllowWatch.
+func (l *Limiter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info.FullMethod != "/etcdserverpb.Watch/Watch" || !l.Enabled() {
+			return handler(srv, ss)
+		}
+		ctx := context.WithValue(ss.Context(), watchKey{}, &watchAdmission{l: l, key: l.grpcKey(ss.Context())})
+		return handler(srv, middleware.WrapServerStream(ss, ctx))
+	}
+}
+
+type watchKey struct{}
+
+type watchAdmission struct {
+	l   *Limiter
+	key string
+}
+
+// AllowWatch takes a watcher creation from the budget of the client of the
+// Watch stream ctx belongs to. Rejecting a single creation leaves the other
+// watchers of the stream alone. Streams not seen by StreamInterceptor are
+// not limited.
+func AllowWatch(ctx context.Context) error {
+	a, ok := ctx.Value(watchKey{}).(*watchAdmission)
+	if !ok {
+		return nil
+	}
+	if ok, delay := a.l.allow(a.key, classWatch); !ok {
+		return exhausted(delay)
+	}
+	return nil
+}
+
+// HTTPHandler limits the gateway requests h serves. It must run after
+// authentication for KeyUser to see the user.
+func (l *Limiter) HTTPHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v3/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		c, ok := httpClasses[r.URL.Path]
+		if !ok {
+			c = classRead
+		}
+		if c == classNone || !l.Enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := l.httpKey(r)
+
+		if ok, delay := l.allow(key, c); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			middleware.WriteHTTPError(w, exhausted(delay))
+			return
+		}
+		// Watches live as long as their clients, so are not in flight.
+		if c != classWatch {
+			done, ok := l.acquire(key)
+			if !ok {
+				middleware.WriteHTTPError(w, errTooManyInFlight)
+				return
+			}
+			defer done()
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
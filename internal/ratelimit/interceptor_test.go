@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type userKey struct{}
+
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// clientContext returns the context of a request from 10.0.0.1 by user.
+func clientContext(user string) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2379}})
+	if user != "" {
+		ctx = context.WithValue(ctx, userKey{}, user)
+	}
+	return ctx
+}
+
+func callUnary(l *Limiter, ctx context.Context, method string, req any) error {
+	_, err := l.UnaryInterceptor()(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// checkExhausted fails unless err is etcd's error for a client over budget
+// with a retry hint.
+func checkExhausted(t *testing.T, err error) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted || !strings.HasPrefix(st.Message(), "etcdserver: too many requests") {
+		t.Fatalf("request over budget returned %v, want ResourceExhausted with too many requests", err)
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok && info.RetryDelay.AsDuration() > 0 {
+			return
+		}
+	}
+	t.Errorf("%v has no retry hint", err)
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	l, err := New(Options{
+		Key:   KeyUser,
+		Read:  Budget{Rate: 0.001, Burst: 2},
+		Write: Budget{Rate: 0.001, Burst: 1},
+	}, userFromContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := clientContext("alice"), clientContext("bob")
+
+	for range 2 {
+		if err := callUnary(l, alice, "/etcdserverpb.KV/Range", &etcdserverpb.RangeRequest{}); err != nil {
+			t.Fatalf("range within the burst: %v", err)
+		}
+	}
+	checkExhausted(t, callUnary(l, alice, "/etcdserverpb.KV/Range", &etcdserverpb.RangeRequest{}))
+
+	// Reads and writes have budgets of their own, and a Txn that only reads
+	// is a read.
+	if err := callUnary(l, alice, "/etcdserverpb.KV/Put", &etcdserverpb.PutRequest{}); err != nil {
+		t.Errorf("put with an exhausted read budget: %v", err)
+	}
+	checkExhausted(t, callUnary(l, alice, "/etcdserverpb.KV/Txn", &etcdserverpb.TxnRequest{
+		Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{}}}},
+	}))
+
+	// Another user from the same address has buckets of its own.
+	if err := callUnary(l, bob, "/etcdserverpb.KV/Range", &etcdserverpb.RangeRequest{}); err != nil {
+		t.Errorf("range of another user: %v", err)
+	}
+	// Methods outside the limited services are never throttled.
+	if err := callUnary(l, alice, "/etcdserverpb.Maintenance/Status", &etcdserverpb.StatusRequest{}); err != nil {
+		t.Errorf("status with an exhausted budget: %v", err)
+	}
+}
+
+// watchStream is a Watch stream that only has a context.
+type watchStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	l, err := New(Options{
+		Read:  Budget{Rate: 0.001, Burst: 1},
+		Watch: Budget{Rate: 0.001, Burst: 2},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &grpc.StreamServerInfo{FullMethod: "/etcdserverpb.Watch/Watch", IsClientStream: true, IsServerStream: true}
+
+	// Only the watchers created on a stream are counted, not the stream.
+	var created []error
+	for range 2 {
+		err := l.StreamInterceptor()(nil, &watchStream{ctx: clientContext("")}, info, func(srv any, ss grpc.ServerStream) error {
+			for range 2 {
+				created = append(created, AllowWatch(ss.Context()))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("watch stream: %v", err)
+		}
+	}
+	for i, err := range created[:2] {
+		if err != nil {
+			t.Errorf("watcher %d within the burst: %v", i, err)
+		}
+	}
+	for _, err := range created[2:] {
+		checkExhausted(t, err)
+	}
+
+	// The streams took nothing from the read budget.
+	if err := callUnary(l, clientContext(""), "/etcdserverpb.KV/Range", &etcdserverpb.RangeRequest{}); err != nil {
+		t.Errorf("range after the watch streams: %v", err)
+	}
+}
+
+func TestHTTPHandlerWatch(t *testing.T) {
+	l, err := New(Options{Watch: Budget{Rate: 0.001, Burst: 1}, MaxInFlight: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watch stays open while a range is served.
+	var ranged int
+	h := l.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/watch" {
+			return
+		}
+		for range 3 {
+			res := httptest.NewRecorder()
+			l.HTTPHandler(http.NotFoundHandler()).ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/v3/kv/range", nil))
+			if res.Code == http.StatusNotFound {
+				ranged++
+			}
+		}
+	}))
+
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/v3/watch", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("first watch stream returned %d", res.Code)
+	}
+	if ranged != 3 {
+		t.Errorf("%d of 3 ranges got through during a watch with one request in flight allowed", ranged)
+	}
+
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/v3/watch", nil))
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") == "" {
+		t.Errorf("second watch stream returned %d with Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+}
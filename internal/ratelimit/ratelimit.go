@@ -0,0 +1,280 @@
+// Package ratelimit throttles clients with token buckets, so a single
+// misbehaving client cannot starve the others. Reads, writes and watch
+// creations draw from separate budgets, and the number of requests a client
+// may have in flight can be capped as well.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/aplulu/etcd-shim/internal/middleware"
+)
+
+const (
+	// KeyIP tells clients apart by their IP address.
+	KeyIP = "ip"
+	// KeyUser tells clients apart by their authenticated user, falling back
+	// to the IP address while auth is disabled.
+	KeyUser = "user"
+	// KeyCN tells clients apart by the common name of their certificate,
+	// falling back to the IP address without TLS.
+	KeyCN = "cn"
+
+	// idleTimeout is how long the buckets of a client are kept after its
+	// last request.
+	idleTimeout = 10 * time.Minute
+)
+
+// Budget is a token bucket refilled at Rate requests per second holding up
+// to Burst requests. A zero Rate is unlimited.
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+func (b Budget) limiter() *rate.Limiter {
+	if b.Rate <= 0 {
+		return nil
+	}
+	burst := b.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(b.Rate), burst)
+}
+
+// update applies b to lim, keeping the tokens left, capped at the new
+// burst. A nil lim was unlimited and starts with a full bucket.
+func (b Budget) update(lim *rate.Limiter) *rate.Limiter {
+	if lim == nil || b.Rate <= 0 {
+		return b.limiter()
+	}
+	lim.SetLimit(rate.Limit(b.Rate))
+	lim.SetBurst(max(b.Burst, 1))
+	return lim
+}
+
+type Options struct {
+	// Key is one of ip, user or cn. Defaults to ip.
+	Key   string
+	Read  Budget
+	Write Budget
+	// Watch limits the watchers a client creates.
+	Watch Budget
+	// MaxInFlight caps the unary requests a client may have in flight. Zero
+	// is unlimited.
+	MaxInFlight int
+}
+
+// Limiter keeps the budgets of every client seen recently.
+type Limiter struct {
+	// opts is replaced by Update.
+	opts atomic.Pointer[Options]
+	// user returns the authenticated user of a request, if any.
+	user func(ctx context.Context) string
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	read, write, watch *rate.Limiter
+	inFlight           int
+	lastSeen           time.Time
+}
+
+// New returns a Limiter enforcing opts. user returns the authenticated user
+// of a request and is only used with KeyUser.
+func New(opts Options, user func(ctx context.Context) string) (*Limiter, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, fmt.Errorf("ratelimit.New: %w", err)
+	}
+
+	l := &Limiter{
+		user:    user,
+		clients: map[string]*client{},
+	}
+	l.opts.Store(&opts)
+	return l, nil
+}
+
+func (o *Options) normalize() error {
+	switch o.Key {
+	case "":
+		o.Key = KeyIP
+	case KeyIP, KeyUser, KeyCN:
+	default:
+		return fmt.Errorf("unknown key %q, want ip, user or cn", o.Key)
+	}
+	return nil
+}
+
+// Update replaces the options. Known clients keep the tokens they have
+// left, capped at the new bursts, and their requests in flight. Watch streams opened while no
+// limit was configured stay unlimited.
+func (l *Limiter) Update(opts Options) error {
+	if err := opts.normalize(); err != nil {
+		return fmt.Errorf("ratelimit.Update: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.opts.Store(&opts)
+	for _, cl := range l.clients {
+		cl.read, cl.write, cl.watch = opts.Read.update(cl.read), opts.Write.update(cl.write), opts.Watch.update(cl.watch)
+	}
+	return nil
+}
+
+// Enabled reports whether any limit is configured.
+func (l *Limiter) Enabled() bool {
+	opts := l.opts.Load()
+	return opts.Read.Rate > 0 || opts.Write.Rate > 0 || opts.Watch.Rate > 0 || opts.MaxInFlight > 0
+}
+
+// class selects the budget of a request.
+type class int
+
+const (
+	classNone class = iota
+	classRead
+	classWrite
+	classWatch
+)
+
+// allow takes a token of class for key. When the budget is exhausted it
+// returns false and how long until a token is available.
+func (l *Limiter) allow(key string, c class) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lim *rate.Limiter
+	switch cl := l.client(key); c {
+	case classRead:
+		lim = cl.read
+	case classWrite:
+		lim = cl.write
+	case classWatch:
+		lim = cl.watch
+	}
+	if lim == nil {
+		return true, 0
+	}
+
+	r := lim.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		// Rejected requests must not use up the tokens of later ones.
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// acquire counts a request of key in flight. The returned func ends it.
+func (l *Limiter) acquire(key string) (func(), bool) {
+	limit := l.opts.Load().MaxInFlight
+	if limit <= 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cl := l.client(key)
+	if cl.inFlight >= limit {
+		return nil, false
+	}
+	cl.inFlight++
+	return func() {
+		l.mu.Lock()
+		cl.inFlight--
+		cl.lastSeen = time.Now()
+		l.mu.Unlock()
+	}, true
+}
+
+// client returns the state of key, forgetting idle clients along the way.
+// l.mu must be held.
+func (l *Limiter) client(key string) *client {
+	now := time.Now()
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for k, cl := range l.clients {
+			if cl.inFlight == 0 && now.Sub(cl.lastSeen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	cl, ok := l.clients[key]
+	if !ok {
+		opts := l.opts.Load()
+		cl = &client{
+			read:  opts.Read.limiter(),
+			write: opts.Write.limiter(),
+			watch: opts.Watch.limiter(),
+		}
+		l.clients[key] = cl
+	}
+	cl.lastSeen = now
+	return cl
+}
+
+// grpcKey returns the key of the client of a gRPC request.
+func (l *Limiter) grpcKey(ctx context.Context) string {
+	p, _ := peer.FromContext(ctx)
+	switch l.opts.Load().Key {
+	case KeyUser:
+		if user := l.user(ctx); user != "" {
+			return "user:" + user
+		}
+	case KeyCN:
+		if p != nil {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				if cn := middleware.CommonName(info.State.PeerCertificates); cn != "" {
+					return "cn:" + cn
+				}
+			}
+		}
+	}
+	if p == nil {
+		return "ip:"
+	}
+	return "ip:" + host(p.Addr.String())
+}
+
+// httpKey returns the key of the client of a gateway request.
+func (l *Limiter) httpKey(r *http.Request) string {
+	switch l.opts.Load().Key {
+	case KeyUser:
+		if user := l.user(r.Context()); user != "" {
+			return "user:" + user
+		}
+	case KeyCN:
+		if r.TLS != nil {
+			if cn := middleware.CommonName(r.TLS.PeerCertificates); cn != "" {
+				return "cn:" + cn
+			}
+		}
+	}
+	return "ip:" + host(r.RemoteAddr)
+}
+
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+// take reports how many read tokens key gets before being throttled.
+func take(l *Limiter, key string) int {
+	n := 0
+	for ; n < 100; n++ {
+		if ok, _ := l.allow(key, classRead); !ok {
+			break
+		}
+	}
+	return n
+}
+
+func TestUpdateKeepsTokens(t *testing.T) {
+	// A rate low enough that no token is refilled during the test.
+	l, err := New(Options{Read: Budget{Rate: 0.001, Burst: 10}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 8 {
+		l.allow("spent", classRead)
+	}
+	for range 2 {
+		l.allow("fresh", classRead)
+	}
+
+	if err := l.Update(Options{Read: Budget{Rate: 0.001, Burst: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := take(l, "spent"); n != 2 {
+		t.Errorf("client with 2 tokens left got %d after the update", n)
+	}
+	if n := take(l, "fresh"); n != 5 {
+		t.Errorf("client with 8 tokens left got %d after the update, want the new burst of 5", n)
+	}
+	if n := take(l, "new"); n != 5 {
+		t.Errorf("new client got %d tokens, want 5", n)
+	}
+
+	// Lifting the limit and setting it again starts from a full bucket.
+	if err := l.Update(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := take(l, "spent"); n != 100 {
+		t.Errorf("unlimited client got %d tokens", n)
+	}
+	if err := l.Update(Options{Read: Budget{Rate: 0.001, Burst: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := take(l, "spent"); n != 3 {
+		t.Errorf("client limited again got %d tokens, want 3", n)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+)
+
+// TLSOptions configures the https and unixs listeners, named after etcd's
+// flags.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// TrustedCAFile verifies client certificates.
+	TrustedCAFile string
+	// ClientCertAuth requires clients to present a certificate signed by
+	// TrustedCAFile.
+	ClientCertAuth bool
+}
+
+// NewTLSConfig loads the certificates of opts. It returns nil without a
+// CertFile.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("server.NewTLSConfig: failed to load key pair: %w", err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if opts.TrustedCAFile != "" {
+		pem, err := os.ReadFile(opts.TrustedCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("server.NewTLSConfig: failed to read trusted CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("server.NewTLSConfig: no certificates in %s", opts.TrustedCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if opts.ClientCertAuth {
+		if conf.ClientCAs == nil {
+			return nil, fmt.Errorf("server.NewTLSConfig: client cert auth requires a trusted CA")
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// Certificates hands the current TLS configuration to every handshake, so
+// certificates can be rotated without closing the listeners or the
+// connections established before.
+type Certificates struct {
+	current atomic.Pointer[tls.Config]
+}
+
+// NewCertificates serves conf, as returned by NewTLSConfig. It returns nil
+// for a nil conf.
+func NewCertificates(conf *tls.Config) *Certificates {
+	if conf == nil {
+		return nil
+	}
+	c := &Certificates{}
+	c.current.Store(conf)
+	return c
+}
+
+// Config returns the configuration to listen with.
+func (c *Certificates) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.current.Load(), nil
+		},
+	}
+}
+
+// Set makes conf, as returned by NewTLSConfig, serve the handshakes from now
+// on.
+func (c *Certificates) Set(conf *tls.Config) {
+	c.current.Store(conf)
+}
+
+// CheckURL reports the errors Listen would return for rawURL and tlsConfig,
+// short of listening.
+func CheckURL(rawURL string, tlsConfig *tls.Config) error {
+	if _, _, _, err := listenAddress(rawURL, tlsConfig); err != nil {
+		return fmt.Errorf("server.CheckURL: %w", err)
+	}
+	return nil
+}
+
+// Listen opens a listener for rawURL, which is one of http://host:port,
+// https://host:port, unix://path or unixs://path. The TLS schemes require
+// tlsConfig. A stale unix socket is removed first, as etcd does.
+func Listen(rawURL string, tlsConfig *tls.Config) (net.Listener, error) {
+	network, address, secure, err := listenAddress(rawURL, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("server.Listen: %w", err)
+	}
+
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("server.Listen: failed to remove stale socket: %w", err)
+			}
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("server.Listen: failed to listen on %s: %w", rawURL, err)
+	}
+
+	if secure {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+// listenAddress returns the network and address to listen on for rawURL,
+// and whether the listener serves TLS.
+func listenAddress(rawURL string, tlsConfig *tls.Config) (network string, address string, secure bool, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", false, fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		network, address = "tcp", u.Host
+	case "unix", "unixs":
+		network, address = "unix", u.Host+u.Path
+	default:
+		return "", "", false, fmt.Errorf("unsupported scheme in %q", rawURL)
+	}
+
+	secure = u.Scheme == "https" || u.Scheme == "unixs"
+	if secure && tlsConfig == nil {
+		return "", "", false, fmt.Errorf("%s requires a certificate", rawURL)
+	}
+	return network, address, secure, nil
+}
@@ -5,105 +5,461 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 
-	"github.com/aplulu/etcd-shim/internal/config"
-	_ "github.com/aplulu/etcd-shim/internal/driver/badger"
-	"github.com/aplulu/etcd-shim/internal/driver/registry"
+	"github.com/aplulu/etcd-shim/internal/alarm"
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/health"
 	interfacegrpc "github.com/aplulu/etcd-shim/internal/interface/grpc"
+	"github.com/aplulu/etcd-shim/internal/lease"
+	"github.com/aplulu/etcd-shim/internal/logging"
+	"github.com/aplulu/etcd-shim/internal/member"
+	"github.com/aplulu/etcd-shim/internal/metrics"
+	"github.com/aplulu/etcd-shim/internal/ratelimit"
+	"github.com/aplulu/etcd-shim/internal/tenant"
+	"github.com/aplulu/etcd-shim/internal/trace"
+	"github.com/aplulu/etcd-shim/internal/tracing"
 )
 
-var server http.Server
+const (
+	defaultETCDVersion     = "3.5.0"
+	defaultMaxRequestBytes = 1.5 * 1024 * 1024
+	defaultMaxTxnOps       = 128
+	defaultHealthTimeout   = 5 * time.Second
+	// grpcOverheadBytes is the room etcd leaves for the gRPC framing when
+	// deriving the receive limit from the request limit.
+	grpcOverheadBytes = 512 * 1024
+	// idlePollInterval is how often Shutdown checks for requests in flight.
+	idlePollInterval = 10 * time.Millisecond
+)
+
+type Options struct {
+	Driver driver.Driver
+	// Listener and Listeners serve the client API. At least one is
+	// required.
+	Listener  net.Listener
+	Listeners []net.Listener
+	// MetricsListeners serve only the metrics, health and version
+	// endpoints, like etcd's --listen-metrics-urls.
+	MetricsListeners []net.Listener
+	// AdvertiseClientURLs are reported as the client URLs of the member.
+	AdvertiseClientURLs []string
+	Logger              *slog.Logger
+	// ETCDVersion and ETCDClusterVersion are reported by /version and
+	// default to 3.5.0.
+	ETCDVersion        string
+	ETCDClusterVersion string
+	// Trace, if set, receives a trace of the KV, Watch and Lease traffic,
+	// see package trace.
+	Trace io.Writer
+	// TracerProvider, if set, receives spans of the gRPC calls, gateway
+	// requests and driver operations, see package tracing.
+	TracerProvider oteltrace.TracerProvider
+	// RequestLog configures which requests are logged and how.
+	RequestLog logging.RequestOptions
+	// Audit, if set, receives a record of every mutation, see package audit.
+	Audit *audit.Logger
+	// RateLimit throttles clients, see package ratelimit. It can be changed
+	// with SetRateLimit.
+	RateLimit ratelimit.Options
+	// Tenants confines clients to key prefixes, see package tenant.
+	Tenants tenant.Options
+	// Limits bounds the KV requests. MaxRequestBytes and MaxTxnOps default
+	// to etcd's 1.5 MiB and 128; negative values disable them.
+	Limits interfacegrpc.Limits
+	// DriverLimits bounds the keys and values written to the driver, and its
+	// size.
+	DriverLimits driver.Limits
+	// MaxRecvMsgBytes defaults to Limits.MaxRequestBytes plus room for the
+	// gRPC framing, as etcd does. MaxSendMsgBytes defaults to gRPC's limit.
+	MaxRecvMsgBytes int
+	MaxSendMsgBytes int
+	// HealthTimeout bounds the driver read of the health checks. Defaults
+	// to 5s.
+	HealthTimeout time.Duration
+}
+
+// Server serves the etcd gRPC API, its JSON gateway and the HTTP endpoints
+// on each client listener, and the HTTP endpoints alone on each metrics
+// listener. It holds no global state, so several servers can run in one
+// process.
+type Server struct {
+	log              *slog.Logger
+	listeners        []net.Listener
+	metricsListeners []net.Listener
+	grpc             *grpc.Server
+	http             *http.Server
+	metricsHTTP      *http.Server
+	lessor           *lease.Lessor
+	limiter          *ratelimit.Limiter
+	ready            chan struct{}
+	// stopping is closed by Shutdown to end the watch and keep-alive
+	// streams.
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+	// inflight counts the requests being served. http.Server does not
+	// track the h2c connections, which are hijacked.
+	inflight atomic.Int64
+	// stop ends the background work, such as the lease expiry and the gRPC
+	// health updates.
+	stop context.CancelFunc
+}
 
-func StartServer(log *slog.Logger) error {
-	ctx := context.Background()
+func New(ctx context.Context, opts Options) (*Server, error) {
+	if opts.Driver == nil {
+		return nil, fmt.Errorf("server.New: driver is required")
+	}
+	if opts.Listener != nil {
+		opts.Listeners = append([]net.Listener{opts.Listener}, opts.Listeners...)
+	}
+	if len(opts.Listeners) == 0 {
+		return nil, fmt.Errorf("server.New: listener is required")
+	}
+	if opts.ETCDVersion == "" {
+		opts.ETCDVersion = defaultETCDVersion
+	}
+	if opts.ETCDClusterVersion == "" {
+		opts.ETCDClusterVersion = defaultETCDVersion
+	}
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = noop.NewTracerProvider()
+	}
+	if opts.HealthTimeout == 0 {
+		opts.HealthTimeout = defaultHealthTimeout
+	}
+	if opts.Limits.MaxRequestBytes == 0 {
+		opts.Limits.MaxRequestBytes = defaultMaxRequestBytes
+	}
+	if opts.Limits.MaxTxnOps == 0 {
+		opts.Limits.MaxTxnOps = defaultMaxTxnOps
+	}
+	if opts.MaxRecvMsgBytes == 0 && opts.Limits.MaxRequestBytes > 0 {
+		opts.MaxRecvMsgBytes = opts.Limits.MaxRequestBytes + grpcOverheadBytes
+	}
+	log := opts.Logger
+	// The metrics read the driver on every scrape, which is not worth a
+	// trace.
+	untraced := opts.Driver
+	limited, err := driver.WithLimits(opts.Driver, opts.DriverLimits)
+	if err != nil {
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
+	opts.Driver = tracing.WrapDriver(limited, opts.TracerProvider)
+
+	mb, err := member.Load(ctx, opts.Driver)
+	if err != nil {
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
+	mb.ClientURLs = opts.AdvertiseClientURLs
+	authStore, err := auth.New(ctx, log, opts.Driver)
+	if err != nil {
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
+	stopping := make(chan struct{})
+	lessorCtx, stop := context.WithCancel(context.Background())
+	lessor, err := lease.New(lessorCtx, log, opts.Driver, opts.Audit)
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
 
-	drv, err := registry.NewDriver(config.Driver(), ctx, log)
+	tenants, err := tenant.New(ctx, untraced, opts.Tenants, interfacegrpc.UserFromContext)
 	if err != nil {
-		return fmt.Errorf("failed to create driver: %w", err)
+		stop()
+		return nil, fmt.Errorf("server.New: %w", err)
 	}
+	go tenants.Prune(lessorCtx, lessor.Leases)
+	go tenants.Reconcile(lessorCtx, log)
 
-	grpcServer := grpc.NewServer()
-	gwMux := runtime.NewServeMux()
+	m := metrics.New(untraced, lessor)
+	if tenants != nil {
+		m.MustRegister(tenants)
+	}
+	alarms := alarm.New()
+	// Probes run often, so like the metrics they are not traced.
+	checker := health.New(log, untraced, alarms, opts.HealthTimeout)
+	requestLog, err := logging.NewRequestLogger(log, opts.RequestLog)
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
+	limiter, err := ratelimit.New(opts.RateLimit, interfacegrpc.UserFromContext)
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: %w", err)
+	}
 
-	if err := interfacegrpc.RegisterKV(ctx, grpcServer, gwMux, log, drv); err != nil {
-		return fmt.Errorf("server.StartServer: failed to register KVServer: %w", err)
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		m.UnaryInterceptor(),
+		requestLog.UnaryInterceptor(),
+		interfacegrpc.AuthUnaryInterceptor(authStore),
 	}
-	if err := interfacegrpc.RegisterWatch(ctx, grpcServer, gwMux, log); err != nil {
-		return fmt.Errorf("server.StartServer: failed to register WatchServer: %w", err)
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		m.StreamInterceptor(),
+		requestLog.StreamInterceptor(),
+		interfacegrpc.AuthStreamInterceptor(authStore),
 	}
-	if err := interfacegrpc.RegisterClusterServer(ctx, grpcServer, gwMux, log); err != nil {
-		return fmt.Errorf("server.StartServer: failed to register ClusterServer: %w", err)
+	if tenants != nil {
+		unaryInterceptors = append(unaryInterceptors, tenants.UnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, tenants.StreamInterceptor())
 	}
-	if err := interfacegrpc.RegisterMaintenanceServer(ctx, grpcServer, gwMux, log); err != nil {
-		return fmt.Errorf("server.StartServer: failed to register maintenance server: %w", err)
+	// The limiter is installed while disabled, so SetRateLimit can enable
+	// it.
+	unaryInterceptors = append(unaryInterceptors, limiter.UnaryInterceptor())
+	streamInterceptors = append(streamInterceptors, limiter.StreamInterceptor())
+	if opts.Trace != nil {
+		revision, err := opts.Driver.CurrentRevision(ctx)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("server.New: failed to get current revision: %w", err)
+		}
+		recorder, err := trace.NewRecorder(log, opts.Trace, revision)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("server.New: %w", err)
+		}
+		unaryInterceptors = append(unaryInterceptors, recorder.UnaryInterceptor())
+		streamInterceptors = append(streamInterceptors, recorder.StreamInterceptor())
+	}
+	// Errors are translated innermost, so everything above sees the status
+	// clients receive.
+	unaryInterceptors = append(unaryInterceptors, interfacegrpc.ErrorUnaryInterceptor())
+	streamInterceptors = append(streamInterceptors, interfacegrpc.ErrorStreamInterceptor())
+
+	serverOpts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithTracerProvider(opts.TracerProvider),
+			otelgrpc.WithPropagators(tracing.Propagator()),
+		)),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+	if opts.MaxRecvMsgBytes > 0 {
+		serverOpts = append(serverOpts, grpc.MaxRecvMsgSize(opts.MaxRecvMsgBytes))
 	}
-	if err := interfacegrpc.RegisterLeaseServer(ctx, grpcServer, gwMux, log); err != nil {
-		return fmt.Errorf("server.StartServer: failed to register LeaseServer: %w", err)
+	if opts.MaxSendMsgBytes > 0 {
+		serverOpts = append(serverOpts, grpc.MaxSendMsgSize(opts.MaxSendMsgBytes))
 	}
+	grpcServer := grpc.NewServer(serverOpts...)
+	gwMux := runtime.NewServeMux(runtime.WithProtoErrorHandler(interfacegrpc.GatewayErrorHandler))
+	gateway := otelhttp.NewHandler(gwMux, "gateway",
+		otelhttp.WithTracerProvider(opts.TracerProvider),
+		otelhttp.WithPropagators(tracing.Propagator()),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+	)
+	// Like the interceptors, authentication runs first for the limiter and
+	// tenants to see the user.
+	gateway = interfacegrpc.AuthHTTPHandler(authStore, gwMux, limiter.HTTPHandler(tenants.HTTPHandler(gateway)))
+
+	if err := interfacegrpc.RegisterKV(ctx, grpcServer, gwMux, log, tenants.WrapDriver(opts.Driver), lessor, authStore, mb, opts.Limits, alarms, m, opts.Audit, tenants); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register KVServer: %w", err)
+	}
+	if err := interfacegrpc.RegisterWatch(ctx, grpcServer, gwMux, log, tenants.WrapDriver(opts.Driver), authStore, mb, m, stopping); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register WatchServer: %w", err)
+	}
+	if err := interfacegrpc.RegisterClusterServer(ctx, grpcServer, gwMux, log, opts.Driver, mb); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register ClusterServer: %w", err)
+	}
+	// The wrappers of the driver hide Sizer, which Status reports.
+	if err := interfacegrpc.RegisterMaintenanceServer(ctx, grpcServer, gwMux, log, untraced, authStore, mb, alarms, opts.ETCDVersion); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register maintenance server: %w", err)
+	}
+	if err := interfacegrpc.RegisterLeaseServer(ctx, grpcServer, gwMux, log, opts.Driver, lessor, mb, alarms, m, opts.Audit, tenants, stopping); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register LeaseServer: %w", err)
+	}
+	if err := interfacegrpc.RegisterAuthServer(ctx, grpcServer, gwMux, log, opts.Driver, authStore, mb, opts.Audit); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to register AuthServer: %w", err)
+	}
+	checker.RegisterGRPC(lessorCtx, grpcServer)
+	m.InitializeGRPC(grpcServer)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		if _, err := w.Write([]byte("ok")); err != nil {
-			log.ErrorContext(r.Context(), fmt.Sprintf("server.StartServer: failed to write response: %s", err.Error()))
-		}
-	})
+	// /livez only fails when the driver cannot be read, which a restart may
+	// fix. /readyz and /health also fail on alarms and confirm the current
+	// revision.
+	livez := checker.ProbeHandler(health.Options{Serializable: true, SkipAlarms: true})
+	mux.Handle("/healthz", livez)
+	mux.Handle("/livez", livez)
+	mux.Handle("/readyz", checker.ProbeHandler(health.Options{}))
+	mux.Handle("/health", checker.HealthHandler())
+	mux.Handle("/metrics", m.Handler())
 	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
 		res := struct {
 			ETCDServer  string `json:"etcdserver"`
 			ETCDCluster string `json:"etcdcluster"`
 		}{
-			ETCDServer:  config.ETCDVersion(),
-			ETCDCluster: config.ETCDClusterVersion(),
+			ETCDServer:  opts.ETCDVersion,
+			ETCDCluster: opts.ETCDClusterVersion,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(res); err != nil {
-			log.ErrorContext(r.Context(), fmt.Sprintf("server.StartServer: failed to write response: %s", err.Error()))
+			log.ErrorContext(r.Context(), fmt.Sprintf("server.New: failed to write response: %s", err.Error()))
 		}
 	})
 
-	server = http.Server{
-		Addr: net.JoinHostPort(config.Listen(), config.Port()),
+	// gRPC requests are logged by the interceptors.
+	httpHandler := requestLog.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v3") {
+			gateway.ServeHTTP(w, r)
+		} else {
+			mux.ServeHTTP(w, r)
+		}
+	}))
+
+	s := &Server{
+		log:              log,
+		listeners:        opts.Listeners,
+		metricsListeners: opts.MetricsListeners,
+		grpc:             grpcServer,
+		metricsHTTP:      &http.Server{Handler: mux},
+		lessor:           lessor,
+		limiter:          limiter,
+		ready:            make(chan struct{}),
+		stopping:         stopping,
+		stop:             stop,
+	}
+	h2s := &http2.Server{}
+	s.http = &http.Server{
 		Handler: h2c.NewHandler(
 			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				log.Info(
-					"Request",
-					"method", r.Method,
-					"path", r.URL.Path,
-					"proto", r.Proto,
-					"remote", r.RemoteAddr,
-					"content-type", r.Header.Get("Content-Type"),
-				)
+				s.inflight.Add(1)
+				defer s.inflight.Add(-1)
 
 				if r.ProtoMajor == 2 && r.Header.Get("Content-Type") == "application/grpc" {
 					grpcServer.ServeHTTP(w, r)
-				} else if strings.HasPrefix(r.URL.Path, "/v3") {
-					gwMux.ServeHTTP(w, r)
 				} else {
-					mux.ServeHTTP(w, r)
+					httpHandler.ServeHTTP(w, r)
 				}
 			}),
-			&http2.Server{},
+			h2s,
 		),
 	}
+	// Shutdown then sends GOAWAY on the HTTP/2 connections, h2c included.
+	if err := http2.ConfigureServer(s.http, h2s); err != nil {
+		stop()
+		return nil, fmt.Errorf("server.New: failed to configure HTTP/2: %w", err)
+	}
 
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return err
+	return s, nil
+}
+
+// Serve accepts connections on every listener until Shutdown is called. If
+// one listener fails, the others are closed and its error is returned.
+func (s *Server) Serve() error {
+	errCh := make(chan error, len(s.listeners)+len(s.metricsListeners))
+	serve := func(srv *http.Server, l net.Listener) {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("server.Serve: %s: %w", l.Addr(), err)
+			return
+		}
+		errCh <- nil
+	}
+	for _, l := range s.listeners {
+		go serve(s.http, l)
 	}
+	for _, l := range s.metricsListeners {
+		go serve(s.metricsHTTP, l)
+	}
+	close(s.ready)
+
+	var first error
+	for range cap(errCh) {
+		if err := <-errCh; err != nil && first == nil {
+			first = err
+			s.http.Close()
+			s.metricsHTTP.Close()
+		}
+	}
+
+	return first
+}
 
+// Ready is closed once the server accepts connections.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// SetRateLimit replaces the rate limits without dropping connections.
+func (s *Server) SetRateLimit(opts ratelimit.Options) error {
+	if err := s.limiter.Update(opts); err != nil {
+		return fmt.Errorf("server.SetRateLimit: %w", err)
+	}
+	return nil
+}
+
+// Shutdown stops the server, giving up on what is left once ctx is done.
+// It stops accepting connections and reports NOT_SERVING, cancels every
+// watcher and ends the keep-alive streams, waits for the other requests in
+// flight, then stops the lease expiry and checkpoints the leases. The driver
+// is left open for the caller to close. Shutdown may be called again, e.g.
+// with a later deadline.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	s.stoppingOnce.Do(func() { close(s.stopping) })
+
+	var errs []error
+	if err := s.http.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down client listeners: %w", err))
+	}
+	if err := s.metricsHTTP.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down metrics listeners: %w", err))
+	}
+	if err := s.waitIdle(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("%d requests still in flight: %w", s.inflight.Load(), err))
+	}
+	// Closes the streams still open after the deadline.
+	s.grpc.Stop()
+	s.http.Close()
+
+	if err := s.lessor.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("server.Shutdown: %w", err)
+	}
 	return nil
 }
 
-func StopServer(ctx context.Context) error {
-	return server.Shutdown(ctx)
+// waitIdle polls until no request is in flight, as http.Server.Shutdown
+// does.
+func (s *Server) waitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
@@ -0,0 +1,623 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/audit"
+	"github.com/aplulu/etcd-shim/internal/config"
+	"github.com/aplulu/etcd-shim/internal/driver"
+	"github.com/aplulu/etcd-shim/internal/driver/bbolt"
+	"github.com/aplulu/etcd-shim/internal/tenant"
+)
+
+// startServer serves opts on a random port until the test ends and returns
+// the client URL. A memory driver and a discarding logger are used unless
+// opts has them.
+func startServer(t *testing.T, opts Options) string {
+	t.Helper()
+
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	log := opts.Logger
+	if opts.Driver == nil {
+		d, err := memory.New(memory.Options{Logger: log})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		opts.Driver = d
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Listener = l
+
+	srv, err := New(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-served
+	})
+	<-srv.Ready()
+
+	return "http://" + l.Addr().String()
+}
+
+func newClient(t *testing.T, url string, user string, password string) *clientv3.Client {
+	t.Helper()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{url},
+		DialTimeout: 5 * time.Second,
+		Username:    user,
+		Password:    password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// enableAuth adds root with password root and enables auth.
+func enableAuth(t *testing.T, ctx context.Context, client *clientv3.Client) {
+	t.Helper()
+
+	if _, err := client.UserAdd(ctx, "root", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UserGrantRole(ctx, "root", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AuthEnable(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// post sends body to the gateway endpoint path and decodes the response.
+func post(t *testing.T, url string, path string, token string, body string) (int, map[string]any) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var out map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return res.StatusCode, out
+}
+
+func TestGatewayAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := startServer(t, Options{})
+	enableAuth(t, ctx, newClient(t, url, "", ""))
+
+	const put = `{"key": "Zm9v", "value": "YmFy"}`
+	_, out := post(t, url, "/v3/kv/put", "", put)
+	if msg := out["message"]; msg != status.Convert(rpctypes.ErrGRPCUserEmpty).Message() {
+		t.Errorf("put without a token failed with %v, want %v", msg, rpctypes.ErrGRPCUserEmpty)
+	}
+	_, out = post(t, url, "/v3/kv/put", "nope", put)
+	if msg := out["message"]; msg != status.Convert(rpctypes.ErrGRPCInvalidAuthToken).Message() {
+		t.Errorf("put with an unknown token failed with %v, want %v", msg, rpctypes.ErrGRPCInvalidAuthToken)
+	}
+
+	code, out := post(t, url, "/v3/auth/authenticate", "", `{"name": "root", "password": "root"}`)
+	token, _ := out["token"].(string)
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("authenticate returned %d %v", code, out)
+	}
+	if code, out := post(t, url, "/v3/kv/put", token, put); code != http.StatusOK {
+		t.Fatalf("put with a token returned %d %v", code, out)
+	}
+
+	res, err := newClient(t, url, "root", "root").Get(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Kvs) != 1 || string(res.Kvs[0].Value) != "bar" {
+		t.Fatalf("foo is %v, want bar", res.Kvs)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var logs syncBuffer
+	url := startServer(t, Options{Logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))})
+	client := newClient(t, url, "", "")
+
+	for range 3 {
+		if _, err := client.Put(ctx, "k", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Compact(ctx, 100); !errors.Is(err, rpctypes.ErrFutureRev) {
+		t.Errorf("compacting a future revision returned %v", err)
+	}
+	if _, err := client.Compact(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Compact(ctx, 2); !errors.Is(err, rpctypes.ErrCompacted) {
+		t.Errorf("compacting a compacted revision returned %v", err)
+	}
+	if _, err := client.Get(ctx, "k", clientv3.WithRev(100)); !errors.Is(err, rpctypes.ErrFutureRev) {
+		t.Errorf("reading a future revision returned %v", err)
+	}
+	if _, err := client.Get(ctx, "k", clientv3.WithRev(1)); !errors.Is(err, rpctypes.ErrCompacted) {
+		t.Errorf("reading a compacted revision returned %v", err)
+	}
+	lease, err := client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+	if _, err := leases.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: int64(lease.ID), TTL: 60}); !errors.Is(rpctypes.Error(err), rpctypes.ErrLeaseExist) {
+		t.Errorf("granting an existing lease returned %v", err)
+	}
+	if _, err := client.Grant(ctx, 9000000001); !errors.Is(err, rpctypes.ErrLeaseTTLTooLarge) {
+		t.Errorf("granting a lease with a too large TTL returned %v", err)
+	}
+	if _, err := client.Revoke(ctx, 12345); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		t.Errorf("revoking a missing lease returned %v", err)
+	}
+
+	if strings.Contains(logs.String(), `"level":"ERROR"`) {
+		t.Errorf("client errors were logged as errors:\n%s", logs.String())
+	}
+}
+
+// syncBuffer is written by the server while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The memory driver cannot report its size.
+	conf := config.DefaultDriverConfig()
+	conf.Bbolt.Path = filepath.Join(t.TempDir(), "db")
+	drv, err := bbolt.New(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { drv.Close() })
+	url := startServer(t, Options{Driver: drv, ETCDVersion: "3.5.16"})
+
+	res, err := newClient(t, url, "", "").Status(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "3.5.16" {
+		t.Errorf("Status reports version %s, want the configured 3.5.16", res.Version)
+	}
+	if res.DbSize <= 0 || res.DbSizeInUse <= 0 {
+		t.Errorf("Status reports a database of %d bytes, %d in use", res.DbSize, res.DbSizeInUse)
+	}
+}
+
+// fullDriver fails every transaction with driver.ErrNoSpace while full is set.
+type fullDriver struct {
+	driver.Driver
+	full atomic.Bool
+}
+
+func (d *fullDriver) Txn(ctx context.Context, fn func(driver.Txn) error) (int64, error) {
+	if d.full.Load() {
+		return 0, driver.ErrNoSpace
+	}
+	return d.Driver.Txn(ctx, fn)
+}
+
+func TestNoSpaceAlarm(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mem, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mem.Close() })
+	drv := &fullDriver{Driver: mem}
+	client := newClient(t, startServer(t, Options{Driver: drv}), "", "")
+
+	drv.full.Store(true)
+	if _, err := client.Put(ctx, "a", "1"); !errors.Is(err, rpctypes.ErrNoSpace) {
+		t.Fatalf("Put on a full driver returned %v", err)
+	}
+	// The space is freed, but the alarm stays until it is disarmed.
+	drv.full.Store(false)
+	writes := map[string]func() error{
+		"put": func() error { return errOnly(client.Put(ctx, "a", "1")) },
+		"txn": func() error {
+			return errOnly(client.Txn(ctx).Then(clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpPut("a", "1")}, nil)).Commit())
+		},
+		"lease grant": func() error { return errOnly(client.Grant(ctx, 60)) },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, rpctypes.ErrNoSpace) {
+			t.Errorf("%s with NOSPACE raised returned %v", name, err)
+		}
+	}
+	if _, err := client.Delete(ctx, "a"); err != nil {
+		t.Errorf("delete with NOSPACE raised failed: %v", err)
+	}
+
+	if _, err := client.AlarmDisarm(ctx, &clientv3.AlarmMember{Alarm: etcdserverpb.AlarmType_NOSPACE}); err != nil {
+		t.Fatal(err)
+	}
+	for name, write := range writes {
+		if err := write(); err != nil {
+			t.Errorf("%s after disarming NOSPACE failed: %v", name, err)
+		}
+	}
+}
+
+func TestAlarmAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := startServer(t, Options{})
+	root := newClient(t, url, "", "")
+	if _, err := root.UserAdd(ctx, "alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	enableAuth(t, ctx, root)
+	root = newClient(t, url, "root", "root")
+	alice := newClient(t, url, "alice", "alice")
+
+	if _, err := alice.AlarmList(ctx); err != nil {
+		t.Errorf("listing the alarms as a user failed: %v", err)
+	}
+	disarm := &clientv3.AlarmMember{Alarm: etcdserverpb.AlarmType_NOSPACE}
+	if _, err := alice.AlarmDisarm(ctx, disarm); !errors.Is(err, rpctypes.ErrPermissionDenied) {
+		t.Errorf("disarming an alarm as a user returned %v", err)
+	}
+	if _, err := root.AlarmDisarm(ctx, disarm); err != nil {
+		t.Errorf("disarming an alarm as root failed: %v", err)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	d, err := memory.New(memory.Options{Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(context.Background(), Options{Driver: d, Logger: log, Listener: l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve() }()
+	<-srv.Ready()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 2 {
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-served
+}
+
+func TestTenantAudit(t *testing.T) {
+	ctx := context.Background()
+	var audited syncBuffer
+	url := startServer(t, Options{
+		Audit:   audit.New(&audited, audit.Options{}),
+		Tenants: tenant.Options{Prefixes: map[string]string{"app": "/app/"}},
+	})
+	root := newClient(t, url, "", "")
+	for _, err := range []error{
+		errOnly(root.UserAdd(ctx, "app", "app")),
+		errOnly(root.RoleAdd(ctx, "app")),
+		errOnly(root.RoleGrantPermission(ctx, "app", "\x00", "\x00", clientv3.PermissionType(clientv3.PermReadWrite))),
+		errOnly(root.UserGrantRole(ctx, "app", "app")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	enableAuth(t, ctx, root)
+
+	if _, err := newClient(t, url, "app", "app").Put(ctx, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := newClient(t, url, "root", "root").Get(ctx, "/app/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Kvs) != 1 {
+		t.Fatalf("the put of tenant app is not stored under its prefix")
+	}
+
+	var rec audit.Record
+	lines := strings.Split(strings.TrimSpace(audited.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Tenant != "app" || rec.Key != "foo" {
+		t.Errorf("put audited as %+v, want tenant app and key foo", rec)
+	}
+}
+
+// errOnly returns the error of a call returning a response and an error.
+func errOnly[T any](_ T, err error) error {
+	return err
+}
+
+// scrape returns the metric families /metrics serves.
+func scrape(t *testing.T, url string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	res, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// metricValue returns the value of the metric of name with labels, or the
+// sample count of a histogram. It returns -1 if there is no such metric.
+func metricValue(families map[string]*dto.MetricFamily, name string, labels map[string]string) float64 {
+	f, ok := families[name]
+	if !ok {
+		return -1
+	}
+metrics:
+	for _, m := range f.Metric {
+		for _, l := range m.Label {
+			if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+				continue metrics
+			}
+		}
+		switch {
+		case m.Counter != nil:
+			return m.Counter.GetValue()
+		case m.Gauge != nil:
+			return m.Gauge.GetValue()
+		case m.Histogram != nil:
+			return float64(m.Histogram.GetSampleCount())
+		}
+	}
+	return -1
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := startServer(t, Options{})
+	client := newClient(t, url, "", "")
+
+	watchCtx, watchCancel := context.WithCancel(ctx)
+	defer watchCancel()
+	wch := client.Watch(watchCtx, "k", clientv3.WithCreatedNotify())
+	if res := <-wch; !res.Created {
+		t.Fatalf("watch not created: %v", res.Err())
+	}
+	if _, err := client.Put(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-wch; len(res.Events) != 1 {
+		t.Fatalf("watch got %d events: %v", len(res.Events), res.Err())
+	}
+	if _, err := client.Get(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+
+	families := scrape(t, url)
+	for _, m := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"etcd_mvcc_put_total", nil, 1},
+		{"etcd_mvcc_range_total", nil, 1},
+		{"etcd_debugging_mvcc_watch_stream_total", nil, 1},
+		{"etcd_debugging_mvcc_watcher_total", nil, 1},
+		{"grpc_server_handled_total", map[string]string{"grpc_method": "Put", "grpc_code": "OK"}, 1},
+		{"grpc_server_handled_total", map[string]string{"grpc_method": "Range", "grpc_code": "OK"}, 1},
+		{"grpc_server_handling_seconds", map[string]string{"grpc_method": "Put"}, 1},
+		{"grpc_server_handling_seconds", map[string]string{"grpc_method": "Range"}, 1},
+		{"grpc_server_started_total", map[string]string{"grpc_method": "Watch", "grpc_type": "bidi_stream"}, 1},
+		{"grpc_server_msg_sent_total", map[string]string{"grpc_method": "Watch"}, 2},
+	} {
+		if got := metricValue(families, m.name, m.labels); got != m.want {
+			t.Errorf("%s%v = %v, want %v", m.name, m.labels, got, m.want)
+		}
+	}
+	// Methods not called yet are reported too.
+	if got := metricValue(families, "grpc_server_handled_total", map[string]string{"grpc_method": "Compact", "grpc_code": "OK"}); got != 0 {
+		t.Errorf("grpc_server_handled_total of Compact = %v, want 0", got)
+	}
+}
+
+// endedSpan waits for the nth span of name to end.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string, n int) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	// The server span ends once the response is sent, which the client may
+	// see first.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		seen := 0
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				if seen++; seen == n {
+					return span
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("span %d of %s did not end", n, name)
+	return nil
+}
+
+// childSpan returns the ended span of name under parent.
+func childSpan(recorder *tracetest.SpanRecorder, parent sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name && span.Parent().SpanID() == parent.SpanContext().SpanID() {
+			return span
+		}
+	}
+	return nil
+}
+
+func hasAttributes(span sdktrace.ReadOnlySpan, want ...attribute.KeyValue) bool {
+	attrs := attribute.NewSet(span.Attributes()...)
+	for _, kv := range want {
+		if v, ok := attrs.Value(kv.Key); !ok || v != kv.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// brokenDriver fails every range of key with errBroken.
+type brokenDriver struct {
+	driver.Driver
+	key string
+}
+
+var errBroken = errors.New("broken")
+
+func (d *brokenDriver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	if string(key) == d.key {
+		return nil, errBroken
+	}
+	return d.Driver.Range(ctx, key, end, opts)
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample()), sdktrace.WithSpanProcessor(recorder))
+	mem, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mem.Close() })
+	client := newClient(t, startServer(t, Options{Driver: &brokenDriver{Driver: mem, key: "broken"}, TracerProvider: tp}), "", "")
+
+	res, err := client.Txn(ctx).Then(clientv3.OpPut("k", "v")).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := endedSpan(t, recorder, "etcdserverpb.KV/Txn", 1)
+	if !hasAttributes(txn, attribute.String("rpc.system", "grpc"), attribute.String("rpc.service", "etcdserverpb.KV"), attribute.String("rpc.method", "Txn")) {
+		t.Errorf("Txn span has attributes %v", txn.Attributes())
+	}
+	if txn.Status().Code == otelcodes.Error {
+		t.Errorf("Txn span has status %v", txn.Status())
+	}
+	child := childSpan(recorder, txn, "driver.Txn")
+	if child == nil {
+		t.Fatal("Txn span has no driver.Txn child")
+	}
+	if !hasAttributes(child, attribute.Int64("etcd.revision", res.Header.Revision), attribute.Int("etcd.txn.attempts", 1)) {
+		t.Errorf("driver.Txn span has attributes %v", child.Attributes())
+	}
+
+	if _, err := client.Get(ctx, "k", clientv3.WithRev(100)); !errors.Is(err, rpctypes.ErrFutureRev) {
+		t.Fatalf("reading a future revision returned %v", err)
+	}
+	// As the semantic conventions ask, the status of a server span is only
+	// set for server errors, but the driver span records every error.
+	get := endedSpan(t, recorder, "etcdserverpb.KV/Range", 1)
+	if !hasAttributes(get, attribute.Int64("rpc.grpc.status_code", int64(codes.OutOfRange))) {
+		t.Errorf("failed Range span has attributes %v", get.Attributes())
+	}
+	child = childSpan(recorder, get, "driver.Range")
+	if child == nil {
+		t.Fatal("failed Range span has no driver.Range child")
+	}
+	if st := child.Status(); st.Code != otelcodes.Error || !strings.Contains(st.Description, driver.ErrFutureRevision.Error()) {
+		t.Errorf("failed driver.Range span has status %v", st)
+	}
+	if events := child.Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("failed driver.Range span has events %v, want the error", events)
+	}
+
+	if _, err := client.Get(ctx, "broken"); err == nil {
+		t.Fatal("reading from a broken driver succeeded")
+	}
+	get = endedSpan(t, recorder, "etcdserverpb.KV/Range", 2)
+	if st := get.Status(); st.Code != otelcodes.Error || !strings.Contains(st.Description, errBroken.Error()) {
+		t.Errorf("Range span of a server error has status %v", st)
+	}
+}
@@ -0,0 +1,242 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// WrapDriver returns drv confining the calls made with a tenant in their
+// context to its prefix. Calls without a tenant are passed through. Of the
+// optional interfaces only ProgressRequester is kept.
+func (ts *Tenants) WrapDriver(drv driver.Driver) driver.Driver {
+	if ts == nil {
+		return drv
+	}
+	d := &namespacedDriver{Driver: drv, ts: ts}
+	if pr, ok := drv.(driver.ProgressRequester); ok {
+		return &namespacedProgressDriver{namespacedDriver: d, pr: pr}
+	}
+	return d
+}
+
+type namespacedDriver struct {
+	driver.Driver
+	ts *Tenants
+}
+
+func (d *namespacedDriver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	t := FromContext(ctx)
+	if t == nil {
+		return d.Driver.Range(ctx, key, end, opts)
+	}
+	key, end = t.prefixRange(key, end)
+	res, err := d.Driver.Range(ctx, key, end, opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.stripResult(res), nil
+}
+
+func (d *namespacedDriver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	t := FromContext(ctx)
+	if t == nil {
+		return d.Driver.Txn(ctx, fn)
+	}
+	// Like the database quota, the usage is read before the transaction.
+	full := t.checkQuota()
+	var u usage
+	revision, err := d.Driver.Txn(ctx, func(txn driver.Txn) error {
+		// Drivers may run fn again after a conflict.
+		u = usage{}
+		return fn(&namespacedTxn{Txn: txn, t: t, full: full, usage: &u})
+	})
+	if err != nil {
+		return 0, err
+	}
+	u.revision = revision
+	t.apply(u)
+	return revision, nil
+}
+
+func (d *namespacedDriver) Compact(ctx context.Context, revision int64) error {
+	if FromContext(ctx) != nil {
+		return ErrNotPermitted
+	}
+	return d.Driver.Compact(ctx, revision)
+}
+
+func (d *namespacedDriver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	t := FromContext(ctx)
+	if t == nil {
+		return d.Driver.Watch(ctx, key, end, startRevision)
+	}
+	key, end = t.prefixRange(key, end)
+	in, err := d.Driver.Watch(ctx, key, end, startRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *driver.WatchEvent)
+	go func() {
+		defer close(out)
+		for ev := range in {
+			select {
+			case out <- t.stripEvent(ev):
+			case <-ctx.Done():
+				// The driver closes in once ctx is done.
+				for range in {
+				}
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (d *namespacedDriver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	t := FromContext(ctx)
+	if t == nil {
+		return d.Driver.History(ctx, startRevision, fn)
+	}
+	return d.Driver.History(ctx, startRevision, func(ev *driver.WatchEvent) error {
+		if ev.KV != nil && !bytes.HasPrefix(ev.KV.Key, t.prefix) {
+			return nil
+		}
+		return fn(t.stripEvent(ev))
+	})
+}
+
+func (d *namespacedDriver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	if FromContext(ctx) != nil {
+		return ErrNotPermitted
+	}
+	return d.Driver.Restore(ctx, events, revision)
+}
+
+type namespacedProgressDriver struct {
+	*namespacedDriver
+	pr driver.ProgressRequester
+}
+
+func (d *namespacedProgressDriver) RequestProgress(ctx context.Context) error {
+	return d.pr.RequestProgress(ctx)
+}
+
+type namespacedTxn struct {
+	driver.Txn
+	t *Tenant
+	// full is the error puts fail with when the quota is reached.
+	full error
+	// usage counts the writes, applied to t once committed.
+	usage *usage
+}
+
+func (txn *namespacedTxn) Range(key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	key, end = txn.t.prefixRange(key, end)
+	res, err := txn.Txn.Range(key, end, opts)
+	if err != nil {
+		return nil, err
+	}
+	return txn.t.stripResult(res), nil
+}
+
+func (txn *namespacedTxn) Put(key []byte, value []byte, lease int64) (*driver.KeyValue, error) {
+	if txn.full != nil {
+		if errors.Is(txn.full, ErrQuotaExceeded) {
+			txn.t.rejected.Inc()
+		}
+		return nil, txn.full
+	}
+	key = txn.t.prefixKey(key)
+	prev, err := txn.Txn.Range(key, nil, driver.RangeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	kv, err := txn.Txn.Put(key, value, lease)
+	if err != nil {
+		return nil, err
+	}
+	txn.usage.bytes += int64(len(key) + len(value))
+	if len(prev.KVs) > 0 {
+		txn.usage.bytes -= int64(len(prev.KVs[0].Key) + len(prev.KVs[0].Value))
+	} else {
+		txn.usage.keys++
+	}
+	if kv != nil {
+		stripped := *kv
+		stripped.Key = txn.t.strip(kv.Key)
+		kv = &stripped
+	}
+	return kv, nil
+}
+
+func (txn *namespacedTxn) DeleteRange(key []byte, end []byte) ([]driver.KeyValue, error) {
+	key, end = txn.t.prefixRange(key, end)
+	kvs, err := txn.Txn.DeleteRange(key, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		txn.usage.bytes -= int64(len(kv.Key) + len(kv.Value))
+	}
+	txn.usage.keys -= int64(len(kvs))
+	return txn.t.stripKVs(kvs), nil
+}
+
+func (t *Tenant) prefixKey(key []byte) []byte {
+	return append(bytes.Clone(t.prefix), key...)
+}
+
+// prefixRange returns the range [key, end) of the tenant in the store. The
+// open end "\x00" stops at the end of the prefix.
+func (t *Tenant) prefixRange(key []byte, end []byte) ([]byte, []byte) {
+	switch {
+	case len(end) == 0:
+	case driver.IsOpenEnd(end):
+		end = t.end
+	default:
+		end = t.prefixKey(end)
+	}
+	return t.prefixKey(key), end
+}
+
+func (t *Tenant) strip(key []byte) []byte {
+	return bytes.TrimPrefix(key, t.prefix)
+}
+
+// stripKVs returns copies of kvs with the keys the tenant sees, leaving
+// kvs alone as drivers may hand out what they keep.
+func (t *Tenant) stripKVs(kvs []driver.KeyValue) []driver.KeyValue {
+	out := make([]driver.KeyValue, len(kvs))
+	for i, kv := range kvs {
+		kv.Key = t.strip(kv.Key)
+		out[i] = kv
+	}
+	return out
+}
+
+func (t *Tenant) stripResult(res *driver.RangeResult) *driver.RangeResult {
+	out := *res
+	out.KVs = t.stripKVs(res.KVs)
+	return &out
+}
+
+// stripEvent returns a copy of ev with the keys the tenant sees, leaving
+// ev alone as drivers may share it between watchers.
+func (t *Tenant) stripEvent(ev *driver.WatchEvent) *driver.WatchEvent {
+	out := *ev
+	if ev.KV != nil {
+		kv := *ev.KV
+		kv.Key = t.strip(kv.Key)
+		out.KV = &kv
+	}
+	if ev.PrevKV != nil {
+		kv := *ev.PrevKV
+		kv.Key = t.strip(kv.Key)
+		out.PrevKV = &kv
+	}
+	return &out
+}
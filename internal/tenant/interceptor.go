@@ -0,0 +1,166 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/aplulu/etcd-shim/internal/middleware"
+)
+
+// confinedServices are the services whose keys are confined to a prefix.
+// Clients not mapped to a prefix are denied them.
+var confinedServices = []string{"/etcdserverpb.KV/", "/etcdserverpb.Watch/", "/etcdserverpb.Lease/"}
+
+// deniedMethods span the store, so are denied to tenants.
+var deniedMethods = map[string]bool{
+	"/etcdserverpb.KV/Compact":             true,
+	"/etcdserverpb.Maintenance/Alarm":      true,
+	"/etcdserverpb.Maintenance/Defragment": true,
+	"/etcdserverpb.Maintenance/Hash":       true,
+	"/etcdserverpb.Maintenance/HashKV":     true,
+	"/etcdserverpb.Maintenance/Snapshot":   true,
+	"/etcdserverpb.Maintenance/MoveLeader": true,
+	"/etcdserverpb.Maintenance/Downgrade":  true,
+}
+
+// httpMethods are the gateway endpoints of the confined services, by the
+// method they call.
+var httpMethods = map[string]string{
+	"/v3/kv/range":            "Range",
+	"/v3/kv/put":              "Put",
+	"/v3/kv/deleterange":      "DeleteRange",
+	"/v3/kv/txn":              "Txn",
+	"/v3/kv/compaction":       "Compact",
+	"/v3/watch":               "Watch",
+	"/v3/lease/grant":         "LeaseGrant",
+	"/v3/lease/revoke":        "LeaseRevoke",
+	"/v3/kv/lease/revoke":     "LeaseRevoke",
+	"/v3/lease/keepalive":     "LeaseKeepAlive",
+	"/v3/lease/timetolive":    "LeaseTimeToLive",
+	"/v3/kv/lease/timetolive": "LeaseTimeToLive",
+	"/v3/lease/leases":        "LeaseLeases",
+	"/v3/kv/lease/leases":     "LeaseLeases",
+}
+
+// deniedPaths are the gateway endpoints of deniedMethods.
+var deniedPaths = map[string]bool{
+	"/v3/kv/compaction":                   true,
+	"/v3/maintenance/alarm":               true,
+	"/v3/maintenance/defragment":          true,
+	"/v3/maintenance/hash":                true,
+	"/v3/maintenance/hashkv":              true,
+	"/v3/maintenance/snapshot":            true,
+	"/v3/maintenance/transfer-leadership": true,
+	"/v3/maintenance/downgrade":           true,
+}
+
+var (
+	errUnmapped = status.Error(codes.PermissionDenied, "etcdserver: client is not mapped to a tenant")
+	errDenied   = status.Error(codes.PermissionDenied, "etcdserver: not permitted to tenants")
+)
+
+// admit returns ctx carrying the tenant of name, or an error if method,
+// whose service is confined or not, is denied to it.
+func (ts *Tenants) admit(ctx context.Context, name string, method string, confined bool, denied bool) (context.Context, error) {
+	t, ok := ts.resolve(name)
+	switch {
+	case !ok && (confined || denied):
+		return nil, errUnmapped
+	case t == nil:
+		return ctx, nil
+	case denied:
+		return nil, errDenied
+	}
+	if confined {
+		ts.requests.WithLabelValues(t.Name, method).Inc()
+	}
+	return NewContext(ctx, t), nil
+}
+
+func isConfined(method string) bool {
+	for _, s := range confinedServices {
+		if strings.HasPrefix(method, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryInterceptor and StreamInterceptor confine the requests of tenants.
+// They must run after authentication for KeyUser to see the user.
+func (ts *Tenants) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := ts.admit(ctx, ts.grpcName(ctx), methodName(info.FullMethod), isConfined(info.FullMethod), deniedMethods[info.FullMethod])
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (ts *Tenants) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := ts.admit(ss.Context(), ts.grpcName(ss.Context()), methodName(info.FullMethod), isConfined(info.FullMethod), deniedMethods[info.FullMethod])
+		if err != nil {
+			return err
+		}
+		return handler(srv, middleware.WrapServerStream(ss, ctx))
+	}
+}
+
+// methodName returns the method of a full gRPC method name, e.g. Range.
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// grpcName returns the name the client of a gRPC request is mapped by.
+func (ts *Tenants) grpcName(ctx context.Context) string {
+	if ts.key == KeyUser {
+		return ts.user(ctx)
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+	return middleware.CommonName(info.State.PeerCertificates)
+}
+
+// httpName returns the name the client of a gateway request is mapped by.
+func (ts *Tenants) httpName(r *http.Request) string {
+	if ts.key == KeyUser {
+		return ts.user(r.Context())
+	}
+	if r.TLS == nil {
+		return ""
+	}
+	return middleware.CommonName(r.TLS.PeerCertificates)
+}
+
+// HTTPHandler confines the gateway requests h serves. It must run after
+// authentication for KeyUser to see the user.
+func (ts *Tenants) HTTPHandler(h http.Handler) http.Handler {
+	if ts == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, confined := httpMethods[r.URL.Path]
+
+		ctx, err := ts.admit(r.Context(), ts.httpName(r), method, confined, deniedPaths[r.URL.Path])
+		if err != nil {
+			middleware.WriteHTTPError(w, err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
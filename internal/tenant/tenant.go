@@ -0,0 +1,471 @@
+// Package tenant confines clients to key prefixes, so one server can host
+// several isolated applications, like etcd's grpc-proxy --namespace. Each
+// authenticated user or client certificate is mapped to a prefix, which is
+// prepended to the keys of its KV, Watch and Lease requests and stripped
+// from the responses.
+//
+// Tenants share the revisions of the store: they see the revision advance
+// with the writes of the others, but never their keys, events or leases.
+// Auth permissions apply to the keys as the tenant sees them. Compaction and
+// the maintenance operations spanning the store are reserved to clients
+// mapped to the whole key space, and to root.
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/aplulu/etcd-shim/internal/auth"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+const (
+	// KeyUser maps clients by their authenticated user. root is always
+	// mapped to the whole key space.
+	KeyUser = "user"
+	// KeyCN maps clients by the common name of their certificate.
+	KeyCN = "cn"
+
+	// LeaseBucket maps the big-endian ID of every lease granted by a tenant
+	// to the tenant's name.
+	LeaseBucket = "tenantLeases"
+
+	// reconcileInterval is how often the usage of the tenants is scanned.
+	reconcileInterval = time.Minute
+	// pruneInterval is how often the owners of revoked and expired leases
+	// are forgotten.
+	pruneInterval = time.Minute
+)
+
+var (
+	// ErrQuotaExceeded is returned by puts of a tenant over its quota. It
+	// does not wrap driver.ErrNoSpace, as the store itself has room left.
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+	// ErrNotPermitted is returned for operations spanning the store.
+	ErrNotPermitted = errors.New("not permitted to tenants")
+)
+
+type Options struct {
+	// Key is one of user or cn. Defaults to user.
+	Key string
+	// Prefixes maps users or common names to the prefix of their keys. An
+	// empty prefix grants the whole key space. Clients not listed are
+	// denied the KV, Watch and Lease services.
+	Prefixes map[string]string
+	// QuotaBytes bounds the keys and values of every tenant, and Quotas
+	// that of the named ones. Zero is unlimited.
+	QuotaBytes int64
+	Quotas     map[string]int64
+}
+
+// Validate reports whether the options are consistent: no prefix may
+// contain another, so tenants cannot see each other's keys.
+func (o Options) Validate() error {
+	switch o.Key {
+	case "", KeyUser, KeyCN:
+	default:
+		return fmt.Errorf("unknown key %q, want user or cn", o.Key)
+	}
+
+	names := make([]string, 0, len(o.Prefixes))
+	for name, prefix := range o.Prefixes {
+		if name == "" {
+			return fmt.Errorf("empty name mapped to %q", prefix)
+		}
+		if prefix != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			pa, pb := o.Prefixes[a], o.Prefixes[b]
+			if bytes.HasPrefix([]byte(pa), []byte(pb)) || bytes.HasPrefix([]byte(pb), []byte(pa)) {
+				return fmt.Errorf("prefix %q of %s overlaps %q of %s", pa, a, pb, b)
+			}
+		}
+	}
+	for name := range o.Quotas {
+		if o.Prefixes[name] == "" {
+			return fmt.Errorf("quota of %s, which is not a tenant", name)
+		}
+	}
+	return nil
+}
+
+// Tenant is a client confined to a prefix.
+type Tenant struct {
+	Name   string
+	prefix []byte
+	// end is the range end of the prefix.
+	end   []byte
+	quota int64
+	// rejected counts the puts rejected by the quota.
+	rejected prometheus.Counter
+
+	mu sync.Mutex
+	// bytes and keys are counted by the writes of the tenant and
+	// reconciled with the store every reconcileInterval.
+	bytes int64
+	keys  int64
+	// pending collects the writes committed during a reconciliation, which
+	// its scan may have missed.
+	scanning bool
+	pending  []usage
+}
+
+// usage is what the writes of a transaction committed at revision add to
+// the usage of a tenant.
+type usage struct {
+	revision int64
+	bytes    int64
+	keys     int64
+}
+
+// Tenants maps the clients of a server to their tenant.
+type Tenants struct {
+	key     string
+	tenants map[string]*Tenant
+	// admins are the names mapped to the whole key space.
+	admins map[string]bool
+	drv    driver.Driver
+	// user returns the authenticated user of a request, if any.
+	user func(ctx context.Context) string
+
+	mu sync.Mutex
+	// owners maps the leases granted by tenants to their name.
+	owners map[int64]string
+
+	requests *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+// New returns the tenants of opts, reading the lease owners from drv. It
+// returns nil without prefixes, which serves every client the whole key
+// space. user returns the authenticated user of a request and is only used
+// with KeyUser.
+func New(ctx context.Context, drv driver.Driver, opts Options, user func(ctx context.Context) string) (*Tenants, error) {
+	if len(opts.Prefixes) == 0 {
+		return nil, nil
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("tenant.New: %w", err)
+	}
+	if opts.Key == "" {
+		opts.Key = KeyUser
+	}
+
+	ts := &Tenants{
+		key:     opts.Key,
+		tenants: map[string]*Tenant{},
+		admins:  map[string]bool{},
+		drv:     drv,
+		user:    user,
+		owners:  map[int64]string{},
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "etcd_shim", Subsystem: "tenant", Name: "requests_total",
+			Help: "Total number of KV, Watch and Lease requests of each tenant.",
+		}, []string{"tenant", "method"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "etcd_shim", Subsystem: "tenant", Name: "quota_rejected_total",
+			Help: "Total number of puts rejected by the quota of each tenant.",
+		}, []string{"tenant"}),
+	}
+	for name, prefix := range opts.Prefixes {
+		if prefix == "" {
+			ts.admins[name] = true
+			continue
+		}
+		quota := opts.QuotaBytes
+		if q, ok := opts.Quotas[name]; ok {
+			quota = q
+		}
+		ts.tenants[name] = &Tenant{
+			Name:   name,
+			prefix: []byte(prefix),
+			end:    prefixEnd([]byte(prefix)),
+			quota:  quota,
+			// Created up front so every tenant is exported.
+			rejected: ts.rejected.WithLabelValues(name),
+		}
+	}
+
+	err := drv.BucketForEach(ctx, LeaseBucket, func(key []byte, value []byte) error {
+		if len(key) != 8 {
+			return fmt.Errorf("invalid lease key %x", key)
+		}
+		ts.owners[int64(binary.BigEndian.Uint64(key))] = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tenant.New: failed to load lease owners: %w", err)
+	}
+
+	return ts, nil
+}
+
+// prefixEnd returns the range end selecting every key with prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+type tenantKey struct{}
+
+// NewContext returns ctx carrying t.
+func NewContext(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// FromContext returns the tenant of ctx, or nil for the whole key space.
+func FromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return t
+}
+
+// resolve returns the tenant of name, or nil and whether name is mapped to
+// the whole key space.
+func (ts *Tenants) resolve(name string) (*Tenant, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if ts.key == KeyUser && name == auth.RootUser {
+		return nil, true
+	}
+	if t, ok := ts.tenants[name]; ok {
+		return t, true
+	}
+	return nil, ts.admins[name]
+}
+
+// OwnsLease reports whether the client of ctx may use the lease id: tenants
+// their own leases, other clients every lease.
+func (ts *Tenants) OwnsLease(ctx context.Context, id int64) bool {
+	t := FromContext(ctx)
+	if ts == nil || t == nil {
+		return true
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.owners[id] == t.Name
+}
+
+// StripKeys returns the keys of a lease the client of ctx owns as it sees
+// them.
+func (ts *Tenants) StripKeys(ctx context.Context, keys [][]byte) [][]byte {
+	t := FromContext(ctx)
+	if ts == nil || t == nil {
+		return keys
+	}
+	out := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if bytes.HasPrefix(k, t.prefix) {
+			out = append(out, t.strip(k))
+		}
+	}
+	return out
+}
+
+// GrantLease records the lease id as granted by the client of ctx.
+func (ts *Tenants) GrantLease(ctx context.Context, id int64) error {
+	t := FromContext(ctx)
+	if ts == nil || t == nil {
+		return nil
+	}
+	if err := ts.drv.BucketPut(ctx, LeaseBucket, leaseKey(id), []byte(t.Name)); err != nil {
+		return fmt.Errorf("tenant.GrantLease: %w", err)
+	}
+	ts.mu.Lock()
+	ts.owners[id] = t.Name
+	ts.mu.Unlock()
+	return nil
+}
+
+// RevokeLease forgets the owner of the revoked lease id.
+func (ts *Tenants) RevokeLease(ctx context.Context, id int64) error {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	_, ok := ts.owners[id]
+	delete(ts.owners, id)
+	ts.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := ts.drv.BucketDelete(ctx, LeaseBucket, leaseKey(id)); err != nil && !errors.Is(err, driver.ErrKeyNotFound) {
+		return fmt.Errorf("tenant.RevokeLease: %w", err)
+	}
+	return nil
+}
+
+// Prune forgets the owners of the leases not in live every minute, which
+// catches the leases that expired, until ctx is done.
+func (ts *Tenants) Prune(ctx context.Context, live func() []int64) {
+	if ts == nil {
+		return
+	}
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		alive := map[int64]bool{}
+		for _, id := range live() {
+			alive[id] = true
+		}
+		ts.mu.Lock()
+		var stale []int64
+		for id := range ts.owners {
+			if !alive[id] {
+				stale = append(stale, id)
+			}
+		}
+		ts.mu.Unlock()
+		for _, id := range stale {
+			// A failure leaves the owner to the next round.
+			_ = ts.RevokeLease(ctx, id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func leaseKey(id int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+// Reconcile scans the keys of every tenant now and every
+// reconcileInterval until ctx is done. In between, the usage is kept by the
+// writes of the tenants; the scans catch up with the keys deleted by lease
+// expiry and the writes of clients mapped to the whole key space. Until the
+// first scan ends the quotas only count the writes since the start.
+func (ts *Tenants) Reconcile(ctx context.Context, log *slog.Logger) {
+	if ts == nil {
+		return
+	}
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		for _, t := range ts.tenants {
+			if err := ts.reconcile(ctx, t); err != nil && ctx.Err() == nil {
+				log.Warn(fmt.Sprintf("tenant.Reconcile: %+v", err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile replaces the usage of t with a scan of its keys, adding the
+// writes committed after the revision scanned.
+func (ts *Tenants) reconcile(ctx context.Context, t *Tenant) error {
+	t.mu.Lock()
+	t.scanning, t.pending = true, nil
+	t.mu.Unlock()
+
+	res, err := ts.drv.Range(ctx, t.prefix, t.end, driver.RangeOptions{})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending
+	t.scanning, t.pending = false, nil
+	if err != nil {
+		return fmt.Errorf("failed to read usage of tenant %s: %w", t.Name, err)
+	}
+
+	var n int64
+	for _, kv := range res.KVs {
+		n += int64(len(kv.Key) + len(kv.Value))
+	}
+	keys := res.Count
+	for _, u := range pending {
+		if u.revision > res.Revision {
+			n, keys = n+u.bytes, keys+u.keys
+		}
+	}
+	t.bytes, t.keys = n, keys
+	return nil
+}
+
+// usage returns the bytes of the keys and values of t, with their prefix,
+// and their number.
+func (t *Tenant) usage() (int64, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.bytes, t.keys
+}
+
+// apply counts the writes of a transaction of t.
+func (t *Tenant) apply(u usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bytes, t.keys = t.bytes+u.bytes, t.keys+u.keys
+	if t.scanning {
+		t.pending = append(t.pending, u)
+	}
+}
+
+// checkQuota returns ErrQuotaExceeded if t has reached its quota.
+func (t *Tenant) checkQuota() error {
+	if t.quota <= 0 {
+		return nil
+	}
+	if n, _ := t.usage(); n >= t.quota {
+		return fmt.Errorf("%w: %s uses %d of %d bytes", ErrQuotaExceeded, t.Name, n, t.quota)
+	}
+	return nil
+}
+
+var (
+	usageBytesDesc = prometheus.NewDesc("etcd_shim_tenant_usage_bytes",
+		"Bytes of the keys and values of each tenant.", []string{"tenant"}, nil)
+	keysDesc = prometheus.NewDesc("etcd_shim_tenant_keys",
+		"Number of keys of each tenant.", []string{"tenant"}, nil)
+	quotaBytesDesc = prometheus.NewDesc("etcd_shim_tenant_quota_bytes",
+		"Quota of each tenant, 0 if unlimited.", []string{"tenant"}, nil)
+)
+
+// Describe and Collect export the requests, usage and quota of every tenant.
+func (ts *Tenants) Describe(ch chan<- *prometheus.Desc) {
+	ts.requests.Describe(ch)
+	ts.rejected.Describe(ch)
+	ch <- usageBytesDesc
+	ch <- keysDesc
+	ch <- quotaBytesDesc
+}
+
+func (ts *Tenants) Collect(ch chan<- prometheus.Metric) {
+	ts.requests.Collect(ch)
+	ts.rejected.Collect(ch)
+
+	for _, t := range ts.tenants {
+		ch <- prometheus.MustNewConstMetric(quotaBytesDesc, prometheus.GaugeValue, float64(t.quota), t.Name)
+		n, keys := t.usage()
+		ch <- prometheus.MustNewConstMetric(usageBytesDesc, prometheus.GaugeValue, float64(n), t.Name)
+		ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(keys), t.Name)
+	}
+}
@@ -0,0 +1,170 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aplulu/etcd-shim/driver/memory"
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// newTenants returns tenants a and b confined to /a/ and /b/, and the
+// driver they share.
+func newTenants(t *testing.T, opts Options) (*Tenants, driver.Driver) {
+	t.Helper()
+	d, err := memory.New(memory.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	opts.Prefixes = map[string]string{"a": "/a/", "b": "/b/", "admin": ""}
+	ts, err := New(context.Background(), d, opts, func(ctx context.Context) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, d
+}
+
+func put(ctx context.Context, d driver.Driver, key string, value string) error {
+	_, err := d.Txn(ctx, func(txn driver.Txn) error {
+		_, err := txn.Put([]byte(key), []byte(value), 0)
+		return err
+	})
+	return err
+}
+
+func keys(t *testing.T, ctx context.Context, d driver.Driver) []string {
+	t.Helper()
+	res, err := d.Range(ctx, []byte{0}, []byte{0}, driver.RangeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, kv := range res.KVs {
+		out = append(out, string(kv.Key))
+	}
+	return out
+}
+
+func TestWrapDriver(t *testing.T) {
+	ts, raw := newTenants(t, Options{})
+	d := ts.WrapDriver(raw)
+	ctxA := NewContext(context.Background(), ts.tenants["a"])
+	ctxB := NewContext(context.Background(), ts.tenants["b"])
+
+	if err := put(ctxA, d, "k", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctxB, d, "k", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(t, context.Background(), raw); len(got) != 2 || got[0] != "/a/k" || got[1] != "/b/k" {
+		t.Fatalf("store holds %q, want /a/k and /b/k", got)
+	}
+	if got := keys(t, ctxA, d); len(got) != 1 || got[0] != "k" {
+		t.Errorf("tenant a sees %q, want k", got)
+	}
+
+	// An open range ends at the prefix, so b's keys stay out of reach.
+	_, err := d.Txn(ctxA, func(txn driver.Txn) error {
+		kvs, err := txn.DeleteRange([]byte{0}, []byte{0})
+		if err == nil && (len(kvs) != 1 || string(kvs[0].Key) != "k") {
+			t.Errorf("tenant a deleted %v", kvs)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(t, context.Background(), raw); len(got) != 1 || got[0] != "/b/k" {
+		t.Errorf("after a deleted everything the store holds %q", got)
+	}
+
+	var seen []string
+	err = d.History(ctxA, 1, func(ev *driver.WatchEvent) error {
+		seen = append(seen, string(ev.KV.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != "k" || seen[1] != "k" {
+		t.Errorf("tenant a's history has %q, want its put and delete of k", seen)
+	}
+
+	if err := d.Compact(ctxA, 1); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("Compact by a tenant returned %v, want %v", err, ErrNotPermitted)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ts, raw := newTenants(t, Options{QuotaBytes: 16})
+	d := ts.WrapDriver(raw)
+	a := ts.tenants["a"]
+	ctx := NewContext(context.Background(), a)
+
+	// /a/k and 8 bytes make 12.
+	if err := put(ctx, d, "k", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting counts the difference.
+	if err := put(ctx, d, "k", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if n, keys := a.usage(); n != 8 || keys != 1 {
+		t.Fatalf("usage after an overwrite is %d bytes in %d keys, want 8 in 1", n, keys)
+	}
+	if err := put(ctx, d, "l", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, d, "m", ""); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("put over the quota returned %v, want %v", err, ErrQuotaExceeded)
+	}
+	// Other tenants have quotas of their own.
+	if err := put(NewContext(context.Background(), ts.tenants["b"]), d, "k", "v"); err != nil {
+		t.Errorf("put of tenant b: %v", err)
+	}
+
+	_, err := d.Txn(ctx, func(txn driver.Txn) error {
+		_, err := txn.DeleteRange([]byte("l"), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, d, "m", ""); err != nil {
+		t.Errorf("put after a delete freed space: %v", err)
+	}
+
+	// Keys removed outside the tenant, e.g. by lease expiry, are caught up
+	// with by the reconciliation.
+	_, err = raw.Txn(context.Background(), func(txn driver.Txn) error {
+		_, err := txn.DeleteRange([]byte("/a/"), a.end)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.reconcile(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if n, keys := a.usage(); n != 0 || keys != 0 {
+		t.Errorf("usage after reconciling is %d bytes in %d keys, want none", n, keys)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, opts := range []Options{
+		{Key: "ip", Prefixes: map[string]string{"a": "/a/"}},
+		{Prefixes: map[string]string{"a": "/a/", "b": "/a/b/"}},
+		{Prefixes: map[string]string{"a": "/a/"}, Quotas: map[string]int64{"b": 1}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Validate accepted %+v", opts)
+		}
+	}
+}
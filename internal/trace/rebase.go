@@ -0,0 +1,178 @@
+package trace
+
+import (
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// rebase maps the keys, revisions and lease IDs of a trace to those of the
+// server it is replayed against.
+type rebase struct {
+	prefix []byte
+	offset int64
+	leases map[int64]int64
+}
+
+func (b *rebase) key(k []byte) []byte {
+	if len(b.prefix) == 0 {
+		return k
+	}
+	return append(append([]byte{}, b.prefix...), k...)
+}
+
+// rangeEnd prefixes end unless it is empty, for a single key, or "\x00",
+// for every key from the start.
+func (b *rebase) rangeEnd(end []byte) []byte {
+	if len(end) == 0 || (len(end) == 1 && end[0] == 0) {
+		return end
+	}
+	return b.key(end)
+}
+
+func (b *rebase) revision(r int64) int64 {
+	if r <= 0 {
+		return r
+	}
+	return r + b.offset
+}
+
+func (b *rebase) lease(id int64) int64 {
+	if mapped, ok := b.leases[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+func (b *rebase) request(m any) {
+	switch r := m.(type) {
+	case *etcdserverpb.RangeRequest:
+		r.Key, r.RangeEnd = b.key(r.Key), b.rangeEnd(r.RangeEnd)
+		r.Revision = b.revision(r.Revision)
+		r.MinModRevision = b.revision(r.MinModRevision)
+		r.MaxModRevision = b.revision(r.MaxModRevision)
+		r.MinCreateRevision = b.revision(r.MinCreateRevision)
+		r.MaxCreateRevision = b.revision(r.MaxCreateRevision)
+	case *etcdserverpb.PutRequest:
+		r.Key = b.key(r.Key)
+		r.Lease = b.lease(r.Lease)
+	case *etcdserverpb.DeleteRangeRequest:
+		r.Key, r.RangeEnd = b.key(r.Key), b.rangeEnd(r.RangeEnd)
+	case *etcdserverpb.TxnRequest:
+		for _, c := range r.Compare {
+			c.Key, c.RangeEnd = b.key(c.Key), b.rangeEnd(c.RangeEnd)
+			switch t := c.TargetUnion.(type) {
+			case *etcdserverpb.Compare_CreateRevision:
+				t.CreateRevision = b.revision(t.CreateRevision)
+			case *etcdserverpb.Compare_ModRevision:
+				t.ModRevision = b.revision(t.ModRevision)
+			case *etcdserverpb.Compare_Lease:
+				t.Lease = b.lease(t.Lease)
+			}
+		}
+		for _, ops := range [][]*etcdserverpb.RequestOp{r.Success, r.Failure} {
+			for _, op := range ops {
+				switch o := op.Request.(type) {
+				case *etcdserverpb.RequestOp_RequestRange:
+					b.request(o.RequestRange)
+				case *etcdserverpb.RequestOp_RequestPut:
+					b.request(o.RequestPut)
+				case *etcdserverpb.RequestOp_RequestDeleteRange:
+					b.request(o.RequestDeleteRange)
+				case *etcdserverpb.RequestOp_RequestTxn:
+					b.request(o.RequestTxn)
+				}
+			}
+		}
+	case *etcdserverpb.CompactionRequest:
+		r.Revision = b.revision(r.Revision)
+	case *etcdserverpb.LeaseRevokeRequest:
+		r.ID = b.lease(r.ID)
+	case *etcdserverpb.LeaseTimeToLiveRequest:
+		r.ID = b.lease(r.ID)
+	case *etcdserverpb.WatchRequest:
+		if c := r.GetCreateRequest(); c != nil {
+			c.Key, c.RangeEnd = b.key(c.Key), b.rangeEnd(c.RangeEnd)
+			c.StartRevision = b.revision(c.StartRevision)
+		}
+	}
+}
+
+// response rebases a recorded response. Headers keep only the revision,
+// which is all a client can rely on.
+func (b *rebase) response(m any) {
+	switch r := m.(type) {
+	case *etcdserverpb.RangeResponse:
+		r.Header = b.header(r.Header)
+		b.kvs(r.Kvs)
+	case *etcdserverpb.PutResponse:
+		r.Header = b.header(r.Header)
+		b.kv(r.PrevKv)
+	case *etcdserverpb.DeleteRangeResponse:
+		r.Header = b.header(r.Header)
+		b.kvs(r.PrevKvs)
+	case *etcdserverpb.TxnResponse:
+		r.Header = b.header(r.Header)
+		for _, op := range r.Responses {
+			switch o := op.Response.(type) {
+			case *etcdserverpb.ResponseOp_ResponseRange:
+				b.response(o.ResponseRange)
+			case *etcdserverpb.ResponseOp_ResponsePut:
+				b.response(o.ResponsePut)
+			case *etcdserverpb.ResponseOp_ResponseDeleteRange:
+				b.response(o.ResponseDeleteRange)
+			case *etcdserverpb.ResponseOp_ResponseTxn:
+				b.response(o.ResponseTxn)
+			}
+		}
+	case *etcdserverpb.CompactionResponse:
+		r.Header = b.header(r.Header)
+	case *etcdserverpb.LeaseGrantResponse:
+		r.Header = b.header(r.Header)
+		r.ID = b.lease(r.ID)
+	case *etcdserverpb.LeaseRevokeResponse:
+		r.Header = b.header(r.Header)
+	case *etcdserverpb.LeaseTimeToLiveResponse:
+		r.Header = b.header(r.Header)
+		r.ID = b.lease(r.ID)
+		for i, k := range r.Keys {
+			r.Keys[i] = b.key(k)
+		}
+	case *etcdserverpb.WatchResponse:
+		r.Header = b.header(r.Header)
+		r.CompactRevision = b.revision(r.CompactRevision)
+		for _, ev := range r.Events {
+			b.kv(ev.Kv)
+			b.kv(ev.PrevKv)
+		}
+	}
+}
+
+func (b *rebase) header(h *etcdserverpb.ResponseHeader) *etcdserverpb.ResponseHeader {
+	if h == nil {
+		return nil
+	}
+	// Unlike elsewhere, a zero revision in a header is a revision.
+	return &etcdserverpb.ResponseHeader{Revision: h.Revision + b.offset}
+}
+
+func (b *rebase) kvs(kvs []*mvccpb.KeyValue) {
+	for _, kv := range kvs {
+		b.kv(kv)
+	}
+}
+
+func (b *rebase) kv(kv *mvccpb.KeyValue) {
+	if kv == nil {
+		return
+	}
+	kv.Key = b.key(kv.Key)
+	kv.CreateRevision = b.revision(kv.CreateRevision)
+	kv.ModRevision = b.revision(kv.ModRevision)
+	kv.Lease = b.lease(kv.Lease)
+}
+
+// normalize strips what legitimately differs between servers from a
+// response received during the replay.
+func normalize(m any) {
+	(&rebase{}).response(m)
+}
@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Recorder writes the traffic passing its interceptors to a trace. Unary
+// calls are serialized while recording so the trace holds them in the
+// order they were applied; do not record a production server.
+type Recorder struct {
+	log *slog.Logger
+	// calls serializes the unary calls.
+	calls sync.Mutex
+
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	streams atomic.Int64
+}
+
+// NewRecorder starts a trace on w at the current revision of the server.
+func NewRecorder(log *slog.Logger, w io.Writer, revision int64) (*Recorder, error) {
+	r := &Recorder{log: log, enc: json.NewEncoder(w)}
+	if err := r.write(&Entry{Revision: revision}); err != nil {
+		return nil, fmt.Errorf("trace.NewRecorder: %w", err)
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) write(e *Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(e); err != nil {
+		return fmt.Errorf("failed to write entry: %w", err)
+	}
+	return nil
+}
+
+func (r *Recorder) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !recorded(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		r.calls.Lock()
+		defer r.calls.Unlock()
+
+		res, err := handler(ctx, req)
+		// The call has been applied, so a failure to record it is only
+		// logged.
+		if rerr := r.recordCall(info.FullMethod, req, res, err); rerr != nil {
+			r.log.ErrorContext(ctx, fmt.Sprintf("trace.Recorder: %+v", rerr), "method", info.FullMethod)
+		}
+
+		return res, err
+	}
+}
+
+func (r *Recorder) recordCall(method string, req any, res any, callErr error) error {
+	e := &Entry{Method: method}
+	var err error
+	if e.Request, err = marshalMessage(req); err != nil {
+		return err
+	}
+	if callErr != nil {
+		e.Error = status.Convert(callErr).Message()
+	} else if e.Response, err = marshalMessage(res); err != nil {
+		return err
+	}
+
+	return r.write(e)
+}
+
+func (r *Recorder) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !recorded(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		return handler(srv, &recordedStream{
+			ServerStream: ss,
+			recorder:     r,
+			method:       info.FullMethod,
+			id:           r.streams.Add(1),
+		})
+	}
+}
+
+type recordedStream struct {
+	grpc.ServerStream
+	recorder *Recorder
+	method   string
+	id       int64
+}
+
+func (s *recordedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.record(m, true)
+	return nil
+}
+
+func (s *recordedStream) SendMsg(m any) error {
+	s.record(m, false)
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *recordedStream) record(m any, request bool) {
+	e := &Entry{Method: s.method, Stream: s.id}
+	data, err := marshalMessage(m)
+	if err == nil {
+		if request {
+			e.Request = data
+		} else {
+			e.Response = data
+		}
+		err = s.recorder.write(e)
+	}
+	if err != nil {
+		s.recorder.log.ErrorContext(s.Context(), fmt.Sprintf("trace.Recorder: %+v", err), "method", s.method)
+	}
+}
+
+func marshalMessage(m any) (json.RawMessage, error) {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("failed to marshal %T: not a protocol buffer message", m)
+	}
+	data, err := marshal(pm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %T: %w", m, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,368 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// watchTimeout bounds how long the replay waits for the recorded watch
+// responses after the last call.
+const watchTimeout = 10 * time.Second
+
+// Replay sends the calls of the trace read from r over conn and compares the
+// responses with the recorded ones. Keys are put under prefix and revisions
+// and lease IDs are rebased, so the server only has to hold none of the
+// keys under prefix. Watch
+// responses are compared per watcher once the trace has been sent, as their
+// interleaving across watchers is not deterministic. Writes the server makes
+// on its own, such as deleting the keys of expired leases, are not part of a
+// trace, so traces that depend on them do not replay.
+func Replay(ctx context.Context, conn *grpc.ClientConn, r io.Reader, prefix string) error {
+	dec := json.NewDecoder(r)
+	var first Entry
+	if err := dec.Decode(&first); err != nil {
+		return fmt.Errorf("trace.Replay: failed to read the first line: %w", err)
+	}
+	res, err := etcdserverpb.NewKVClient(conn).Range(ctx, &etcdserverpb.RangeRequest{Key: []byte{0}, CountOnly: true})
+	if err != nil {
+		return fmt.Errorf("trace.Replay: failed to get current revision: %w", err)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p := &player{
+		ctx:  streamCtx,
+		conn: conn,
+		rebase: &rebase{
+			prefix: []byte(prefix),
+			offset: res.Header.Revision - first.Revision,
+			leases: map[int64]int64{},
+		},
+		streams: map[int64]*playedStream{},
+	}
+
+	for line := 2; ; line++ {
+		var e Entry
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("trace.Replay: failed to read line %d: %w", line, err)
+		}
+		if err := p.play(ctx, &e); err != nil {
+			return fmt.Errorf("trace.Replay: line %d: %s: %w", line, shortMethod(e.Method), err)
+		}
+	}
+
+	if err := p.finish(ctx); err != nil {
+		return fmt.Errorf("trace.Replay: %w", err)
+	}
+
+	return nil
+}
+
+type player struct {
+	ctx     context.Context
+	conn    *grpc.ClientConn
+	rebase  *rebase
+	streams map[int64]*playedStream
+}
+
+func (p *player) play(ctx context.Context, e *Entry) error {
+	if e.Stream != 0 {
+		return p.playStream(e)
+	}
+
+	msgs, ok := unaryMethods[e.Method]
+	if !ok {
+		return fmt.Errorf("unknown method")
+	}
+	req := msgs.request()
+	if err := unmarshal(e.Request, req); err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+	p.rebase.request(req)
+
+	res := msgs.response()
+	if err := p.conn.Invoke(ctx, e.Method, req, res); err != nil || e.Error != "" {
+		var got string
+		if err != nil {
+			got = status.Convert(err).Message()
+		}
+		if got != e.Error {
+			return fmt.Errorf("error = %q, want %q", got, e.Error)
+		}
+		return nil
+	}
+
+	want := msgs.response()
+	if err := unmarshal(e.Response, want); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	switch r := res.(type) {
+	case *etcdserverpb.LeaseGrantResponse:
+		p.rebase.leases[want.(*etcdserverpb.LeaseGrantResponse).ID] = r.ID
+	case *etcdserverpb.LeaseTimeToLiveResponse:
+		// The remaining TTL depends on timing.
+		want.(*etcdserverpb.LeaseTimeToLiveResponse).TTL = r.TTL
+	}
+	p.rebase.response(want)
+	normalize(res)
+
+	return compare(res, want)
+}
+
+func compare(got proto.Message, want proto.Message) error {
+	g, err := marshal(got)
+	if err != nil {
+		return err
+	}
+	w, err := marshal(want)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(g, w) {
+		return fmt.Errorf("got %s, want %s", g, w)
+	}
+	return nil
+}
+
+// playedStream is a replayed Watch stream. The responses are kept per
+// watcher as lines of text.
+type playedStream struct {
+	stream grpc.ClientStream
+
+	mu   sync.Mutex
+	got  map[int64][]string
+	want map[int64][]string
+	err  error
+	// sent and acked count the requests of each kind and the responses
+	// acknowledging them, so a request is applied before the next call.
+	sent    map[string]int
+	acked   map[string]int
+	changed chan struct{}
+}
+
+func (p *player) playStream(e *Entry) error {
+	if e.Method != watchMethod {
+		return fmt.Errorf("unknown method")
+	}
+
+	s, ok := p.streams[e.Stream]
+	if !ok {
+		stream, err := p.conn.NewStream(p.ctx, &grpc.StreamDesc{StreamName: "Watch", ServerStreams: true, ClientStreams: true}, watchMethod)
+		if err != nil {
+			return fmt.Errorf("failed to open stream: %w", err)
+		}
+		s = &playedStream{
+			stream:  stream,
+			got:     map[int64][]string{},
+			want:    map[int64][]string{},
+			sent:    map[string]int{},
+			acked:   map[string]int{},
+			changed: make(chan struct{}),
+		}
+		p.streams[e.Stream] = s
+		go s.recv()
+	}
+
+	if e.Request != nil {
+		req := &etcdserverpb.WatchRequest{}
+		if err := unmarshal(e.Request, req); err != nil {
+			return fmt.Errorf("failed to decode request: %w", err)
+		}
+		p.rebase.request(req)
+		if err := s.stream.SendMsg(req); err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		return s.wait(requestKind(req))
+	}
+
+	res := &etcdserverpb.WatchResponse{}
+	if err := unmarshal(e.Response, res); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	p.rebase.response(res)
+	s.mu.Lock()
+	s.want[res.WatchId] = append(s.want[res.WatchId], watchLines(res)...)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *playedStream) recv() {
+	for {
+		res := &etcdserverpb.WatchResponse{}
+		err := s.stream.RecvMsg(res)
+
+		s.mu.Lock()
+		if err != nil {
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+		normalize(res)
+		s.got[res.WatchId] = append(s.got[res.WatchId], watchLines(res)...)
+		for _, kind := range responseKinds(res) {
+			s.acked[kind]++
+		}
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// wait waits until the requests of kind sent so far are acknowledged.
+func (s *playedStream) wait(kind string) error {
+	timer := time.NewTimer(watchTimeout)
+	defer timer.Stop()
+
+	s.mu.Lock()
+	s.sent[kind]++
+	for s.acked[kind] < s.sent[kind] {
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return fmt.Errorf("stream failed: %w", err)
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("no response to %s request within %s", kind, watchTimeout)
+		}
+		s.mu.Lock()
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func requestKind(req *etcdserverpb.WatchRequest) string {
+	switch req.RequestUnion.(type) {
+	case *etcdserverpb.WatchRequest_CreateRequest:
+		return "create"
+	case *etcdserverpb.WatchRequest_CancelRequest:
+		return "cancel"
+	default:
+		return "progress"
+	}
+}
+
+// responseKinds returns the kinds of request res acknowledges. Watchers
+// canceled by the server are counted as well, which only makes a later
+// cancel request return early.
+func responseKinds(res *etcdserverpb.WatchResponse) []string {
+	switch {
+	case res.Created:
+		return []string{"create"}
+	case res.Canceled:
+		return []string{"cancel"}
+	case res.WatchId == -1 && len(res.Events) == 0:
+		return []string{"progress"}
+	}
+	return nil
+}
+
+// watchLines describes a watch response as lines that do not depend on how
+// events are batched.
+func watchLines(res *etcdserverpb.WatchResponse) []string {
+	var lines []string
+	if res.Created {
+		lines = append(lines, "created")
+	}
+	for _, ev := range res.Events {
+		data, err := marshal(ev)
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		lines = append(lines, "event "+string(data))
+	}
+	if res.Canceled {
+		lines = append(lines, fmt.Sprintf("canceled compact_revision=%d", res.CompactRevision))
+	}
+	if !res.Created && !res.Canceled && len(res.Events) == 0 {
+		lines = append(lines, fmt.Sprintf("progress revision=%d", res.Header.GetRevision()))
+	}
+	return lines
+}
+
+// finish waits for the recorded watch responses and compares them.
+func (p *player) finish(ctx context.Context) error {
+	ids := make([]int64, 0, len(p.streams))
+	for id := range p.streams {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	deadline := time.Now().Add(watchTimeout)
+	for _, id := range ids {
+		s := p.streams[id]
+		for !s.complete() && time.Now().Before(deadline) {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := s.compare(); err != nil {
+			return fmt.Errorf("stream %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *playedStream) complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return true
+	}
+	for id, want := range s.want {
+		if len(s.got[id]) < len(want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *playedStream) compare() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, want := range s.want {
+		got := s.got[id]
+		for i, w := range want {
+			if i >= len(got) {
+				if s.err != nil {
+					return fmt.Errorf("watch %d: stream failed after %d of %d responses: %w", id, len(got), len(want), s.err)
+				}
+				return fmt.Errorf("watch %d: got %d of %d responses, next want %s", id, len(got), len(want), w)
+			}
+			if got[i] != w {
+				return fmt.Errorf("watch %d: response %d = %s, want %s", id, i, got[i], w)
+			}
+		}
+	}
+	for id, got := range s.got {
+		if len(got) > len(s.want[id]) {
+			return fmt.Errorf("watch %d: unexpected response %s", id, got[len(s.want[id])])
+		}
+	}
+
+	return nil
+}
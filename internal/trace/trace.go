@@ -0,0 +1,94 @@
+// Package trace records the KV, Watch and Lease traffic a server receives,
+// e.g. from kube-apiserver, and replays it against another server to check
+// that it answers the same way.
+//
+// A trace is a file of JSON lines. The first line holds the revision the
+// server was at when the recording started; every other line holds one
+// unary call or one message of a Watch stream, in the order they happened.
+package trace
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// Entry is one line of a trace.
+type Entry struct {
+	// Revision is only set on the first line.
+	Revision int64  `json:"revision,omitempty"`
+	Method   string `json:"method,omitempty"`
+	// Stream numbers the streams of a trace, starting at 1. It is zero for
+	// unary calls.
+	Stream   int64           `json:"stream,omitempty"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Error is the status message of a failed unary call.
+	Error string `json:"error,omitempty"`
+}
+
+const watchMethod = "/etcdserverpb.Watch/Watch"
+
+type messages struct {
+	request  func() proto.Message
+	response func() proto.Message
+}
+
+// unaryMethods are the unary calls that are recorded.
+var unaryMethods = map[string]messages{
+	"/etcdserverpb.KV/Range": {
+		func() proto.Message { return &etcdserverpb.RangeRequest{} },
+		func() proto.Message { return &etcdserverpb.RangeResponse{} },
+	},
+	"/etcdserverpb.KV/Put": {
+		func() proto.Message { return &etcdserverpb.PutRequest{} },
+		func() proto.Message { return &etcdserverpb.PutResponse{} },
+	},
+	"/etcdserverpb.KV/DeleteRange": {
+		func() proto.Message { return &etcdserverpb.DeleteRangeRequest{} },
+		func() proto.Message { return &etcdserverpb.DeleteRangeResponse{} },
+	},
+	"/etcdserverpb.KV/Txn": {
+		func() proto.Message { return &etcdserverpb.TxnRequest{} },
+		func() proto.Message { return &etcdserverpb.TxnResponse{} },
+	},
+	"/etcdserverpb.KV/Compact": {
+		func() proto.Message { return &etcdserverpb.CompactionRequest{} },
+		func() proto.Message { return &etcdserverpb.CompactionResponse{} },
+	},
+	"/etcdserverpb.Lease/LeaseGrant": {
+		func() proto.Message { return &etcdserverpb.LeaseGrantRequest{} },
+		func() proto.Message { return &etcdserverpb.LeaseGrantResponse{} },
+	},
+	"/etcdserverpb.Lease/LeaseRevoke": {
+		func() proto.Message { return &etcdserverpb.LeaseRevokeRequest{} },
+		func() proto.Message { return &etcdserverpb.LeaseRevokeResponse{} },
+	},
+	"/etcdserverpb.Lease/LeaseTimeToLive": {
+		func() proto.Message { return &etcdserverpb.LeaseTimeToLiveRequest{} },
+		func() proto.Message { return &etcdserverpb.LeaseTimeToLiveResponse{} },
+	},
+}
+
+// recorded reports whether calls of method are recorded.
+func recorded(method string) bool {
+	_, ok := unaryMethods[method]
+	return ok || method == watchMethod
+}
+
+var marshaler = &runtime.JSONPb{OrigName: true}
+
+func marshal(m proto.Message) (json.RawMessage, error) {
+	return marshaler.Marshal(m)
+}
+
+func unmarshal(data json.RawMessage, m proto.Message) error {
+	return marshaler.Unmarshal(data, m)
+}
+
+func shortMethod(method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
@@ -0,0 +1,165 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aplulu/etcd-shim/internal/driver"
+)
+
+// WrapDriver records a span for every operation of drv. Keys and values are
+// left out of the spans. The span is in the context drv receives, so drivers
+// can add events to it, e.g. for retried transactions. Of the optional
+// interfaces only driver.ProgressRequester is kept.
+func WrapDriver(drv driver.Driver, tp trace.TracerProvider) driver.Driver {
+	d := &tracedDriver{drv: drv, tracer: tp.Tracer(scope)}
+	if pr, ok := drv.(driver.ProgressRequester); ok {
+		return &tracedProgressDriver{tracedDriver: d, pr: pr}
+	}
+	return d
+}
+
+type tracedDriver struct {
+	drv    driver.Driver
+	tracer trace.Tracer
+}
+
+func (d *tracedDriver) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return d.tracer.Start(ctx, "driver."+op, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attrs...))
+}
+
+// finish ends span, marking it failed when err is set.
+func finish(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (d *tracedDriver) CurrentRevision(ctx context.Context) (int64, error) {
+	ctx, span := d.start(ctx, "CurrentRevision")
+	revision, err := d.drv.CurrentRevision(ctx)
+	span.SetAttributes(attribute.Int64("etcd.revision", revision))
+	finish(span, err)
+	return revision, err
+}
+
+func (d *tracedDriver) CompactRevision(ctx context.Context) (int64, error) {
+	ctx, span := d.start(ctx, "CompactRevision")
+	revision, err := d.drv.CompactRevision(ctx)
+	span.SetAttributes(attribute.Int64("etcd.revision", revision))
+	finish(span, err)
+	return revision, err
+}
+
+func (d *tracedDriver) Range(ctx context.Context, key []byte, end []byte, opts driver.RangeOptions) (*driver.RangeResult, error) {
+	ctx, span := d.start(ctx, "Range",
+		attribute.Int64("etcd.revision", opts.Revision),
+		attribute.Int64("etcd.limit", opts.Limit),
+		attribute.Bool("etcd.count_only", opts.CountOnly),
+		attribute.Bool("etcd.keys_only", opts.KeysOnly),
+	)
+	result, err := d.drv.Range(ctx, key, end, opts)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("etcd.count", result.Count), attribute.Int("etcd.kvs", len(result.KVs)))
+	}
+	finish(span, err)
+	return result, err
+}
+
+func (d *tracedDriver) Txn(ctx context.Context, fn func(txn driver.Txn) error) (int64, error) {
+	ctx, span := d.start(ctx, "Txn")
+	attempts := 0
+	revision, err := d.drv.Txn(ctx, func(txn driver.Txn) error {
+		attempts++
+		return fn(txn)
+	})
+	span.SetAttributes(attribute.Int64("etcd.revision", revision), attribute.Int("etcd.txn.attempts", attempts))
+	finish(span, err)
+	return revision, err
+}
+
+func (d *tracedDriver) Compact(ctx context.Context, revision int64) error {
+	ctx, span := d.start(ctx, "Compact", attribute.Int64("etcd.revision", revision))
+	err := d.drv.Compact(ctx, revision)
+	finish(span, err)
+	return err
+}
+
+// Watch records the setup of the watch only; the channel outlives the span.
+func (d *tracedDriver) Watch(ctx context.Context, key []byte, end []byte, startRevision int64) (<-chan *driver.WatchEvent, error) {
+	ctx, span := d.start(ctx, "Watch", attribute.Int64("etcd.start_revision", startRevision))
+	ch, err := d.drv.Watch(ctx, key, end, startRevision)
+	finish(span, err)
+	return ch, err
+}
+
+func (d *tracedDriver) History(ctx context.Context, startRevision int64, fn func(ev *driver.WatchEvent) error) error {
+	ctx, span := d.start(ctx, "History", attribute.Int64("etcd.start_revision", startRevision))
+	err := d.drv.History(ctx, startRevision, fn)
+	finish(span, err)
+	return err
+}
+
+func (d *tracedDriver) Restore(ctx context.Context, events []*driver.WatchEvent, revision int64) error {
+	ctx, span := d.start(ctx, "Restore", attribute.Int("etcd.events", len(events)), attribute.Int64("etcd.revision", revision))
+	err := d.drv.Restore(ctx, events, revision)
+	finish(span, err)
+	return err
+}
+
+func (d *tracedDriver) Buckets(ctx context.Context) ([]string, error) {
+	ctx, span := d.start(ctx, "Buckets")
+	buckets, err := d.drv.Buckets(ctx)
+	finish(span, err)
+	return buckets, err
+}
+
+func (d *tracedDriver) BucketGet(ctx context.Context, bucket string, key []byte) ([]byte, error) {
+	ctx, span := d.start(ctx, "BucketGet", attribute.String("etcd.bucket", bucket))
+	value, err := d.drv.BucketGet(ctx, bucket, key)
+	finish(span, err)
+	return value, err
+}
+
+func (d *tracedDriver) BucketPut(ctx context.Context, bucket string, key []byte, value []byte) error {
+	ctx, span := d.start(ctx, "BucketPut", attribute.String("etcd.bucket", bucket))
+	err := d.drv.BucketPut(ctx, bucket, key, value)
+	finish(span, err)
+	return err
+}
+
+func (d *tracedDriver) BucketDelete(ctx context.Context, bucket string, key []byte) error {
+	ctx, span := d.start(ctx, "BucketDelete", attribute.String("etcd.bucket", bucket))
+	err := d.drv.BucketDelete(ctx, bucket, key)
+	finish(span, err)
+	return err
+}
+
+func (d *tracedDriver) BucketForEach(ctx context.Context, bucket string, fn func(key []byte, value []byte) error) error {
+	ctx, span := d.start(ctx, "BucketForEach", attribute.String("etcd.bucket", bucket))
+	err := d.drv.BucketForEach(ctx, bucket, fn)
+	finish(span, err)
+	return err
+}
+
+// Close has no context to record a span in.
+func (d *tracedDriver) Close() error {
+	return d.drv.Close()
+}
+
+type tracedProgressDriver struct {
+	*tracedDriver
+	pr driver.ProgressRequester
+}
+
+func (d *tracedProgressDriver) RequestProgress(ctx context.Context) error {
+	ctx, span := d.start(ctx, "RequestProgress")
+	err := d.pr.RequestProgress(ctx)
+	finish(span, err)
+	return err
+}
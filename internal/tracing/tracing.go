@@ -0,0 +1,55 @@
+// Package tracing exports OpenTelemetry traces of the gRPC calls, gateway
+// requests and driver operations of a server. Nothing is registered
+// globally: the tracer provider is handed to the server, and spans reach the
+// driver and the logs through the request context.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	serviceName = "etcd-shim"
+	// scope names the tracer of the spans created by the shim itself.
+	scope = "github.com/aplulu/etcd-shim"
+)
+
+type Options struct {
+	// Endpoint is the host:port of the OTLP/gRPC collector.
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the fraction of traces sampled when the caller has not
+	// decided already.
+	SampleRatio float64
+}
+
+// NewProvider returns a tracer provider exporting to opts.Endpoint. Shut it
+// down to flush the remaining spans.
+func NewProvider(ctx context.Context, opts Options) (*sdktrace.TracerProvider, error) {
+	exporterOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing.NewProvider: failed to create exporter: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// Propagator reads and writes the W3C trace context and baggage headers.
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}